@@ -0,0 +1,430 @@
+package aggregator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/buffer"
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+)
+
+type CollisionStrategy string
+
+const (
+	// KeepFirst keeps a plan from the first backend that lists its ID and
+	// drops it from later ones. Plans of a service listed by several
+	// backends are merged into the service of the first.
+	KeepFirst CollisionStrategy = "first"
+	// Reject refuses to serve a catalog in which an ID is listed twice.
+	Reject CollisionStrategy = "reject"
+)
+
+// Backend is an upstream broker. Its handler is expected to authenticate
+// and forward requests to the broker.
+type Backend struct {
+	Name    string
+	Handler http.Handler
+}
+
+// ownersKey is the key of the plan owners in the routes store, which
+// cannot be taken by an instance ID since those are GUIDs in Cloud Foundry.
+const ownersKey = "#owners"
+
+// Aggregator presents several backends as one broker. It merges their
+// catalogs and routes instance and binding requests to the backend that
+// owns the plan. Which backend an instance lives on, and which backend owns
+// every plan, is kept in the routes store so that requests can be routed
+// after a restart without fetching the catalogs first. Requests for plans
+// without a known owner fetch the catalogs again at most once per refresh
+// interval.
+type Aggregator struct {
+	backends        []Backend
+	strategy        CollisionStrategy
+	routes          *store.Store
+	refreshInterval time.Duration
+	now             func() time.Time
+
+	refreshing  sync.Mutex
+	refreshedAt time.Time
+
+	mu sync.RWMutex
+	// owners maps service IDs to plan IDs to the name of their backend.
+	owners map[string]map[string]string
+}
+
+type Option func(*Aggregator)
+
+// WithRefreshInterval sets how often requests for unknown plans may fetch
+// the catalogs.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(a *Aggregator) {
+		a.refreshInterval = interval
+	}
+}
+
+// WithClock sets the clock that the refresh interval is measured with.
+func WithClock(now func() time.Time) Option {
+	return func(a *Aggregator) {
+		a.now = now
+	}
+}
+
+type catalogError struct {
+	status      int
+	description string
+}
+
+func (e catalogError) Error() string {
+	return e.description
+}
+
+func New(backends []Backend, strategy CollisionStrategy, routes *store.Store, opts ...Option) *Aggregator {
+	owners := map[string]map[string]string{}
+	// Owners that cannot be read are found again from the catalogs.
+	if _, err := routes.Get(ownersKey, &owners); err != nil {
+		owners = map[string]map[string]string{}
+	}
+
+	a := &Aggregator{
+		backends:        backends,
+		strategy:        strategy,
+		routes:          routes,
+		refreshInterval: catalog.DefaultRefreshInterval,
+		now:             time.Now,
+		owners:          owners,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+func (a *Aggregator) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	route := osbapi.ParseRoute(r.Method, r.URL.Path)
+
+	switch route.Operation {
+	case osbapi.Catalog:
+		a.serveCatalog(rw, r)
+		return
+	case osbapi.Unknown:
+		osbapi.WriteError(rw, http.StatusNotFound, "", "Unknown endpoint "+r.URL.Path)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusBadRequest, "", "Could not read request body")
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	backend, err := a.backendFor(r, route, body)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusBadGateway, "", err.Error())
+		return
+	}
+
+	if backend == nil {
+		if r.Method == http.MethodGet {
+			a.probe(rw, r, route)
+			return
+		}
+		osbapi.WriteError(rw, http.StatusBadRequest, "", fmt.Sprintf("Could not determine the broker of service instance %s", route.InstanceID))
+		return
+	}
+
+	res := negroni.NewResponseWriter(rw)
+	backend.Handler.ServeHTTP(res, r)
+	a.recordRoute(logging.FromContext(r.Context()), route, backend, res.Status())
+}
+
+func (a *Aggregator) serveCatalog(rw http.ResponseWriter, r *http.Request) {
+	merged, err := a.mergedCatalog(r)
+	if err != nil {
+		status := http.StatusBadGateway
+		if catalogErr, ok := err.(catalogError); ok {
+			status = catalogErr.status
+		}
+		osbapi.WriteError(rw, status, "", err.Error())
+		return
+	}
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to encode the catalog: "+err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(body)
+}
+
+// mergedCatalog fetches the catalog of every backend and merges them. The
+// owner of every plan is remembered for routing.
+func (a *Aggregator) mergedCatalog(r *http.Request) (catalog.Catalog, error) {
+	responses := make([]*buffer.Response, len(a.backends))
+
+	var wg sync.WaitGroup
+	for i, backend := range a.backends {
+		wg.Add(1)
+		go func(i int, backend Backend) {
+			defer wg.Done()
+
+			req, _ := http.NewRequest(http.MethodGet, "/v2/catalog", nil)
+			req.Header = cloneHeader(r.Header)
+
+			responses[i] = buffer.NewResponse()
+			backend.Handler.ServeHTTP(responses[i], req.WithContext(r.Context()))
+		}(i, backend)
+	}
+	wg.Wait()
+
+	logger := logging.FromContext(r.Context())
+	merged := catalog.Catalog{Services: []catalog.Service{}}
+	services := map[string]int{}
+	serviceOwners := map[string]string{}
+	planOwners := map[string]string{}
+	owners := map[string]map[string]string{}
+
+	for i, backend := range a.backends {
+		if responses[i].Status() != http.StatusOK {
+			return catalog.Catalog{}, fmt.Errorf("Broker %s responded to the catalog request with status %d", backend.Name, responses[i].Status())
+		}
+
+		backendCatalog, err := catalog.Parse(responses[i].Body.Bytes())
+		if err != nil {
+			return catalog.Catalog{}, fmt.Errorf("Broker %s responded with an invalid catalog: %s", backend.Name, err)
+		}
+
+		for _, service := range backendCatalog.Services {
+			index, shared := services[service.ID]
+			if shared && a.strategy == Reject {
+				return catalog.Catalog{}, a.collision(logger, "service", service.ID, serviceOwners[service.ID], backend.Name)
+			}
+
+			var plans []catalog.Plan
+			for _, plan := range service.Plans {
+				if owner, taken := planOwners[plan.ID]; taken {
+					if err := a.collision(logger, "plan", plan.ID, owner, backend.Name); err != nil {
+						return catalog.Catalog{}, err
+					}
+					continue
+				}
+				planOwners[plan.ID] = backend.Name
+				if owners[service.ID] == nil {
+					owners[service.ID] = map[string]string{}
+				}
+				owners[service.ID][plan.ID] = backend.Name
+				plans = append(plans, plan)
+			}
+
+			if len(plans) == 0 {
+				continue
+			}
+
+			if shared {
+				logger.Info(fmt.Sprintf("Merging the plans of service %s of broker %s into those of broker %s", service.ID, backend.Name, serviceOwners[service.ID]))
+				merged.Services[index].Plans = append(merged.Services[index].Plans, plans...)
+				continue
+			}
+
+			service.Plans = plans
+			services[service.ID] = len(merged.Services)
+			serviceOwners[service.ID] = backend.Name
+			merged.Services = append(merged.Services, service)
+		}
+	}
+
+	a.mu.Lock()
+	changed := !reflect.DeepEqual(a.owners, owners)
+	a.owners = owners
+	a.refreshedAt = a.now()
+	a.mu.Unlock()
+
+	if changed {
+		if err := a.routes.Put(ownersKey, owners); err != nil {
+			logger.Error("Failed to record the brokers of the plans", err)
+		}
+	}
+
+	return merged, nil
+}
+
+func (a *Aggregator) collision(logger *logging.Logger, kind, id, owner, backend string) error {
+	if a.strategy == Reject {
+		return catalogError{
+			status:      http.StatusInternalServerError,
+			description: fmt.Sprintf("The %s ID %s is used by both broker %s and broker %s", kind, id, owner, backend),
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Dropping %s %s of broker %s: its ID is already used by broker %s", kind, id, backend, owner))
+	return nil
+}
+
+// backendFor finds the backend for a request from the recorded route of its
+// instance or from its service and plan IDs. It returns nil when none of
+// them are known.
+func (a *Aggregator) backendFor(r *http.Request, route osbapi.Route, body []byte) (*Backend, error) {
+	var name string
+	if found, err := a.routes.Get(route.InstanceID, &name); err == nil && found {
+		if backend := a.backend(name); backend != nil {
+			return backend, nil
+		}
+	}
+
+	var details struct {
+		ServiceID string `json:"service_id"`
+		PlanID    string `json:"plan_id"`
+	}
+	json.Unmarshal(body, &details)
+	serviceID, planID := details.ServiceID, details.PlanID
+	if query := r.URL.Query(); query.Get("service_id") != "" {
+		serviceID, planID = query.Get("service_id"), query.Get("plan_id")
+	}
+
+	if serviceID == "" {
+		return nil, nil
+	}
+
+	if backend, err := a.planBackend(serviceID, planID); backend != nil || err != nil {
+		return backend, err
+	}
+
+	if err := a.refreshOwners(r); err != nil {
+		return nil, err
+	}
+
+	if backend, err := a.planBackend(serviceID, planID); backend != nil || err != nil {
+		return backend, err
+	}
+
+	a.mu.RLock()
+	_, offered := a.owners[serviceID]
+	a.mu.RUnlock()
+	if offered {
+		return nil, fmt.Errorf("Plan %s of service %s is not offered by any broker", planID, serviceID)
+	}
+	return nil, fmt.Errorf("Service %s is not offered by any broker", serviceID)
+}
+
+// refreshOwners fetches the catalogs to find plans added since they were
+// last fetched, unless that was less than the refresh interval ago.
+// Concurrent refreshes are made one at a time, so requests waiting for one
+// use its result.
+func (a *Aggregator) refreshOwners(r *http.Request) error {
+	a.refreshing.Lock()
+	defer a.refreshing.Unlock()
+
+	a.mu.Lock()
+	due := a.now().Sub(a.refreshedAt) >= a.refreshInterval
+	if due {
+		// Failed fetches count too, so that a failing broker is not asked
+		// for its catalog on every request.
+		a.refreshedAt = a.now()
+	}
+	a.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	_, err := a.mergedCatalog(r)
+	return err
+}
+
+// planBackend returns the backend that owns the plan. Without a plan ID it
+// returns the backend of the service's plans, and an error if they are
+// spread over several backends.
+func (a *Aggregator) planBackend(serviceID, planID string) (*Backend, error) {
+	a.mu.RLock()
+	plans := a.owners[serviceID]
+	name, ok := plans[planID]
+	if planID == "" {
+		for _, owner := range plans {
+			if ok && owner != name {
+				a.mu.RUnlock()
+				return nil, fmt.Errorf("Service %s is offered by several brokers, so requests for it need a plan ID", serviceID)
+			}
+			name, ok = owner, true
+		}
+	}
+	a.mu.RUnlock()
+
+	if !ok {
+		return nil, nil
+	}
+	return a.backend(name), nil
+}
+
+// probe sends a read-only request to each backend in turn until one of them
+// knows the instance.
+func (a *Aggregator) probe(rw http.ResponseWriter, r *http.Request, route osbapi.Route) {
+	var res *buffer.Response
+
+	for i := range a.backends {
+		backend := &a.backends[i]
+
+		req := r.WithContext(r.Context())
+		req.Header = cloneHeader(r.Header)
+
+		res = buffer.NewResponse()
+		backend.Handler.ServeHTTP(res, req)
+
+		if res.Status() != http.StatusNotFound && res.Status() != http.StatusGone {
+			if res.Status() == http.StatusOK {
+				a.remember(logging.FromContext(r.Context()), route.InstanceID, backend)
+			}
+			break
+		}
+	}
+
+	res.WriteTo(rw)
+}
+
+func (a *Aggregator) recordRoute(logger *logging.Logger, route osbapi.Route, backend *Backend, status int) {
+	switch {
+	case route.Operation == osbapi.Provision && status >= 200 && status < 300:
+		a.remember(logger, route.InstanceID, backend)
+	case route.Operation == osbapi.Deprovision && (status == http.StatusOK || status == http.StatusGone),
+		route.Operation == osbapi.LastOperation && status == http.StatusGone:
+		if err := a.routes.Delete(route.InstanceID); err != nil {
+			logger.Error("Failed to forget the broker of service instance "+route.InstanceID, err)
+		}
+	}
+}
+
+func (a *Aggregator) remember(logger *logging.Logger, instanceID string, backend *Backend) {
+	if err := a.routes.Put(instanceID, backend.Name); err != nil {
+		logger.Error(fmt.Sprintf("Failed to record broker %s for service instance %s", backend.Name, instanceID), err)
+	}
+}
+
+func (a *Aggregator) backend(name string) *Backend {
+	for i := range a.backends {
+		if a.backends[i].Name == name {
+			return &a.backends[i]
+		}
+	}
+	return nil
+}
+
+// cloneHeader copies headers so that backends setting their own
+// Authorization header do not interfere with each other.
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for key, values := range header {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
@@ -0,0 +1,334 @@
+package aggregator_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/aggregator"
+	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/urfave/negroni"
+)
+
+var _ = Describe("Aggregator", func() {
+	const (
+		catalogA = `{"services": [{"id": "mysql-id", "name": "google-cloudsql-mysql", "plans": [{"id": "mysql-beta-id", "name": "beta"}]}]}`
+		catalogB = `{"services": [{"id": "pubsub-id", "name": "google-pubsub", "plans": [{"id": "pubsub-beta-id", "name": "beta"}]}]}`
+	)
+
+	var (
+		brokerA, brokerB *ghttp.Server
+		dir              string
+		routesPath       string
+		strategy         aggregator.CollisionStrategy
+		writer           *httptest.ResponseRecorder
+	)
+
+	backend := func(name string, server *ghttp.Server) aggregator.Backend {
+		brokerURL, err := url.ParseRequestURI(server.URL())
+		Expect(err).NotTo(HaveOccurred())
+
+		return aggregator.Backend{Name: name, Handler: negroni.New(proxy.ReverseProxy(brokerURL))}
+	}
+
+	newAggregator := func() *aggregator.Aggregator {
+		routes, err := store.Open(routesPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		return aggregator.New([]aggregator.Backend{backend("a", brokerA), backend("b", brokerB)}, strategy, routes)
+	}
+
+	serve := func(agg *aggregator.Aggregator, method, path, body string) {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("X-Broker-API-Version", "2.14")
+
+		writer = httptest.NewRecorder()
+		agg.ServeHTTP(writer, req)
+	}
+
+	BeforeEach(func() {
+		brokerA = ghttp.NewServer()
+		brokerB = ghttp.NewServer()
+		strategy = aggregator.KeepFirst
+
+		var err error
+		dir, err = ioutil.TempDir("", "aggregator")
+		Expect(err).NotTo(HaveOccurred())
+		routesPath = filepath.Join(dir, "routes.json")
+	})
+
+	AfterEach(func() {
+		brokerA.Close()
+		brokerB.Close()
+		os.RemoveAll(dir)
+	})
+
+	Describe("the catalog", func() {
+		It("merges the catalogs of every backend", func() {
+			brokerA.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/v2/catalog"),
+				ghttp.VerifyHeaderKV("X-Broker-API-Version", "2.14"),
+				ghttp.RespondWith(http.StatusOK, catalogA),
+			))
+			brokerB.AppendHandlers(ghttp.RespondWith(http.StatusOK, catalogB))
+
+			serve(newAggregator(), "GET", "/v2/catalog", "")
+
+			Expect(writer.Code).To(Equal(http.StatusOK))
+			Expect(writer.Body.String()).To(MatchJSON(`{"services": [
+				{"id": "mysql-id", "name": "google-cloudsql-mysql", "plans": [{"id": "mysql-beta-id", "name": "beta"}]},
+				{"id": "pubsub-id", "name": "google-pubsub", "plans": [{"id": "pubsub-beta-id", "name": "beta"}]}
+			]}`))
+		})
+
+		Context("when backends share service or plan IDs", func() {
+			BeforeEach(func() {
+				brokerA.AppendHandlers(ghttp.RespondWith(http.StatusOK, catalogA))
+				brokerB.AppendHandlers(ghttp.RespondWith(http.StatusOK, `{"services": [
+					{"id": "mysql-id", "name": "duplicate-service", "plans": [{"id": "other-id", "name": "beta"}]},
+					{"id": "storage-id", "name": "google-storage", "plans": [
+						{"id": "mysql-beta-id", "name": "duplicate-plan"},
+						{"id": "storage-beta-id", "name": "beta"}
+					]}
+				]}`))
+			})
+
+			It("keeps the plans of the first backend and merges the plans of shared services", func() {
+				serve(newAggregator(), "GET", "/v2/catalog", "")
+
+				Expect(writer.Code).To(Equal(http.StatusOK))
+				Expect(writer.Body.String()).To(MatchJSON(`{"services": [
+					{"id": "mysql-id", "name": "google-cloudsql-mysql", "plans": [{"id": "mysql-beta-id", "name": "beta"}, {"id": "other-id", "name": "beta"}]},
+					{"id": "storage-id", "name": "google-storage", "plans": [{"id": "storage-beta-id", "name": "beta"}]}
+				]}`))
+			})
+
+			Context("and duplicates are rejected", func() {
+				BeforeEach(func() {
+					strategy = aggregator.Reject
+				})
+
+				It("responds with an error", func() {
+					serve(newAggregator(), "GET", "/v2/catalog", "")
+
+					Expect(writer.Code).To(Equal(http.StatusInternalServerError))
+					Expect(writer.Body.String()).To(MatchJSON(`{"description": "The service ID mysql-id is used by both broker a and broker b"}`))
+				})
+			})
+		})
+
+		Context("when a backend fails", func() {
+			It("responds with an error rather than a partial catalog", func() {
+				brokerA.AppendHandlers(ghttp.RespondWith(http.StatusOK, catalogA))
+				brokerB.AppendHandlers(ghttp.RespondWith(http.StatusInternalServerError, "{}"))
+
+				serve(newAggregator(), "GET", "/v2/catalog", "")
+
+				Expect(writer.Code).To(Equal(http.StatusBadGateway))
+				Expect(writer.Body.String()).To(ContainSubstring("Broker b responded to the catalog request with status 500"))
+			})
+		})
+	})
+
+	Describe("routing", func() {
+		const instancePath = "/v2/service_instances/instance-1"
+
+		BeforeEach(func() {
+			brokerA.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, catalogA))
+			brokerB.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, catalogB))
+		})
+
+		It("routes provisions by service ID", func() {
+			brokerB.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", instancePath),
+				ghttp.VerifyBody([]byte(`{"service_id": "pubsub-id", "plan_id": "pubsub-beta-id"}`)),
+				ghttp.RespondWith(http.StatusCreated, "{}"),
+			))
+
+			serve(newAggregator(), "PUT", instancePath, `{"service_id": "pubsub-id", "plan_id": "pubsub-beta-id"}`)
+
+			Expect(writer.Code).To(Equal(http.StatusCreated))
+			Expect(brokerB.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("does not fetch the catalogs again after a restart", func() {
+			brokerB.AppendHandlers(
+				ghttp.RespondWith(http.StatusCreated, "{}"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v2/service_instances/instance-2"),
+					ghttp.RespondWith(http.StatusCreated, "{}"),
+				),
+			)
+			serve(newAggregator(), "PUT", instancePath, `{"service_id": "pubsub-id", "plan_id": "pubsub-beta-id"}`)
+			Expect(writer.Code).To(Equal(http.StatusCreated))
+
+			serve(newAggregator(), "PUT", "/v2/service_instances/instance-2", `{"service_id": "pubsub-id", "plan_id": "pubsub-beta-id"}`)
+
+			Expect(writer.Code).To(Equal(http.StatusCreated))
+			Expect(brokerA.ReceivedRequests()).To(HaveLen(1))
+			Expect(brokerB.ReceivedRequests()).To(HaveLen(3))
+		})
+
+		Context("when backends offer plans of the same service", func() {
+			BeforeEach(func() {
+				brokerB.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK,
+					`{"services": [{"id": "mysql-id", "name": "google-cloudsql-mysql", "plans": [{"id": "mysql-ga-id", "name": "ga"}]}]}`))
+			})
+
+			It("routes provisions by plan ID", func() {
+				brokerB.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", instancePath),
+					ghttp.RespondWith(http.StatusCreated, "{}"),
+				))
+
+				serve(newAggregator(), "PUT", instancePath, `{"service_id": "mysql-id", "plan_id": "mysql-ga-id"}`)
+
+				Expect(writer.Code).To(Equal(http.StatusCreated))
+				Expect(brokerA.ReceivedRequests()).To(HaveLen(1))
+			})
+
+			It("rejects plans no backend offers", func() {
+				serve(newAggregator(), "PUT", instancePath, `{"service_id": "mysql-id", "plan_id": "unknown"}`)
+
+				Expect(writer.Code).To(Equal(http.StatusBadGateway))
+				Expect(writer.Body.String()).To(ContainSubstring("Plan unknown of service mysql-id is not offered by any broker"))
+			})
+
+			It("rejects requests for the service without a plan ID", func() {
+				serve(newAggregator(), "DELETE", instancePath+"?service_id=mysql-id", "")
+
+				Expect(writer.Code).To(Equal(http.StatusBadGateway))
+				Expect(writer.Body.String()).To(ContainSubstring("Service mysql-id is offered by several brokers, so requests for it need a plan ID"))
+			})
+		})
+
+		It("rejects services no backend offers", func() {
+			serve(newAggregator(), "PUT", instancePath, `{"service_id": "unknown", "plan_id": "unknown"}`)
+
+			Expect(writer.Code).To(Equal(http.StatusBadGateway))
+			Expect(writer.Body.String()).To(ContainSubstring("Service unknown is not offered by any broker"))
+		})
+
+		It("fetches the catalogs for unknown services at most once per refresh interval", func() {
+			now := time.Now()
+			routes, err := store.Open(routesPath)
+			Expect(err).NotTo(HaveOccurred())
+			agg := aggregator.New([]aggregator.Backend{backend("a", brokerA), backend("b", brokerB)}, strategy, routes,
+				aggregator.WithRefreshInterval(time.Minute),
+				aggregator.WithClock(func() time.Time { return now }))
+
+			for i := 0; i < 3; i++ {
+				serve(agg, "PUT", instancePath, `{"service_id": "unknown", "plan_id": "unknown"}`)
+				Expect(writer.Code).To(Equal(http.StatusBadGateway))
+				Expect(writer.Body.String()).To(ContainSubstring("Service unknown is not offered by any broker"))
+			}
+			Expect(brokerA.ReceivedRequests()).To(HaveLen(1))
+			Expect(brokerB.ReceivedRequests()).To(HaveLen(1))
+
+			now = now.Add(time.Minute)
+			serve(agg, "PUT", instancePath, `{"service_id": "unknown", "plan_id": "unknown"}`)
+			Expect(brokerA.ReceivedRequests()).To(HaveLen(2))
+			Expect(brokerB.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		Context("once an instance has been provisioned", func() {
+			BeforeEach(func() {
+				brokerB.AppendHandlers(ghttp.RespondWith(http.StatusAccepted, `{"operation": "op"}`))
+				serve(newAggregator(), "PUT", instancePath, `{"service_id": "pubsub-id", "plan_id": "pubsub-beta-id"}`)
+				Expect(writer.Code).To(Equal(http.StatusAccepted))
+			})
+
+			It("routes requests without a service ID after a restart", func() {
+				brokerB.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", instancePath+"/last_operation", "operation=op"),
+					ghttp.RespondWith(http.StatusOK, `{"state": "succeeded"}`),
+				))
+
+				serve(newAggregator(), "GET", instancePath+"/last_operation?operation=op", "")
+
+				Expect(writer.Code).To(Equal(http.StatusOK))
+				Expect(writer.Body.String()).To(MatchJSON(`{"state": "succeeded"}`))
+			})
+
+			It("routes bindings to the same backend", func() {
+				brokerB.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", instancePath+"/service_bindings/binding-1"),
+					ghttp.RespondWith(http.StatusCreated, `{"credentials": {}}`),
+				))
+
+				serve(newAggregator(), "PUT", instancePath+"/service_bindings/binding-1", `{"service_id": "pubsub-id", "plan_id": "pubsub-beta-id"}`)
+
+				Expect(writer.Code).To(Equal(http.StatusCreated))
+			})
+
+			It("forgets the route once the instance is deprovisioned", func() {
+				brokerB.AppendHandlers(
+					ghttp.RespondWith(http.StatusOK, "{}"),
+				)
+				serve(newAggregator(), "DELETE", instancePath+"?service_id=pubsub-id&plan_id=pubsub-beta-id", "")
+				Expect(writer.Code).To(Equal(http.StatusOK))
+
+				routes, err := store.Open(routesPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes.Keys("instance-")).To(BeEmpty())
+			})
+		})
+
+		Context("when nothing is known about an instance", func() {
+			It("asks every backend for read-only requests", func() {
+				brokerA.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", instancePath),
+					ghttp.RespondWith(http.StatusNotFound, "{}"),
+				))
+				brokerB.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", instancePath),
+					ghttp.RespondWith(http.StatusOK, `{"service_id": "pubsub-id"}`),
+				))
+
+				agg := newAggregator()
+				serve(agg, "GET", instancePath, "")
+
+				Expect(writer.Code).To(Equal(http.StatusOK))
+				Expect(writer.Body.String()).To(MatchJSON(`{"service_id": "pubsub-id"}`))
+
+				brokerB.AppendHandlers(ghttp.RespondWith(http.StatusOK, `{"state": "succeeded"}`))
+				serve(agg, "GET", instancePath+"/last_operation", "")
+				Expect(writer.Code).To(Equal(http.StatusOK))
+				Expect(brokerA.ReceivedRequests()).To(HaveLen(1))
+			})
+
+			It("responds with the last answer when no backend knows the instance", func() {
+				brokerA.AppendHandlers(ghttp.RespondWith(http.StatusGone, "{}"))
+				brokerB.AppendHandlers(ghttp.RespondWith(http.StatusGone, "{}"))
+
+				serve(newAggregator(), "GET", instancePath+"/last_operation", "")
+
+				Expect(writer.Code).To(Equal(http.StatusGone))
+			})
+
+			It("rejects other requests", func() {
+				serve(newAggregator(), "DELETE", instancePath, "")
+
+				Expect(writer.Code).To(Equal(http.StatusBadRequest))
+				Expect(writer.Body.String()).To(ContainSubstring("Could not determine the broker of service instance instance-1"))
+			})
+		})
+
+		It("rejects unknown endpoints", func() {
+			serve(newAggregator(), "GET", "/v2/any-endpoint", "")
+
+			Expect(writer.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
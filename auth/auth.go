@@ -1,21 +1,160 @@
 package auth
 
 import (
+	"context"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
 )
 
+type options struct {
+	lockout      *Lockout
+	certificates *CertificateRules
+	tokens       *TokenVerifier
+}
+
+type Option func(*options)
+
+// WithLockout rejects clients and users that failed to authenticate too
+// often with a 429 until their lockout ends.
+func WithLockout(lockout *Lockout) Option {
+	return func(o *options) {
+		o.lockout = lockout
+	}
+}
+
+// WithClientCertificates also accepts requests with a verified client
+// certificate that matches one of the rules. Such requests need no basic
+// auth credentials.
+func WithClientCertificates(rules *CertificateRules) Option {
+	return func(o *options) {
+		o.certificates = rules
+	}
+}
+
+// WithBearerTokens also accepts requests with an Authorization: Bearer
+// token that the verifier accepts and that has the scope the OSBAPI
+// operation requires.
+func WithBearerTokens(verifier *TokenVerifier) Option {
+	return func(o *options) {
+		o.tokens = verifier
+	}
+}
+
+// BasicAuth accepts a single username and password.
 func BasicAuth(username, password string) negroni.HandlerFunc {
+	credentials, err := NewCredentials([]Credential{{Username: username, Password: password}})
+	if err != nil {
+		return reject
+	}
+	return Authenticator(credentials)
+}
+
+type contextKey int
+
+const credentialKey contextKey = iota
+
+// Authenticator accepts any of the credentials. The label of the credential
+// used is added to the request log, and the credential to the request
+// context. Credentials may be nil when only client certificates or bearer
+// tokens are accepted.
+func Authenticator(credentials *Credentials, opts ...Option) negroni.HandlerFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		user, pass, _ := r.BasicAuth()
+		if credential, certificate, ok := o.certificates.authenticateCertificate(r); ok {
+			logging.Annotate(r.Context(), logging.Data{
+				"credential":         credential.Label,
+				"client_certificate": certificate.Subject.String(),
+			})
+			next(w, r.WithContext(context.WithValue(r.Context(), credentialKey, credential)))
+			return
+		}
+
+		if o.tokens != nil {
+			if token, ok := bearerToken(r); ok {
+				o.tokens.authenticate(w, r, next, token)
+				return
+			}
+		}
 
-		if user != username || pass != password {
+		if credentials == nil {
 			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Incorrect username/password"))
+			w.Write([]byte(o.missingCredentials()))
+			return
+		}
+
+		user, pass, _ := r.BasicAuth()
+
+		var client string
+		if o.lockout != nil {
+			client = o.lockout.ClientAddress(r)
+			if wait := o.lockout.RetryAfter(client); wait > 0 {
+				lockedOut(w, r, wait)
+				return
+			}
+		}
+
+		credential, err := credentials.Authenticate(user, pass)
+		if err == ErrCredentialExpired {
+			logging.Annotate(r.Context(), logging.Data{"credential": credential.Label, "credential_expired": true})
+		}
+		if err != nil {
+			if o.lockout != nil {
+				wait := o.lockout.UsernameRetryAfter(user)
+				o.lockout.Failure(client, user)
+				if wait > 0 {
+					lockedOut(w, r, wait)
+					return
+				}
+			}
+			reject(w, r, next)
 			return
 		}
 
-		next(w, r)
+		if o.lockout != nil {
+			o.lockout.Success(client, user)
+		}
+
+		logging.Annotate(r.Context(), logging.Data{"credential": credential.Label})
+		next(w, r.WithContext(context.WithValue(r.Context(), credentialKey, credential)))
 	})
 }
+
+func lockedOut(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	logging.Annotate(r.Context(), logging.Data{"locked_out": true})
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	osbapi.WriteError(w, http.StatusTooManyRequests, "", "Too many failed authentication attempts, try again later")
+}
+
+func (o options) missingCredentials() string {
+	switch {
+	case o.certificates != nil && o.tokens != nil:
+		return "A trusted client certificate or a bearer token is required"
+	case o.tokens != nil:
+		return "A bearer token is required"
+	default:
+		return "A trusted client certificate is required"
+	}
+}
+
+// CredentialFromContext returns the credential the request was
+// authenticated with.
+func CredentialFromContext(ctx context.Context) (Credential, bool) {
+	credential, ok := ctx.Value(credentialKey).(Credential)
+	return credential, ok
+}
+
+func reject(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("Incorrect username/password"))
+}
@@ -1,10 +1,15 @@
 package auth_test
 
 import (
+	"bytes"
 	"net/http"
 	"net/http/httptest"
+	"time"
+
+	"github.com/urfave/negroni"
 
 	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -67,3 +72,48 @@ var _ = Describe("BasicAuth", func() {
 		})
 	})
 })
+
+var _ = Describe("Authenticator", func() {
+	var (
+		credentials *auth.Credentials
+		logs        *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		credentials, err = auth.NewCredentials([]auth.Credential{
+			{Label: "expired", Username: "broker", Password: "old", Expires: time.Now().Add(-time.Minute)},
+			{Label: "current", Username: "broker", PasswordHash: newSecretHash},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		logs = &bytes.Buffer{}
+	})
+
+	serve := func(username, password string) int {
+		n := negroni.New(logging.RequestLogger(logging.New(logs, logs)), auth.Authenticator(credentials))
+		n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		req.SetBasicAuth(username, password)
+
+		writer := httptest.NewRecorder()
+		n.ServeHTTP(writer, req)
+		return writer.Code
+	}
+
+	It("logs the label of the credential used", func() {
+		Expect(serve("broker", "new-secret")).To(Equal(http.StatusOK))
+		Expect(logs.String()).To(ContainSubstring(`"credential":"current"`))
+	})
+
+	It("logs the use of expired credentials", func() {
+		Expect(serve("broker", "old")).To(Equal(http.StatusUnauthorized))
+		Expect(logs.String()).To(ContainSubstring(`"credential":"expired","credential_expired":true`))
+	})
+
+	It("does not log a label for unknown credentials", func() {
+		Expect(serve("broker", "wrong")).To(Equal(http.StatusUnauthorized))
+		Expect(logs.String()).NotTo(ContainSubstring(`"credential"`))
+	})
+})
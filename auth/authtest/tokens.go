@@ -0,0 +1,87 @@
+// Package authtest issues signed bearer tokens for tests.
+package authtest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+)
+
+// Signer signs tokens with an RSA key, as the UAA does.
+type Signer struct {
+	KeyID string
+	key   *rsa.PrivateKey
+}
+
+func NewSigner(keyID string) (*Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{KeyID: keyID, key: key}, nil
+}
+
+// JWK returns the public key as a JSON Web Key.
+func (s *Signer) JWK() map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": s.KeyID,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}
+}
+
+// Sign returns an RS256 token with the claims.
+func (s *Signer) Sign(claims map[string]interface{}) (string, error) {
+	return s.SignWithHeader(map[string]interface{}{"alg": "RS256", "kid": s.KeyID, "typ": "JWT"}, claims)
+}
+
+// SignWithHeader returns a token with the header and claims, signed with
+// RS256 whatever the header says.
+func (s *Signer) SignWithHeader(header, claims map[string]interface{}) (string, error) {
+	encodedHeader, err := encode(header)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := encode(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := encodedHeader + "." + encodedClaims
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// JWKS returns a key set with the public keys of the signers.
+func JWKS(signers ...*Signer) []byte {
+	keys := []map[string]string{}
+	for _, signer := range signers {
+		keys = append(keys, signer.JWK())
+	}
+
+	document, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		panic(err)
+	}
+	return document
+}
+
+func encode(v interface{}) (string, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// CertificateRule maps client certificates to a caller. A certificate
+// matches when its subject, such as "CN=cloud_controller,O=Cloud Foundry",
+// matches Subject and one of its DNS, email, IP or URI SANs matches SAN.
+// Patterns may contain * wildcards, and an empty pattern matches anything,
+// but a rule needs at least one pattern.
+type CertificateRule struct {
+	Label   string `yaml:"label"`
+	Subject string `yaml:"subject"`
+	SAN     string `yaml:"san"`
+	Role    Role   `yaml:"role"`
+}
+
+type certificateRule struct {
+	CertificateRule
+	subject *regexp.Regexp
+	san     *regexp.Regexp
+}
+
+// CertificateRules authenticates verified client certificates.
+type CertificateRules struct {
+	rules []certificateRule
+}
+
+// NewCertificateRules checks the rules. A rule without a label is labelled
+// with its patterns, and one without a role has the full role.
+func NewCertificateRules(rules []CertificateRule) (*CertificateRules, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("at least one rule is required")
+	}
+
+	c := &CertificateRules{}
+	for i, rule := range rules {
+		if rule.Subject == "" && rule.SAN == "" {
+			return nil, fmt.Errorf("certificate rule %d needs a subject or san pattern", i)
+		}
+		if rule.Label == "" {
+			rule.Label = strings.TrimSpace(rule.Subject + " " + rule.SAN)
+		}
+		if rule.Role == "" {
+			rule.Role = Full
+		}
+		if !rule.Role.valid() {
+			return nil, fmt.Errorf("certificate rule %s has an unknown role %s, use %s, %s or %s", rule.Label, rule.Role, CatalogOnly, ReadOnly, Full)
+		}
+
+		c.rules = append(c.rules, certificateRule{
+			CertificateRule: rule,
+			subject:         compilePattern(rule.Subject),
+			san:             compilePattern(rule.SAN),
+		})
+	}
+
+	return c, nil
+}
+
+// compilePattern turns a pattern with * wildcards into a regexp matching
+// whole strings.
+func compilePattern(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// Match returns the credential of the first rule the certificate matches.
+func (c *CertificateRules) Match(certificate *x509.Certificate) (Credential, bool) {
+	for _, rule := range c.rules {
+		if rule.subject != nil && !rule.subject.MatchString(certificate.Subject.String()) {
+			continue
+		}
+		if rule.san != nil && !matchesAny(rule.san, subjectAltNames(certificate)) {
+			continue
+		}
+
+		return Credential{Label: rule.Label, Role: rule.Role}, true
+	}
+
+	return Credential{}, false
+}
+
+// authenticateCertificate returns the credential for the verified client
+// certificate of the request, if any.
+func (c *CertificateRules) authenticateCertificate(r *http.Request) (Credential, *x509.Certificate, bool) {
+	if c == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Credential{}, nil, false
+	}
+
+	certificate := r.TLS.VerifiedChains[0][0]
+	credential, ok := c.Match(certificate)
+	return credential, certificate, ok
+}
+
+func subjectAltNames(certificate *x509.Certificate) []string {
+	var names []string
+	names = append(names, certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+	for _, ip := range certificate.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+func matchesAny(pattern *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
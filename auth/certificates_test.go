@@ -0,0 +1,134 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig/tlsconfigtest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CertificateRules", func() {
+	var (
+		ca    *tlsconfigtest.CA
+		rules *auth.CertificateRules
+	)
+
+	issue := func(opts tlsconfigtest.Options) *x509.Certificate {
+		certificate, err := ca.Issue(opts)
+		Expect(err).NotTo(HaveOccurred())
+		return certificate.Certificate
+	}
+
+	BeforeEach(func() {
+		var err error
+		ca, err = tlsconfigtest.NewCA("test-ca")
+		Expect(err).NotTo(HaveOccurred())
+
+		rules, err = auth.NewCertificateRules([]auth.CertificateRule{
+			{Label: "cloud-controller", Subject: "CN=cloud_controller*,O=Cloud Foundry"},
+			{SAN: "spiffe://cf.internal/monitoring/*", Role: auth.CatalogOnly},
+			{Subject: "CN=automation", SAN: "*.automation.internal", Role: auth.ReadOnly},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("matches subjects", func() {
+		credential, ok := rules.Match(issue(tlsconfigtest.Options{CommonName: "cloud_controller_ng", Organization: "Cloud Foundry"}))
+		Expect(ok).To(BeTrue())
+		Expect(credential).To(Equal(auth.Credential{Label: "cloud-controller", Role: auth.Full}))
+
+		_, ok = rules.Match(issue(tlsconfigtest.Options{CommonName: "cloud_controller_ng", Organization: "Other"}))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("matches SANs", func() {
+		credential, ok := rules.Match(issue(tlsconfigtest.Options{CommonName: "prometheus", URIs: []string{"spiffe://cf.internal/monitoring/prometheus"}}))
+		Expect(ok).To(BeTrue())
+		Expect(credential).To(Equal(auth.Credential{Label: "spiffe://cf.internal/monitoring/*", Role: auth.CatalogOnly}))
+	})
+
+	It("requires both patterns of a rule to match", func() {
+		credential, ok := rules.Match(issue(tlsconfigtest.Options{CommonName: "automation", DNSNames: []string{"ci.automation.internal"}}))
+		Expect(ok).To(BeTrue())
+		Expect(credential.Label).To(Equal("CN=automation *.automation.internal"))
+
+		_, ok = rules.Match(issue(tlsconfigtest.Options{CommonName: "automation", DNSNames: []string{"ci.example.com"}}))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("rejects invalid rules", func() {
+		_, err := auth.NewCertificateRules([]auth.CertificateRule{{Label: "empty"}})
+		Expect(err).To(MatchError("certificate rule 0 needs a subject or san pattern"))
+
+		_, err = auth.NewCertificateRules([]auth.CertificateRule{{Subject: "CN=a", Role: "root"}})
+		Expect(err).To(MatchError("certificate rule CN=a has an unknown role root, use catalog, read-only or full"))
+	})
+
+	Describe("with Authenticator", func() {
+		var credentials *auth.Credentials
+
+		serve := func(certificate *x509.Certificate, username, password string) (int, string) {
+			var role auth.Role
+			handler := negroni.New(auth.Authenticator(credentials, auth.WithClientCertificates(rules)))
+			handler.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				credential, _ := auth.CredentialFromContext(r.Context())
+				role = credential.Role
+			})
+
+			req := httptest.NewRequest("GET", "/v2/catalog", nil)
+			if certificate != nil {
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate, ca.Certificate}}}
+			}
+			if username != "" {
+				req.SetBasicAuth(username, password)
+			}
+
+			writer := httptest.NewRecorder()
+			handler.ServeHTTP(writer, req)
+			return writer.Code, string(role)
+		}
+
+		BeforeEach(func() {
+			var err error
+			credentials, err = auth.NewCredentials([]auth.Credential{{Username: "broker", Password: "secret"}})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("accepts matching certificates without basic auth", func() {
+			code, role := serve(issue(tlsconfigtest.Options{CommonName: "prometheus", URIs: []string{"spiffe://cf.internal/monitoring/a"}}), "", "")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(role).To(Equal("catalog"))
+		})
+
+		It("falls back to basic auth", func() {
+			code, role := serve(issue(tlsconfigtest.Options{CommonName: "unknown"}), "broker", "secret")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(role).To(Equal("full"))
+
+			code, _ = serve(nil, "broker", "wrong")
+			Expect(code).To(Equal(http.StatusUnauthorized))
+		})
+
+		Context("when only certificates are accepted", func() {
+			BeforeEach(func() {
+				credentials = nil
+			})
+
+			It("rejects requests without a matching certificate", func() {
+				code, _ := serve(issue(tlsconfigtest.Options{CommonName: "unknown"}), "broker", "secret")
+				Expect(code).To(Equal(http.StatusUnauthorized))
+
+				code, _ = serve(issue(tlsconfigtest.Options{CommonName: "cloud_controller", Organization: "Cloud Foundry"}), "", "")
+				Expect(code).To(Equal(http.StatusOK))
+			})
+		})
+	})
+})
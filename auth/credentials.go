@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("incorrect username or password")
+	ErrCredentialExpired  = errors.New("credential has expired")
+)
+
+// Credential is a username and password accepted by the proxy. The password
+// is given either in plain text or as a hash from HashPassword. A credential
+// with an expiry stops being accepted once it has passed, which lets an old
+// and a new credential be valid together while the platform is rotated.
+type Credential struct {
+	Label        string    `yaml:"label"`
+	Username     string    `yaml:"username"`
+	Password     string    `yaml:"password"`
+	PasswordHash string    `yaml:"password_hash"`
+	Expires      time.Time `yaml:"expires"`
+	Role         Role      `yaml:"role"`
+}
+
+func (c Credential) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && now.After(c.Expires)
+}
+
+type credential struct {
+	Credential
+	username [sha256.Size]byte
+	password [sha256.Size]byte
+	hash     passwordHash
+}
+
+// Credentials is a set of credentials that is safe for concurrent use.
+type Credentials struct {
+	credentials []credential
+	now         func() time.Time
+
+	// verified remembers digests of username and password pairs that
+	// matched a hashed credential, so that each request does not pay for
+	// an scrypt derivation.
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]int
+}
+
+type CredentialsOption func(*Credentials)
+
+// WithClock sets the clock used to expire credentials.
+func WithClock(now func() time.Time) CredentialsOption {
+	return func(c *Credentials) {
+		c.now = now
+	}
+}
+
+// NewCredentials checks the credentials and parses their hashes. A
+// credential without a label is labelled with its username, and one without
+// a role has the full role.
+func NewCredentials(credentials []Credential, opts ...CredentialsOption) (*Credentials, error) {
+	c := &Credentials{now: time.Now, verified: map[[sha256.Size]byte]int{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if len(credentials) == 0 {
+		return nil, errors.New("at least one credential is required")
+	}
+
+	labels := map[string]bool{}
+	for i, cred := range credentials {
+		if cred.Label == "" {
+			cred.Label = cred.Username
+		}
+		if cred.Role == "" {
+			cred.Role = Full
+		}
+
+		switch {
+		case cred.Username == "":
+			return nil, fmt.Errorf("credential %d is missing a username", i)
+		case labels[cred.Label]:
+			return nil, fmt.Errorf("credential label %s is used more than once", cred.Label)
+		case cred.Password == "" && cred.PasswordHash == "":
+			return nil, fmt.Errorf("credential %s is missing a password or password_hash", cred.Label)
+		case cred.Password != "" && cred.PasswordHash != "":
+			return nil, fmt.Errorf("credential %s has both a password and a password_hash", cred.Label)
+		case !cred.Role.valid():
+			return nil, fmt.Errorf("credential %s has an unknown role %s, use %s, %s or %s", cred.Label, cred.Role, CatalogOnly, ReadOnly, Full)
+		}
+		labels[cred.Label] = true
+
+		parsed := credential{
+			Credential: cred,
+			username:   sha256.Sum256([]byte(cred.Username)),
+			password:   sha256.Sum256([]byte(cred.Password)),
+		}
+
+		if cred.PasswordHash != "" {
+			hash, err := parseHash(cred.PasswordHash)
+			if err != nil {
+				return nil, fmt.Errorf("credential %s has an invalid password_hash: %s", cred.Label, err)
+			}
+			parsed.hash = hash
+		}
+
+		c.credentials = append(c.credentials, parsed)
+	}
+
+	return c, nil
+}
+
+// Authenticate returns the credential matching the username and password.
+// Usernames and plain text passwords are compared in constant time, by
+// their digests so that their lengths do not leak either. An expired
+// credential is returned together with ErrCredentialExpired.
+func (c *Credentials) Authenticate(username, password string) (Credential, error) {
+	usernameDigest := sha256.Sum256([]byte(username))
+	passwordDigest := sha256.Sum256([]byte(password))
+
+	now := c.now()
+	match, expired := -1, -1
+	for i, cred := range c.credentials {
+		if subtle.ConstantTimeCompare(usernameDigest[:], cred.username[:]) != 1 {
+			continue
+		}
+
+		var matches bool
+		if cred.hash == nil {
+			matches = subtle.ConstantTimeCompare(passwordDigest[:], cred.password[:]) == 1
+		} else {
+			matches = c.matchesHash(i, username, password)
+		}
+
+		switch {
+		case !matches:
+		case cred.expired(now):
+			if expired == -1 {
+				expired = i
+			}
+		case match == -1:
+			match = i
+		}
+	}
+
+	switch {
+	case match != -1:
+		return c.credentials[match].Credential, nil
+	case expired != -1:
+		return c.credentials[expired].Credential, ErrCredentialExpired
+	default:
+		return Credential{}, ErrInvalidCredentials
+	}
+}
+
+func (c *Credentials) matchesHash(i int, username, password string) bool {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+
+	c.mu.Lock()
+	verified, ok := c.verified[key]
+	c.mu.Unlock()
+	if ok {
+		return verified == i
+	}
+
+	if !c.credentials[i].hash.matches(password) {
+		return false
+	}
+
+	c.mu.Lock()
+	c.verified[key] = i
+	c.mu.Unlock()
+	return true
+}
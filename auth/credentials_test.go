@@ -0,0 +1,124 @@
+package auth_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credentials", func() {
+	var (
+		now         time.Time
+		credentials *auth.Credentials
+	)
+
+	clock := func() time.Time {
+		return now
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		var err error
+		credentials, err = auth.NewCredentials([]auth.Credential{
+			{Label: "old", Username: "broker", PasswordHash: oldSecretHash, Expires: now.Add(time.Hour)},
+			{Label: "new", Username: "broker", PasswordHash: newSecretHash},
+			{Username: "monitoring", Password: "plain"},
+		}, auth.WithClock(clock))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("accepts both credentials during a rotation", func() {
+		credential, err := credentials.Authenticate("broker", "old-secret")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credential.Label).To(Equal("old"))
+
+		credential, err = credentials.Authenticate("broker", "new-secret")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credential.Label).To(Equal("new"))
+	})
+
+	It("stops accepting a credential once it has expired", func() {
+		now = now.Add(2 * time.Hour)
+
+		credential, err := credentials.Authenticate("broker", "old-secret")
+		Expect(err).To(Equal(auth.ErrCredentialExpired))
+		Expect(credential.Label).To(Equal("old"))
+
+		_, err = credentials.Authenticate("broker", "new-secret")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("keeps checking the expiry of verified passwords", func() {
+		_, err := credentials.Authenticate("broker", "old-secret")
+		Expect(err).NotTo(HaveOccurred())
+
+		now = now.Add(2 * time.Hour)
+
+		_, err = credentials.Authenticate("broker", "old-secret")
+		Expect(err).To(Equal(auth.ErrCredentialExpired))
+	})
+
+	It("accepts plain text passwords and labels them with the username", func() {
+		credential, err := credentials.Authenticate("monitoring", "plain")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credential.Label).To(Equal("monitoring"))
+	})
+
+	It("rejects wrong usernames and passwords", func() {
+		for _, pair := range [][2]string{
+			{"broker", "wrong"},
+			{"monitoring", "old-secret"},
+			{"other", "plain"},
+			{"", ""},
+		} {
+			credential, err := credentials.Authenticate(pair[0], pair[1])
+			Expect(err).To(Equal(auth.ErrInvalidCredentials))
+			Expect(credential).To(Equal(auth.Credential{}))
+		}
+	})
+
+	It("can be used concurrently", func() {
+		done := make(chan struct{})
+		for i := 0; i < 10; i++ {
+			go func() {
+				defer GinkgoRecover()
+				defer func() { done <- struct{}{} }()
+
+				_, err := credentials.Authenticate("broker", "new-secret")
+				Expect(err).NotTo(HaveOccurred())
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			<-done
+		}
+	})
+
+	Describe("validation", func() {
+		check := func(credential auth.Credential) error {
+			_, err := auth.NewCredentials([]auth.Credential{{Username: "user", Password: "pass"}, credential})
+			return err
+		}
+
+		It("requires a username", func() {
+			Expect(check(auth.Credential{Password: "pass"})).To(MatchError("credential 1 is missing a username"))
+		})
+
+		It("requires unique labels", func() {
+			Expect(check(auth.Credential{Username: "user", Password: "other"})).To(MatchError("credential label user is used more than once"))
+		})
+
+		It("requires exactly one of password and password_hash", func() {
+			Expect(check(auth.Credential{Label: "a", Username: "user"})).To(MatchError("credential a is missing a password or password_hash"))
+			Expect(check(auth.Credential{Label: "a", Username: "user", Password: "p", PasswordHash: newSecretHash})).To(MatchError("credential a has both a password and a password_hash"))
+		})
+
+		It("requires a credential", func() {
+			_, err := auth.NewCredentials(nil)
+			Expect(err).To(MatchError("at least one credential is required"))
+		})
+	})
+})
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+)
+
+const (
+	// DefaultKeysRefreshInterval is how long keys fetched from a JWKS URL
+	// are used before they are fetched again.
+	DefaultKeysRefreshInterval = time.Hour
+
+	// minKeysRefreshInterval limits how often tokens signed with an unknown
+	// key can make the key set be fetched again.
+	minKeysRefreshInterval = 10 * time.Second
+)
+
+// KeySet returns the public key that signed a token by its key ID. An empty
+// key ID selects the only key of a set that has one.
+type KeySet interface {
+	Key(kid string) (crypto.PublicKey, error)
+}
+
+// jwk is a JSON Web Key as served by the UAA token_keys endpoint.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// publicKeys parses the signing keys of a key set. Keys of other types or
+// uses are ignored.
+func (s jwks) publicKeys() (map[string]crypto.PublicKey, error) {
+	keys := map[string]crypto.PublicKey{}
+	for i, key := range s.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		var (
+			public crypto.PublicKey
+			err    error
+		)
+		switch key.Kty {
+		case "RSA":
+			public, err = key.rsa()
+		case "EC":
+			public, err = key.ecdsa()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %s", i, err)
+		}
+
+		if _, ok := keys[key.Kid]; ok {
+			return nil, fmt.Errorf("key ID %q is used more than once", key.Kid)
+		}
+		keys[key.Kid] = public
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("the key set has no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) rsa() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %s", err)
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (k jwk) ecdsa() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x coordinate: %s", err)
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y coordinate: %s", err)
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("the point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeBigInt(encoded string) (*big.Int, error) {
+	if encoded == "" {
+		return nil, errors.New("missing")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+func lookupKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// StaticKeySet is a key set given in the configuration.
+type StaticKeySet struct {
+	keys map[string]crypto.PublicKey
+}
+
+// NewStaticKeySet parses a JWKS document.
+func NewStaticKeySet(document []byte) (*StaticKeySet, error) {
+	var set jwks
+	if err := json.Unmarshal(document, &set); err != nil {
+		return nil, err
+	}
+
+	keys, err := set.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &StaticKeySet{keys: keys}, nil
+}
+
+func (s *StaticKeySet) Key(kid string) (crypto.PublicKey, error) {
+	key, ok := lookupKey(s.keys, kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return key, nil
+}
+
+// RemoteKeySet fetches keys from a JWKS URL, such as the token_keys
+// endpoint of the UAA, and caches them. The keys are fetched again when
+// they are older than the refresh interval, or when a token is signed with
+// an unknown key because the issuer rotated its keys. It is safe for
+// concurrent use.
+type RemoteKeySet struct {
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+	now             func() time.Time
+	logger          *logging.Logger
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+}
+
+type RemoteKeySetOption func(*RemoteKeySet)
+
+// WithKeysClient sets the HTTP client used to fetch the keys.
+func WithKeysClient(client *http.Client) RemoteKeySetOption {
+	return func(s *RemoteKeySet) {
+		s.client = client
+	}
+}
+
+// WithKeysRefreshInterval sets how long fetched keys are used.
+func WithKeysRefreshInterval(interval time.Duration) RemoteKeySetOption {
+	return func(s *RemoteKeySet) {
+		s.refreshInterval = interval
+	}
+}
+
+// WithKeysClock sets the clock used to age the fetched keys.
+func WithKeysClock(now func() time.Time) RemoteKeySetOption {
+	return func(s *RemoteKeySet) {
+		s.now = now
+	}
+}
+
+// NewRemoteKeySet returns a key set that fetches its keys from url when
+// they are first needed.
+func NewRemoteKeySet(url string, opts ...RemoteKeySetOption) *RemoteKeySet {
+	s := &RemoteKeySet{
+		url:             url,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		refreshInterval: DefaultKeysRefreshInterval,
+		now:             time.Now,
+		logger:          logging.Default().With(logging.Data{"jwks_url": url}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *RemoteKeySet) Key(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	key, ok := lookupKey(s.keys, kid)
+
+	stale := now.Sub(s.fetched) >= s.refreshInterval
+	if (stale || !ok) && now.Sub(s.attempted) >= minKeysRefreshInterval {
+		s.attempted = now
+		keys, err := s.fetch()
+		if err != nil {
+			if ok {
+				// Keep the stale keys rather than reject every token while
+				// the issuer is unreachable.
+				s.logger.Error("Failed to refresh the JWT signing keys, using the cached keys", err)
+				return key, nil
+			}
+			return nil, fmt.Errorf("failed to fetch keys: %s", err)
+		}
+
+		s.keys = keys
+		s.fetched = now
+		key, ok = lookupKey(s.keys, kid)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return key, nil
+}
+
+func (s *RemoteKeySet) fetch() (map[string]crypto.PublicKey, error) {
+	res, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", s.url, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var set jwks
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %s", err)
+	}
+	return set.publicKeys()
+}
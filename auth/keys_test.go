@@ -0,0 +1,155 @@
+package auth_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/onsi/gomega/ghttp"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/auth/authtest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Key sets", func() {
+	var first, second *authtest.Signer
+
+	BeforeEach(func() {
+		var err error
+		first, err = authtest.NewSigner("key-1")
+		Expect(err).NotTo(HaveOccurred())
+		second, err = authtest.NewSigner("key-2")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("StaticKeySet", func() {
+		It("returns keys by ID", func() {
+			keys, err := auth.NewStaticKeySet(authtest.JWKS(first, second))
+			Expect(err).NotTo(HaveOccurred())
+
+			key, err := keys.Key("key-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key).NotTo(BeNil())
+
+			_, err = keys.Key("key-3")
+			Expect(err).To(MatchError(`unknown key ID "key-3"`))
+		})
+
+		It("returns the only key for tokens without a key ID", func() {
+			keys, err := auth.NewStaticKeySet(authtest.JWKS(first))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = keys.Key("")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects key sets without signing keys", func() {
+			_, err := auth.NewStaticKeySet([]byte(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`))
+			Expect(err).To(MatchError("the key set has no RSA or EC signing keys"))
+		})
+
+		It("rejects invalid keys", func() {
+			_, err := auth.NewStaticKeySet([]byte(`{"keys": [{"kty": "RSA", "kid": "a", "e": "AQAB"}]}`))
+			Expect(err).To(MatchError("key 0: invalid modulus: missing"))
+
+			_, err = auth.NewStaticKeySet([]byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))
+			Expect(err).To(MatchError("key 0: the point is not on the curve"))
+		})
+	})
+
+	Describe("RemoteKeySet", func() {
+		var (
+			server *ghttp.Server
+			now    time.Time
+			keys   *auth.RemoteKeySet
+		)
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+			now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			keys = auth.NewRemoteKeySet(server.URL()+"/token_keys",
+				auth.WithKeysRefreshInterval(time.Hour),
+				auth.WithKeysClock(func() time.Time { return now }))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		serve := func(signers ...*authtest.Signer) http.HandlerFunc {
+			return ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/token_keys"),
+				ghttp.RespondWith(http.StatusOK, authtest.JWKS(signers...)),
+			)
+		}
+
+		It("fetches the keys once and caches them", func() {
+			server.AppendHandlers(serve(first, second))
+
+			_, err := keys.Key("key-1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = keys.Key("key-2")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("fetches the keys again when they are stale", func() {
+			server.AppendHandlers(serve(first), serve(first))
+
+			_, err := keys.Key("key-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			now = now.Add(time.Hour)
+			_, err = keys.Key("key-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("fetches the keys again for an unknown key, at most every 10 seconds", func() {
+			server.AppendHandlers(serve(first), serve(first), serve(first, second))
+
+			_, err := keys.Key("key-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			now = now.Add(time.Second)
+			_, err = keys.Key("key-2")
+			Expect(err).To(MatchError(`unknown key ID "key-2"`))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+
+			now = now.Add(10 * time.Second)
+			_, err = keys.Key("key-2")
+			Expect(err).To(MatchError(`unknown key ID "key-2"`))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+
+			now = now.Add(10 * time.Second)
+			_, err = keys.Key("key-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+		})
+
+		It("keeps using cached keys when they cannot be fetched", func() {
+			server.AppendHandlers(serve(first), ghttp.RespondWith(http.StatusInternalServerError, ""))
+
+			_, err := keys.Key("key-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			now = now.Add(time.Hour)
+			_, err = keys.Key("key-1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = keys.Key("key-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("fails when the keys cannot be fetched", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, ""))
+
+			_, err := keys.Key("key-1")
+			Expect(err).To(MatchError(ContainSubstring("failed to fetch keys: " + server.URL() + "/token_keys returned 404 Not Found")))
+		})
+	})
+})
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pruneAbove is the number of tracked clients and users above which stale
+// entries are removed.
+const pruneAbove = 10000
+
+// LockoutConfig configures the tracking of failed authentication attempts.
+type LockoutConfig struct {
+	// Threshold is the number of failures after which a client or user is
+	// locked out. Zero disables lockouts.
+	Threshold int
+	// Backoff is the first lockout, doubled by every further failure up
+	// to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Window is how long failures are remembered.
+	Window time.Duration
+	// TrustedProxies is the number of proxies, such as the Cloud Foundry
+	// router, that append the client address to X-Forwarded-For.
+	TrustedProxies int
+}
+
+// LockoutEvent describes a client address or username being locked out.
+type LockoutEvent struct {
+	Scope    string
+	Key      string
+	Failures int
+	Until    time.Time
+}
+
+const (
+	ScopeClient   = "client"
+	ScopeUsername = "username"
+)
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// stale reports whether the failures are old enough to be forgotten: the
+// window has passed since the last failure and since the end of the
+// lockout.
+func (a *attempts) stale(now time.Time, window time.Duration) bool {
+	last := a.lastFailure
+	if a.lockedUntil.After(last) {
+		last = a.lockedUntil
+	}
+	return now.Sub(last) > window
+}
+
+// Lockout tracks failed authentication attempts per client address and per
+// username, and locks them out for exponentially growing periods once they
+// pass the threshold. A locked out client may not try to authenticate at
+// all, while a locked out username only throttles failed attempts, so that
+// failures from elsewhere cannot lock out callers that know the password.
+// It is safe for concurrent use.
+type Lockout struct {
+	config  LockoutConfig
+	now     func() time.Time
+	observe func(LockoutEvent)
+
+	mu       sync.Mutex
+	attempts map[string]*attempts
+}
+
+type LockoutOption func(*Lockout)
+
+// WithLockoutClock sets the clock used to time failures and lockouts.
+func WithLockoutClock(now func() time.Time) LockoutOption {
+	return func(l *Lockout) {
+		l.now = now
+	}
+}
+
+// WithLockoutObserver calls observe whenever a client or user is locked
+// out, for example to log it or record metrics.
+func WithLockoutObserver(observe func(LockoutEvent)) LockoutOption {
+	return func(l *Lockout) {
+		l.observe = observe
+	}
+}
+
+func NewLockout(config LockoutConfig, opts ...LockoutOption) *Lockout {
+	l := &Lockout{
+		config:   config,
+		now:      time.Now,
+		observe:  func(LockoutEvent) {},
+		attempts: map[string]*attempts{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// ClientAddress returns the address of the client that sent the request,
+// taken from X-Forwarded-For when the request came through trusted proxies.
+func (l *Lockout) ClientAddress(r *http.Request) string {
+	if header := r.Header.Get("X-Forwarded-For"); header != "" && l.config.TrustedProxies > 0 {
+		forwarded := strings.Split(header, ",")
+		if i := len(forwarded) - l.config.TrustedProxies; i >= 0 {
+			return strings.TrimSpace(forwarded[i])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RetryAfter returns how long the client must wait before it may try to
+// authenticate again, or zero if it may try now.
+func (l *Lockout) RetryAfter(client string) time.Duration {
+	return l.retryAfter(ScopeClient, client)
+}
+
+// UsernameRetryAfter returns how long failed attempts to authenticate as the
+// user are refused, or zero if they are not.
+func (l *Lockout) UsernameRetryAfter(username string) time.Duration {
+	return l.retryAfter(ScopeUsername, username)
+}
+
+func (l *Lockout) retryAfter(scope, value string) time.Duration {
+	if l.config.Threshold <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lockedFor(scope, value, l.now())
+}
+
+// Failure records a failed attempt by the client to authenticate as the
+// user.
+func (l *Lockout) Failure(client, username string) {
+	if l.config.Threshold <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+
+	now := l.now()
+	if len(l.attempts) > pruneAbove {
+		l.prune(now)
+	}
+
+	var events []LockoutEvent
+	if event, locked := l.fail(ScopeClient, client, now); locked {
+		events = append(events, event)
+	}
+	if username != "" {
+		if event, locked := l.fail(ScopeUsername, username, now); locked {
+			events = append(events, event)
+		}
+	}
+
+	l.mu.Unlock()
+
+	for _, event := range events {
+		l.observe(event)
+	}
+}
+
+// Success forgets the failures of the client and the user.
+func (l *Lockout) Success(client, username string) {
+	if l.config.Threshold <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, key(ScopeClient, client))
+	delete(l.attempts, key(ScopeUsername, username))
+}
+
+func (l *Lockout) fail(scope, value string, now time.Time) (LockoutEvent, bool) {
+	k := key(scope, value)
+	a, ok := l.attempts[k]
+	if !ok || a.stale(now, l.config.Window) {
+		a = &attempts{}
+		l.attempts[k] = a
+	}
+
+	a.failures++
+	a.lastFailure = now
+	if a.failures < l.config.Threshold {
+		return LockoutEvent{}, false
+	}
+
+	backoff := l.config.Backoff
+	for i := l.config.Threshold; i < a.failures && backoff < l.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > l.config.MaxBackoff {
+		backoff = l.config.MaxBackoff
+	}
+
+	a.lockedUntil = now.Add(backoff)
+	return LockoutEvent{Scope: scope, Key: value, Failures: a.failures, Until: a.lockedUntil}, true
+}
+
+func (l *Lockout) lockedFor(scope, value string, now time.Time) time.Duration {
+	a, ok := l.attempts[key(scope, value)]
+	if !ok || !now.Before(a.lockedUntil) {
+		return 0
+	}
+	return a.lockedUntil.Sub(now)
+}
+
+func (l *Lockout) prune(now time.Time) {
+	for k, a := range l.attempts {
+		if a.stale(now, l.config.Window) {
+			delete(l.attempts, k)
+		}
+	}
+}
+
+func key(scope, value string) string {
+	return scope + "\x00" + value
+}
@@ -0,0 +1,225 @@
+package auth_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lockout", func() {
+	var (
+		now     time.Time
+		events  []auth.LockoutEvent
+		config  auth.LockoutConfig
+		lockout *auth.Lockout
+	)
+
+	clock := func() time.Time {
+		return now
+	}
+
+	fail := func(client, username string, times int) {
+		for i := 0; i < times; i++ {
+			lockout.Failure(client, username)
+		}
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		events = nil
+		config = auth.LockoutConfig{
+			Threshold:  3,
+			Backoff:    time.Second,
+			MaxBackoff: 10 * time.Second,
+			Window:     time.Minute,
+		}
+	})
+
+	JustBeforeEach(func() {
+		lockout = auth.NewLockout(config,
+			auth.WithLockoutClock(clock),
+			auth.WithLockoutObserver(func(event auth.LockoutEvent) {
+				events = append(events, event)
+			}),
+		)
+	})
+
+	It("locks out a client and username after the threshold", func() {
+		fail("10.0.0.1", "broker", 2)
+		Expect(lockout.RetryAfter("10.0.0.1")).To(BeZero())
+		Expect(lockout.UsernameRetryAfter("broker")).To(BeZero())
+
+		fail("10.0.0.1", "broker", 1)
+		Expect(lockout.RetryAfter("10.0.0.1")).To(Equal(time.Second))
+		Expect(lockout.RetryAfter("10.0.0.2")).To(BeZero())
+		Expect(lockout.UsernameRetryAfter("broker")).To(Equal(time.Second))
+		Expect(lockout.UsernameRetryAfter("other")).To(BeZero())
+
+		Expect(events).To(ConsistOf(
+			auth.LockoutEvent{Scope: auth.ScopeClient, Key: "10.0.0.1", Failures: 3, Until: now.Add(time.Second)},
+			auth.LockoutEvent{Scope: auth.ScopeUsername, Key: "broker", Failures: 3, Until: now.Add(time.Second)},
+		))
+	})
+
+	It("backs off exponentially up to the maximum", func() {
+		var waits []time.Duration
+		for i := 0; i < 7; i++ {
+			fail("10.0.0.1", "", 1)
+			waits = append(waits, lockout.RetryAfter("10.0.0.1"))
+		}
+
+		Expect(waits).To(Equal([]time.Duration{
+			0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second,
+		}))
+	})
+
+	It("lifts the lockout once it has passed", func() {
+		fail("10.0.0.1", "broker", 3)
+
+		now = now.Add(time.Second)
+		Expect(lockout.RetryAfter("10.0.0.1")).To(BeZero())
+		Expect(lockout.UsernameRetryAfter("broker")).To(BeZero())
+	})
+
+	It("forgets failures after the window", func() {
+		fail("10.0.0.1", "broker", 2)
+
+		now = now.Add(2 * time.Minute)
+		fail("10.0.0.1", "broker", 1)
+		Expect(lockout.RetryAfter("10.0.0.1")).To(BeZero())
+	})
+
+	It("forgets failures after a success", func() {
+		fail("10.0.0.1", "broker", 2)
+		lockout.Success("10.0.0.1", "broker")
+
+		fail("10.0.0.1", "broker", 2)
+		Expect(lockout.RetryAfter("10.0.0.1")).To(BeZero())
+		Expect(lockout.UsernameRetryAfter("broker")).To(BeZero())
+	})
+
+	Context("when the threshold is zero", func() {
+		BeforeEach(func() {
+			config.Threshold = 0
+		})
+
+		It("never locks out", func() {
+			fail("10.0.0.1", "broker", 100)
+			Expect(lockout.RetryAfter("10.0.0.1")).To(BeZero())
+			Expect(lockout.UsernameRetryAfter("broker")).To(BeZero())
+			Expect(events).To(BeEmpty())
+		})
+	})
+
+	Describe("ClientAddress", func() {
+		var req *http.Request
+
+		BeforeEach(func() {
+			req = httptest.NewRequest("GET", "/v2/catalog", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+		})
+
+		It("uses the remote address without trusted proxies", func() {
+			Expect(lockout.ClientAddress(req)).To(Equal("10.0.0.1"))
+		})
+
+		Context("with trusted proxies", func() {
+			BeforeEach(func() {
+				config.TrustedProxies = 1
+			})
+
+			It("uses the address the last trusted proxy added to X-Forwarded-For", func() {
+				Expect(lockout.ClientAddress(req)).To(Equal("2.2.2.2"))
+			})
+
+			It("uses the remote address without X-Forwarded-For", func() {
+				req.Header.Del("X-Forwarded-For")
+				Expect(lockout.ClientAddress(req)).To(Equal("10.0.0.1"))
+			})
+		})
+	})
+
+	Describe("with Authenticator", func() {
+		var (
+			handler *negroni.Negroni
+			logs    *bytes.Buffer
+		)
+
+		JustBeforeEach(func() {
+			credentials, err := auth.NewCredentials([]auth.Credential{{Username: "broker", Password: "secret"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			logs = &bytes.Buffer{}
+			handler = negroni.New(
+				logging.RequestLogger(logging.New(logs, logs)),
+				auth.Authenticator(credentials, auth.WithLockout(lockout)),
+			)
+			handler.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		})
+
+		serve := func(client, password string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/v2/catalog", nil)
+			req.RemoteAddr = client + ":1234"
+			req.SetBasicAuth("broker", password)
+
+			writer := httptest.NewRecorder()
+			handler.ServeHTTP(writer, req)
+			return writer
+		}
+
+		It("rejects locked out clients without checking their password", func() {
+			Expect(serve("10.0.0.1", "secret").Code).To(Equal(http.StatusOK))
+			for i := 0; i < 3; i++ {
+				Expect(serve("10.0.0.2", "wrong").Code).To(Equal(http.StatusUnauthorized))
+			}
+
+			writer := serve("10.0.0.2", "secret")
+			Expect(writer.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(writer.Header().Get("Retry-After")).To(Equal("1"))
+			Expect(writer.Body.String()).To(MatchJSON(`{"description": "Too many failed authentication attempts, try again later"}`))
+			Expect(logs.String()).To(ContainSubstring(`"locked_out":true`))
+
+			By("still accepting other clients")
+			Expect(serve("10.0.0.1", "secret").Code).To(Equal(http.StatusOK))
+
+			now = now.Add(time.Second)
+			Expect(serve("10.0.0.2", "secret").Code).To(Equal(http.StatusOK))
+		})
+
+		It("ignores X-Forwarded-For from clients that connect directly", func() {
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest("GET", "/v2/catalog", nil)
+				req.RemoteAddr = "10.0.0.2:1234"
+				req.Header.Set("X-Forwarded-For", fmt.Sprintf("192.0.2.%d", i))
+				req.SetBasicAuth("other", "wrong")
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			Expect(serve("10.0.0.2", "secret").Code).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("only refuses failed attempts of a locked out username", func() {
+			for _, client := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+				Expect(serve(client, "wrong").Code).To(Equal(http.StatusUnauthorized))
+			}
+
+			writer := serve("10.0.0.5", "wrong")
+			Expect(writer.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(writer.Header().Get("Retry-After")).To(Equal("1"))
+
+			By("accepting any client that knows the password")
+			Expect(serve("10.0.0.1", "secret").Code).To(Equal(http.StatusOK))
+		})
+	})
+})
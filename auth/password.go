@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	defaultLogN    = 15
+	defaultR       = 8
+	defaultP       = 1
+	saltLength     = 16
+	hashKeyLength  = 32
+	scryptIdentity = "scrypt"
+
+	// Hashes are verified on requests, so their cost is capped to keep a
+	// configured hash from exhausting memory or CPU. Verifying an scrypt
+	// hash takes 128 * 2^ln * r bytes of memory, and p times as long as
+	// with p=1.
+	maxLogN         = 20
+	maxR            = 32
+	maxP            = 16
+	maxScryptMemory = 256 << 20
+	maxBcryptCost   = 15
+)
+
+var hashEncoding = base64.RawStdEncoding
+
+// passwordHash verifies passwords against a hash from HashPassword, or a
+// bcrypt hash such as one made by htpasswd.
+type passwordHash interface {
+	matches(password string) bool
+}
+
+// scryptHash is an scrypt hash in the PHC string format, such as
+// $scrypt$ln=15,r=8,p=1$<salt>$<key> with base64 encoded salt and key.
+type scryptHash struct {
+	logN, r, p int
+	salt, key  []byte
+}
+
+type bcryptHash []byte
+
+// HashPassword hashes the password with scrypt and a random salt.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	h := scryptHash{logN: defaultLogN, r: defaultR, p: defaultP, salt: salt}
+
+	var err error
+	h.key, err = h.derive(password, hashKeyLength)
+	if err != nil {
+		return "", err
+	}
+
+	return h.String(), nil
+}
+
+func parseHash(encoded string) (passwordHash, error) {
+	if strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$") {
+		return parseBcryptHash(encoded)
+	}
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != scryptIdentity {
+		return nil, fmt.Errorf("password hash must look like $scrypt$ln=15,r=8,p=1$<salt>$<hash> or be a bcrypt hash")
+	}
+
+	var h scryptHash
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &h.logN, &h.r, &h.p); err != nil {
+		return nil, fmt.Errorf("invalid scrypt parameters %q", parts[2])
+	}
+	switch {
+	case h.logN < 1 || h.logN > maxLogN:
+		return nil, fmt.Errorf("scrypt ln must be between 1 and %d", maxLogN)
+	case h.r < 1 || h.r > maxR:
+		return nil, fmt.Errorf("scrypt r must be between 1 and %d", maxR)
+	case h.p < 1 || h.p > maxP:
+		return nil, fmt.Errorf("scrypt p must be between 1 and %d", maxP)
+	case 128*(1<<uint(h.logN))*h.r > maxScryptMemory:
+		return nil, fmt.Errorf("scrypt ln=%d with r=%d needs more than %d MiB of memory", h.logN, h.r, maxScryptMemory>>20)
+	}
+
+	var err error
+	if h.salt, err = hashEncoding.DecodeString(parts[3]); err != nil {
+		return nil, fmt.Errorf("invalid salt: %s", err)
+	}
+	if h.key, err = hashEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid hash: %s", err)
+	}
+	if len(h.key) == 0 {
+		return nil, fmt.Errorf("invalid hash: it is empty")
+	}
+
+	return &h, nil
+}
+
+func parseBcryptHash(encoded string) (passwordHash, error) {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bcrypt hash: %s", err)
+	}
+	if cost > maxBcryptCost {
+		return nil, fmt.Errorf("bcrypt cost must be at most %d", maxBcryptCost)
+	}
+	return bcryptHash(encoded), nil
+}
+
+func (h *scryptHash) derive(password string, keyLen int) ([]byte, error) {
+	return scrypt.Key([]byte(password), h.salt, 1<<uint(h.logN), h.r, h.p, keyLen)
+}
+
+// matches compares the password with the hash in constant time.
+func (h *scryptHash) matches(password string) bool {
+	key, err := h.derive(password, len(h.key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+func (h *scryptHash) String() string {
+	return fmt.Sprintf("$%s$ln=%d,r=%d,p=%d$%s$%s", scryptIdentity, h.logN, h.r, h.p,
+		hashEncoding.EncodeToString(h.salt), hashEncoding.EncodeToString(h.key))
+}
+
+// matches compares the password with the hash in constant time.
+func (h bcryptHash) matches(password string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
@@ -0,0 +1,74 @@
+package auth_test
+
+import (
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// Hashes of old-secret and new-secret with a cheap N so tests stay fast.
+const (
+	oldSecretHash = "$scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$sIuFtQEBHvRUGtaL6N7PJ7NMgxsI3vKh9KWCnInPVAo"
+	newSecretHash = "$scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$WKsC9ZI0iGLMMz/KHfEcD2EOm8ToKPyPG/5qc3GwrzY"
+
+	// A bcrypt hash of old-secret with the lowest cost.
+	oldSecretBcryptHash = "$2a$04$arrjMuvsthog3k6wVC89pOb5SZXBfxRMwjNype1DezO4R2Vom22ne"
+)
+
+var _ = Describe("HashPassword", func() {
+	It("produces a salted scrypt hash that verifies the password", func() {
+		hash, err := auth.HashPassword("secret")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hash).To(MatchRegexp(`^\$scrypt\$ln=15,r=8,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`))
+
+		other, err := auth.HashPassword("secret")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).NotTo(Equal(hash))
+
+		credentials, err := auth.NewCredentials([]auth.Credential{{Username: "user", PasswordHash: hash}})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = credentials.Authenticate("user", "secret")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("verifies bcrypt hashes", func() {
+		credentials, err := auth.NewCredentials([]auth.Credential{{Username: "user", PasswordHash: oldSecretBcryptHash}})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = credentials.Authenticate("user", "old-secret")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = credentials.Authenticate("user", "new-secret")
+		Expect(err).To(HaveOccurred())
+	})
+
+	DescribeTable("rejects invalid hashes",
+		func(hash, message string) {
+			_, err := auth.NewCredentials([]auth.Credential{{Username: "user", PasswordHash: hash}})
+			Expect(err).To(MatchError("credential user has an invalid password_hash: " + message))
+		},
+		Entry("unknown format", "secret",
+			"password hash must look like $scrypt$ln=15,r=8,p=1$<salt>$<hash> or be a bcrypt hash"),
+		Entry("bad parameters", "$scrypt$n=16$c2FsdA$a2V5",
+			`invalid scrypt parameters "n=16"`),
+		Entry("huge N", "$scrypt$ln=40,r=8,p=1$c2FsdA$a2V5",
+			"scrypt ln must be between 1 and 20"),
+		Entry("huge r", "$scrypt$ln=4,r=64,p=1$c2FsdA$a2V5",
+			"scrypt r must be between 1 and 32"),
+		Entry("huge p", "$scrypt$ln=4,r=8,p=1000$c2FsdA$a2V5",
+			"scrypt p must be between 1 and 16"),
+		Entry("too much memory", "$scrypt$ln=20,r=8,p=1$c2FsdA$a2V5",
+			"scrypt ln=20 with r=8 needs more than 256 MiB of memory"),
+		Entry("truncated bcrypt", "$2a$04$arrjMuvsthog3k6wVC89pO",
+			"invalid bcrypt hash: crypto/bcrypt: hashedSecret too short to be a bcrypted password"),
+		Entry("huge bcrypt cost", "$2a$20$arrjMuvsthog3k6wVC89pOb5SZXBfxRMwjNype1DezO4R2Vom22ne",
+			"bcrypt cost must be at most 15"),
+		Entry("bad salt", "$scrypt$ln=4,r=8,p=1$!$a2V5",
+			"invalid salt: illegal base64 data at input byte 0"),
+		Entry("empty hash", "$scrypt$ln=4,r=8,p=1$c2FsdA$",
+			"invalid hash: it is empty"),
+	)
+})
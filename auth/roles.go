@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Role restricts the OSBAPI operations a credential may use.
+type Role string
+
+const (
+	// CatalogOnly may only fetch the catalog.
+	CatalogOnly Role = "catalog"
+	// ReadOnly may fetch the catalog, instances and bindings and poll last
+	// operations.
+	ReadOnly Role = "read-only"
+	// Full may use every operation. Credentials without a role have it.
+	Full Role = "full"
+)
+
+var roleOperations = map[Role]map[osbapi.Operation]bool{
+	CatalogOnly: {
+		osbapi.Catalog: true,
+	},
+	ReadOnly: {
+		osbapi.Catalog:              true,
+		osbapi.FetchInstance:        true,
+		osbapi.LastOperation:        true,
+		osbapi.FetchBinding:         true,
+		osbapi.BindingLastOperation: true,
+	},
+}
+
+func (r Role) valid() bool {
+	_, ok := roleOperations[r]
+	return ok || r == Full
+}
+
+// Allows reports whether the role may use the operation. Only the full role
+// may send requests that are not part of the OSBAPI.
+func (r Role) Allows(operation osbapi.Operation) bool {
+	if r == Full {
+		return true
+	}
+	return roleOperations[r][operation]
+}
+
+// Authorize rejects requests whose credential's role does not allow the
+// OSBAPI operation with a 403. It must come after Authenticator.
+func Authorize() negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		operation := osbapi.ParseRoute(r.Method, r.URL.Path).Operation
+
+		credential, ok := CredentialFromContext(r.Context())
+		if !ok {
+			osbapi.WriteError(w, http.StatusForbidden, "", "The request was not authenticated")
+			return
+		}
+
+		if !credential.Role.Allows(operation) {
+			osbapi.WriteError(w, http.StatusForbidden, "",
+				fmt.Sprintf("Credential %s has the %s role, which does not allow the %s operation", credential.Label, credential.Role, operation))
+			return
+		}
+
+		next(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Roles", func() {
+	DescribeTable("allow operations",
+		func(role auth.Role, allowed []osbapi.Operation) {
+			for _, operation := range []osbapi.Operation{
+				osbapi.Catalog, osbapi.Provision, osbapi.Update, osbapi.Deprovision, osbapi.FetchInstance,
+				osbapi.LastOperation, osbapi.Bind, osbapi.Unbind, osbapi.FetchBinding,
+				osbapi.BindingLastOperation, osbapi.Unknown,
+			} {
+				Expect(role.Allows(operation)).To(Equal(containsOperation(allowed, operation)), string(operation))
+			}
+		},
+		Entry("catalog", auth.CatalogOnly, []osbapi.Operation{osbapi.Catalog}),
+		Entry("read-only", auth.ReadOnly, []osbapi.Operation{
+			osbapi.Catalog, osbapi.FetchInstance, osbapi.LastOperation, osbapi.FetchBinding, osbapi.BindingLastOperation,
+		}),
+		Entry("full", auth.Full, []osbapi.Operation{
+			osbapi.Catalog, osbapi.Provision, osbapi.Update, osbapi.Deprovision, osbapi.FetchInstance,
+			osbapi.LastOperation, osbapi.Bind, osbapi.Unbind, osbapi.FetchBinding,
+			osbapi.BindingLastOperation, osbapi.Unknown,
+		}),
+	)
+
+	It("rejects unknown roles", func() {
+		_, err := auth.NewCredentials([]auth.Credential{{Username: "user", Password: "pass", Role: "admin"}})
+		Expect(err).To(MatchError("credential user has an unknown role admin, use catalog, read-only or full"))
+	})
+
+	Describe("Authorize", func() {
+		var (
+			handler  *negroni.Negroni
+			received bool
+		)
+
+		BeforeEach(func() {
+			credentials, err := auth.NewCredentials([]auth.Credential{
+				{Username: "monitoring", Password: "pass", Role: auth.ReadOnly},
+				{Username: "cf", Password: "pass"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			received = false
+			handler = negroni.New(auth.Authenticator(credentials), auth.Authorize())
+			handler.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = true
+			})
+		})
+
+		serve := func(username, method, path string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, nil)
+			req.SetBasicAuth(username, "pass")
+
+			writer := httptest.NewRecorder()
+			handler.ServeHTTP(writer, req)
+			return writer
+		}
+
+		It("lets allowed operations through", func() {
+			Expect(serve("monitoring", "GET", "/v2/service_instances/1/last_operation").Code).To(Equal(http.StatusOK))
+			Expect(received).To(BeTrue())
+		})
+
+		It("gives credentials without a role full access", func() {
+			Expect(serve("cf", "DELETE", "/v2/service_instances/1").Code).To(Equal(http.StatusOK))
+			Expect(received).To(BeTrue())
+		})
+
+		It("rejects other operations with an OSBAPI error", func() {
+			writer := serve("monitoring", "DELETE", "/v2/service_instances/1")
+
+			Expect(received).To(BeFalse())
+			Expect(writer.Code).To(Equal(http.StatusForbidden))
+			Expect(writer.Body.String()).To(MatchJSON(`{"description": "Credential monitoring has the read-only role, which does not allow the deprovision operation"}`))
+		})
+
+		It("rejects unauthenticated requests", func() {
+			handler = negroni.New(auth.Authorize())
+
+			writer := serve("cf", "GET", "/v2/catalog")
+			Expect(writer.Code).To(Equal(http.StatusForbidden))
+		})
+	})
+})
+
+func containsOperation(operations []osbapi.Operation, operation osbapi.Operation) bool {
+	for _, o := range operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
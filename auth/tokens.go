@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// clockSkew is how far token timestamps may be off from the proxy's clock.
+const clockSkew = 30 * time.Second
+
+// TokenConfig configures which bearer tokens are accepted.
+type TokenConfig struct {
+	Keys KeySet
+	// Issuer must equal the iss claim, e.g.
+	// https://uaa.example.com/oauth/token for the UAA.
+	Issuer string
+	// Audience must be one of the aud claims.
+	Audience string
+	// Scopes is the scope a token needs for each OSBAPI operation.
+	// Operations without a scope, including requests that are not part of
+	// the OSBAPI, need DefaultScope, and are forbidden if it is empty.
+	Scopes       map[osbapi.Operation]string
+	DefaultScope string
+}
+
+// Token is the identity of a verified bearer token.
+type Token struct {
+	ClientID string
+	Subject  string
+	Scopes   []string
+	Expires  time.Time
+}
+
+// Label identifies the caller in logs: the OAuth client, or the subject
+// of tokens without one.
+func (t Token) Label() string {
+	if t.ClientID != "" {
+		return t.ClientID
+	}
+	return t.Subject
+}
+
+// HasScope reports whether the token was granted the scope.
+func (t Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenVerifier verifies JWT bearer tokens, such as those issued by the
+// Cloud Foundry UAA.
+type TokenVerifier struct {
+	config TokenConfig
+	now    func() time.Time
+}
+
+type TokenVerifierOption func(*TokenVerifier)
+
+// WithTokenClock sets the clock used to check token expiry.
+func WithTokenClock(now func() time.Time) TokenVerifierOption {
+	return func(v *TokenVerifier) {
+		v.now = now
+	}
+}
+
+func NewTokenVerifier(config TokenConfig, opts ...TokenVerifierOption) (*TokenVerifier, error) {
+	if config.Keys == nil {
+		return nil, errors.New("a key set is required")
+	}
+	if config.Issuer == "" {
+		return nil, errors.New("an issuer is required")
+	}
+	if config.Audience == "" {
+		return nil, errors.New("an audience is required")
+	}
+	for operation := range config.Scopes {
+		if !operation.Valid() {
+			return nil, fmt.Errorf("unknown operation %q", operation)
+		}
+	}
+
+	v := &TokenVerifier{config: config, now: time.Now}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v, nil
+}
+
+// RequiredScope returns the scope a token needs for the operation, if any
+// scope allows it.
+func (v *TokenVerifier) RequiredScope(operation osbapi.Operation) (string, bool) {
+	if scope, ok := v.config.Scopes[operation]; ok && scope != "" {
+		return scope, true
+	}
+	return v.config.DefaultScope, v.config.DefaultScope != ""
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  stringList  `json:"aud"`
+	Expires   json.Number `json:"exp"`
+	NotBefore json.Number `json:"nbf"`
+	Scope     stringList  `json:"scope"`
+	ClientID  string      `json:"client_id"`
+	Subject   string      `json:"sub"`
+}
+
+// stringList is a claim given as a list of strings, or as a single string
+// of space separated values as in RFC 8693.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("must be a string or a list of strings")
+	}
+	*l = strings.Fields(s)
+	return nil
+}
+
+// Verify checks the signature, issuer, audience and expiry of a token.
+func (v *TokenVerifier) Verify(raw string) (Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return Token{}, errors.New("malformed token")
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Token{}, fmt.Errorf("malformed token header: %s", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Token{}, errors.New("malformed token signature")
+	}
+
+	key, err := v.config.Keys.Key(header.Kid)
+	if err != nil {
+		return Token{}, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return Token{}, err
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Token{}, fmt.Errorf("malformed token claims: %s", err)
+	}
+
+	if claims.Issuer != v.config.Issuer {
+		return Token{}, fmt.Errorf("the token was issued by %q, not %q", claims.Issuer, v.config.Issuer)
+	}
+	if !contains(claims.Audience, v.config.Audience) {
+		return Token{}, fmt.Errorf("the token audience does not include %q", v.config.Audience)
+	}
+
+	now := v.now()
+	expires, err := numericDate(claims.Expires)
+	if err != nil || expires.IsZero() {
+		return Token{}, errors.New("the token has no valid expiry")
+	}
+	if now.After(expires.Add(clockSkew)) {
+		return Token{}, errors.New("the token has expired")
+	}
+	notBefore, err := numericDate(claims.NotBefore)
+	if err != nil {
+		return Token{}, errors.New("the token has an invalid nbf claim")
+	}
+	if now.Add(clockSkew).Before(notBefore) {
+		return Token{}, errors.New("the token is not valid yet")
+	}
+
+	return Token{
+		ClientID: claims.ClientID,
+		Subject:  claims.Subject,
+		Scopes:   claims.Scope,
+		Expires:  expires,
+	}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+func numericDate(n json.Number) (time.Time, error) {
+	if n == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(seconds), 0), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySignature checks an RS or ES signature. Symmetric and unsigned
+// tokens are rejected, so a public key can never be used as an HMAC
+// secret.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	digest := hash.New()
+	digest.Write(signed)
+	hashed := digest.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("an RSA key cannot verify %s signatures", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, hashed, signature); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("an EC key cannot verify %s signatures", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, hashed, r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+
+	return nil
+}
+
+// bearerToken returns the token of an Authorization: Bearer header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// authenticate verifies the bearer token of a request and checks that it
+// has the scope the OSBAPI operation requires.
+func (v *TokenVerifier) authenticate(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, raw string) {
+	token, err := v.Verify(raw)
+	if err != nil {
+		logging.Annotate(r.Context(), logging.Data{"token_error": err.Error()})
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid bearer token"))
+		return
+	}
+
+	label := token.Label()
+	logging.Annotate(r.Context(), logging.Data{"credential": label, "token_client": token.ClientID})
+
+	operation := osbapi.ParseRoute(r.Method, r.URL.Path).Operation
+	scope, ok := v.RequiredScope(operation)
+	if !ok {
+		osbapi.WriteError(w, http.StatusForbidden, "",
+			fmt.Sprintf("Bearer tokens are not allowed to use the %s operation", operation))
+		return
+	}
+	if !token.HasScope(scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+		osbapi.WriteError(w, http.StatusForbidden, "",
+			fmt.Sprintf("Token of %s lacks the %s scope, which the %s operation requires", label, scope, operation))
+		return
+	}
+
+	credential := Credential{Label: label, Role: Full}
+	next(w, r.WithContext(context.WithValue(r.Context(), credentialKey, credential)))
+}
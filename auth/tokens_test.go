@@ -0,0 +1,316 @@
+package auth_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/onsi/gomega/ghttp"
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/auth/authtest"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const issuer = "https://uaa.example.com/oauth/token"
+
+var _ = Describe("TokenVerifier", func() {
+	var (
+		signer   *authtest.Signer
+		verifier *auth.TokenVerifier
+		now      time.Time
+		claims   map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		signer, err = authtest.NewSigner("key-1")
+		Expect(err).NotTo(HaveOccurred())
+
+		keys, err := auth.NewStaticKeySet(authtest.JWKS(signer))
+		Expect(err).NotTo(HaveOccurred())
+
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		verifier, err = auth.NewTokenVerifier(auth.TokenConfig{
+			Keys:     keys,
+			Issuer:   issuer,
+			Audience: "gcp-broker-proxy",
+		}, auth.WithTokenClock(func() time.Time { return now }))
+		Expect(err).NotTo(HaveOccurred())
+
+		claims = map[string]interface{}{
+			"iss":       issuer,
+			"aud":       []string{"gcp-broker-proxy", "openid"},
+			"exp":       now.Add(time.Hour).Unix(),
+			"client_id": "automation",
+			"sub":       "automation",
+			"scope":     []string{"gcp-broker-proxy.read", "gcp-broker-proxy.write"},
+		}
+	})
+
+	verify := func() (auth.Token, error) {
+		token, err := signer.Sign(claims)
+		Expect(err).NotTo(HaveOccurred())
+		return verifier.Verify(token)
+	}
+
+	It("accepts valid tokens", func() {
+		token, err := verify()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).To(Equal(auth.Token{
+			ClientID: "automation",
+			Subject:  "automation",
+			Scopes:   []string{"gcp-broker-proxy.read", "gcp-broker-proxy.write"},
+			Expires:  time.Unix(now.Add(time.Hour).Unix(), 0),
+		}))
+	})
+
+	It("accepts a single audience and space separated scopes", func() {
+		claims["aud"] = "gcp-broker-proxy"
+		claims["scope"] = "gcp-broker-proxy.read gcp-broker-proxy.write"
+
+		token, err := verify()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.Scopes).To(Equal([]string{"gcp-broker-proxy.read", "gcp-broker-proxy.write"}))
+	})
+
+	It("rejects tokens from another issuer", func() {
+		claims["iss"] = "https://uaa.other.com/oauth/token"
+		_, err := verify()
+		Expect(err).To(MatchError(`the token was issued by "https://uaa.other.com/oauth/token", not "` + issuer + `"`))
+	})
+
+	It("rejects tokens for another audience", func() {
+		claims["aud"] = []string{"cloud_controller"}
+		_, err := verify()
+		Expect(err).To(MatchError(`the token audience does not include "gcp-broker-proxy"`))
+	})
+
+	It("rejects expired tokens, allowing for clock skew", func() {
+		claims["exp"] = now.Add(-20 * time.Second).Unix()
+		_, err := verify()
+		Expect(err).NotTo(HaveOccurred())
+
+		claims["exp"] = now.Add(-time.Minute).Unix()
+		_, err = verify()
+		Expect(err).To(MatchError("the token has expired"))
+	})
+
+	It("rejects tokens without an expiry", func() {
+		delete(claims, "exp")
+		_, err := verify()
+		Expect(err).To(MatchError("the token has no valid expiry"))
+	})
+
+	It("rejects tokens that are not valid yet", func() {
+		claims["nbf"] = now.Add(time.Minute).Unix()
+		_, err := verify()
+		Expect(err).To(MatchError("the token is not valid yet"))
+	})
+
+	It("rejects tokens signed with another key", func() {
+		other, err := authtest.NewSigner("key-1")
+		Expect(err).NotTo(HaveOccurred())
+
+		token, err := other.Sign(claims)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = verifier.Verify(token)
+		Expect(err).To(MatchError("invalid token signature"))
+	})
+
+	It("rejects tokens with a tampered payload", func() {
+		token, err := signer.Sign(claims)
+		Expect(err).NotTo(HaveOccurred())
+
+		claims["scope"] = []string{"gcp-broker-proxy.admin"}
+		tampered, err := signer.Sign(claims)
+		Expect(err).NotTo(HaveOccurred())
+
+		parts := strings.Split(token, ".")
+		parts[1] = strings.Split(tampered, ".")[1]
+		_, err = verifier.Verify(strings.Join(parts, "."))
+		Expect(err).To(MatchError("invalid token signature"))
+	})
+
+	It("rejects unsigned and symmetrically signed tokens", func() {
+		for _, alg := range []string{"none", "HS256"} {
+			token, err := signer.SignWithHeader(map[string]interface{}{"alg": alg, "kid": "key-1"}, claims)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = verifier.Verify(token)
+			Expect(err).To(MatchError(`unsupported signing algorithm "` + alg + `"`))
+		}
+	})
+
+	It("rejects malformed tokens", func() {
+		_, err := verifier.Verify("not-a-token")
+		Expect(err).To(MatchError("malformed token"))
+	})
+
+	It("verifies ES256 signatures", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"kid": "ec",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+		Expect(err).NotTo(HaveOccurred())
+		keys, err := auth.NewStaticKeySet(jwks)
+		Expect(err).NotTo(HaveOccurred())
+		verifier, err = auth.NewTokenVerifier(auth.TokenConfig{Keys: keys, Issuer: issuer, Audience: "gcp-broker-proxy"},
+			auth.WithTokenClock(func() time.Time { return now }))
+		Expect(err).NotTo(HaveOccurred())
+
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "ec"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		Expect(err).NotTo(HaveOccurred())
+		signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+		_, err = verifier.Verify(signed + "." + base64.RawURLEncoding.EncodeToString(signature))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("requires a key set, issuer and audience, and known operations", func() {
+		_, err := auth.NewTokenVerifier(auth.TokenConfig{Issuer: issuer, Audience: "a"})
+		Expect(err).To(MatchError("a key set is required"))
+
+		keys, err := auth.NewStaticKeySet(authtest.JWKS(signer))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = auth.NewTokenVerifier(auth.TokenConfig{Keys: keys, Audience: "a"})
+		Expect(err).To(MatchError("an issuer is required"))
+		_, err = auth.NewTokenVerifier(auth.TokenConfig{Keys: keys, Issuer: issuer})
+		Expect(err).To(MatchError("an audience is required"))
+		_, err = auth.NewTokenVerifier(auth.TokenConfig{Keys: keys, Issuer: issuer, Audience: "a",
+			Scopes: map[osbapi.Operation]string{"provisioning": "write"}})
+		Expect(err).To(MatchError(`unknown operation "provisioning"`))
+	})
+})
+
+var _ = Describe("Authenticator with bearer tokens", func() {
+	var (
+		jwksServer *ghttp.Server
+		signer     *authtest.Signer
+		verifier   *auth.TokenVerifier
+		logs       *bytes.Buffer
+		scopes     []string
+	)
+
+	BeforeEach(func() {
+		var err error
+		signer, err = authtest.NewSigner("key-1")
+		Expect(err).NotTo(HaveOccurred())
+
+		jwksServer = ghttp.NewServer()
+		jwksServer.RouteToHandler("GET", "/token_keys", ghttp.RespondWith(http.StatusOK, authtest.JWKS(signer)))
+
+		verifier, err = auth.NewTokenVerifier(auth.TokenConfig{
+			Keys:         auth.NewRemoteKeySet(jwksServer.URL() + "/token_keys"),
+			Issuer:       issuer,
+			Audience:     "gcp-broker-proxy",
+			Scopes:       map[osbapi.Operation]string{osbapi.Catalog: "gcp-broker-proxy.read"},
+			DefaultScope: "gcp-broker-proxy.admin",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		logs = &bytes.Buffer{}
+		scopes = []string{"gcp-broker-proxy.read"}
+	})
+
+	AfterEach(func() {
+		jwksServer.Close()
+	})
+
+	serve := func(method, path string, authorize func(*http.Request)) *httptest.ResponseRecorder {
+		credentials, err := auth.NewCredentials([]auth.Credential{{Username: "broker", Password: "secret"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		n := negroni.New(
+			logging.RequestLogger(logging.New(logs, logs)),
+			auth.Authenticator(credentials, auth.WithBearerTokens(verifier)),
+			auth.Authorize(),
+		)
+		n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+		req := httptest.NewRequest(method, path, nil)
+		authorize(req)
+
+		writer := httptest.NewRecorder()
+		n.ServeHTTP(writer, req)
+		return writer
+	}
+
+	withToken := func(r *http.Request) {
+		token, err := signer.Sign(map[string]interface{}{
+			"iss":       issuer,
+			"aud":       []string{"gcp-broker-proxy"},
+			"exp":       time.Now().Add(time.Hour).Unix(),
+			"client_id": "automation",
+			"scope":     scopes,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	It("accepts tokens with the scope of the operation and logs the client", func() {
+		Expect(serve("GET", "/v2/catalog", withToken).Code).To(Equal(http.StatusOK))
+		Expect(logs.String()).To(ContainSubstring(`"credential":"automation"`))
+	})
+
+	It("requires the default scope for operations without a scope", func() {
+		res := serve("PUT", "/v2/service_instances/instance-1", withToken)
+		Expect(res.Code).To(Equal(http.StatusForbidden))
+		Expect(res.Header().Get("WWW-Authenticate")).To(Equal(`Bearer error="insufficient_scope", scope="gcp-broker-proxy.admin"`))
+
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(MatchJSON(`{"description": "Token of automation lacks the gcp-broker-proxy.admin scope, which the provision operation requires"}`))
+
+		scopes = []string{"gcp-broker-proxy.admin"}
+		Expect(serve("PUT", "/v2/service_instances/instance-1", withToken).Code).To(Equal(http.StatusOK))
+	})
+
+	It("rejects invalid tokens and logs why", func() {
+		res := serve("GET", "/v2/catalog", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer not-a-token")
+		})
+		Expect(res.Code).To(Equal(http.StatusUnauthorized))
+		Expect(res.Header().Get("WWW-Authenticate")).To(Equal(`Bearer error="invalid_token"`))
+		Expect(logs.String()).To(ContainSubstring(`"token_error":"malformed token"`))
+	})
+
+	It("still accepts basic auth", func() {
+		Expect(serve("GET", "/v2/catalog", func(r *http.Request) {
+			r.SetBasicAuth("broker", "secret")
+		}).Code).To(Equal(http.StatusOK))
+	})
+
+	It("asks for a bearer token when only tokens are accepted", func() {
+		n := negroni.New(auth.Authenticator(nil, auth.WithBearerTokens(verifier)))
+		writer := httptest.NewRecorder()
+		n.ServeHTTP(writer, httptest.NewRequest("GET", "/v2/catalog", nil))
+
+		Expect(writer.Code).To(Equal(http.StatusUnauthorized))
+		Expect(writer.Body.String()).To(Equal("A bearer token is required"))
+	})
+})
@@ -0,0 +1,231 @@
+// Package breaker stops calls to an upstream that keeps failing, so that
+// requests fail fast instead of waiting for it to time out.
+package breaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OpenError is returned by Allow while the breaker is open. RetryAt is when
+// the breaker lets calls through again.
+type OpenError struct {
+	Name    string
+	RetryAt time.Time
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker %s is open", e.Name)
+}
+
+type State string
+
+const (
+	// Closed lets every call through and counts consecutive failures.
+	Closed State = "closed"
+	// Open rejects every call until the open timeout has passed.
+	Open State = "open"
+	// HalfOpen lets a few trial calls through to find out whether the
+	// upstream has recovered.
+	HalfOpen State = "half_open"
+)
+
+// States lists every state of a breaker.
+var States = []State{Closed, Open, HalfOpen}
+
+// Outcome is how a call allowed by the breaker ended.
+type Outcome int
+
+const (
+	Success Outcome = iota
+	Failure
+	// Canceled calls were given up by their caller before they could tell
+	// whether the upstream is healthy. They count neither way, and free
+	// their slot for another trial call.
+	Canceled
+)
+
+type Config struct {
+	// FailureThreshold is how many consecutive failures open the breaker.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before it lets trial
+	// calls through.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is how many trial calls may be in flight while the
+	// breaker is half-open. It closes once that many have succeeded.
+	HalfOpenRequests int
+}
+
+// Status describes a breaker, as served by Handler.
+type Status struct {
+	Name                string     `json:"name"`
+	State               State      `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+}
+
+// Breaker is a circuit breaker. It is safe for concurrent use.
+type Breaker struct {
+	name     string
+	config   Config
+	now      func() time.Time
+	observer func(from, to State)
+
+	mu         sync.Mutex
+	state      State
+	generation int
+	failures   int
+	openedAt   time.Time
+	trials     int
+	successes  int
+}
+
+type Option func(*Breaker)
+
+// WithClock sets the clock that times the open state.
+func WithClock(now func() time.Time) Option {
+	return func(b *Breaker) {
+		b.now = now
+	}
+}
+
+// WithObserver calls observe whenever the breaker changes state, for
+// example to log it or record metrics. It is called with the breaker
+// locked, so it must not call the breaker.
+func WithObserver(observe func(from, to State)) Option {
+	return func(b *Breaker) {
+		b.observer = observe
+	}
+}
+
+func New(name string, config Config, opts ...Option) *Breaker {
+	b := &Breaker{
+		name:   name,
+		config: config,
+		now:    time.Now,
+		state:  Closed,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// Allow returns an *OpenError if the call may not be made. Otherwise the
+// caller must report the outcome of the call to done.
+func (b *Breaker) Allow() (done func(outcome Outcome), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && !b.now().Before(b.openedAt.Add(b.config.OpenTimeout)) {
+		b.transition(HalfOpen)
+	}
+
+	switch b.state {
+	case Open:
+		return nil, &OpenError{Name: b.name, RetryAt: b.openedAt.Add(b.config.OpenTimeout)}
+	case HalfOpen:
+		// The trial calls will tell soon whether the upstream recovered.
+		if b.trials >= b.config.HalfOpenRequests {
+			return nil, &OpenError{Name: b.name, RetryAt: b.now()}
+		}
+		b.trials++
+	}
+
+	generation := b.generation
+	var once sync.Once
+	return func(outcome Outcome) {
+		once.Do(func() { b.report(generation, outcome) })
+	}, nil
+}
+
+// report records the outcome of a call allowed in the given generation.
+// Outcomes of calls that were allowed before the last change of state are
+// ignored.
+func (b *Breaker) report(generation int, outcome Outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case Closed:
+		if outcome == Canceled {
+			return
+		}
+		if outcome == Success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.open()
+		}
+	case HalfOpen:
+		b.trials--
+		if outcome == Canceled {
+			return
+		}
+		if outcome == Failure {
+			b.failures++
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.transition(Closed)
+		}
+	}
+}
+
+// State returns the current state, taking the open timeout into account.
+func (b *Breaker) State() State {
+	return b.Status().State
+}
+
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := Status{Name: b.name, State: b.state, ConsecutiveFailures: b.failures}
+	if b.state == Open {
+		openedAt := b.openedAt
+		retryAt := openedAt.Add(b.config.OpenTimeout)
+		status.OpenedAt = &openedAt
+		status.RetryAt = &retryAt
+		if !b.now().Before(retryAt) {
+			status.State = HalfOpen
+		}
+	}
+	return status
+}
+
+// open must be called with b.mu held.
+func (b *Breaker) open() {
+	b.openedAt = b.now()
+	b.transition(Open)
+}
+
+// transition must be called with b.mu held.
+func (b *Breaker) transition(to State) {
+	from := b.state
+	b.state = to
+	b.generation++
+	b.trials = 0
+	b.successes = 0
+	if to == Closed {
+		b.failures = 0
+	}
+
+	if b.observer != nil && from != to {
+		b.observer(from, to)
+	}
+}
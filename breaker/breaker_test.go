@@ -0,0 +1,161 @@
+package breaker_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Breaker", func() {
+	var (
+		now         time.Time
+		transitions []string
+		b           *breaker.Breaker
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		transitions = nil
+		b = breaker.New("broker", breaker.Config{
+			FailureThreshold: 3,
+			OpenTimeout:      30 * time.Second,
+			HalfOpenRequests: 2,
+		},
+			breaker.WithClock(func() time.Time { return now }),
+			breaker.WithObserver(func(from, to breaker.State) {
+				transitions = append(transitions, string(from)+" -> "+string(to))
+			}),
+		)
+	})
+
+	call := func(success bool) error {
+		done, err := b.Allow()
+		if err != nil {
+			return err
+		}
+		if success {
+			done(breaker.Success)
+		} else {
+			done(breaker.Failure)
+		}
+		return nil
+	}
+
+	open := func() {
+		for i := 0; i < 3; i++ {
+			Expect(call(false)).To(Succeed())
+		}
+		Expect(b.State()).To(Equal(breaker.Open))
+	}
+
+	It("opens after consecutive failures", func() {
+		Expect(call(false)).To(Succeed())
+		Expect(call(false)).To(Succeed())
+		Expect(b.State()).To(Equal(breaker.Closed))
+
+		Expect(call(false)).To(Succeed())
+		Expect(b.State()).To(Equal(breaker.Open))
+		Expect(call(true)).To(MatchError("circuit breaker broker is open"))
+		Expect(transitions).To(Equal([]string{"closed -> open"}))
+	})
+
+	It("forgets failures after a success", func() {
+		Expect(call(false)).To(Succeed())
+		Expect(call(false)).To(Succeed())
+		Expect(call(true)).To(Succeed())
+		Expect(call(false)).To(Succeed())
+		Expect(call(false)).To(Succeed())
+
+		Expect(b.State()).To(Equal(breaker.Closed))
+		Expect(b.Status().ConsecutiveFailures).To(Equal(2))
+	})
+
+	It("lets a limited number of trial calls through after the open timeout", func() {
+		open()
+
+		now = now.Add(30 * time.Second)
+		Expect(b.State()).To(Equal(breaker.HalfOpen))
+
+		first, err := b.Allow()
+		Expect(err).NotTo(HaveOccurred())
+		second, err := b.Allow()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = b.Allow()
+		Expect(err).To(BeAssignableToTypeOf(&breaker.OpenError{}))
+
+		first(breaker.Success)
+		Expect(b.State()).To(Equal(breaker.HalfOpen))
+		second(breaker.Success)
+		Expect(b.State()).To(Equal(breaker.Closed))
+		Expect(transitions).To(Equal([]string{"closed -> open", "open -> half_open", "half_open -> closed"}))
+	})
+
+	It("opens again when a trial call fails", func() {
+		open()
+		now = now.Add(30 * time.Second)
+
+		Expect(call(false)).To(Succeed())
+		Expect(b.State()).To(Equal(breaker.Open))
+		Expect(*b.Status().RetryAt).To(Equal(now.Add(30 * time.Second)))
+
+		_, err := b.Allow()
+		Expect(err).To(Equal(&breaker.OpenError{Name: "broker", RetryAt: now.Add(30 * time.Second)}))
+	})
+
+	It("frees the slot of canceled trial calls without closing or opening", func() {
+		open()
+		now = now.Add(30 * time.Second)
+
+		canceled, err := b.Allow()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = b.Allow()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = b.Allow()
+		Expect(err).To(BeAssignableToTypeOf(&breaker.OpenError{}))
+
+		canceled(breaker.Canceled)
+		Expect(b.State()).To(Equal(breaker.HalfOpen))
+		Expect(call(true)).To(Succeed())
+		Expect(b.State()).To(Equal(breaker.HalfOpen))
+	})
+
+	It("ignores the outcome of calls allowed before the state changed", func() {
+		late, err := b.Allow()
+		Expect(err).NotTo(HaveOccurred())
+		open()
+
+		now = now.Add(30 * time.Second)
+		Expect(call(true)).To(Succeed())
+
+		late(breaker.Failure)
+		Expect(b.State()).To(Equal(breaker.HalfOpen))
+	})
+
+	Describe("Handler", func() {
+		It("serves the status of the breakers", func() {
+			open()
+			other := breaker.New("token", breaker.Config{FailureThreshold: 1})
+
+			w := httptest.NewRecorder()
+			breaker.Handler(b, other).ServeHTTP(w, httptest.NewRequest("GET", "/admin/breakers", nil))
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(MatchJSON(`{"breakers": [
+				{"name": "broker", "state": "open", "consecutive_failures": 3, "opened_at": "2026-01-01T00:00:00Z", "retry_at": "2026-01-01T00:00:30Z"},
+				{"name": "token", "state": "closed", "consecutive_failures": 0}
+			]}`))
+		})
+
+		It("only supports GET", func() {
+			w := httptest.NewRecorder()
+			breaker.Handler(b).ServeHTTP(w, httptest.NewRequest("POST", "/admin/breakers", nil))
+
+			Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
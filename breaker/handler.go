@@ -0,0 +1,47 @@
+package breaker
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Handler serves the status of the breakers as JSON.
+func Handler(breakers ...*Breaker) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			osbapi.WriteError(rw, http.StatusMethodNotAllowed, "", "Only GET is supported")
+			return
+		}
+
+		statuses := make([]Status, 0, len(breakers))
+		for _, b := range breakers {
+			statuses = append(statuses, b.Status())
+		}
+
+		encoded, err := json.Marshal(map[string]interface{}{"breakers": statuses})
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to encode the breakers: "+err.Error())
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(encoded)
+	})
+}
+
+// WriteOpen responds to a request that was rejected by an open breaker
+// with 503 Service Unavailable, the OSBAPI error description and a
+// Retry-After header.
+func WriteOpen(rw http.ResponseWriter, err *OpenError, description string) {
+	seconds := math.Ceil(time.Until(err.RetryAt).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+	osbapi.WriteError(rw, http.StatusServiceUnavailable, "", description)
+}
@@ -0,0 +1,58 @@
+package buffer
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Response is an http.ResponseWriter that keeps the response in memory so
+// that it can be inspected or rewritten before it is sent on.
+type Response struct {
+	header http.Header
+	status int
+	Body   bytes.Buffer
+}
+
+func NewResponse() *Response {
+	return &Response{header: http.Header{}}
+}
+
+func (b *Response) Header() http.Header {
+	return b.header
+}
+
+func (b *Response) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *Response) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.Body.Write(p)
+}
+
+// Status returns the status code written so far, or 200 if none was written.
+func (b *Response) Status() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+// WriteTo sends the buffered response to rw.
+func (b *Response) WriteTo(rw http.ResponseWriter) {
+	b.WriteBody(rw, b.Body.Bytes())
+}
+
+// WriteBody sends the buffered status and headers to rw with a replacement body.
+func (b *Response) WriteBody(rw http.ResponseWriter, body []byte) {
+	for key, values := range b.header {
+		if key == "Content-Length" {
+			continue
+		}
+		rw.Header()[key] = values
+	}
+	rw.WriteHeader(b.Status())
+	rw.Write(body)
+}
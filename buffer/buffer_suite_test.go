@@ -0,0 +1,13 @@
+package buffer_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestBuffer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Buffer Suite")
+}
@@ -0,0 +1,57 @@
+package buffer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/buffer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response", func() {
+	var res *buffer.Response
+
+	BeforeEach(func() {
+		res = buffer.NewResponse()
+	})
+
+	It("defaults to a 200 status", func() {
+		res.Write([]byte("body"))
+
+		Expect(res.Status()).To(Equal(http.StatusOK))
+		Expect(res.Body.String()).To(Equal("body"))
+	})
+
+	It("keeps the first status written", func() {
+		res.WriteHeader(http.StatusAccepted)
+		res.WriteHeader(http.StatusInternalServerError)
+
+		Expect(res.Status()).To(Equal(http.StatusAccepted))
+	})
+
+	It("writes the buffered response on", func() {
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusCreated)
+		res.Write([]byte("{}"))
+
+		writer := httptest.NewRecorder()
+		res.WriteTo(writer)
+
+		Expect(writer.Code).To(Equal(http.StatusCreated))
+		Expect(writer.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(writer.Body.String()).To(Equal("{}"))
+	})
+
+	It("drops the content length when writing a replacement body", func() {
+		res.Header().Set("Content-Length", "2")
+		res.Write([]byte("{}"))
+
+		writer := httptest.NewRecorder()
+		res.WriteBody(writer, []byte(`{"a": "b"}`))
+
+		Expect(writer.Header().Get("Content-Length")).To(BeEmpty())
+		Expect(writer.Body.String()).To(Equal(`{"a": "b"}`))
+	})
+})
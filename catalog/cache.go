@@ -0,0 +1,126 @@
+package catalog
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTTL             = 5 * time.Minute
+	DefaultRefreshInterval = 10 * time.Second
+)
+
+// Cache holds the most recent catalog seen from the broker. The catalog is
+// reloaded once it is older than the TTL, and reloads for plans missing from
+// it happen at most once per refresh interval, so that requests for unknown
+// plans cannot make every request fetch the catalog. Concurrent loads are
+// made one at a time, so requests waiting for one use its result.
+type Cache struct {
+	ttl             time.Duration
+	refreshInterval time.Duration
+	now             func() time.Time
+
+	loading sync.Mutex
+
+	mu       sync.RWMutex
+	catalog  *Catalog
+	schemas  parameterSchemas
+	storedAt time.Time
+}
+
+type CacheOption func(*Cache)
+
+// WithTTL sets how long a catalog is used before it is reloaded.
+func WithTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.ttl = ttl
+	}
+}
+
+// WithRefreshInterval sets how long after a catalog was loaded Refresh
+// reloads it.
+func WithRefreshInterval(interval time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.refreshInterval = interval
+	}
+}
+
+// WithClock sets the clock that ages the cached catalog.
+func WithClock(now func() time.Time) CacheOption {
+	return func(c *Cache) {
+		c.now = now
+	}
+}
+
+func NewCache(opts ...CacheOption) *Cache {
+	c := &Cache{
+		ttl:             DefaultTTL,
+		refreshInterval: DefaultRefreshInterval,
+		now:             time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Get returns the cached catalog, calling load to populate the cache if it
+// is empty or older than the TTL. A stale catalog is returned if it cannot
+// be reloaded.
+func (c *Cache) Get(load func() (Catalog, error)) (Catalog, error) {
+	if catalog, ok := c.cached(c.ttl); ok {
+		return catalog, nil
+	}
+	return c.reload(load, c.ttl)
+}
+
+// Refresh reloads the catalog, for example to find a plan that may have been
+// added since, unless it was loaded less than the refresh interval ago.
+func (c *Cache) Refresh(load func() (Catalog, error)) (Catalog, error) {
+	return c.reload(load, c.refreshInterval)
+}
+
+func (c *Cache) Store(catalog Catalog) {
+	schemas := compileSchemas(catalog)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.catalog = &catalog
+	c.schemas = schemas
+	c.storedAt = c.now()
+}
+
+// cached returns the cached catalog if it is younger than maxAge.
+func (c *Cache) cached(maxAge time.Duration) (Catalog, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.catalog == nil || c.now().Sub(c.storedAt) >= maxAge {
+		return Catalog{}, false
+	}
+	return *c.catalog, true
+}
+
+func (c *Cache) reload(load func() (Catalog, error), maxAge time.Duration) (Catalog, error) {
+	c.loading.Lock()
+	defer c.loading.Unlock()
+
+	// The catalog may have been loaded while this call waited.
+	if catalog, ok := c.cached(maxAge); ok {
+		return catalog, nil
+	}
+
+	catalog, err := load()
+	if err != nil {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		if c.catalog != nil {
+			return *c.catalog, nil
+		}
+		return Catalog{}, err
+	}
+
+	c.Store(catalog)
+	return catalog, nil
+}
@@ -0,0 +1,157 @@
+package catalog
+
+import (
+	"encoding/json"
+)
+
+type Catalog struct {
+	Services []Service `json:"services"`
+}
+
+// Service is a catalog service offering. Attributes the proxy does not model
+// are kept so that a rewritten catalog does not lose them.
+type Service struct {
+	ID         string
+	Name       string
+	Plans      []Plan
+	attributes map[string]json.RawMessage
+}
+
+// Plan is a service plan. Like Service it keeps every attribute it was
+// decoded from.
+type Plan struct {
+	ID         string
+	Name       string
+	attributes map[string]json.RawMessage
+}
+
+func Parse(body []byte) (Catalog, error) {
+	var catalog Catalog
+	err := json.Unmarshal(body, &catalog)
+	return catalog, err
+}
+
+// FindPlan returns the service and plan with the given IDs.
+func (c Catalog) FindPlan(serviceID, planID string) (Service, Plan, bool) {
+	for _, service := range c.Services {
+		if service.ID != serviceID {
+			continue
+		}
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return service, plan, true
+			}
+		}
+	}
+	return Service{}, Plan{}, false
+}
+
+// Describe names a service or plan by name, or by ID when it is not in the
+// catalog.
+func Describe(name, id string) string {
+	if name != "" {
+		return name
+	}
+	return id
+}
+
+// Get decodes the named attribute into v and reports whether it was present.
+func (s Service) Get(key string, v interface{}) (bool, error) {
+	return getAttribute(s.attributes, key, v)
+}
+
+// Set replaces the named attribute. Copies of the service made before the
+// call are not affected.
+func (s *Service) Set(key string, v interface{}) error {
+	return setAttribute(&s.attributes, key, v)
+}
+
+func (s *Service) UnmarshalJSON(data []byte) error {
+	var known struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Plans []Plan `json:"plans"`
+	}
+	if err := json.Unmarshal(data, &known); err != nil {
+		return err
+	}
+
+	s.ID, s.Name, s.Plans = known.ID, known.Name, known.Plans
+	return json.Unmarshal(data, &s.attributes)
+}
+
+func (s Service) MarshalJSON() ([]byte, error) {
+	attributes := copyAttributes(s.attributes)
+
+	for key, value := range map[string]interface{}{"id": s.ID, "name": s.Name, "plans": s.Plans} {
+		if err := setAttribute(&attributes, key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(attributes)
+}
+
+// Get decodes the named attribute into v and reports whether it was present.
+func (p Plan) Get(key string, v interface{}) (bool, error) {
+	return getAttribute(p.attributes, key, v)
+}
+
+// Set replaces the named attribute. Copies of the plan made before the call
+// are not affected.
+func (p *Plan) Set(key string, v interface{}) error {
+	return setAttribute(&p.attributes, key, v)
+}
+
+func (p *Plan) UnmarshalJSON(data []byte) error {
+	var known struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &known); err != nil {
+		return err
+	}
+
+	p.ID, p.Name = known.ID, known.Name
+	return json.Unmarshal(data, &p.attributes)
+}
+
+func (p Plan) MarshalJSON() ([]byte, error) {
+	attributes := copyAttributes(p.attributes)
+
+	for key, value := range map[string]interface{}{"id": p.ID, "name": p.Name} {
+		if err := setAttribute(&attributes, key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(attributes)
+}
+
+func getAttribute(attributes map[string]json.RawMessage, key string, v interface{}) (bool, error) {
+	raw, ok := attributes[key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+func setAttribute(attributes *map[string]json.RawMessage, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	*attributes = copyAttributes(*attributes)
+	(*attributes)[key] = raw
+
+	return nil
+}
+
+func copyAttributes(attributes map[string]json.RawMessage) map[string]json.RawMessage {
+	result := make(map[string]json.RawMessage, len(attributes))
+	for key, value := range attributes {
+		result[key] = value
+	}
+	return result
+}
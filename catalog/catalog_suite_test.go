@@ -0,0 +1,39 @@
+package catalog_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCatalog(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Catalog Suite")
+}
+
+const googleCatalog = `{
+	"services": [
+		{
+			"id": "cloudsql-mysql-id",
+			"name": "google-cloudsql-mysql",
+			"description": "Google Cloud SQL for MySQL",
+			"bindable": true,
+			"tags": ["gcp", "mysql"],
+			"metadata": {"displayName": "Cloud SQL - MySQL", "imageUrl": "https://example.com/mysql.png"},
+			"plans": [
+				{"id": "mysql-beta-id", "name": "beta", "description": "Beta plan", "free": false, "schemas": {"service_instance": {}}},
+				{"id": "mysql-dev-id", "name": "dev", "description": "Dev plan", "free": false}
+			]
+		},
+		{
+			"id": "pubsub-id",
+			"name": "google-pubsub",
+			"description": "Google Cloud Pub/Sub",
+			"bindable": true,
+			"plans": [
+				{"id": "pubsub-beta-id", "name": "beta", "description": "Beta plan", "free": true}
+			]
+		}
+	]
+}`
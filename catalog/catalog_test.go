@@ -0,0 +1,70 @@
+package catalog_test
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Catalog", func() {
+	var c catalog.Catalog
+
+	BeforeEach(func() {
+		var err error
+		c, err = catalog.Parse([]byte(googleCatalog))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("parses services and plans", func() {
+		Expect(c.Services).To(HaveLen(2))
+		Expect(c.Services[0].ID).To(Equal("cloudsql-mysql-id"))
+		Expect(c.Services[0].Name).To(Equal("google-cloudsql-mysql"))
+		Expect(c.Services[0].Plans).To(HaveLen(2))
+		Expect(c.Services[0].Plans[1].Name).To(Equal("dev"))
+	})
+
+	It("keeps every attribute when encoded again", func() {
+		body, err := json.Marshal(c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(MatchJSON(googleCatalog))
+	})
+
+	It("finds plans by service and plan ID", func() {
+		service, plan, found := c.FindPlan("pubsub-id", "pubsub-beta-id")
+		Expect(found).To(BeTrue())
+		Expect(service.Name).To(Equal("google-pubsub"))
+		Expect(plan.Name).To(Equal("beta"))
+
+		_, _, found = c.FindPlan("pubsub-id", "mysql-beta-id")
+		Expect(found).To(BeFalse())
+	})
+
+	Describe("attributes", func() {
+		It("decodes attributes", func() {
+			var tags []string
+			present, err := c.Services[0].Get("tags", &tags)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(present).To(BeTrue())
+			Expect(tags).To(Equal([]string{"gcp", "mysql"}))
+
+			present, err = c.Services[1].Get("tags", &tags)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(present).To(BeFalse())
+		})
+
+		It("does not change copies when setting attributes", func() {
+			service := c.Services[0]
+			Expect(service.Set("description", "changed")).To(Succeed())
+
+			var description string
+			c.Services[0].Get("description", &description)
+			Expect(description).To(Equal("Google Cloud SQL for MySQL"))
+
+			service.Get("description", &description)
+			Expect(description).To(Equal("changed"))
+		})
+	})
+})
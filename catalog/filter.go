@@ -0,0 +1,134 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/buffer"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Filter applies the policy to catalog responses and rejects provisions and
+// plan updates for plans the policy does not allow. The unfiltered catalog
+// is kept in the cache.
+func Filter(policy Policy, cache *Cache) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		switch osbapi.ParseRoute(r.Method, r.URL.Path).Operation {
+		case osbapi.Catalog:
+			filterCatalog(policy, cache, rw, r, next)
+		case osbapi.Provision, osbapi.Update:
+			checkPlan(policy, cache, rw, r, next)
+		default:
+			next(rw, r)
+		}
+	})
+}
+
+func filterCatalog(policy Policy, cache *Cache, rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	res := buffer.NewResponse()
+	next(res, r)
+
+	if res.Status() != http.StatusOK {
+		res.WriteTo(rw)
+		return
+	}
+
+	catalog, err := Parse(res.Body.Bytes())
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusBadGateway, "", "Broker responded with an invalid catalog: "+err.Error())
+		return
+	}
+	cache.Store(catalog)
+
+	filtered, err := policy.Apply(catalog)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to apply the catalog policy: "+err.Error())
+		return
+	}
+
+	body, err := json.Marshal(filtered)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to encode the catalog: "+err.Error())
+		return
+	}
+
+	res.WriteBody(rw, body)
+}
+
+func checkPlan(policy Policy, cache *Cache, rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusBadRequest, "", "Could not read request body")
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var details struct {
+		ServiceID string `json:"service_id"`
+		PlanID    string `json:"plan_id"`
+	}
+	// Malformed bodies and updates that keep the plan are left to the broker.
+	if json.Unmarshal(body, &details) != nil || details.PlanID == "" {
+		next(rw, r)
+		return
+	}
+
+	service, plan, found, err := Lookup(cache, r, next, details.ServiceID, details.PlanID)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusBadGateway, "", "Could not retrieve the catalog: "+err.Error())
+		return
+	}
+
+	if !found || !policy.Allows(service, plan) {
+		osbapi.WriteError(rw, http.StatusBadRequest, "PlanNotAvailable", fmt.Sprintf("Plan %s of service %s is not available through this broker", details.PlanID, details.ServiceID))
+		return
+	}
+
+	next(rw, r)
+}
+
+// Lookup finds a plan in the cached catalog. The catalog is requested
+// through the rest of the middleware chain if it is not cached or has
+// expired, or again if it does not have the plan, which may have been added
+// since, unless it was loaded within the cache's refresh interval.
+func Lookup(cache *Cache, r *http.Request, next http.HandlerFunc, serviceID, planID string) (Service, Plan, bool, error) {
+	load := func() (Catalog, error) {
+		return fetchCatalog(r, next)
+	}
+
+	catalog, err := cache.Get(load)
+	if err != nil {
+		return Service{}, Plan{}, false, err
+	}
+
+	service, plan, found := catalog.FindPlan(serviceID, planID)
+	if !found {
+		if catalog, err = cache.Refresh(load); err == nil {
+			service, plan, found = catalog.FindPlan(serviceID, planID)
+		}
+	}
+	return service, plan, found, nil
+}
+
+// fetchCatalog requests the catalog through the rest of the middleware chain.
+func fetchCatalog(r *http.Request, next http.HandlerFunc) (Catalog, error) {
+	req, err := http.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	if err != nil {
+		return Catalog{}, err
+	}
+	req.Header.Set("X-Broker-API-Version", r.Header.Get("X-Broker-API-Version"))
+
+	res := buffer.NewResponse()
+	next(res, req.WithContext(r.Context()))
+
+	if res.Status() != http.StatusOK {
+		return Catalog{}, fmt.Errorf("broker responded with status %d", res.Status())
+	}
+
+	return Parse(res.Body.Bytes())
+}
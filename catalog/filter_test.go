@@ -0,0 +1,212 @@
+package catalog_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/urfave/negroni"
+)
+
+var _ = Describe("Filter", func() {
+	var (
+		policy   catalog.Policy
+		cache    *catalog.Cache
+		filter   negroni.HandlerFunc
+		writer   *httptest.ResponseRecorder
+		requests []*http.Request
+		bodies   []string
+		broker   http.HandlerFunc
+		now      time.Time
+	)
+
+	BeforeEach(func() {
+		policy = catalog.Policy{Services: catalog.Rules{Deny: []string{"google-pubsub"}}}
+		now = time.Now()
+		cache = catalog.NewCache(catalog.WithClock(func() time.Time { return now }))
+		writer = httptest.NewRecorder()
+		requests = nil
+		bodies = nil
+
+		broker = func(w http.ResponseWriter, r *http.Request) {
+			var body []byte
+			if r.Body != nil {
+				body, _ = ioutil.ReadAll(r.Body)
+			}
+			requests = append(requests, r)
+			bodies = append(bodies, string(body))
+
+			if r.URL.Path == "/v2/catalog" {
+				w.Header().Set("Content-Length", "1000")
+				w.Write([]byte(googleCatalog))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		}
+	})
+
+	JustBeforeEach(func() {
+		filter = catalog.Filter(policy, cache)
+	})
+
+	Describe("GET /v2/catalog", func() {
+		It("responds with the filtered catalog", func() {
+			req, _ := http.NewRequest("GET", "/v2/catalog", nil)
+			filter(writer, req, broker)
+
+			Expect(writer.Code).To(Equal(http.StatusOK))
+			Expect(writer.Header().Get("Content-Length")).To(BeEmpty())
+
+			var filtered catalog.Catalog
+			Expect(json.Unmarshal(writer.Body.Bytes(), &filtered)).To(Succeed())
+			Expect(filtered.Services).To(HaveLen(1))
+			Expect(filtered.Services[0].Name).To(Equal("google-cloudsql-mysql"))
+		})
+
+		It("caches the unfiltered catalog", func() {
+			req, _ := http.NewRequest("GET", "/v2/catalog", nil)
+			filter(writer, req, broker)
+
+			cached, err := cache.Get(func() (catalog.Catalog, error) {
+				Fail("should not load the catalog")
+				return catalog.Catalog{}, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cached.Services).To(HaveLen(2))
+		})
+
+		It("passes unsuccessful responses through", func() {
+			req, _ := http.NewRequest("GET", "/v2/catalog", nil)
+			filter(writer, req, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("oops"))
+			})
+
+			Expect(writer.Code).To(Equal(http.StatusInternalServerError))
+			Expect(writer.Body.String()).To(Equal("oops"))
+		})
+
+		It("rejects catalogs it cannot parse", func() {
+			req, _ := http.NewRequest("GET", "/v2/catalog", nil)
+			filter(writer, req, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("not json"))
+			})
+
+			Expect(writer.Code).To(Equal(http.StatusBadGateway))
+			Expect(writer.Body.String()).To(ContainSubstring("invalid catalog"))
+		})
+	})
+
+	Describe("provisioning", func() {
+		provision := func(body string) {
+			req, _ := http.NewRequest("PUT", "/v2/service_instances/instance-1", strings.NewReader(body))
+			req.Header.Set("X-Broker-API-Version", "2.14")
+			filter(writer, req, broker)
+		}
+
+		It("loads the catalog through the chain and forwards allowed plans unchanged", func() {
+			body := `{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`
+			provision(body)
+
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[0].URL.Path).To(Equal("/v2/catalog"))
+			Expect(requests[0].Header.Get("X-Broker-API-Version")).To(Equal("2.14"))
+			Expect(requests[1].URL.Path).To(Equal("/v2/service_instances/instance-1"))
+			Expect(bodies[1]).To(Equal(body))
+			Expect(writer.Code).To(Equal(http.StatusCreated))
+		})
+
+		It("rejects filtered plans with an OSBAPI error", func() {
+			provision(`{"service_id": "pubsub-id", "plan_id": "pubsub-beta-id"}`)
+
+			Expect(writer.Code).To(Equal(http.StatusBadRequest))
+			Expect(writer.Body.String()).To(MatchJSON(`{"error": "PlanNotAvailable", "description": "Plan pubsub-beta-id of service pubsub-id is not available through this broker"}`))
+			for _, req := range requests {
+				Expect(req.URL.Path).To(Equal("/v2/catalog"))
+			}
+		})
+
+		It("rejects plans that are not in the catalog after reloading it at most once per refresh interval", func() {
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "unknown"}`)
+			Expect(writer.Code).To(Equal(http.StatusBadRequest))
+			Expect(requests).To(HaveLen(1))
+
+			now = now.Add(catalog.DefaultRefreshInterval)
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "unknown"}`)
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "unknown"}`)
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].URL.Path).To(Equal("/v2/catalog"))
+		})
+
+		It("reloads the catalog once it has expired", func() {
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`)
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`)
+			Expect(requests).To(HaveLen(3))
+
+			now = now.Add(catalog.DefaultTTL)
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`)
+			Expect(requests).To(HaveLen(5))
+			Expect(requests[3].URL.Path).To(Equal("/v2/catalog"))
+		})
+
+		It("keeps using an expired catalog that cannot be reloaded", func() {
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`)
+
+			now = now.Add(catalog.DefaultTTL)
+			broker = func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/catalog" {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}
+			writer = httptest.NewRecorder()
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`)
+
+			Expect(writer.Code).To(Equal(http.StatusCreated))
+		})
+
+		It("reports when the catalog cannot be loaded", func() {
+			broker = func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			provision(`{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`)
+
+			Expect(writer.Code).To(Equal(http.StatusBadGateway))
+			Expect(writer.Body.String()).To(ContainSubstring("status 503"))
+		})
+	})
+
+	Describe("updating", func() {
+		It("checks the new plan", func() {
+			req, _ := http.NewRequest("PATCH", "/v2/service_instances/instance-1", strings.NewReader(`{"service_id": "pubsub-id", "plan_id": "pubsub-beta-id"}`))
+			filter(writer, req, broker)
+
+			Expect(writer.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("forwards updates that keep the plan", func() {
+			req, _ := http.NewRequest("PATCH", "/v2/service_instances/instance-1", strings.NewReader(`{"service_id": "pubsub-id", "parameters": {}}`))
+			filter(writer, req, broker)
+
+			Expect(requests).To(HaveLen(1))
+			Expect(writer.Code).To(Equal(http.StatusCreated))
+		})
+	})
+
+	It("forwards other requests", func() {
+		req, _ := http.NewRequest("DELETE", "/v2/service_instances/instance-1", nil)
+		filter(writer, req, broker)
+
+		Expect(requests).To(HaveLen(1))
+		Expect(writer.Code).To(Equal(http.StatusCreated))
+	})
+})
@@ -0,0 +1,221 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/buffer"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/schema"
+)
+
+// schemaPaths are where plans publish the schema of each operation's
+// parameters.
+var schemaPaths = map[osbapi.Operation][]string{
+	osbapi.Provision: {"service_instance", "create", "parameters"},
+	osbapi.Update:    {"service_instance", "update", "parameters"},
+	osbapi.Bind:      {"service_binding", "create", "parameters"},
+}
+
+// ParameterSchema returns the JSON Schema the plan publishes for the
+// parameters of the operation, or nil if it publishes none.
+func (p Plan) ParameterSchema(operation osbapi.Operation) (*schema.Schema, error) {
+	path, ok := schemaPaths[operation]
+	if !ok {
+		return nil, nil
+	}
+
+	var schemas map[string]interface{}
+	if found, err := p.Get("schemas", &schemas); !found || err != nil {
+		return nil, err
+	}
+
+	var node interface{} = schemas
+	for _, key := range path {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		if node, ok = object[key]; !ok {
+			return nil, nil
+		}
+	}
+
+	return schema.New(node)
+}
+
+// schemaKey identifies the schema a plan publishes for the parameters of an
+// operation.
+type schemaKey struct {
+	serviceID, planID string
+	operation         osbapi.Operation
+}
+
+// parameterSchemas are the compiled parameter schemas of a catalog, and the
+// errors of those that are invalid.
+type parameterSchemas struct {
+	valid   map[schemaKey]*schema.Schema
+	invalid map[schemaKey]error
+}
+
+func compileSchemas(catalog Catalog) parameterSchemas {
+	schemas := parameterSchemas{valid: map[schemaKey]*schema.Schema{}, invalid: map[schemaKey]error{}}
+	for _, service := range catalog.Services {
+		for _, plan := range service.Plans {
+			for operation := range schemaPaths {
+				key := schemaKey{serviceID: service.ID, planID: plan.ID, operation: operation}
+				compiled, err := plan.ParameterSchema(operation)
+				switch {
+				case err != nil:
+					schemas.invalid[key] = err
+				case compiled != nil:
+					schemas.valid[key] = compiled
+				}
+			}
+		}
+	}
+	return schemas
+}
+
+// ParameterSchema returns the JSON Schema the plan publishes in the cached
+// catalog for the parameters of the operation, or nil if it publishes none.
+// Schemas are compiled once, when a catalog is stored.
+func (c *Cache) ParameterSchema(serviceID, planID string, operation osbapi.Operation) (*schema.Schema, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key := schemaKey{serviceID: serviceID, planID: planID, operation: operation}
+	if err, ok := c.schemas.invalid[key]; ok {
+		return nil, err
+	}
+	return c.schemas.valid[key], nil
+}
+
+// InvalidSchemas returns how many parameter schemas of the cached catalog
+// are invalid, and so are not checked.
+func (c *Cache) InvalidSchemas() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.schemas.invalid)
+}
+
+type parameterDetails struct {
+	ServiceID      string          `json:"service_id"`
+	PlanID         string          `json:"plan_id"`
+	Parameters     json.RawMessage `json:"parameters"`
+	PreviousValues struct {
+		PlanID string `json:"plan_id"`
+	} `json:"previous_values"`
+}
+
+// ValidateParameters rejects provisions, updates and binds whose parameters
+// do not match the JSON Schema of their plan in the catalog with 400,
+// listing every problem. Catalog responses passing through it are stored in
+// the cache. Requests whose plan or schema cannot be found are passed on.
+func ValidateParameters(cache *Cache) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		operation := osbapi.ParseRoute(r.Method, r.URL.Path).Operation
+		switch operation {
+		case osbapi.Catalog:
+			storeCatalog(cache, rw, r, next)
+		case osbapi.Provision, osbapi.Update, osbapi.Bind:
+			checkParameters(operation, cache, rw, r, next)
+		default:
+			next(rw, r)
+		}
+	})
+}
+
+func storeCatalog(cache *Cache, rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	res := buffer.NewResponse()
+	next(res, r)
+
+	if res.Status() == http.StatusOK {
+		if catalog, err := Parse(res.Body.Bytes()); err == nil {
+			cache.Store(catalog)
+		}
+	}
+
+	res.WriteTo(rw)
+}
+
+func checkParameters(operation osbapi.Operation, cache *Cache, rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusBadRequest, "", "Could not read request body")
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var details parameterDetails
+	if json.Unmarshal(body, &details) != nil {
+		next(rw, r)
+		return
+	}
+
+	// Updates that keep the plan may name it in previous_values, and updates
+	// without parameters change none.
+	planID := details.PlanID
+	if operation == osbapi.Update {
+		if planID == "" {
+			planID = details.PreviousValues.PlanID
+		}
+		if planID == "" || len(details.Parameters) == 0 {
+			next(rw, r)
+			return
+		}
+	}
+
+	service, plan, found, err := Lookup(cache, r, next, details.ServiceID, planID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to fetch the catalog to validate parameters", err)
+		next(rw, r)
+		return
+	}
+	if !found {
+		next(rw, r)
+		return
+	}
+
+	parameterSchema, err := cache.ParameterSchema(service.ID, plan.ID, operation)
+	if err != nil {
+		logging.FromContext(r.Context()).Error(fmt.Sprintf("Plan %s of service %s has an invalid %s parameter schema", plan.Name, service.Name, operation), err)
+		next(rw, r)
+		return
+	}
+	if parameterSchema == nil {
+		next(rw, r)
+		return
+	}
+
+	// Missing parameters are checked as none, so that required ones are
+	// reported.
+	var parameters interface{}
+	if len(details.Parameters) != 0 {
+		json.Unmarshal(details.Parameters, &parameters)
+	}
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+
+	problems := parameterSchema.Validate("parameters", parameters)
+	if len(problems) == 0 {
+		next(rw, r)
+		return
+	}
+
+	descriptions := make([]string, len(problems))
+	for i, problem := range problems {
+		descriptions[i] = problem.String()
+	}
+	osbapi.WriteError(rw, http.StatusBadRequest, "InvalidParameters",
+		fmt.Sprintf("Invalid parameters for plan %s of service %s: %s", plan.Name, service.Name, strings.Join(descriptions, "; ")))
+}
@@ -0,0 +1,234 @@
+package catalog_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/urfave/negroni"
+)
+
+const catalogWithSchemas = `{
+	"services": [
+		{
+			"id": "cloudsql-mysql-id",
+			"name": "google-cloudsql-mysql",
+			"bindable": true,
+			"plans": [
+				{
+					"id": "mysql-beta-id",
+					"name": "beta",
+					"schemas": {
+						"service_instance": {
+							"create": {
+								"parameters": {
+									"$schema": "http://json-schema.org/draft-04/schema#",
+									"type": "object",
+									"properties": {
+										"instance_name": {"type": "string", "pattern": "^[a-z][a-z0-9-]+$", "maxLength": 84},
+										"tier": {"type": "string", "pattern": "^db-(f1-micro|g1-small|n1-standard-[0-9]+)$"},
+										"disk_size": {"type": "integer", "minimum": 10, "maximum": 30720},
+										"labels": {"type": "object", "additionalProperties": {"type": "string"}}
+									},
+									"required": ["instance_name"]
+								}
+							},
+							"update": {
+								"parameters": {
+									"type": "object",
+									"properties": {"disk_size": {"type": "integer", "minimum": 10}},
+									"additionalProperties": false
+								}
+							}
+						}
+					}
+				},
+				{"id": "mysql-dev-id", "name": "dev"}
+			]
+		},
+		{
+			"id": "storage-id",
+			"name": "google-storage",
+			"bindable": true,
+			"plans": [
+				{
+					"id": "storage-standard-id",
+					"name": "standard",
+					"schemas": {
+						"service_binding": {
+							"create": {
+								"parameters": {
+									"type": "object",
+									"properties": {
+										"role": {"type": "string", "enum": ["storage.objectAdmin", "storage.objectViewer", "storage.admin"]}
+									},
+									"required": ["role"]
+								}
+							}
+						}
+					}
+				}
+			]
+		}
+	]
+}`
+
+var _ = Describe("ValidateParameters", func() {
+	var (
+		cache     *catalog.Cache
+		requests  []string
+		forwarded string
+		handler   http.Handler
+	)
+
+	BeforeEach(func() {
+		cache = catalog.NewCache()
+		requests = nil
+		forwarded = ""
+
+		n := negroni.New(catalog.ValidateParameters(cache))
+		n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if r.URL.Path == "/v2/catalog" {
+				w.Write([]byte(catalogWithSchemas))
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			forwarded = string(body)
+			w.WriteHeader(http.StatusCreated)
+		})
+		handler = n
+	})
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	It("forwards provisions with valid parameters unchanged", func() {
+		body := `{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id", "parameters": {"instance_name": "orders", "tier": "db-n1-standard-2"}}`
+
+		Expect(serve("PUT", "/v2/service_instances/i1", body).Code).To(Equal(http.StatusCreated))
+		Expect(forwarded).To(Equal(body))
+		Expect(requests).To(Equal([]string{"GET /v2/catalog", "PUT /v2/service_instances/i1"}))
+	})
+
+	It("rejects provisions listing every problem with the parameters", func() {
+		w := serve("PUT", "/v2/service_instances/i1", `{
+			"service_id": "cloudsql-mysql-id",
+			"plan_id": "mysql-beta-id",
+			"parameters": {"tier": "db-n2-highmem", "disk_size": "100GB", "labels": {"team": 1}}
+		}`)
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(w.Body.String()).To(MatchJSON(`{
+			"error": "InvalidParameters",
+			"description": "Invalid parameters for plan beta of service google-cloudsql-mysql: parameters.instance_name is required; parameters.disk_size must be an integer; parameters.labels.team must be a string; parameters.tier must match the pattern ^db-(f1-micro|g1-small|n1-standard-[0-9]+)$"
+		}`))
+		Expect(requests).To(Equal([]string{"GET /v2/catalog"}))
+	})
+
+	It("reports required parameters when there are none", func() {
+		w := serve("PUT", "/v2/service_instances/i1", `{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`)
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(w.Body.String()).To(ContainSubstring("parameters.instance_name is required"))
+	})
+
+	It("checks binds against the binding schema", func() {
+		w := serve("PUT", "/v2/service_instances/i1/service_bindings/b1", `{"service_id": "storage-id", "plan_id": "storage-standard-id", "parameters": {"role": "owner"}}`)
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(w.Body.String()).To(ContainSubstring(`Invalid parameters for plan standard of service google-storage: parameters.role must be one of \"storage.objectAdmin\", \"storage.objectViewer\", \"storage.admin\"`))
+	})
+
+	It("checks updates against the plan they keep", func() {
+		w := serve("PATCH", "/v2/service_instances/i1", `{"service_id": "cloudsql-mysql-id", "parameters": {"disk_size": 5, "tier": "db-f1-micro"}, "previous_values": {"plan_id": "mysql-beta-id"}}`)
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(w.Body.String()).To(ContainSubstring("parameters.disk_size must be at least 10; parameters.tier is not allowed"))
+	})
+
+	It("forwards updates without parameters", func() {
+		Expect(serve("PATCH", "/v2/service_instances/i1", `{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id"}`).Code).To(Equal(http.StatusCreated))
+		Expect(requests).To(Equal([]string{"PATCH /v2/service_instances/i1"}))
+	})
+
+	It("forwards requests for plans without a schema", func() {
+		Expect(serve("PUT", "/v2/service_instances/i1", `{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-dev-id", "parameters": {"anything": true}}`).Code).To(Equal(http.StatusCreated))
+	})
+
+	It("forwards requests for unknown plans without reloading a catalog it just loaded", func() {
+		Expect(serve("PUT", "/v2/service_instances/i1", `{"service_id": "cloudsql-mysql-id", "plan_id": "new-plan-id"}`).Code).To(Equal(http.StatusCreated))
+		Expect(requests).To(Equal([]string{"GET /v2/catalog", "PUT /v2/service_instances/i1"}))
+	})
+
+	It("caches catalogs it passes on", func() {
+		Expect(serve("GET", "/v2/catalog", "").Body.String()).To(MatchJSON(catalogWithSchemas))
+
+		Expect(serve("PUT", "/v2/service_instances/i1", `{"service_id": "cloudsql-mysql-id", "plan_id": "mysql-beta-id", "parameters": {"instance_name": "orders"}}`).Code).To(Equal(http.StatusCreated))
+		Expect(requests).To(Equal([]string{"GET /v2/catalog", "PUT /v2/service_instances/i1"}))
+	})
+
+	Describe("Cache.ParameterSchema", func() {
+		It("compiles the schemas once when the catalog is stored", func() {
+			parsed, err := catalog.Parse([]byte(catalogWithSchemas))
+			Expect(err).NotTo(HaveOccurred())
+			cache.Store(parsed)
+
+			first, err := cache.ParameterSchema("cloudsql-mysql-id", "mysql-beta-id", osbapi.Provision)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(first).NotTo(BeNil())
+
+			second, err := cache.ParameterSchema("cloudsql-mysql-id", "mysql-beta-id", osbapi.Provision)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(second).To(BeIdenticalTo(first))
+
+			none, err := cache.ParameterSchema("cloudsql-mysql-id", "mysql-dev-id", osbapi.Provision)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(none).To(BeNil())
+			Expect(cache.InvalidSchemas()).To(BeZero())
+		})
+
+		It("counts invalid schemas and forwards their requests unchecked", func() {
+			parsed, err := catalog.Parse([]byte(`{"services": [{"id": "s1", "name": "service", "plans": [{
+				"id": "p1",
+				"name": "plan",
+				"schemas": {"service_instance": {"create": {"parameters": {"type": "object", "properties": {"name": {"pattern": "("}}}}}}
+			}]}]}`))
+			Expect(err).NotTo(HaveOccurred())
+			cache.Store(parsed)
+
+			Expect(cache.InvalidSchemas()).To(Equal(1))
+			_, err = cache.ParameterSchema("s1", "p1", osbapi.Provision)
+			Expect(err).To(MatchError(ContainSubstring("invalid pattern")))
+
+			Expect(serve("PUT", "/v2/service_instances/i1", `{"service_id": "s1", "plan_id": "p1", "parameters": {"name": 1}}`).Code).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Describe("Plan.ParameterSchema", func() {
+		It("returns nil for operations without parameters", func() {
+			parsed, err := catalog.Parse([]byte(catalogWithSchemas))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, plan, found := parsed.FindPlan("cloudsql-mysql-id", "mysql-beta-id")
+			Expect(found).To(BeTrue())
+
+			s, err := plan.ParameterSchema(osbapi.Deprovision)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s).To(BeNil())
+
+			s, err = plan.ParameterSchema(osbapi.Bind)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,253 @@
+package catalog
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Policy decides which services and plans of the broker's catalog are
+// exposed and how they are presented. Services are matched by name or ID;
+// plans by name, ID or "service-name/plan-name".
+type Policy struct {
+	Services         Rules                      `yaml:"services"`
+	Plans            Rules                      `yaml:"plans"`
+	ServiceOverrides map[string]ServiceOverride `yaml:"service_overrides"`
+	PlanOverrides    map[string]PlanOverride    `yaml:"plan_overrides"`
+}
+
+// Rules allow only the listed entries when Allow is not empty, and never
+// the entries listed in Deny.
+type Rules struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+type ServiceOverride struct {
+	DisplayName *string                `yaml:"display_name"`
+	Description *string                `yaml:"description"`
+	Tags        []string               `yaml:"tags"`
+	Metadata    map[string]interface{} `yaml:"metadata"`
+}
+
+type PlanOverride struct {
+	DisplayName *string                `yaml:"display_name"`
+	Description *string                `yaml:"description"`
+	Metadata    map[string]interface{} `yaml:"metadata"`
+	Bindable    *bool                  `yaml:"bindable"`
+	Free        *bool                  `yaml:"free"`
+}
+
+// ParsePolicy reads a policy from YAML, or JSON as a subset of it.
+func ParsePolicy(raw string) (Policy, error) {
+	var policy Policy
+	if err := yaml.UnmarshalStrict([]byte(raw), &policy); err != nil {
+		return Policy{}, err
+	}
+
+	for key, override := range policy.ServiceOverrides {
+		metadata, err := jsonCompatible(override.Metadata)
+		if err != nil {
+			return Policy{}, fmt.Errorf("service_overrides.%s.metadata: %s", key, err)
+		}
+		override.Metadata, _ = metadata.(map[string]interface{})
+		policy.ServiceOverrides[key] = override
+	}
+
+	for key, override := range policy.PlanOverrides {
+		metadata, err := jsonCompatible(override.Metadata)
+		if err != nil {
+			return Policy{}, fmt.Errorf("plan_overrides.%s.metadata: %s", key, err)
+		}
+		override.Metadata, _ = metadata.(map[string]interface{})
+		policy.PlanOverrides[key] = override
+	}
+
+	return policy, nil
+}
+
+// Allows reports whether the plan of the service may be used.
+func (p Policy) Allows(service Service, plan Plan) bool {
+	return p.Services.allows(service.ID, service.Name) &&
+		p.Plans.allows(plan.ID, plan.Name, service.Name+"/"+plan.Name)
+}
+
+// Apply returns the catalog with the disallowed services and plans removed
+// and the overrides applied. Services left without plans are removed too.
+func (p Policy) Apply(catalog Catalog) (Catalog, error) {
+	filtered := Catalog{Services: []Service{}}
+
+	for _, service := range catalog.Services {
+		var plans []Plan
+		for _, plan := range service.Plans {
+			if !p.Allows(service, plan) {
+				continue
+			}
+
+			if override, ok := p.planOverride(service, plan); ok {
+				if err := override.apply(&plan); err != nil {
+					return Catalog{}, err
+				}
+			}
+			plans = append(plans, plan)
+		}
+
+		if len(plans) == 0 {
+			continue
+		}
+		service.Plans = plans
+
+		if override, ok := p.serviceOverride(service); ok {
+			if err := override.apply(&service); err != nil {
+				return Catalog{}, err
+			}
+		}
+		filtered.Services = append(filtered.Services, service)
+	}
+
+	return filtered, nil
+}
+
+func (p Policy) serviceOverride(service Service) (ServiceOverride, bool) {
+	for _, key := range []string{service.ID, service.Name} {
+		if override, ok := p.ServiceOverrides[key]; ok {
+			return override, true
+		}
+	}
+	return ServiceOverride{}, false
+}
+
+func (p Policy) planOverride(service Service, plan Plan) (PlanOverride, bool) {
+	for _, key := range []string{plan.ID, service.Name + "/" + plan.Name, plan.Name} {
+		if override, ok := p.PlanOverrides[key]; ok {
+			return override, true
+		}
+	}
+	return PlanOverride{}, false
+}
+
+func (r Rules) allows(keys ...string) bool {
+	if len(r.Allow) != 0 && !containsAny(r.Allow, keys) {
+		return false
+	}
+	return !containsAny(r.Deny, keys)
+}
+
+func (o ServiceOverride) apply(service *Service) error {
+	if o.Description != nil {
+		if err := service.Set("description", *o.Description); err != nil {
+			return err
+		}
+	}
+	if o.Tags != nil {
+		if err := service.Set("tags", o.Tags); err != nil {
+			return err
+		}
+	}
+
+	metadata := map[string]interface{}{}
+	if _, err := service.Get("metadata", &metadata); err != nil {
+		return err
+	}
+	return applyMetadata(service, metadata, o.DisplayName, o.Metadata)
+}
+
+func (o PlanOverride) apply(plan *Plan) error {
+	if o.Description != nil {
+		if err := plan.Set("description", *o.Description); err != nil {
+			return err
+		}
+	}
+	if o.Bindable != nil {
+		if err := plan.Set("bindable", *o.Bindable); err != nil {
+			return err
+		}
+	}
+	if o.Free != nil {
+		if err := plan.Set("free", *o.Free); err != nil {
+			return err
+		}
+	}
+
+	metadata := map[string]interface{}{}
+	if _, err := plan.Get("metadata", &metadata); err != nil {
+		return err
+	}
+	return applyMetadata(plan, metadata, o.DisplayName, o.Metadata)
+}
+
+type setter interface {
+	Set(key string, v interface{}) error
+}
+
+func applyMetadata(target setter, metadata map[string]interface{}, displayName *string, overrides map[string]interface{}) error {
+	if displayName == nil && len(overrides) == 0 {
+		return nil
+	}
+
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	for key, value := range overrides {
+		metadata[key] = value
+	}
+	if displayName != nil {
+		metadata["displayName"] = *displayName
+	}
+
+	return target.Set("metadata", metadata)
+}
+
+func containsAny(list []string, keys []string) bool {
+	for _, entry := range list {
+		for _, key := range keys {
+			if entry == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonCompatible converts the map[interface{}]interface{} values produced by
+// the YAML decoder into maps that can be encoded as JSON.
+func jsonCompatible(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			result[keyString] = converted
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = converted
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = converted
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
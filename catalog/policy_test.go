@@ -0,0 +1,185 @@
+package catalog_test
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy", func() {
+	var (
+		c      catalog.Catalog
+		policy catalog.Policy
+	)
+
+	BeforeEach(func() {
+		var err error
+		c, err = catalog.Parse([]byte(googleCatalog))
+		Expect(err).NotTo(HaveOccurred())
+		policy = catalog.Policy{}
+	})
+
+	applied := func() string {
+		filtered, err := policy.Apply(c)
+		Expect(err).NotTo(HaveOccurred())
+
+		body, err := json.Marshal(filtered)
+		Expect(err).NotTo(HaveOccurred())
+		return string(body)
+	}
+
+	planIDs := func() []string {
+		filtered, err := policy.Apply(c)
+		Expect(err).NotTo(HaveOccurred())
+
+		ids := []string{}
+		for _, service := range filtered.Services {
+			for _, plan := range service.Plans {
+				ids = append(ids, plan.ID)
+			}
+		}
+		return ids
+	}
+
+	Context("when the policy is empty", func() {
+		It("leaves the catalog unchanged", func() {
+			Expect(applied()).To(MatchJSON(googleCatalog))
+		})
+	})
+
+	Context("when services are allowed by name", func() {
+		BeforeEach(func() {
+			policy.Services.Allow = []string{"google-pubsub"}
+		})
+
+		It("only keeps those services", func() {
+			Expect(planIDs()).To(Equal([]string{"pubsub-beta-id"}))
+		})
+	})
+
+	Context("when services are denied by ID", func() {
+		BeforeEach(func() {
+			policy.Services.Deny = []string{"pubsub-id"}
+		})
+
+		It("removes those services", func() {
+			Expect(planIDs()).To(Equal([]string{"mysql-beta-id", "mysql-dev-id"}))
+		})
+	})
+
+	Context("when plans are denied by name", func() {
+		BeforeEach(func() {
+			policy.Plans.Deny = []string{"beta"}
+		})
+
+		It("removes them from every service and drops services without plans", func() {
+			filtered, err := policy.Apply(c)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filtered.Services).To(HaveLen(1))
+			Expect(planIDs()).To(Equal([]string{"mysql-dev-id"}))
+		})
+	})
+
+	Context("when plans are allowed by service and plan name", func() {
+		BeforeEach(func() {
+			policy.Plans.Allow = []string{"google-cloudsql-mysql/beta", "pubsub-beta-id"}
+		})
+
+		It("only keeps those plans", func() {
+			Expect(planIDs()).To(Equal([]string{"mysql-beta-id", "pubsub-beta-id"}))
+		})
+	})
+
+	Context("when a plan is both allowed and denied", func() {
+		BeforeEach(func() {
+			policy.Plans.Allow = []string{"beta"}
+			policy.Plans.Deny = []string{"pubsub-beta-id"}
+		})
+
+		It("denies it", func() {
+			Expect(planIDs()).To(Equal([]string{"mysql-beta-id"}))
+		})
+	})
+
+	Describe("Allows", func() {
+		BeforeEach(func() {
+			policy.Services.Deny = []string{"google-pubsub"}
+		})
+
+		It("reports whether a plan may be used", func() {
+			mysql, beta, _ := c.FindPlan("cloudsql-mysql-id", "mysql-beta-id")
+			Expect(policy.Allows(mysql, beta)).To(BeTrue())
+
+			pubsub, pubsubBeta, _ := c.FindPlan("pubsub-id", "pubsub-beta-id")
+			Expect(policy.Allows(pubsub, pubsubBeta)).To(BeFalse())
+		})
+	})
+
+	Describe("overrides", func() {
+		BeforeEach(func() {
+			var err error
+			policy, err = catalog.ParsePolicy(`
+service_overrides:
+  google-cloudsql-mysql:
+    display_name: MySQL
+    description: Managed MySQL
+    tags: [sql]
+    metadata:
+      providerDisplayName: ACME
+plan_overrides:
+  google-cloudsql-mysql/dev:
+    display_name: Development
+    bindable: false
+    free: true
+    metadata:
+      bullets: [cheap]
+`)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rewrites the matching services and plans", func() {
+			filtered, err := policy.Apply(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			body, err := json.Marshal(filtered.Services[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(MatchJSON(`{
+				"id": "cloudsql-mysql-id",
+				"name": "google-cloudsql-mysql",
+				"description": "Managed MySQL",
+				"bindable": true,
+				"tags": ["sql"],
+				"metadata": {"displayName": "MySQL", "imageUrl": "https://example.com/mysql.png", "providerDisplayName": "ACME"},
+				"plans": [
+					{"id": "mysql-beta-id", "name": "beta", "description": "Beta plan", "free": false, "schemas": {"service_instance": {}}},
+					{"id": "mysql-dev-id", "name": "dev", "description": "Dev plan", "free": true, "bindable": false, "metadata": {"displayName": "Development", "bullets": ["cheap"]}}
+				]
+			}`))
+		})
+
+		It("does not modify the original catalog", func() {
+			_, err := policy.Apply(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			body, err := json.Marshal(c)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(MatchJSON(googleCatalog))
+		})
+	})
+
+	Describe("ParsePolicy", func() {
+		It("accepts JSON", func() {
+			policy, err := catalog.ParsePolicy(`{"services": {"allow": ["google-pubsub"]}}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policy.Services.Allow).To(Equal([]string{"google-pubsub"}))
+		})
+
+		It("rejects unknown keys", func() {
+			_, err := catalog.ParsePolicy(`{"servics": {}}`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,540 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/aggregator"
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/parameters"
+	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
+	"code.cloudfoundry.org/gcp-broker-proxy/quota"
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig"
+)
+
+// Config is the configuration of the proxy. It is read from an optional
+// YAML file, and every setting can be overridden by the environment
+// variable named in its env tag.
+type Config struct {
+	Port               string   `yaml:"port" env:"PORT"`
+	Username           string   `yaml:"username" env:"USERNAME"`
+	Password           string   `yaml:"password" env:"PASSWORD"`
+	BrokerURL          string   `yaml:"broker_url" env:"BROKER_URL"`
+	ServiceAccountJSON string   `yaml:"service_account_json" env:"SERVICE_ACCOUNT_JSON"`
+	Brokers            []Broker `yaml:"brokers" env:"BROKERS"`
+
+	// Credentials are accepted for broker requests in addition to USERNAME
+	// and PASSWORD.
+	Credentials []auth.Credential `yaml:"credentials" env:"BROKER_CREDENTIALS"`
+
+	// BasicAuth can be turned off when callers authenticate with client
+	// certificates or bearer tokens.
+	BasicAuth          bool                   `yaml:"basic_auth" env:"BASIC_AUTH"`
+	ClientCertificates []auth.CertificateRule `yaml:"client_certificates" env:"CLIENT_CERTIFICATES"`
+
+	CredentialsService CredentialsService `yaml:"credentials_service"`
+
+	// The routing state and inventory default to files in the working
+	// directory, which on Cloud Foundry is the container's disk and is lost
+	// when the app is restaged or moved. Point them at a mounted volume to
+	// keep them. Deleted inventory records are pruned after
+	// InventoryRetention, or never when it is zero.
+	RoutingStateFile   string   `yaml:"routing_state_file" env:"ROUTING_STATE_FILE"`
+	InventoryFile      string   `yaml:"inventory_file" env:"INVENTORY_FILE"`
+	InventoryRetention Duration `yaml:"inventory_retention" env:"INVENTORY_RETENTION"`
+
+	Bindings Bindings `yaml:"bindings"`
+	Token    Token    `yaml:"token"`
+	Catalog  Catalog  `yaml:"catalog"`
+
+	Validation Validation `yaml:"validation"`
+	Parameters Parameters `yaml:"parameters"`
+	Quotas     Document   `yaml:"quotas" env:"QUOTAS"`
+
+	Upstream Upstream `yaml:"upstream"`
+	Retries  Retries  `yaml:"retries"`
+	Breaker  Breaker  `yaml:"breaker"`
+	TLS      TLS      `yaml:"tls"`
+	JWT      JWT      `yaml:"jwt"`
+	Lockout  Lockout  `yaml:"lockout"`
+	Admin    Admin    `yaml:"admin"`
+	Metrics  Metrics  `yaml:"metrics"`
+	Logging  Logging  `yaml:"logging"`
+	Health   Health   `yaml:"health"`
+	Shutdown Shutdown `yaml:"shutdown"`
+
+	policy             *catalog.Policy
+	parameterPolicy    *parameters.Policy
+	parameterLabels    *parameters.Labels
+	quotaLimits        *quota.Limits
+	brokerCredentials  *auth.Credentials
+	adminCredentials   *auth.Credentials
+	metricsCredentials *auth.Credentials
+	certificateRules   *auth.CertificateRules
+	tokenVerifier      *auth.TokenVerifier
+	tlsOptions         []tlsconfig.Option
+	upstreamTransport  http.RoundTripper
+	retryConfig        proxy.RetryConfig
+	validatorOptions   []osbapi.ValidatorOption
+}
+
+// Broker is an upstream broker. Brokers configured through BROKER_URL and
+// SERVICE_ACCOUNT_JSON have no name.
+type Broker struct {
+	Name               string `yaml:"name"`
+	URL                string `yaml:"url"`
+	ServiceAccountJSON string `yaml:"service_account_json"`
+}
+
+type Bindings struct {
+	PollInterval Duration `yaml:"poll_interval" env:"BINDING_POLL_INTERVAL"`
+	Timeout      Duration `yaml:"timeout" env:"BINDING_TIMEOUT"`
+}
+
+type Token struct {
+	RefreshBefore Duration `yaml:"refresh_before" env:"TOKEN_REFRESH_BEFORE"`
+	FetchTimeout  Duration `yaml:"fetch_timeout" env:"TOKEN_FETCH_TIMEOUT"`
+}
+
+// Catalog configures the catalog. The cached catalog is reloaded once it is
+// older than TTL, and to find plans missing from it at most once per
+// RefreshInterval.
+type Catalog struct {
+	Policy          Document `yaml:"policy" env:"CATALOG_POLICY"`
+	Collisions      string   `yaml:"collisions" env:"CATALOG_COLLISIONS"`
+	TTL             Duration `yaml:"ttl" env:"CATALOG_TTL"`
+	RefreshInterval Duration `yaml:"refresh_interval" env:"CATALOG_REFRESH_INTERVAL"`
+}
+
+// Validation configures the checks of OSBAPI requests before they are
+// forwarded. They are off unless Enabled is set, since they reject requests
+// the broker may accept. AsyncRequired lists operations that must accept an
+// asynchronous response, and Parameters checks parameters against the plans'
+// schemas.
+type Validation struct {
+	Enabled       bool     `yaml:"enabled" env:"VALIDATE_REQUESTS"`
+	AsyncRequired []string `yaml:"async_required" env:"ASYNC_REQUIRED"`
+	Parameters    bool     `yaml:"parameters" env:"VALIDATE_PARAMETERS"`
+}
+
+// Parameters configures the rewriting of provision, update and bind
+// parameters before they are validated and forwarded. Labels configures the
+// GCP labels identifying the Cloud Foundry org and space added to
+// provisions.
+type Parameters struct {
+	Policy Document `yaml:"policy" env:"PARAMETER_POLICY"`
+	Labels Document `yaml:"labels" env:"PARAMETER_LABELS"`
+}
+
+// Upstream configures the connections to the brokers. Pool sizes of zero
+// mean what they do for http.Transport.
+type Upstream struct {
+	DialTimeout           Duration `yaml:"dial_timeout" env:"UPSTREAM_DIAL_TIMEOUT"`
+	TLSHandshakeTimeout   Duration `yaml:"tls_handshake_timeout" env:"UPSTREAM_TLS_HANDSHAKE_TIMEOUT"`
+	ResponseHeaderTimeout Duration `yaml:"response_header_timeout" env:"UPSTREAM_RESPONSE_HEADER_TIMEOUT"`
+	Timeout               Duration `yaml:"timeout" env:"UPSTREAM_TIMEOUT"`
+	MaxIdleConns          int      `yaml:"max_idle_conns" env:"UPSTREAM_MAX_IDLE_CONNS"`
+	MaxIdleConnsPerHost   int      `yaml:"max_idle_conns_per_host" env:"UPSTREAM_MAX_IDLE_CONNS_PER_HOST"`
+	IdleConnTimeout       Duration `yaml:"idle_conn_timeout" env:"UPSTREAM_IDLE_CONN_TIMEOUT"`
+	HTTP2                 bool     `yaml:"http2" env:"UPSTREAM_HTTP2"`
+	ProxyURL              string   `yaml:"proxy_url" env:"UPSTREAM_PROXY_URL"`
+	ProxyUsername         string   `yaml:"proxy_username" env:"UPSTREAM_PROXY_USERNAME"`
+	ProxyPassword         string   `yaml:"proxy_password" env:"UPSTREAM_PROXY_PASSWORD"`
+	CAFile                string   `yaml:"ca_file" env:"UPSTREAM_CA_FILE"`
+}
+
+// Retries configures the retries of idempotent broker requests. Budgets maps
+// operations, or "default" for every other one, to how often and for how
+// long their requests are retried.
+type Retries struct {
+	BaseDelay Duration               `yaml:"base_delay" env:"RETRY_BASE_DELAY"`
+	MaxDelay  Duration               `yaml:"max_delay" env:"RETRY_MAX_DELAY"`
+	Budgets   map[string]RetryBudget `yaml:"budgets" env:"RETRY_BUDGETS"`
+}
+
+type RetryBudget struct {
+	MaxRetries int      `yaml:"max_retries"`
+	MaxElapsed Duration `yaml:"max_elapsed"`
+}
+
+// Breaker configures the circuit breakers around each broker and its token
+// endpoint. A failure threshold of 0 turns them off.
+type Breaker struct {
+	FailureThreshold int      `yaml:"failure_threshold" env:"BREAKER_FAILURE_THRESHOLD"`
+	OpenTimeout      Duration `yaml:"open_timeout" env:"BREAKER_OPEN_TIMEOUT"`
+	HalfOpenRequests int      `yaml:"half_open_requests" env:"BREAKER_HALF_OPEN_REQUESTS"`
+}
+
+// TLS configures HTTPS. Enabled serves PORT over HTTPS, and Port adds a
+// second HTTPS listener, which is where client certificates are verified.
+type TLS struct {
+	Enabled        bool     `yaml:"enabled" env:"TLS_ENABLED"`
+	Port           string   `yaml:"port" env:"TLS_PORT"`
+	CertFile       string   `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile        string   `yaml:"key_file" env:"TLS_KEY_FILE"`
+	ClientCAFile   string   `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	MinVersion     string   `yaml:"min_version" env:"TLS_MIN_VERSION"`
+	CipherSuites   []string `yaml:"cipher_suites" env:"TLS_CIPHER_SUITES"`
+	ReloadInterval Duration `yaml:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+}
+
+// JWT configures bearer tokens, such as those the UAA issues. Scopes maps
+// OSBAPI operations, or "default" for every other request, to the scope a
+// token needs.
+type JWT struct {
+	JWKSURL             string            `yaml:"jwks_url" env:"JWT_JWKS_URL"`
+	Keys                KeySet            `yaml:"keys" env:"JWT_KEYS"`
+	KeysRefreshInterval Duration          `yaml:"keys_refresh_interval" env:"JWT_KEYS_REFRESH_INTERVAL"`
+	Issuer              string            `yaml:"issuer" env:"JWT_ISSUER"`
+	Audience            string            `yaml:"audience" env:"JWT_AUDIENCE"`
+	Scopes              map[string]string `yaml:"scopes" env:"JWT_SCOPES"`
+}
+
+type Lockout struct {
+	Threshold      int      `yaml:"threshold" env:"LOCKOUT_THRESHOLD"`
+	Backoff        Duration `yaml:"backoff" env:"LOCKOUT_BACKOFF"`
+	MaxBackoff     Duration `yaml:"max_backoff" env:"LOCKOUT_MAX_BACKOFF"`
+	Window         Duration `yaml:"window" env:"LOCKOUT_WINDOW"`
+	TrustedProxies int      `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+type Admin struct {
+	Username string `yaml:"username" env:"ADMIN_USERNAME"`
+	Password string `yaml:"password" env:"ADMIN_PASSWORD"`
+}
+
+type Metrics struct {
+	Port     string `yaml:"port" env:"METRICS_PORT"`
+	Username string `yaml:"username" env:"METRICS_USERNAME"`
+	Password string `yaml:"password" env:"METRICS_PASSWORD"`
+}
+
+type Logging struct {
+	Bodies bool `yaml:"bodies" env:"LOG_BODIES"`
+}
+
+type Health struct {
+	Interval      Duration `yaml:"interval" env:"HEALTH_CHECK_INTERVAL"`
+	DegradedStart bool     `yaml:"degraded_start" env:"DEGRADED_START"`
+}
+
+// Shutdown configures how long in-flight requests may take to finish after
+// SIGTERM. It must be at least the binding timeout, so that bindings being
+// polled are not cut off.
+type Shutdown struct {
+	Timeout Duration `yaml:"timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// Duration is a time.Duration written like "30s" or "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Document is a YAML document that can be given as a string, as it is in
+// environment variables, or as nested YAML in the config file.
+type Document string
+
+func (d *Document) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err == nil {
+		*d = Document(raw)
+		return nil
+	}
+
+	var nested interface{}
+	if err := unmarshal(&nested); err != nil {
+		return err
+	}
+
+	encoded, err := yaml.Marshal(nested)
+	if err != nil {
+		return err
+	}
+
+	*d = Document(encoded)
+	return nil
+}
+
+// KeySet is a JWKS document in JSON, as it is in environment variables, or
+// nested YAML in the config file. Key parameters are decoded as strings, so
+// that YAML does not read the RSA modulus "n" as false.
+type KeySet string
+
+func (k *KeySet) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err == nil {
+		*k = KeySet(raw)
+		return nil
+	}
+
+	var nested struct {
+		Keys []map[string]string `yaml:"keys" json:"keys"`
+	}
+	if err := unmarshal(&nested); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(nested)
+	if err != nil {
+		return err
+	}
+
+	*k = KeySet(encoded)
+	return nil
+}
+
+// Error lists every problem found in a configuration.
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+func defaults() Config {
+	return Config{
+		Port:               "8080",
+		BasicAuth:          true,
+		RoutingStateFile:   "routing-state.json",
+		InventoryFile:      "inventory.json",
+		InventoryRetention: Duration(7 * 24 * time.Hour),
+		Bindings: Bindings{
+			PollInterval: Duration(2 * time.Second),
+			Timeout:      Duration(50 * time.Second),
+		},
+		Token: Token{
+			RefreshBefore: Duration(5 * time.Minute),
+			FetchTimeout:  Duration(10 * time.Second),
+		},
+		Catalog: Catalog{
+			Collisions:      string(aggregator.KeepFirst),
+			TTL:             Duration(catalog.DefaultTTL),
+			RefreshInterval: Duration(catalog.DefaultRefreshInterval),
+		},
+		Validation: Validation{
+			Parameters: true,
+		},
+		Upstream: Upstream{
+			DialTimeout:           Duration(10 * time.Second),
+			TLSHandshakeTimeout:   Duration(10 * time.Second),
+			ResponseHeaderTimeout: Duration(55 * time.Second),
+			Timeout:               Duration(60 * time.Second),
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   10,
+			IdleConnTimeout:       Duration(90 * time.Second),
+			HTTP2:                 true,
+		},
+		Retries: Retries{
+			BaseDelay: Duration(200 * time.Millisecond),
+			MaxDelay:  Duration(5 * time.Second),
+		},
+		Breaker: Breaker{
+			FailureThreshold: 5,
+			OpenTimeout:      Duration(30 * time.Second),
+			HalfOpenRequests: 1,
+		},
+		TLS: TLS{
+			MinVersion:     "1.2",
+			ReloadInterval: Duration(10 * time.Second),
+		},
+		JWT: JWT{
+			KeysRefreshInterval: Duration(auth.DefaultKeysRefreshInterval),
+		},
+		Lockout: Lockout{
+			Threshold:  5,
+			Backoff:    Duration(time.Second),
+			MaxBackoff: Duration(15 * time.Minute),
+			Window:     Duration(15 * time.Minute),
+		},
+		Health: Health{
+			Interval: Duration(30 * time.Second),
+		},
+		Shutdown: Shutdown{
+			Timeout: Duration(60 * time.Second),
+		},
+	}
+}
+
+// Load reads the config file at path, if any, applies the environment on
+// top of it, then the credentials of the service instance selected in
+// VCAP_SERVICES, and validates the result. The returned error is an *Error
+// listing every problem.
+func Load(path string, getenv func(string) string) (Config, error) {
+	config := defaults()
+
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, &Error{Problems: []string{fmt.Sprintf("Failed to read config file: %s", err)}}
+		}
+
+		if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+			return Config{}, &Error{Problems: []string{fmt.Sprintf("Invalid config file %s: %s", path, err)}}
+		}
+	}
+
+	problems := applyEnv(&config, getenv)
+	problems = append(problems, applyVCAP(&config, getenv("VCAP_SERVICES"))...)
+	problems = append(problems, config.validate()...)
+
+	if len(problems) != 0 {
+		return config, &Error{Problems: problems}
+	}
+	return config, nil
+}
+
+// BrokerList returns the configured brokers, which is the broker given by
+// BROKER_URL and SERVICE_ACCOUNT_JSON unless BROKERS is set.
+func (c Config) BrokerList() []Broker {
+	if len(c.Brokers) != 0 {
+		return c.Brokers
+	}
+	return []Broker{{URL: c.BrokerURL, ServiceAccountJSON: c.ServiceAccountJSON}}
+}
+
+// Policy returns the catalog policy, or nil when there is none.
+func (c Config) Policy() *catalog.Policy {
+	return c.policy
+}
+
+// ParameterPolicy returns the parameter policy, or nil when there is none.
+func (c Config) ParameterPolicy() *parameters.Policy {
+	return c.parameterPolicy
+}
+
+// ParameterLabels returns the configuration of the labels added to
+// provisions, or nil when none are added.
+func (c Config) ParameterLabels() *parameters.Labels {
+	return c.parameterLabels
+}
+
+// QuotaLimits returns the limits on instances and bindings, or nil when
+// there are none.
+func (c Config) QuotaLimits() *quota.Limits {
+	return c.quotaLimits
+}
+
+// BrokerCredentials returns the credentials accepted for broker requests.
+func (c Config) BrokerCredentials() *auth.Credentials {
+	return c.brokerCredentials
+}
+
+// CertificateRules returns the rules for client certificates, or nil when
+// client certificates are not accepted.
+func (c Config) CertificateRules() *auth.CertificateRules {
+	return c.certificateRules
+}
+
+// TokenVerifier returns the verifier of bearer tokens, or nil when bearer
+// tokens are not accepted.
+func (c Config) TokenVerifier() *auth.TokenVerifier {
+	return c.tokenVerifier
+}
+
+// TLSFiles returns the files of the TLS listener.
+func (c Config) TLSFiles() tlsconfig.Files {
+	return tlsconfig.Files{
+		CertFile:     c.TLS.CertFile,
+		KeyFile:      c.TLS.KeyFile,
+		ClientCAFile: c.TLS.ClientCAFile,
+	}
+}
+
+// TLSOptions returns the TLS version and cipher suites to serve HTTPS with.
+func (c Config) TLSOptions() []tlsconfig.Option {
+	return c.tlsOptions
+}
+
+// ValidatorOptions returns the options of the OSBAPI request validator.
+func (c Config) ValidatorOptions() []osbapi.ValidatorOption {
+	return c.validatorOptions
+}
+
+// UpstreamTransport returns the transport shared by every request to the
+// brokers.
+func (c Config) UpstreamTransport() http.RoundTripper {
+	return c.upstreamTransport
+}
+
+// RetryConfig returns the retries of broker requests.
+func (c Config) RetryConfig() proxy.RetryConfig {
+	return c.retryConfig
+}
+
+// BreakerConfig returns the configuration of the circuit breakers.
+func (c Config) BreakerConfig() breaker.Config {
+	return breaker.Config{
+		FailureThreshold: c.Breaker.FailureThreshold,
+		OpenTimeout:      time.Duration(c.Breaker.OpenTimeout),
+		HalfOpenRequests: c.Breaker.HalfOpenRequests,
+	}
+}
+
+// AdminCredentials default to the broker credentials.
+func (c Config) AdminCredentials() *auth.Credentials {
+	if c.adminCredentials == nil {
+		return c.brokerCredentials
+	}
+	return c.adminCredentials
+}
+
+// MetricsCredentials default to the admin credentials.
+func (c Config) MetricsCredentials() *auth.Credentials {
+	if c.metricsCredentials != nil {
+		return c.metricsCredentials
+	}
+	return c.AdminCredentials()
+}
+
+// MetricsAuthenticated reports whether metrics need authentication. Metrics
+// on their own port need none unless credentials are configured.
+func (c Config) MetricsAuthenticated() bool {
+	return c.Metrics.Port == "" || c.metricsCredentials != nil
+}
+
+// LockoutConfig returns the configuration of the tracking of failed
+// authentication attempts.
+func (c Config) LockoutConfig() auth.LockoutConfig {
+	return auth.LockoutConfig{
+		Threshold:      c.Lockout.Threshold,
+		Backoff:        time.Duration(c.Lockout.Backoff),
+		MaxBackoff:     time.Duration(c.Lockout.MaxBackoff),
+		Window:         time.Duration(c.Lockout.Window),
+		TrustedProxies: c.Lockout.TrustedProxies,
+	}
+}
+
+// Setting names the environment variable or BROKERS key a value came from.
+func (b Broker) Setting(env, key string) string {
+	if b.Name == "" {
+		return env
+	}
+	return fmt.Sprintf("BROKERS[%s].%s", b.Name, key)
+}
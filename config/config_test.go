@@ -0,0 +1,824 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/aggregator"
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/auth/authtest"
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+	"code.cloudfoundry.org/gcp-broker-proxy/config"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig/tlsconfigtest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const serviceAccountJSON = `{"type": "service_account", "client_email": "proxy@example.com", "private_key": "key", "token_uri": "https://example.com/token"}`
+
+var _ = Describe("Config", func() {
+	var (
+		dir  string
+		path string
+		env  map[string]string
+	)
+
+	getenv := func(key string) string {
+		return env[key]
+	}
+
+	writeFile := func(content string) {
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+	}
+
+	problems := func(err error) []string {
+		Expect(err).To(BeAssignableToTypeOf(&config.Error{}))
+		return err.(*config.Error).Problems
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "config.yml")
+
+		env = map[string]string{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("with only environment variables", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+			}
+		})
+
+		It("applies the defaults", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Port).To(Equal("8080"))
+			Expect(c.InventoryFile).To(Equal("inventory.json"))
+			Expect(c.RoutingStateFile).To(Equal("routing-state.json"))
+			Expect(c.InventoryRetention).To(Equal(config.Duration(7 * 24 * time.Hour)))
+			Expect(c.Bindings.PollInterval).To(Equal(config.Duration(2 * time.Second)))
+			Expect(c.Bindings.Timeout).To(Equal(config.Duration(50 * time.Second)))
+			Expect(c.Token.RefreshBefore).To(Equal(config.Duration(5 * time.Minute)))
+			Expect(c.Token.FetchTimeout).To(Equal(config.Duration(10 * time.Second)))
+			Expect(c.Health.Interval).To(Equal(config.Duration(30 * time.Second)))
+			Expect(c.Shutdown.Timeout).To(Equal(config.Duration(60 * time.Second)))
+			Expect(c.Upstream.Timeout).To(Equal(config.Duration(60 * time.Second)))
+			Expect(c.Upstream.HTTP2).To(BeTrue())
+			Expect(c.UpstreamTransport()).NotTo(BeNil())
+			Expect(c.BreakerConfig()).To(Equal(breaker.Config{
+				FailureThreshold: 5,
+				OpenTimeout:      30 * time.Second,
+				HalfOpenRequests: 1,
+			}))
+			Expect(c.RetryConfig()).To(Equal(proxy.RetryConfig{
+				BaseDelay:     200 * time.Millisecond,
+				MaxDelay:      5 * time.Second,
+				Budgets:       map[osbapi.Operation]proxy.RetryBudget{},
+				DefaultBudget: proxy.RetryBudget{MaxRetries: 3, MaxElapsed: 20 * time.Second},
+			}))
+			Expect(c.Catalog.Collisions).To(Equal(string(aggregator.KeepFirst)))
+			Expect(c.Catalog.TTL).To(Equal(config.Duration(5 * time.Minute)))
+			Expect(c.Catalog.RefreshInterval).To(Equal(config.Duration(10 * time.Second)))
+			Expect(c.Policy()).To(BeNil())
+			Expect(c.Validation.Enabled).To(BeFalse())
+			Expect(c.Validation.Parameters).To(BeTrue())
+			Expect(c.ValidatorOptions()).To(BeEmpty())
+			Expect(c.LockoutConfig()).To(Equal(auth.LockoutConfig{
+				Threshold:  5,
+				Backoff:    time.Second,
+				MaxBackoff: 15 * time.Minute,
+				Window:     15 * time.Minute,
+			}))
+		})
+
+		It("returns the single broker", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.BrokerList()).To(Equal([]config.Broker{{
+				URL:                "https://broker.example.com",
+				ServiceAccountJSON: serviceAccountJSON,
+			}}))
+		})
+
+		It("parses durations, booleans and brokers", func() {
+			env["BINDING_TIMEOUT"] = "1m"
+			env["LOG_BODIES"] = "true"
+			env["LOCKOUT_THRESHOLD"] = "0"
+			env["BROKERS"] = `[{"name": "a", "url": "https://a.example.com", "service_account_json": "` + `{\"type\": \"service_account\"}` + `"}]`
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Bindings.Timeout).To(Equal(config.Duration(time.Minute)))
+			Expect(c.Logging.Bodies).To(BeTrue())
+			Expect(c.Lockout.Threshold).To(BeZero())
+			Expect(c.BrokerList()).To(HaveLen(1))
+			Expect(c.BrokerList()[0].Name).To(Equal("a"))
+		})
+
+		It("reports values that cannot be parsed", func() {
+			env["BINDING_TIMEOUT"] = "soon"
+			env["LOG_BODIES"] = "sometimes"
+			env["LOCKOUT_THRESHOLD"] = "many"
+			env["TRUSTED_PROXIES"] = "-1"
+			env["INVENTORY_RETENTION"] = "-1h"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(ConsistOf(
+				"BINDING_TIMEOUT must be a positive duration: soon",
+				"LOG_BODIES must be true or false: sometimes",
+				"LOCKOUT_THRESHOLD must be a number: many",
+				"TRUSTED_PROXIES must not be negative: -1",
+				"INVENTORY_RETENTION must not be negative: -1h0m0s",
+			))
+		})
+
+		It("rejects a shutdown timeout shorter than the binding timeout", func() {
+			env["BINDING_TIMEOUT"] = "50s"
+			env["SHUTDOWN_TIMEOUT"] = "8s"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(ConsistOf(
+				"SHUTDOWN_TIMEOUT must be at least BINDING_TIMEOUT (50s): 8s",
+			))
+		})
+	})
+
+	Context("with a config file", func() {
+		BeforeEach(func() {
+			writeFile(`
+port: "9000"
+username: user
+password: pass
+broker_url: https://broker.example.com
+service_account_json: '` + serviceAccountJSON + `'
+bindings:
+  timeout: 10s
+catalog:
+  policy:
+    plans:
+      deny: [beta]
+admin:
+  username: admin
+  password: secret
+health:
+  degraded_start: true
+`)
+		})
+
+		It("reads the settings", func() {
+			c, err := config.Load(path, getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Port).To(Equal("9000"))
+			Expect(c.Bindings.Timeout).To(Equal(config.Duration(10 * time.Second)))
+			Expect(c.Bindings.PollInterval).To(Equal(config.Duration(2 * time.Second)))
+			Expect(c.Health.DegradedStart).To(BeTrue())
+			Expect(c.Policy()).NotTo(BeNil())
+			Expect(c.Policy().Plans.Deny).To(Equal([]string{"beta"}))
+		})
+
+		It("lets the environment override individual keys", func() {
+			env["PORT"] = "9001"
+			env["ADMIN_PASSWORD"] = "other"
+
+			c, err := config.Load(path, getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Port).To(Equal("9001"))
+			Expect(c.Username).To(Equal("user"))
+			Expect(c.Admin).To(Equal(config.Admin{Username: "admin", Password: "other"}))
+		})
+
+		It("accepts the catalog policy as a string", func() {
+			env["CATALOG_POLICY"] = "services: {allow: [google-pubsub]}"
+
+			c, err := config.Load(path, getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Policy().Services.Allow).To(Equal([]string{"google-pubsub"}))
+		})
+
+		It("rejects unknown keys", func() {
+			writeFile("usernme: user\n")
+
+			_, err := config.Load(path, getenv)
+			Expect(problems(err)).To(ConsistOf(ContainSubstring("field usernme not found")))
+		})
+
+		It("reports a missing file", func() {
+			_, err := config.Load(filepath.Join(dir, "missing.yml"), getenv)
+			Expect(problems(err)).To(ConsistOf(HavePrefix("Failed to read config file")))
+		})
+	})
+
+	Describe("validation", func() {
+		It("reports every problem at once", func() {
+			writeFile(`
+port: "http"
+broker_url: notaurl
+service_account_json: '{}'
+bindings:
+  poll_interval: 0s
+catalog:
+  collisions: merge
+  policy: "unknown: key"
+  ttl: 0s
+admin:
+  username: admin
+`)
+
+			_, err := config.Load(path, getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Missing USERNAME, PASSWORD environment variable(s)",
+				"BROKER_URL must be a valid URL: notaurl",
+				"Invalid SERVICE_ACCOUNT_JSON: google: read JWT from JSON credentials: 'type' field is \"\" (expected \"service_account\")",
+				"PORT must be a port number: http",
+				"BINDING_POLL_INTERVAL must be a positive duration: 0s",
+				"CATALOG_TTL must be a positive duration: 0s",
+				"CATALOG_COLLISIONS must be first or reject: merge",
+				"Invalid CATALOG_POLICY: yaml: unmarshal errors:\n  line 1: field unknown not found in type catalog.Policy",
+				"ADMIN_USERNAME and ADMIN_PASSWORD must be set together",
+			}))
+			Expect(err).To(MatchError(ContainSubstring("; BROKER_URL must be a valid URL: notaurl; ")))
+		})
+
+		It("names every missing setting", func() {
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Missing USERNAME, PASSWORD, BROKER_URL, SERVICE_ACCOUNT_JSON environment variable(s)",
+			}))
+		})
+
+		It("reports every broker problem", func() {
+			env["USERNAME"] = "user"
+			env["PASSWORD"] = "pass"
+			env["BROKERS"] = `[{"name": "a", "url": "notaurl"}, {"url": "https://b.example.com"}]`
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Invalid BROKERS: broker a is missing a service_account_json",
+				"Invalid BROKERS: broker 1 is missing a name",
+				"BROKERS[a].url must be a valid URL: notaurl",
+			}))
+		})
+	})
+
+	Describe("credentials", func() {
+		accepts := func(credentials *auth.Credentials, username, password string) bool {
+			_, err := credentials.Authenticate(username, password)
+			return err == nil
+		}
+
+		BeforeEach(func() {
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+			}
+		})
+
+		It("defaults the admin and metrics credentials to the broker credentials", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(accepts(c.BrokerCredentials(), "user", "pass")).To(BeTrue())
+			Expect(accepts(c.AdminCredentials(), "user", "pass")).To(BeTrue())
+			Expect(accepts(c.MetricsCredentials(), "user", "pass")).To(BeTrue())
+		})
+
+		It("needs no metrics credentials on a separate port", func() {
+			env["METRICS_PORT"] = "9090"
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.MetricsAuthenticated()).To(BeFalse())
+		})
+
+		It("uses the admin and metrics credentials when set", func() {
+			env["ADMIN_USERNAME"] = "admin"
+			env["ADMIN_PASSWORD"] = "secret"
+			env["METRICS_PORT"] = "9090"
+			env["METRICS_USERNAME"] = "prom"
+			env["METRICS_PASSWORD"] = "scrape"
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(accepts(c.AdminCredentials(), "admin", "secret")).To(BeTrue())
+			Expect(accepts(c.AdminCredentials(), "user", "pass")).To(BeFalse())
+			Expect(accepts(c.MetricsCredentials(), "prom", "scrape")).To(BeTrue())
+			Expect(c.MetricsAuthenticated()).To(BeTrue())
+		})
+
+		It("accepts a list of credentials instead of USERNAME and PASSWORD", func() {
+			delete(env, "USERNAME")
+			delete(env, "PASSWORD")
+			env["BROKER_CREDENTIALS"] = `
+- label: old
+  username: broker
+  password: old-secret
+  expires: 2026-01-01T00:00:00Z
+- label: new
+  username: broker
+  password_hash: $scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$WKsC9ZI0iGLMMz/KHfEcD2EOm8ToKPyPG/5qc3GwrzY
+`
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Credentials[0].Expires).To(Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)))
+			Expect(accepts(c.BrokerCredentials(), "broker", "new-secret")).To(BeTrue())
+		})
+
+		It("reports invalid credentials", func() {
+			env["BROKER_CREDENTIALS"] = `[{"label": "a", "username": "broker", "password_hash": "secret"}]`
+			env["ADMIN_USERNAME"] = "admin"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Invalid BROKER_CREDENTIALS: credential a has an invalid password_hash: password hash must look like $scrypt$ln=15,r=8,p=1$<salt>$<hash> or be a bcrypt hash",
+				"ADMIN_USERNAME and ADMIN_PASSWORD must be set together",
+			}))
+		})
+	})
+
+	Describe("client certificates", func() {
+		BeforeEach(func() {
+			ca, err := tlsconfigtest.NewCA("test-ca")
+			Expect(err).NotTo(HaveOccurred())
+			certificate, err := ca.Issue(tlsconfigtest.Options{CommonName: "proxy"})
+			Expect(err).NotTo(HaveOccurred())
+
+			certFile, keyFile, err := certificate.WriteFiles(dir)
+			Expect(err).NotTo(HaveOccurred())
+			caFile := filepath.Join(dir, "ca.pem")
+			Expect(ioutil.WriteFile(caFile, ca.PEM, 0600)).To(Succeed())
+
+			env = map[string]string{
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+				"BASIC_AUTH":           "false",
+				"CLIENT_CERTIFICATES":  `[{"subject": "CN=cloud_controller"}]`,
+				"TLS_PORT":             "8443",
+				"TLS_CERT_FILE":        certFile,
+				"TLS_KEY_FILE":         keyFile,
+				"TLS_CLIENT_CA_FILE":   caFile,
+			}
+		})
+
+		It("can replace basic auth", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.BrokerCredentials()).To(BeNil())
+			Expect(c.CertificateRules()).NotTo(BeNil())
+			Expect(c.TLSFiles().ClientCAFile).To(Equal(filepath.Join(dir, "ca.pem")))
+		})
+
+		It("requires the TLS listener and client CAs", func() {
+			delete(env, "TLS_PORT")
+			delete(env, "TLS_CLIENT_CA_FILE")
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{"CLIENT_CERTIFICATES require TLS_PORT and TLS_CLIENT_CA_FILE"}))
+		})
+
+		It("requires a certificate for the TLS listener", func() {
+			delete(env, "TLS_KEY_FILE")
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{"TLS_CERT_FILE and TLS_KEY_FILE are required with TLS_ENABLED or TLS_PORT"}))
+		})
+
+		It("checks the certificate files", func() {
+			env["TLS_CLIENT_CA_FILE"] = filepath.Join(dir, "missing.pem")
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(ConsistOf(HavePrefix("Invalid TLS configuration: failed to load the client CAs: ")))
+		})
+
+		It("requires client certificates without basic auth", func() {
+			delete(env, "CLIENT_CERTIFICATES")
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{"BASIC_AUTH=false requires CLIENT_CERTIFICATES or JWT_JWKS_URL or JWT_KEYS"}))
+		})
+	})
+
+	Describe("bearer tokens", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+				"BASIC_AUTH":           "false",
+				"JWT_JWKS_URL":         "https://uaa.example.com/token_keys",
+				"JWT_ISSUER":           "https://uaa.example.com/oauth/token",
+				"JWT_AUDIENCE":         "gcp-broker-proxy",
+				"JWT_SCOPES":           `{"catalog": "gcp-broker-proxy.read", "default": "gcp-broker-proxy.admin"}`,
+			}
+		})
+
+		It("can replace basic auth", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.BrokerCredentials()).To(BeNil())
+			Expect(c.TokenVerifier()).NotTo(BeNil())
+			scope, _ := c.TokenVerifier().RequiredScope(osbapi.Catalog)
+			Expect(scope).To(Equal("gcp-broker-proxy.read"))
+			scope, _ = c.TokenVerifier().RequiredScope(osbapi.Bind)
+			Expect(scope).To(Equal("gcp-broker-proxy.admin"))
+		})
+
+		It("accepts a static key set from the config file", func() {
+			signer, err := authtest.NewSigner("key-1")
+			Expect(err).NotTo(HaveOccurred())
+			jwk := signer.JWK()
+
+			delete(env, "JWT_JWKS_URL")
+			writeFile(`
+jwt:
+  keys:
+    keys:
+    - kty: RSA
+      kid: key-1
+      n: ` + jwk["n"] + `
+      e: ` + jwk["e"] + `
+`)
+
+			c, err := config.Load(path, getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.TokenVerifier()).NotTo(BeNil())
+		})
+
+		It("requires an issuer, audience and scopes", func() {
+			delete(env, "JWT_ISSUER")
+			delete(env, "JWT_SCOPES")
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"JWT_ISSUER and JWT_AUDIENCE are required with JWT_JWKS_URL or JWT_KEYS",
+				"JWT_SCOPES must map operations or default to the scope they require",
+				"BASIC_AUTH=false requires CLIENT_CERTIFICATES or JWT_JWKS_URL or JWT_KEYS",
+			}))
+		})
+
+		It("rejects unknown operations", func() {
+			env["JWT_SCOPES"] = `{"provisioning": "gcp-broker-proxy.write"}`
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(ContainElement(`Invalid JWT_SCOPES: unknown operation "provisioning"`))
+		})
+
+		It("rejects invalid key sets", func() {
+			delete(env, "JWT_JWKS_URL")
+			env["JWT_KEYS"] = `{"keys": []}`
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(ContainElement("Invalid JWT_KEYS: the key set has no RSA or EC signing keys"))
+		})
+
+		It("rejects both a JWKS URL and static keys", func() {
+			env["JWT_KEYS"] = `{"keys": []}`
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(ContainElement("JWT_JWKS_URL and JWT_KEYS cannot both be set"))
+		})
+
+		It("requires keys for the other settings", func() {
+			delete(env, "JWT_JWKS_URL")
+			env["BASIC_AUTH"] = "true"
+			env["USERNAME"] = "user"
+			env["PASSWORD"] = "pass"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{"JWT_ISSUER, JWT_AUDIENCE and JWT_SCOPES require JWT_JWKS_URL or JWT_KEYS"}))
+		})
+	})
+
+	Describe("HTTPS", func() {
+		BeforeEach(func() {
+			ca, err := tlsconfigtest.NewCA("test-ca")
+			Expect(err).NotTo(HaveOccurred())
+			certificate, err := ca.Issue(tlsconfigtest.Options{CommonName: "proxy"})
+			Expect(err).NotTo(HaveOccurred())
+
+			certFile, keyFile, err := certificate.WriteFiles(dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+				"TLS_ENABLED":          "true",
+				"TLS_CERT_FILE":        certFile,
+				"TLS_KEY_FILE":         keyFile,
+				"TLS_MIN_VERSION":      "1.3",
+				"TLS_CIPHER_SUITES":    "[TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256]",
+			}
+		})
+
+		It("serves PORT over HTTPS with the version and cipher suites", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.TLS.Enabled).To(BeTrue())
+			Expect(c.TLS.CipherSuites).To(HaveLen(2))
+			Expect(c.TLSOptions()).To(HaveLen(2))
+		})
+
+		It("requires a certificate", func() {
+			delete(env, "TLS_CERT_FILE")
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{"TLS_CERT_FILE and TLS_KEY_FILE are required with TLS_ENABLED or TLS_PORT"}))
+		})
+
+		It("rejects old versions and insecure cipher suites", func() {
+			env["TLS_MIN_VERSION"] = "1.1"
+			env["TLS_CIPHER_SUITES"] = "[TLS_RSA_WITH_RC4_128_SHA]"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				`Invalid TLS_MIN_VERSION: unsupported TLS version "1.1", use 1.2 or 1.3`,
+				`Invalid TLS_CIPHER_SUITES: unsupported or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`,
+			}))
+		})
+	})
+
+	Describe("upstream", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+				"UPSTREAM_TIMEOUT":     "2m",
+				"UPSTREAM_HTTP2":       "false",
+				"UPSTREAM_PROXY_URL":   "http://proxy.example.com:3128",
+			}
+		})
+
+		It("reads the transport settings", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Upstream.Timeout).To(Equal(config.Duration(2 * time.Minute)))
+			Expect(c.Upstream.HTTP2).To(BeFalse())
+			Expect(c.UpstreamTransport()).NotTo(BeNil())
+		})
+
+		It("rejects invalid timeouts and pool sizes", func() {
+			env["UPSTREAM_DIAL_TIMEOUT"] = "0s"
+			env["UPSTREAM_MAX_IDLE_CONNS"] = "-1"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"UPSTREAM_DIAL_TIMEOUT must be a positive duration: 0s",
+				"UPSTREAM_MAX_IDLE_CONNS must not be negative: -1",
+			}))
+		})
+
+		It("rejects invalid proxies and CA files", func() {
+			env["UPSTREAM_PROXY_PASSWORD"] = "secret"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{"Invalid upstream configuration: a proxy password requires a proxy username"}))
+
+			delete(env, "UPSTREAM_PROXY_PASSWORD")
+			env["UPSTREAM_CA_FILE"] = filepath.Join(dir, "missing.pem")
+
+			_, err = config.Load("", getenv)
+			Expect(problems(err)).To(ConsistOf(ContainSubstring("Invalid upstream configuration: failed to read the CA file")))
+		})
+	})
+
+	Describe("retries", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+				"RETRY_BUDGETS":        "{default: {max_retries: 1, max_elapsed: 5s}, catalog: {max_retries: 5, max_elapsed: 30s}, update: {max_retries: 0}}",
+			}
+		})
+
+		It("reads the budgets of operations", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.RetryConfig().DefaultBudget).To(Equal(proxy.RetryBudget{MaxRetries: 1, MaxElapsed: 5 * time.Second}))
+			Expect(c.RetryConfig().Budgets).To(Equal(map[osbapi.Operation]proxy.RetryBudget{
+				osbapi.Catalog: {MaxRetries: 5, MaxElapsed: 30 * time.Second},
+				osbapi.Update:  {},
+			}))
+		})
+
+		It("refuses to retry operations that are not idempotent", func() {
+			env["RETRY_BUDGETS"] = "{deprovision: {max_retries: 2, max_elapsed: 10s}, provisioning: {max_retries: 1, max_elapsed: 1s}, bind: {max_retries: 2}}"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Invalid RETRY_BUDGETS: max_elapsed of bind must be a positive duration: 0s",
+				"Invalid RETRY_BUDGETS: deprovision is not idempotent and cannot be retried",
+				`Invalid RETRY_BUDGETS: unknown operation "provisioning"`,
+			}))
+		})
+
+		It("refuses budgets that outlast the platform's timeout", func() {
+			env["RETRY_BUDGETS"] = "{catalog: {max_retries: 1, max_elapsed: 90s}}"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Invalid RETRY_BUDGETS: max_elapsed of catalog must be shorter than the platform's 1m0s timeout: 1m30s",
+			}))
+		})
+	})
+
+	Describe("circuit breakers", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+			}
+		})
+
+		It("can be turned off", func() {
+			env["BREAKER_FAILURE_THRESHOLD"] = "0"
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.BreakerConfig().FailureThreshold).To(BeZero())
+		})
+
+		It("rejects invalid settings", func() {
+			env["BREAKER_OPEN_TIMEOUT"] = "0s"
+			env["BREAKER_HALF_OPEN_REQUESTS"] = "0"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"BREAKER_OPEN_TIMEOUT must be a positive duration: 0s",
+				"BREAKER_HALF_OPEN_REQUESTS must be at least 1: 0",
+			}))
+		})
+	})
+
+	Describe("request validation", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+			}
+		})
+
+		It("reads the operations that must be asynchronous", func() {
+			env["VALIDATE_REQUESTS"] = "true"
+			env["ASYNC_REQUIRED"] = "[provision, deprovision]"
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Validation.AsyncRequired).To(Equal([]string{"provision", "deprovision"}))
+			Expect(c.ValidatorOptions()).To(HaveLen(1))
+		})
+
+		It("rejects operations that cannot be asynchronous", func() {
+			env["VALIDATE_REQUESTS"] = "true"
+			env["ASYNC_REQUIRED"] = "[provision, catalog]"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Invalid ASYNC_REQUIRED: catalog cannot be performed asynchronously",
+			}))
+		})
+
+		It("requires request validation for asynchronous operations", func() {
+			env["ASYNC_REQUIRED"] = "[provision]"
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"ASYNC_REQUIRED requires VALIDATE_REQUESTS=true",
+			}))
+		})
+
+		It("can be turned on and off", func() {
+			env["VALIDATE_REQUESTS"] = "true"
+			env["VALIDATE_PARAMETERS"] = "false"
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Validation.Enabled).To(BeTrue())
+			Expect(c.Validation.Parameters).To(BeFalse())
+		})
+	})
+
+	Describe("parameters", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+			}
+		})
+
+		It("has none by default", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.ParameterPolicy()).To(BeNil())
+			Expect(c.ParameterLabels()).To(BeNil())
+		})
+
+		It("reads the policy from PARAMETER_POLICY", func() {
+			env["PARAMETER_POLICY"] = `{"rules": [{"services": [google-cloudsql-mysql], "forbidden": [binlog]}]}`
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.ParameterPolicy().Rules).To(HaveLen(1))
+			Expect(c.ParameterPolicy().Rules[0].Forbidden).To(Equal([]string{"binlog"}))
+		})
+
+		It("rejects invalid policies", func() {
+			env["PARAMETER_POLICY"] = `{"rules": [{"operations": [unbind]}]}`
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Invalid PARAMETER_POLICY: rules[0].operations: unbind has no parameters",
+			}))
+		})
+
+		It("reads the labels from PARAMETER_LABELS", func() {
+			env["PARAMETER_LABELS"] = `{"services": {"google-storage": labels}, "keys": {"org": organization_guid}}`
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.ParameterLabels().Services).To(Equal(map[string]string{"google-storage": "labels"}))
+			Expect(c.ParameterLabels().Keys).To(Equal(map[string]string{"org": "organization_guid"}))
+		})
+
+		It("rejects invalid labels", func() {
+			env["PARAMETER_LABELS"] = `{"keys": {"Org": organization_guid}}`
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(ConsistOf(HavePrefix(`Invalid PARAMETER_LABELS: keys: "Org" is not a valid label key`)))
+		})
+	})
+
+	Describe("quotas", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"USERNAME":             "user",
+				"PASSWORD":             "pass",
+				"BROKER_URL":           "https://broker.example.com",
+				"SERVICE_ACCOUNT_JSON": serviceAccountJSON,
+			}
+		})
+
+		It("has no limits by default", func() {
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.QuotaLimits()).To(BeNil())
+		})
+
+		It("reads the limits from QUOTAS", func() {
+			env["QUOTAS"] = `{"instances_per_space": 5, "bindings_per_instance": 3}`
+
+			c, err := config.Load("", getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.QuotaLimits().InstancesPerSpace.Default).To(Equal(5))
+			Expect(c.QuotaLimits().BindingsPerInstance).To(Equal(3))
+		})
+
+		It("rejects invalid limits", func() {
+			env["QUOTAS"] = `{"instances_per_plan": {"beta": -1}}`
+
+			_, err := config.Load("", getenv)
+			Expect(problems(err)).To(Equal([]string{
+				"Invalid QUOTAS: instances_per_plan.beta must not be negative: -1",
+			}))
+		})
+	})
+})
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// applyEnv sets every field with an env tag whose environment variable is
+// set, descending into nested structs.
+func applyEnv(config *Config, getenv func(string) string) []string {
+	return applyEnvToStruct(reflect.ValueOf(config).Elem(), getenv)
+}
+
+func applyEnvToStruct(v reflect.Value, getenv func(string) string) []string {
+	var problems []string
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		structField := v.Type().Field(i)
+
+		if structField.PkgPath != "" {
+			continue
+		}
+
+		env := structField.Tag.Get("env")
+		if env == "" {
+			if field.Kind() == reflect.Struct {
+				problems = append(problems, applyEnvToStruct(field, getenv)...)
+			}
+			continue
+		}
+
+		value := getenv(env)
+		if value == "" {
+			continue
+		}
+
+		if problem := setField(field, env, value); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+// setField parses value into field and returns the problem with it, if any.
+func setField(field reflect.Value, env, value string) string {
+	if field.Type() == durationType {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Sprintf("%s must be a positive duration: %s", env, value)
+		}
+		field.SetInt(int64(duration))
+		return ""
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Sprintf("%s must be a number: %s", env, value)
+		}
+		field.SetInt(int64(parsed))
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Sprintf("%s must be true or false: %s", env, value)
+		}
+		field.SetBool(parsed)
+	case reflect.Slice, reflect.Map:
+		parsed := reflect.New(field.Type())
+		if err := yaml.UnmarshalStrict([]byte(value), parsed.Interface()); err != nil {
+			return fmt.Sprintf("Invalid %s: %s", env, err)
+		}
+		field.Set(parsed.Elem())
+	default:
+		return fmt.Sprintf("%s has an unsupported type %s", env, field.Type())
+	}
+
+	return ""
+}
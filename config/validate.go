@@ -0,0 +1,438 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/aggregator"
+	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/parameters"
+	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
+	"code.cloudfoundry.org/gcp-broker-proxy/quota"
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig"
+	"code.cloudfoundry.org/gcp-broker-proxy/upstream"
+)
+
+func (c *Config) validate() []string {
+	var problems []string
+
+	var missing []string
+	require := func(value, env string) {
+		if value == "" {
+			missing = append(missing, env)
+		}
+	}
+
+	if c.BasicAuth && len(c.Credentials) == 0 {
+		require(c.Username, "USERNAME")
+		require(c.Password, "PASSWORD")
+	}
+	if len(c.Brokers) == 0 {
+		require(c.BrokerURL, "BROKER_URL")
+		require(c.ServiceAccountJSON, "SERVICE_ACCOUNT_JSON")
+	}
+
+	if len(missing) != 0 {
+		problems = append(problems, fmt.Sprintf("Missing %s environment variable(s)", strings.Join(missing, ", ")))
+	}
+
+	problems = append(problems, c.validateBrokers()...)
+
+	for _, port := range []struct{ value, env string }{{c.Port, "PORT"}, {c.Metrics.Port, "METRICS_PORT"}, {c.TLS.Port, "TLS_PORT"}} {
+		if port.value == "" {
+			continue
+		}
+		if number, err := strconv.Atoi(port.value); err != nil || number < 1 || number > 65535 {
+			problems = append(problems, fmt.Sprintf("%s must be a port number: %s", port.env, port.value))
+		}
+	}
+
+	for _, duration := range []struct {
+		value Duration
+		env   string
+	}{
+		{c.Bindings.PollInterval, "BINDING_POLL_INTERVAL"},
+		{c.Bindings.Timeout, "BINDING_TIMEOUT"},
+		{c.Token.RefreshBefore, "TOKEN_REFRESH_BEFORE"},
+		{c.Token.FetchTimeout, "TOKEN_FETCH_TIMEOUT"},
+		{c.Catalog.TTL, "CATALOG_TTL"},
+		{c.Catalog.RefreshInterval, "CATALOG_REFRESH_INTERVAL"},
+		{c.Health.Interval, "HEALTH_CHECK_INTERVAL"},
+		{c.Shutdown.Timeout, "SHUTDOWN_TIMEOUT"},
+		{c.Upstream.DialTimeout, "UPSTREAM_DIAL_TIMEOUT"},
+		{c.Upstream.TLSHandshakeTimeout, "UPSTREAM_TLS_HANDSHAKE_TIMEOUT"},
+		{c.Upstream.ResponseHeaderTimeout, "UPSTREAM_RESPONSE_HEADER_TIMEOUT"},
+		{c.Upstream.Timeout, "UPSTREAM_TIMEOUT"},
+		{c.Upstream.IdleConnTimeout, "UPSTREAM_IDLE_CONN_TIMEOUT"},
+		{c.Retries.BaseDelay, "RETRY_BASE_DELAY"},
+		{c.Retries.MaxDelay, "RETRY_MAX_DELAY"},
+		{c.Breaker.OpenTimeout, "BREAKER_OPEN_TIMEOUT"},
+		{c.TLS.ReloadInterval, "TLS_RELOAD_INTERVAL"},
+		{c.JWT.KeysRefreshInterval, "JWT_KEYS_REFRESH_INTERVAL"},
+		{c.Lockout.Backoff, "LOCKOUT_BACKOFF"},
+		{c.Lockout.MaxBackoff, "LOCKOUT_MAX_BACKOFF"},
+		{c.Lockout.Window, "LOCKOUT_WINDOW"},
+	} {
+		if duration.value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be a positive duration: %s", duration.env, duration.value))
+		}
+	}
+
+	if c.Bindings.Timeout > 0 && c.Shutdown.Timeout > 0 && c.Shutdown.Timeout < c.Bindings.Timeout {
+		problems = append(problems, fmt.Sprintf("SHUTDOWN_TIMEOUT must be at least BINDING_TIMEOUT (%s): %s", c.Bindings.Timeout, c.Shutdown.Timeout))
+	}
+
+	if c.InventoryRetention < 0 {
+		problems = append(problems, fmt.Sprintf("INVENTORY_RETENTION must not be negative: %s", c.InventoryRetention))
+	}
+
+	for _, number := range []struct {
+		value int
+		env   string
+	}{
+		{c.Lockout.Threshold, "LOCKOUT_THRESHOLD"},
+		{c.Lockout.TrustedProxies, "TRUSTED_PROXIES"},
+		{c.Upstream.MaxIdleConns, "UPSTREAM_MAX_IDLE_CONNS"},
+		{c.Upstream.MaxIdleConnsPerHost, "UPSTREAM_MAX_IDLE_CONNS_PER_HOST"},
+		{c.Breaker.FailureThreshold, "BREAKER_FAILURE_THRESHOLD"},
+	} {
+		if number.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative: %d", number.env, number.value))
+		}
+	}
+
+	if c.Breaker.HalfOpenRequests < 1 {
+		problems = append(problems, fmt.Sprintf("BREAKER_HALF_OPEN_REQUESTS must be at least 1: %d", c.Breaker.HalfOpenRequests))
+	}
+
+	strategy := aggregator.CollisionStrategy(c.Catalog.Collisions)
+	if strategy != aggregator.KeepFirst && strategy != aggregator.Reject {
+		problems = append(problems, fmt.Sprintf("CATALOG_COLLISIONS must be %s or %s: %s", aggregator.KeepFirst, aggregator.Reject, strategy))
+	}
+
+	if c.Catalog.Policy != "" {
+		policy, err := catalog.ParsePolicy(string(c.Catalog.Policy))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid CATALOG_POLICY: %s", err))
+		} else {
+			c.policy = &policy
+		}
+	}
+
+	if c.Parameters.Policy != "" {
+		policy, err := parameters.ParsePolicy(string(c.Parameters.Policy))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid PARAMETER_POLICY: %s", err))
+		} else {
+			c.parameterPolicy = &policy
+		}
+	}
+
+	if c.Parameters.Labels != "" {
+		labels, err := parameters.ParseLabels(string(c.Parameters.Labels))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid PARAMETER_LABELS: %s", err))
+		} else {
+			c.parameterLabels = &labels
+		}
+	}
+
+	if c.Quotas != "" {
+		limits, err := quota.ParseLimits(string(c.Quotas))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid QUOTAS: %s", err))
+		} else {
+			c.quotaLimits = &limits
+		}
+	}
+
+	var asyncRequired []osbapi.Operation
+	for _, operation := range c.Validation.AsyncRequired {
+		if !osbapi.Operation(operation).AcceptsIncomplete() {
+			problems = append(problems, fmt.Sprintf("Invalid ASYNC_REQUIRED: %s cannot be performed asynchronously", operation))
+			continue
+		}
+		asyncRequired = append(asyncRequired, osbapi.Operation(operation))
+	}
+	if len(c.Validation.AsyncRequired) != 0 && !c.Validation.Enabled {
+		problems = append(problems, "ASYNC_REQUIRED requires VALIDATE_REQUESTS=true")
+	}
+	if len(asyncRequired) != 0 {
+		c.validatorOptions = []osbapi.ValidatorOption{osbapi.WithAsyncRequired(asyncRequired...)}
+	}
+
+	problems = append(problems, c.validateCredentials()...)
+	problems = append(problems, c.validateUpstream()...)
+	problems = append(problems, c.validateRetries()...)
+	problems = append(problems, c.validateTLS()...)
+	problems = append(problems, c.validateJWT()...)
+
+	if !c.BasicAuth && len(c.ClientCertificates) == 0 && c.tokenVerifier == nil {
+		problems = append(problems, "BASIC_AUTH=false requires CLIENT_CERTIFICATES or JWT_JWKS_URL or JWT_KEYS")
+	}
+
+	return problems
+}
+
+func (c *Config) validateBrokers() []string {
+	var problems []string
+
+	if len(c.Brokers) != 0 {
+		names := map[string]bool{}
+		for i, broker := range c.Brokers {
+			switch {
+			case broker.Name == "":
+				problems = append(problems, fmt.Sprintf("Invalid BROKERS: broker %d is missing a name", i))
+				continue
+			case names[broker.Name]:
+				problems = append(problems, fmt.Sprintf("Invalid BROKERS: broker name %s is used more than once", broker.Name))
+			}
+			names[broker.Name] = true
+
+			if broker.URL == "" {
+				problems = append(problems, fmt.Sprintf("Invalid BROKERS: broker %s is missing a url", broker.Name))
+			}
+			if broker.ServiceAccountJSON == "" {
+				problems = append(problems, fmt.Sprintf("Invalid BROKERS: broker %s is missing a service_account_json", broker.Name))
+			}
+		}
+	}
+
+	for _, broker := range c.BrokerList() {
+		if broker.URL != "" {
+			if _, err := url.ParseRequestURI(broker.URL); err != nil {
+				problems = append(problems, fmt.Sprintf("%s must be a valid URL: %s", broker.Setting("BROKER_URL", "url"), broker.URL))
+			}
+		}
+		if broker.ServiceAccountJSON != "" {
+			if _, err := google.JWTConfigFromJSON([]byte(broker.ServiceAccountJSON)); err != nil {
+				problems = append(problems, fmt.Sprintf("Invalid %s: %s", broker.Setting("SERVICE_ACCOUNT_JSON", "service_account_json"), err))
+			}
+		}
+	}
+
+	return problems
+}
+
+func (c *Config) validateCredentials() []string {
+	var problems []string
+
+	var brokerCredentials []auth.Credential
+	if c.Username != "" && c.Password != "" {
+		brokerCredentials = append(brokerCredentials, auth.Credential{Username: c.Username, Password: c.Password})
+	}
+	brokerCredentials = append(brokerCredentials, c.Credentials...)
+
+	if c.BasicAuth && len(brokerCredentials) != 0 {
+		credentials, err := auth.NewCredentials(brokerCredentials)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid BROKER_CREDENTIALS: %s", err))
+		}
+		c.brokerCredentials = credentials
+	}
+
+	var problem string
+	if c.adminCredentials, problem = pair("ADMIN", c.Admin.Username, c.Admin.Password); problem != "" {
+		problems = append(problems, problem)
+	}
+	if c.metricsCredentials, problem = pair("METRICS", c.Metrics.Username, c.Metrics.Password); problem != "" {
+		problems = append(problems, problem)
+	}
+
+	return problems
+}
+
+func (c *Config) validateUpstream() []string {
+	transport, err := upstream.NewTransport(upstream.Config{
+		DialTimeout:           time.Duration(c.Upstream.DialTimeout),
+		TLSHandshakeTimeout:   time.Duration(c.Upstream.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(c.Upstream.ResponseHeaderTimeout),
+		Timeout:               time.Duration(c.Upstream.Timeout),
+		MaxIdleConns:          c.Upstream.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.Upstream.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(c.Upstream.IdleConnTimeout),
+		HTTP2:                 c.Upstream.HTTP2,
+		ProxyURL:              c.Upstream.ProxyURL,
+		ProxyUsername:         c.Upstream.ProxyUsername,
+		ProxyPassword:         c.Upstream.ProxyPassword,
+		CAFile:                c.Upstream.CAFile,
+	})
+	if err != nil {
+		return []string{fmt.Sprintf("Invalid upstream configuration: %s", err)}
+	}
+	c.upstreamTransport = transport
+	return nil
+}
+
+// defaultRetryBudget applies to operations that RETRY_BUDGETS does not
+// mention, unless it sets a default.
+var defaultRetryBudget = proxy.RetryBudget{MaxRetries: 3, MaxElapsed: 20 * time.Second}
+
+func (c *Config) validateRetries() []string {
+	var problems []string
+
+	c.retryConfig = proxy.RetryConfig{
+		BaseDelay:     time.Duration(c.Retries.BaseDelay),
+		MaxDelay:      time.Duration(c.Retries.MaxDelay),
+		Budgets:       map[osbapi.Operation]proxy.RetryBudget{},
+		DefaultBudget: defaultRetryBudget,
+	}
+
+	operations := make([]string, 0, len(c.Retries.Budgets))
+	for operation := range c.Retries.Budgets {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	for _, operation := range operations {
+		budget := c.Retries.Budgets[operation]
+		switch {
+		case operation == "default":
+		case !osbapi.Operation(operation).Valid():
+			problems = append(problems, fmt.Sprintf("Invalid RETRY_BUDGETS: unknown operation %q", operation))
+			continue
+		case !osbapi.Operation(operation).Idempotent() && budget.MaxRetries != 0:
+			problems = append(problems, fmt.Sprintf("Invalid RETRY_BUDGETS: %s is not idempotent and cannot be retried", operation))
+			continue
+		}
+
+		if budget.MaxRetries < 0 {
+			problems = append(problems, fmt.Sprintf("Invalid RETRY_BUDGETS: max_retries of %s must not be negative: %d", operation, budget.MaxRetries))
+		}
+		if budget.MaxRetries > 0 && budget.MaxElapsed <= 0 {
+			problems = append(problems, fmt.Sprintf("Invalid RETRY_BUDGETS: max_elapsed of %s must be a positive duration: %s", operation, budget.MaxElapsed))
+		}
+		if budget.MaxRetries > 0 && time.Duration(budget.MaxElapsed) >= proxy.PlatformTimeout {
+			problems = append(problems, fmt.Sprintf("Invalid RETRY_BUDGETS: max_elapsed of %s must be shorter than the platform's %s timeout: %s", operation, proxy.PlatformTimeout, budget.MaxElapsed))
+		}
+
+		converted := proxy.RetryBudget{MaxRetries: budget.MaxRetries, MaxElapsed: time.Duration(budget.MaxElapsed)}
+		if operation == "default" {
+			c.retryConfig.DefaultBudget = converted
+		} else {
+			c.retryConfig.Budgets[osbapi.Operation(operation)] = converted
+		}
+	}
+
+	return problems
+}
+
+func (c *Config) validateTLS() []string {
+	var problems []string
+
+	if c.TLS.Enabled || c.TLS.Port != "" {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			problems = append(problems, "TLS_CERT_FILE and TLS_KEY_FILE are required with TLS_ENABLED or TLS_PORT")
+		} else if err := tlsconfig.Load(c.TLSFiles()); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid TLS configuration: %s", err))
+		}
+	}
+
+	version, err := tlsconfig.ParseVersion(c.TLS.MinVersion)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid TLS_MIN_VERSION: %s", err))
+	}
+	suites, err := tlsconfig.ParseCipherSuites(c.TLS.CipherSuites)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid TLS_CIPHER_SUITES: %s", err))
+	}
+	c.tlsOptions = []tlsconfig.Option{tlsconfig.WithMinVersion(version), tlsconfig.WithCipherSuites(suites)}
+
+	if len(c.ClientCertificates) != 0 {
+		if c.TLS.Port == "" || c.TLS.ClientCAFile == "" {
+			problems = append(problems, "CLIENT_CERTIFICATES require TLS_PORT and TLS_CLIENT_CA_FILE")
+		}
+
+		rules, err := auth.NewCertificateRules(c.ClientCertificates)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid CLIENT_CERTIFICATES: %s", err))
+		}
+		c.certificateRules = rules
+	}
+
+	return problems
+}
+
+func (c *Config) validateJWT() []string {
+	if c.JWT.JWKSURL == "" && c.JWT.Keys == "" {
+		if c.JWT.Issuer != "" || c.JWT.Audience != "" || len(c.JWT.Scopes) != 0 {
+			return []string{"JWT_ISSUER, JWT_AUDIENCE and JWT_SCOPES require JWT_JWKS_URL or JWT_KEYS"}
+		}
+		return nil
+	}
+
+	var problems []string
+
+	var keys auth.KeySet
+	switch {
+	case c.JWT.JWKSURL != "" && c.JWT.Keys != "":
+		problems = append(problems, "JWT_JWKS_URL and JWT_KEYS cannot both be set")
+	case c.JWT.JWKSURL != "":
+		if parsed, err := url.ParseRequestURI(c.JWT.JWKSURL); err != nil || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("JWT_JWKS_URL must be a valid URL: %s", c.JWT.JWKSURL))
+		} else {
+			keys = auth.NewRemoteKeySet(c.JWT.JWKSURL, auth.WithKeysRefreshInterval(time.Duration(c.JWT.KeysRefreshInterval)))
+		}
+	default:
+		staticKeys, err := auth.NewStaticKeySet([]byte(c.JWT.Keys))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid JWT_KEYS: %s", err))
+		} else {
+			keys = staticKeys
+		}
+	}
+
+	if c.JWT.Issuer == "" || c.JWT.Audience == "" {
+		problems = append(problems, "JWT_ISSUER and JWT_AUDIENCE are required with JWT_JWKS_URL or JWT_KEYS")
+	}
+
+	tokenConfig := auth.TokenConfig{
+		Keys:     keys,
+		Issuer:   c.JWT.Issuer,
+		Audience: c.JWT.Audience,
+		Scopes:   map[osbapi.Operation]string{},
+	}
+	for operation, scope := range c.JWT.Scopes {
+		if operation == "default" {
+			tokenConfig.DefaultScope = scope
+			continue
+		}
+		tokenConfig.Scopes[osbapi.Operation(operation)] = scope
+	}
+	if len(c.JWT.Scopes) == 0 {
+		problems = append(problems, "JWT_SCOPES must map operations or default to the scope they require")
+	}
+
+	if len(problems) != 0 {
+		return problems
+	}
+
+	verifier, err := auth.NewTokenVerifier(tokenConfig)
+	if err != nil {
+		return []string{fmt.Sprintf("Invalid JWT_SCOPES: %s", err)}
+	}
+	c.tokenVerifier = verifier
+	return nil
+}
+
+// pair returns the credentials <prefix>_USERNAME and <prefix>_PASSWORD, or
+// nil when neither is set.
+func pair(prefix, username, password string) (*auth.Credentials, string) {
+	if username == "" && password == "" {
+		return nil, ""
+	}
+
+	credentials, err := auth.NewCredentials([]auth.Credential{{Username: username, Password: password}})
+	if err != nil {
+		return nil, fmt.Sprintf("%s_USERNAME and %s_PASSWORD must be set together", prefix, prefix)
+	}
+	return credentials, ""
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CredentialsService selects the service instance in VCAP_SERVICES that
+// holds the proxy's credentials, such as a user-provided or CredHub service
+// instance.
+type CredentialsService struct {
+	Name string `yaml:"name" env:"CREDENTIALS_SERVICE_NAME"`
+	Tag  string `yaml:"tag" env:"CREDENTIALS_SERVICE_TAG"`
+}
+
+type vcapService struct {
+	Name        string          `json:"name"`
+	Tags        []string        `json:"tags"`
+	Credentials vcapCredentials `json:"credentials"`
+}
+
+type vcapCredentials struct {
+	Username           string       `json:"username"`
+	Password           string       `json:"password"`
+	BrokerURL          string       `json:"broker_url"`
+	ServiceAccountJSON jsonDocument `json:"service_account_json"`
+	Brokers            []vcapBroker `json:"brokers"`
+}
+
+type vcapBroker struct {
+	Name               string       `json:"name"`
+	URL                string       `json:"url"`
+	ServiceAccountJSON jsonDocument `json:"service_account_json"`
+}
+
+// jsonDocument is a JSON document that can be given as a string or as a
+// nested object, so a service account key can be stored as it was
+// downloaded.
+type jsonDocument string
+
+func (d *jsonDocument) UnmarshalJSON(raw []byte) error {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		*d = jsonDocument(s)
+		return nil
+	}
+
+	*d = jsonDocument(raw)
+	return nil
+}
+
+// applyVCAP sets the credentials, broker URLs and service account keys
+// found in the selected service instance. Settings the instance does not
+// have keep their values from the environment or config file.
+func applyVCAP(config *Config, vcapServices string) []string {
+	selector := config.CredentialsService
+	if selector.Name == "" && selector.Tag == "" {
+		return nil
+	}
+
+	if vcapServices == "" {
+		return []string{"VCAP_SERVICES must be set to use CREDENTIALS_SERVICE_NAME or CREDENTIALS_SERVICE_TAG"}
+	}
+
+	var services map[string][]vcapService
+	if err := json.Unmarshal([]byte(vcapServices), &services); err != nil {
+		return []string{fmt.Sprintf("Invalid VCAP_SERVICES: %s", err)}
+	}
+
+	var matches []vcapService
+	for _, instances := range services {
+		for _, instance := range instances {
+			if selector.matches(instance) {
+				matches = append(matches, instance)
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return []string{fmt.Sprintf("No service instance in VCAP_SERVICES is %s", selector)}
+	case 1:
+	default:
+		return []string{fmt.Sprintf("%d service instances in VCAP_SERVICES are %s", len(matches), selector)}
+	}
+
+	credentials := matches[0].Credentials
+	setIfPresent(&config.Username, credentials.Username)
+	setIfPresent(&config.Password, credentials.Password)
+	setIfPresent(&config.BrokerURL, credentials.BrokerURL)
+	setIfPresent(&config.ServiceAccountJSON, string(credentials.ServiceAccountJSON))
+
+	if len(credentials.Brokers) != 0 {
+		config.Brokers = nil
+		for _, broker := range credentials.Brokers {
+			config.Brokers = append(config.Brokers, Broker{
+				Name:               broker.Name,
+				URL:                broker.URL,
+				ServiceAccountJSON: string(broker.ServiceAccountJSON),
+			})
+		}
+	}
+
+	return nil
+}
+
+func (s CredentialsService) matches(instance vcapService) bool {
+	if s.Name != "" {
+		return instance.Name == s.Name
+	}
+
+	for _, tag := range instance.Tags {
+		if tag == s.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s CredentialsService) String() string {
+	if s.Name != "" {
+		return fmt.Sprintf("named %s", s.Name)
+	}
+	return fmt.Sprintf("tagged %s", s.Tag)
+}
+
+func setIfPresent(setting *string, value string) {
+	if value != "" {
+		*setting = value
+	}
+}
@@ -0,0 +1,136 @@
+package config_test
+
+import (
+	"code.cloudfoundry.org/gcp-broker-proxy/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const vcapServices = `{
+	"user-provided": [
+		{
+			"name": "gcp-proxy-credentials",
+			"label": "user-provided",
+			"tags": ["gcp-broker-proxy"],
+			"credentials": {
+				"username": "vcap-user",
+				"password": "vcap-pass",
+				"broker_url": "https://broker.example.com",
+				"service_account_json": {"type": "service_account", "client_email": "proxy@example.com", "private_key": "key", "token_uri": "https://example.com/token"}
+			}
+		},
+		{
+			"name": "other",
+			"label": "user-provided",
+			"tags": ["database"],
+			"credentials": {"username": "db"}
+		}
+	],
+	"credhub": [
+		{
+			"name": "gcp-proxy-brokers",
+			"label": "credhub",
+			"plan": "default",
+			"tags": ["gcp-broker-proxy-brokers"],
+			"credentials": {
+				"brokers": [
+					{"name": "a", "url": "https://a.example.com", "service_account_json": "{\"type\": \"service_account\"}"},
+					{"name": "b", "url": "https://b.example.com", "service_account_json": {"type": "service_account"}}
+				]
+			}
+		}
+	]
+}`
+
+var _ = Describe("VCAP_SERVICES", func() {
+	var env map[string]string
+
+	getenv := func(key string) string {
+		return env[key]
+	}
+
+	BeforeEach(func() {
+		env = map[string]string{"VCAP_SERVICES": vcapServices}
+	})
+
+	It("reads the credentials of the instance selected by name", func() {
+		env["CREDENTIALS_SERVICE_NAME"] = "gcp-proxy-credentials"
+
+		c, err := config.Load("", getenv)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(c.Username).To(Equal("vcap-user"))
+		Expect(c.Password).To(Equal("vcap-pass"))
+		Expect(c.BrokerURL).To(Equal("https://broker.example.com"))
+		Expect(c.ServiceAccountJSON).To(MatchJSON(serviceAccountJSON))
+	})
+
+	It("reads the brokers of the instance selected by tag", func() {
+		env["CREDENTIALS_SERVICE_TAG"] = "gcp-broker-proxy-brokers"
+		env["USERNAME"] = "user"
+		env["PASSWORD"] = "pass"
+
+		c, err := config.Load("", getenv)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(c.BrokerList()).To(HaveLen(2))
+		Expect(c.BrokerList()[0]).To(Equal(config.Broker{
+			Name:               "a",
+			URL:                "https://a.example.com",
+			ServiceAccountJSON: `{"type": "service_account"}`,
+		}))
+		Expect(c.BrokerList()[1].ServiceAccountJSON).To(MatchJSON(`{"type": "service_account"}`))
+	})
+
+	It("falls back to the environment for settings the instance does not have", func() {
+		env["CREDENTIALS_SERVICE_NAME"] = "other"
+		env["USERNAME"] = "user"
+		env["PASSWORD"] = "pass"
+		env["BROKER_URL"] = "https://env.example.com"
+		env["SERVICE_ACCOUNT_JSON"] = serviceAccountJSON
+
+		c, err := config.Load("", getenv)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(c.Username).To(Equal("db"))
+		Expect(c.Password).To(Equal("pass"))
+		Expect(c.BrokerURL).To(Equal("https://env.example.com"))
+	})
+
+	It("is not used unless an instance is selected", func() {
+		_, err := config.Load("", getenv)
+		Expect(err).To(MatchError("Missing USERNAME, PASSWORD, BROKER_URL, SERVICE_ACCOUNT_JSON environment variable(s)"))
+	})
+
+	It("reports a missing instance", func() {
+		env["CREDENTIALS_SERVICE_NAME"] = "missing"
+
+		_, err := config.Load("", getenv)
+		Expect(err).To(MatchError(HavePrefix("No service instance in VCAP_SERVICES is named missing; ")))
+	})
+
+	It("reports ambiguous tags", func() {
+		env["VCAP_SERVICES"] = `{"user-provided": [{"name": "a", "tags": ["t"]}, {"name": "b", "tags": ["t"]}]}`
+		env["CREDENTIALS_SERVICE_TAG"] = "t"
+
+		_, err := config.Load("", getenv)
+		Expect(err).To(MatchError(HavePrefix("2 service instances in VCAP_SERVICES are tagged t; ")))
+	})
+
+	It("reports invalid VCAP_SERVICES", func() {
+		env["VCAP_SERVICES"] = "{"
+		env["CREDENTIALS_SERVICE_NAME"] = "gcp-proxy-credentials"
+
+		_, err := config.Load("", getenv)
+		Expect(err).To(MatchError(HavePrefix("Invalid VCAP_SERVICES: ")))
+	})
+
+	It("requires VCAP_SERVICES when an instance is selected", func() {
+		delete(env, "VCAP_SERVICES")
+		env["CREDENTIALS_SERVICE_TAG"] = "gcp-broker-proxy"
+
+		_, err := config.Load("", getenv)
+		Expect(err).To(MatchError(HavePrefix("VCAP_SERVICES must be set to use CREDENTIALS_SERVICE_NAME or CREDENTIALS_SERVICE_TAG; ")))
+	})
+})
@@ -0,0 +1,88 @@
+package inventory
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Handler serves the inventory below prefix:
+//
+//	GET <prefix>/instances            instances, filtered by the query parameters
+//	GET <prefix>/instances/:id        an instance and its bindings
+//	GET <prefix>/bindings             bindings, filtered by the query parameters
+//
+// Supported query parameters are instance_id, service_id, plan_id,
+// organization_guid, space_guid, state and include_deleted.
+func Handler(inv *Inventory, prefix string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			osbapi.WriteError(rw, http.StatusMethodNotAllowed, "", "Only GET is supported")
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		segments := strings.Split(path, "/")
+		filter := filterFromQuery(r)
+
+		switch {
+		case path == "instances":
+			instances, err := inv.Instances(filter)
+			respond(rw, map[string]interface{}{"instances": instances}, err)
+		case len(segments) == 2 && segments[0] == "instances":
+			serveInstance(inv, rw, segments[1])
+		case path == "bindings":
+			bindings, err := inv.Bindings(filter)
+			respond(rw, map[string]interface{}{"bindings": bindings}, err)
+		default:
+			osbapi.WriteError(rw, http.StatusNotFound, "", "Unknown endpoint "+r.URL.Path)
+		}
+	})
+}
+
+func serveInstance(inv *Inventory, rw http.ResponseWriter, instanceID string) {
+	instance, found, err := inv.Instance(instanceID)
+	if err == nil && !found {
+		osbapi.WriteError(rw, http.StatusNotFound, "", "Unknown service instance "+instanceID)
+		return
+	}
+
+	var bindings []Binding
+	if err == nil {
+		bindings, err = inv.Bindings(Filter{InstanceID: instanceID, IncludeDeleted: true})
+	}
+
+	respond(rw, map[string]interface{}{"instance": instance, "bindings": bindings}, err)
+}
+
+func respond(rw http.ResponseWriter, body interface{}, err error) {
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to read the inventory: "+err.Error())
+		return
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to encode the inventory: "+err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(encoded)
+}
+
+func filterFromQuery(r *http.Request) Filter {
+	query := r.URL.Query()
+
+	return Filter{
+		InstanceID:       query.Get("instance_id"),
+		ServiceID:        query.Get("service_id"),
+		PlanID:           query.Get("plan_id"),
+		OrganizationGUID: query.Get("organization_guid"),
+		SpaceGUID:        query.Get("space_guid"),
+		State:            query.Get("state"),
+		IncludeDeleted:   query.Get("include_deleted") == "true",
+	}
+}
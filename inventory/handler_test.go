@@ -0,0 +1,96 @@
+package inventory_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/inventory"
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handler", func() {
+	var (
+		handler http.Handler
+		writer  *httptest.ResponseRecorder
+	)
+
+	get := func(path string) {
+		req, err := http.NewRequest("GET", path, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		writer = httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+	}
+
+	BeforeEach(func() {
+		s, err := store.Open("")
+		Expect(err).NotTo(HaveOccurred())
+		inv := inventory.New(s)
+
+		Expect(inv.PutInstance(inventory.Instance{InstanceID: "i1", ServiceID: "s1", SpaceGUID: "space-1", Operation: "provision", State: inventory.Succeeded})).To(Succeed())
+		Expect(inv.PutInstance(inventory.Instance{InstanceID: "i2", ServiceID: "s2", SpaceGUID: "space-2", Operation: "provision", State: inventory.Succeeded})).To(Succeed())
+		Expect(inv.PutBinding(inventory.Binding{InstanceID: "i1", BindingID: "b1", Operation: "bind", State: inventory.Succeeded})).To(Succeed())
+
+		handler = inventory.Handler(inv, "/admin")
+	})
+
+	It("lists instances", func() {
+		get("/admin/instances?space_guid=space-2")
+
+		Expect(writer.Code).To(Equal(http.StatusOK))
+		Expect(writer.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var body struct {
+			Instances []inventory.Instance `json:"instances"`
+		}
+		Expect(json.Unmarshal(writer.Body.Bytes(), &body)).To(Succeed())
+		Expect(body.Instances).To(HaveLen(1))
+		Expect(body.Instances[0].InstanceID).To(Equal("i2"))
+	})
+
+	It("shows an instance with its bindings", func() {
+		get("/admin/instances/i1")
+
+		Expect(writer.Code).To(Equal(http.StatusOK))
+
+		var body struct {
+			Instance inventory.Instance  `json:"instance"`
+			Bindings []inventory.Binding `json:"bindings"`
+		}
+		Expect(json.Unmarshal(writer.Body.Bytes(), &body)).To(Succeed())
+		Expect(body.Instance.ServiceID).To(Equal("s1"))
+		Expect(body.Bindings).To(HaveLen(1))
+		Expect(body.Bindings[0].BindingID).To(Equal("b1"))
+	})
+
+	It("lists bindings", func() {
+		get("/admin/bindings?instance_id=i1")
+
+		Expect(writer.Code).To(Equal(http.StatusOK))
+		Expect(writer.Body.String()).To(ContainSubstring(`"binding_id":"b1"`))
+	})
+
+	It("responds with 404 for unknown instances", func() {
+		get("/admin/instances/unknown")
+
+		Expect(writer.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("responds with 404 for unknown endpoints", func() {
+		get("/admin/unknown")
+
+		Expect(writer.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("only supports GET", func() {
+		req, _ := http.NewRequest("DELETE", "/admin/instances/i1", nil)
+		writer = httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+
+		Expect(writer.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
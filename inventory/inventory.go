@@ -0,0 +1,312 @@
+package inventory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+)
+
+const (
+	InProgress = "in progress"
+	Succeeded  = "succeeded"
+	Failed     = "failed"
+
+	instancePrefix = "instance/"
+	bindingPrefix  = "binding/"
+)
+
+// Instance is what the proxy knows about a service instance created through
+// it. Operation is the last operation requested for the instance and State
+// its outcome.
+type Instance struct {
+	InstanceID       string          `json:"instance_id"`
+	ServiceID        string          `json:"service_id"`
+	PlanID           string          `json:"plan_id"`
+	OrganizationGUID string          `json:"organization_guid,omitempty"`
+	SpaceGUID        string          `json:"space_guid,omitempty"`
+	Context          json.RawMessage `json:"context,omitempty"`
+	ParametersHash   string          `json:"parameters_hash,omitempty"`
+	Operation        string          `json:"operation"`
+	State            string          `json:"state"`
+	CreatedAt        time.Time       `json:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+}
+
+// Binding is what the proxy knows about a service binding created through it.
+type Binding struct {
+	InstanceID     string          `json:"instance_id"`
+	BindingID      string          `json:"binding_id"`
+	ServiceID      string          `json:"service_id"`
+	PlanID         string          `json:"plan_id"`
+	AppGUID        string          `json:"app_guid,omitempty"`
+	Context        json.RawMessage `json:"context,omitempty"`
+	ParametersHash string          `json:"parameters_hash,omitempty"`
+	Operation      string          `json:"operation"`
+	State          string          `json:"state"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// Deleted reports whether the instance has been deprovisioned.
+func (i Instance) Deleted() bool {
+	return i.Operation == "deprovision" && i.State == Succeeded
+}
+
+// Deleted reports whether the binding has been unbound.
+func (b Binding) Deleted() bool {
+	return b.Operation == "unbind" && b.State == Succeeded
+}
+
+// Filter selects records by the fields that are set.
+type Filter struct {
+	InstanceID       string
+	ServiceID        string
+	PlanID           string
+	OrganizationGUID string
+	SpaceGUID        string
+	State            string
+	IncludeDeleted   bool
+}
+
+type Inventory struct {
+	store *store.Store
+	now   func() time.Time
+
+	// mu orders the changes, so that watchers see them one at a time.
+	mu       sync.Mutex
+	watchers []Watcher
+}
+
+// Watcher is called with the records of an instance or binding before and
+// after each change to them. Before is nil for new records and after is nil
+// for pruned ones.
+type Watcher struct {
+	Instance func(before, after *Instance)
+	Binding  func(before, after *Binding)
+}
+
+func New(s *store.Store) *Inventory {
+	return &Inventory{store: s, now: time.Now}
+}
+
+func (inv *Inventory) Instance(instanceID string) (Instance, bool, error) {
+	var instance Instance
+	found, err := inv.store.Get(instancePrefix+instanceID, &instance)
+	return instance, found, err
+}
+
+func (inv *Inventory) PutInstance(instance Instance) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	before, found, err := inv.Instance(instance.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	instance.UpdatedAt = inv.now().UTC()
+	if instance.CreatedAt.IsZero() {
+		instance.CreatedAt = instance.UpdatedAt
+	}
+	if err := inv.store.Put(instancePrefix+instance.InstanceID, instance); err != nil {
+		return err
+	}
+
+	for _, watcher := range inv.watchers {
+		if found {
+			watcher.Instance(&before, &instance)
+		} else {
+			watcher.Instance(nil, &instance)
+		}
+	}
+	return nil
+}
+
+func (inv *Inventory) Instances(filter Filter) ([]Instance, error) {
+	instances := []Instance{}
+	for _, key := range inv.store.Keys(instancePrefix) {
+		var instance Instance
+		if _, err := inv.store.Get(key, &instance); err != nil {
+			return nil, err
+		}
+
+		if filter.matchesInstance(instance) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+func (inv *Inventory) Binding(instanceID, bindingID string) (Binding, bool, error) {
+	var binding Binding
+	found, err := inv.store.Get(bindingKey(instanceID, bindingID), &binding)
+	return binding, found, err
+}
+
+func (inv *Inventory) PutBinding(binding Binding) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	before, found, err := inv.Binding(binding.InstanceID, binding.BindingID)
+	if err != nil {
+		return err
+	}
+
+	binding.UpdatedAt = inv.now().UTC()
+	if binding.CreatedAt.IsZero() {
+		binding.CreatedAt = binding.UpdatedAt
+	}
+	if err := inv.store.Put(bindingKey(binding.InstanceID, binding.BindingID), binding); err != nil {
+		return err
+	}
+
+	for _, watcher := range inv.watchers {
+		if found {
+			watcher.Binding(&before, &binding)
+		} else {
+			watcher.Binding(nil, &binding)
+		}
+	}
+	return nil
+}
+
+func (inv *Inventory) Bindings(filter Filter) ([]Binding, error) {
+	prefix := bindingPrefix
+	if filter.InstanceID != "" {
+		prefix = bindingKey(filter.InstanceID, "")
+	}
+
+	bindings := []Binding{}
+	for _, key := range inv.store.Keys(prefix) {
+		var binding Binding
+		if _, err := inv.store.Get(key, &binding); err != nil {
+			return nil, err
+		}
+
+		if filter.matchesBinding(binding) {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings, nil
+}
+
+// Prune removes the records of instances deprovisioned and bindings unbound
+// before the given time, and returns how many it removed.
+func (inv *Inventory) Prune(before time.Time) (int, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	instances, err := inv.Instances(Filter{IncludeDeleted: true})
+	if err != nil {
+		return 0, err
+	}
+	bindings, err := inv.Bindings(Filter{IncludeDeleted: true})
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, instance := range instances {
+		if !instance.Deleted() || !instance.UpdatedAt.Before(before) {
+			continue
+		}
+		if err := inv.store.Delete(instancePrefix + instance.InstanceID); err != nil {
+			return pruned, err
+		}
+		pruned++
+
+		instance := instance
+		for _, watcher := range inv.watchers {
+			watcher.Instance(&instance, nil)
+		}
+	}
+	for _, binding := range bindings {
+		if !binding.Deleted() || !binding.UpdatedAt.Before(before) {
+			continue
+		}
+		if err := inv.store.Delete(bindingKey(binding.InstanceID, binding.BindingID)); err != nil {
+			return pruned, err
+		}
+		pruned++
+
+		binding := binding
+		for _, watcher := range inv.watchers {
+			watcher.Binding(&binding, nil)
+		}
+	}
+	return pruned, nil
+}
+
+// Watch calls the watcher with every record in the inventory, as new
+// records, and then with every change to them.
+func (inv *Inventory) Watch(watcher Watcher) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	instances, err := inv.Instances(Filter{IncludeDeleted: true})
+	if err != nil {
+		return err
+	}
+	bindings, err := inv.Bindings(Filter{IncludeDeleted: true})
+	if err != nil {
+		return err
+	}
+
+	for i := range instances {
+		watcher.Instance(nil, &instances[i])
+	}
+	for i := range bindings {
+		watcher.Binding(nil, &bindings[i])
+	}
+	inv.watchers = append(inv.watchers, watcher)
+	return nil
+}
+
+func (f Filter) matchesInstance(instance Instance) bool {
+	return matches(f.InstanceID, instance.InstanceID) &&
+		matches(f.ServiceID, instance.ServiceID) &&
+		matches(f.PlanID, instance.PlanID) &&
+		matches(f.OrganizationGUID, instance.OrganizationGUID) &&
+		matches(f.SpaceGUID, instance.SpaceGUID) &&
+		matches(f.State, instance.State) &&
+		(f.IncludeDeleted || !instance.Deleted())
+}
+
+func (f Filter) matchesBinding(binding Binding) bool {
+	return matches(f.InstanceID, binding.InstanceID) &&
+		matches(f.ServiceID, binding.ServiceID) &&
+		matches(f.PlanID, binding.PlanID) &&
+		matches(f.State, binding.State) &&
+		(f.IncludeDeleted || !binding.Deleted())
+}
+
+func matches(wanted, actual string) bool {
+	return wanted == "" || wanted == actual
+}
+
+func bindingKey(instanceID, bindingID string) string {
+	return bindingPrefix + instanceID + "/" + bindingID
+}
+
+// HashParameters returns a digest of the parameters that does not depend on
+// key order or formatting, so that it can be compared between requests
+// without storing the parameters themselves.
+func HashParameters(parameters json.RawMessage) string {
+	if len(parameters) == 0 || strings.TrimSpace(string(parameters)) == "null" {
+		return ""
+	}
+
+	var decoded interface{}
+	canonical := []byte(parameters)
+	if err := json.Unmarshal(parameters, &decoded); err == nil {
+		canonical, _ = json.Marshal(decoded)
+	}
+
+	sum := sha256.Sum256(canonical)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
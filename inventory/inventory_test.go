@@ -0,0 +1,173 @@
+package inventory_test
+
+import (
+	"encoding/json"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/inventory"
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Inventory", func() {
+	var inv *inventory.Inventory
+
+	BeforeEach(func() {
+		s, err := store.Open("")
+		Expect(err).NotTo(HaveOccurred())
+		inv = inventory.New(s)
+	})
+
+	Describe("instances", func() {
+		BeforeEach(func() {
+			Expect(inv.PutInstance(inventory.Instance{InstanceID: "i1", ServiceID: "s1", OrganizationGUID: "org-1", SpaceGUID: "space-1", Operation: "provision", State: inventory.Succeeded})).To(Succeed())
+			Expect(inv.PutInstance(inventory.Instance{InstanceID: "i2", ServiceID: "s2", OrganizationGUID: "org-1", SpaceGUID: "space-2", Operation: "provision", State: inventory.InProgress})).To(Succeed())
+			Expect(inv.PutInstance(inventory.Instance{InstanceID: "i3", ServiceID: "s1", OrganizationGUID: "org-2", Operation: "deprovision", State: inventory.Succeeded})).To(Succeed())
+		})
+
+		ids := func(instances []inventory.Instance) []string {
+			result := []string{}
+			for _, instance := range instances {
+				result = append(result, instance.InstanceID)
+			}
+			return result
+		}
+
+		It("sets timestamps", func() {
+			instance, found, err := inv.Instance("i1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(instance.CreatedAt).NotTo(BeZero())
+			Expect(instance.UpdatedAt).To(Equal(instance.CreatedAt))
+		})
+
+		It("keeps the creation time on updates", func() {
+			instance, _, _ := inv.Instance("i1")
+			instance.State = inventory.Failed
+			Expect(inv.PutInstance(instance)).To(Succeed())
+
+			updated, _, _ := inv.Instance("i1")
+			Expect(updated.CreatedAt).To(Equal(instance.CreatedAt))
+			Expect(updated.UpdatedAt).To(BeTemporally(">=", instance.CreatedAt))
+		})
+
+		It("lists instances that have not been deprovisioned", func() {
+			instances, err := inv.Instances(inventory.Filter{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids(instances)).To(Equal([]string{"i1", "i2"}))
+		})
+
+		It("includes deprovisioned instances on request", func() {
+			instances, err := inv.Instances(inventory.Filter{IncludeDeleted: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids(instances)).To(Equal([]string{"i1", "i2", "i3"}))
+		})
+
+		It("filters instances", func() {
+			instances, err := inv.Instances(inventory.Filter{OrganizationGUID: "org-1", ServiceID: "s1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids(instances)).To(Equal([]string{"i1"}))
+
+			instances, err = inv.Instances(inventory.Filter{State: inventory.InProgress})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids(instances)).To(Equal([]string{"i2"}))
+		})
+	})
+
+	Describe("bindings", func() {
+		It("lists the bindings of an instance", func() {
+			Expect(inv.PutBinding(inventory.Binding{InstanceID: "i1", BindingID: "b1", Operation: "bind", State: inventory.Succeeded})).To(Succeed())
+			Expect(inv.PutBinding(inventory.Binding{InstanceID: "i1", BindingID: "b2", Operation: "unbind", State: inventory.Succeeded})).To(Succeed())
+			Expect(inv.PutBinding(inventory.Binding{InstanceID: "i10", BindingID: "b3", Operation: "bind", State: inventory.Succeeded})).To(Succeed())
+
+			bindings, err := inv.Bindings(inventory.Filter{InstanceID: "i1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bindings).To(HaveLen(1))
+			Expect(bindings[0].BindingID).To(Equal("b1"))
+
+			bindings, err = inv.Bindings(inventory.Filter{IncludeDeleted: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bindings).To(HaveLen(3))
+		})
+	})
+
+	Describe("Prune", func() {
+		It("removes deprovisioned instances and unbound bindings updated before the given time", func() {
+			Expect(inv.PutInstance(inventory.Instance{InstanceID: "i1", Operation: "provision", State: inventory.Succeeded})).To(Succeed())
+			Expect(inv.PutInstance(inventory.Instance{InstanceID: "i2", Operation: "deprovision", State: inventory.Succeeded})).To(Succeed())
+			Expect(inv.PutInstance(inventory.Instance{InstanceID: "i3", Operation: "deprovision", State: inventory.InProgress})).To(Succeed())
+			Expect(inv.PutBinding(inventory.Binding{InstanceID: "i1", BindingID: "b1", Operation: "bind", State: inventory.Succeeded})).To(Succeed())
+			Expect(inv.PutBinding(inventory.Binding{InstanceID: "i1", BindingID: "b2", Operation: "unbind", State: inventory.Succeeded})).To(Succeed())
+
+			pruned, err := inv.Prune(time.Now().Add(-time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pruned).To(Equal(0))
+
+			pruned, err = inv.Prune(time.Now().Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pruned).To(Equal(2))
+
+			instances, err := inv.Instances(inventory.Filter{IncludeDeleted: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(HaveLen(2))
+			bindings, err := inv.Bindings(inventory.Filter{IncludeDeleted: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bindings).To(HaveLen(1))
+			Expect(bindings[0].BindingID).To(Equal("b1"))
+		})
+	})
+
+	Describe("Watch", func() {
+		It("passes the existing records and then every change", func() {
+			Expect(inv.PutInstance(inventory.Instance{InstanceID: "i1", Operation: "provision", State: inventory.Succeeded})).To(Succeed())
+
+			var changes []string
+			describe := func(instance *inventory.Instance) string {
+				if instance == nil {
+					return "none"
+				}
+				return instance.InstanceID + " " + instance.Operation + " " + instance.State
+			}
+			Expect(inv.Watch(inventory.Watcher{
+				Instance: func(before, after *inventory.Instance) {
+					changes = append(changes, describe(before)+" -> "+describe(after))
+				},
+				Binding: func(before, after *inventory.Binding) {
+					changes = append(changes, "binding "+after.BindingID)
+				},
+			})).To(Succeed())
+
+			Expect(inv.PutInstance(inventory.Instance{InstanceID: "i1", Operation: "deprovision", State: inventory.Succeeded})).To(Succeed())
+			Expect(inv.PutBinding(inventory.Binding{InstanceID: "i2", BindingID: "b1", Operation: "bind", State: inventory.Succeeded})).To(Succeed())
+			Expect(inv.Prune(time.Now().Add(time.Hour))).To(Equal(1))
+
+			Expect(changes).To(Equal([]string{
+				"none -> i1 provision succeeded",
+				"i1 provision succeeded -> i1 deprovision succeeded",
+				"binding b1",
+				"i1 deprovision succeeded -> none",
+			}))
+		})
+	})
+
+	Describe("HashParameters", func() {
+		It("does not depend on key order or formatting", func() {
+			a := inventory.HashParameters(json.RawMessage(`{"a": 1, "b": {"c": true}}`))
+			b := inventory.HashParameters(json.RawMessage(`{"b":{"c":true},"a":1}`))
+
+			Expect(a).To(HavePrefix("sha256:"))
+			Expect(a).To(Equal(b))
+		})
+
+		It("differs for different parameters", func() {
+			Expect(inventory.HashParameters(json.RawMessage(`{"a": 1}`))).NotTo(Equal(inventory.HashParameters(json.RawMessage(`{"a": 2}`))))
+		})
+
+		It("is empty without parameters", func() {
+			Expect(inventory.HashParameters(nil)).To(BeEmpty())
+			Expect(inventory.HashParameters(json.RawMessage("null"))).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,241 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/buffer"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+type requestDetails struct {
+	ServiceID        string          `json:"service_id"`
+	PlanID           string          `json:"plan_id"`
+	OrganizationGUID string          `json:"organization_guid"`
+	SpaceGUID        string          `json:"space_guid"`
+	Context          json.RawMessage `json:"context"`
+	Parameters       json.RawMessage `json:"parameters"`
+	BindResource     struct {
+		AppGUID string `json:"app_guid"`
+	} `json:"bind_resource"`
+}
+
+type cfContext struct {
+	OrganizationGUID string `json:"organization_guid"`
+	SpaceGUID        string `json:"space_guid"`
+}
+
+// Recorder records every instance and binding operation that passes through
+// it, together with its outcome, in the inventory.
+func Recorder(inv *Inventory) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		route := osbapi.ParseRoute(r.Method, r.URL.Path)
+		if route.Operation == osbapi.Catalog || route.Operation == osbapi.Unknown ||
+			route.Operation == osbapi.FetchInstance || route.Operation == osbapi.FetchBinding {
+			next(rw, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusBadRequest, "", "Could not read request body")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var details requestDetails
+		json.Unmarshal(body, &details)
+		query := r.URL.Query()
+		if details.ServiceID == "" {
+			details.ServiceID = query.Get("service_id")
+		}
+		if details.PlanID == "" {
+			details.PlanID = query.Get("plan_id")
+		}
+
+		res := buffer.NewResponse()
+		next(res, r)
+		res.WriteTo(rw)
+
+		if err := inv.record(route, details, res); err != nil {
+			logging.FromContext(r.Context()).Error(fmt.Sprintf("Failed to record %s of service instance %s in the inventory", route.Operation, route.InstanceID), err)
+		}
+	})
+}
+
+func (inv *Inventory) record(route osbapi.Route, details requestDetails, res *buffer.Response) error {
+	switch route.Operation {
+	case osbapi.Provision, osbapi.Update, osbapi.Deprovision:
+		return inv.recordInstance(route, details, res.Status())
+	case osbapi.Bind, osbapi.Unbind:
+		return inv.recordBinding(route, details, res.Status())
+	case osbapi.LastOperation:
+		return inv.recordInstanceLastOperation(route, res)
+	case osbapi.BindingLastOperation:
+		return inv.recordBindingLastOperation(route, res)
+	}
+	return nil
+}
+
+func (inv *Inventory) recordInstance(route osbapi.Route, details requestDetails, status int) error {
+	instance, found, err := inv.Instance(route.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	state := stateFor(route.Operation, status)
+	// A failed provision of an instance that already exists, such as a
+	// conflicting one, says nothing about the instance itself.
+	if state == Failed && found && route.Operation == osbapi.Provision {
+		return nil
+	}
+
+	instance.InstanceID = route.InstanceID
+	instance.Operation = string(route.Operation)
+	instance.State = state
+
+	// Failed updates and deprovisions leave the instance as it was.
+	if !found || (state != Failed && route.Operation != osbapi.Deprovision) {
+		describeInstance(&instance, route.Operation, details)
+	}
+
+	return inv.PutInstance(instance)
+}
+
+func describeInstance(instance *Instance, operation osbapi.Operation, details requestDetails) {
+	if details.ServiceID != "" {
+		instance.ServiceID = details.ServiceID
+	}
+	if details.PlanID != "" {
+		instance.PlanID = details.PlanID
+	}
+	if len(details.Context) != 0 {
+		instance.Context = details.Context
+	}
+	if operation == osbapi.Provision || details.Parameters != nil {
+		instance.ParametersHash = HashParameters(details.Parameters)
+	}
+
+	org, space := details.OrganizationGUID, details.SpaceGUID
+	var context cfContext
+	if json.Unmarshal(details.Context, &context) == nil {
+		if context.OrganizationGUID != "" {
+			org = context.OrganizationGUID
+		}
+		if context.SpaceGUID != "" {
+			space = context.SpaceGUID
+		}
+	}
+
+	if org != "" {
+		instance.OrganizationGUID = org
+	}
+	if space != "" {
+		instance.SpaceGUID = space
+	}
+}
+
+func (inv *Inventory) recordBinding(route osbapi.Route, details requestDetails, status int) error {
+	binding, found, err := inv.Binding(route.InstanceID, route.BindingID)
+	if err != nil {
+		return err
+	}
+
+	state := stateFor(route.Operation, status)
+	if state == Failed && found && route.Operation == osbapi.Bind {
+		return nil
+	}
+
+	binding.InstanceID = route.InstanceID
+	binding.BindingID = route.BindingID
+	binding.Operation = string(route.Operation)
+	binding.State = state
+
+	if route.Operation == osbapi.Bind {
+		binding.ServiceID = details.ServiceID
+		binding.PlanID = details.PlanID
+		binding.AppGUID = details.BindResource.AppGUID
+		binding.Context = details.Context
+		binding.ParametersHash = HashParameters(details.Parameters)
+	} else if !found {
+		binding.ServiceID = details.ServiceID
+		binding.PlanID = details.PlanID
+	}
+
+	return inv.PutBinding(binding)
+}
+
+func (inv *Inventory) recordInstanceLastOperation(route osbapi.Route, res *buffer.Response) error {
+	instance, found, err := inv.Instance(route.InstanceID)
+	if err != nil || !found || instance.State != InProgress {
+		return err
+	}
+
+	state, ok := lastOperationState(instance.Operation, res)
+	if !ok {
+		return nil
+	}
+
+	instance.State = state
+	return inv.PutInstance(instance)
+}
+
+func (inv *Inventory) recordBindingLastOperation(route osbapi.Route, res *buffer.Response) error {
+	binding, found, err := inv.Binding(route.InstanceID, route.BindingID)
+	if err != nil || !found || binding.State != InProgress {
+		return err
+	}
+
+	state, ok := lastOperationState(binding.Operation, res)
+	if !ok {
+		return nil
+	}
+
+	binding.State = state
+	return inv.PutBinding(binding)
+}
+
+// lastOperationState interprets a last_operation response. A resource that
+// is gone has been deleted successfully when deleting it was the operation.
+func lastOperationState(operation string, res *buffer.Response) (string, bool) {
+	deleting := operation == string(osbapi.Deprovision) || operation == string(osbapi.Unbind)
+
+	if res.Status() == http.StatusGone && deleting {
+		return Succeeded, true
+	}
+	if res.Status() != http.StatusOK {
+		return "", false
+	}
+
+	var lastOperation struct {
+		State string `json:"state"`
+	}
+	if json.Unmarshal(res.Body.Bytes(), &lastOperation) != nil {
+		return "", false
+	}
+
+	switch lastOperation.State {
+	case InProgress, Succeeded, Failed:
+		return lastOperation.State, true
+	}
+	return "", false
+}
+
+func stateFor(operation osbapi.Operation, status int) string {
+	deleting := operation == osbapi.Deprovision || operation == osbapi.Unbind
+
+	switch {
+	case status == http.StatusAccepted:
+		return InProgress
+	case status >= 200 && status < 300, deleting && status == http.StatusGone:
+		return Succeeded
+	default:
+		return Failed
+	}
+}
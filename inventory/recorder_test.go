@@ -0,0 +1,223 @@
+package inventory_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/inventory"
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/urfave/negroni"
+)
+
+var _ = Describe("Recorder", func() {
+	const provisionBody = `{
+		"service_id": "s1",
+		"plan_id": "p1",
+		"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1", "instance_name": "db"},
+		"parameters": {"tier": "small"}
+	}`
+
+	var (
+		inv            *inventory.Inventory
+		recorder       negroni.HandlerFunc
+		brokerStatus   int
+		brokerResponse string
+		receivedBody   string
+		writer         *httptest.ResponseRecorder
+	)
+
+	serve := func(method, path, body string) {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+
+		writer = httptest.NewRecorder()
+		recorder(writer, req, func(w http.ResponseWriter, r *http.Request) {
+			received, _ := ioutil.ReadAll(r.Body)
+			receivedBody = string(received)
+			w.WriteHeader(brokerStatus)
+			w.Write([]byte(brokerResponse))
+		})
+	}
+
+	instance := func(id string) inventory.Instance {
+		instance, found, err := inv.Instance(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		return instance
+	}
+
+	binding := func(instanceID, bindingID string) inventory.Binding {
+		binding, found, err := inv.Binding(instanceID, bindingID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		return binding
+	}
+
+	BeforeEach(func() {
+		s, err := store.Open("")
+		Expect(err).NotTo(HaveOccurred())
+		inv = inventory.New(s)
+		recorder = inventory.Recorder(inv)
+		brokerStatus = http.StatusCreated
+		brokerResponse = "{}"
+	})
+
+	It("forwards the request and response unchanged", func() {
+		brokerResponse = `{"dashboard_url": "https://example.com"}`
+		serve("PUT", "/v2/service_instances/i1", provisionBody)
+
+		Expect(receivedBody).To(Equal(provisionBody))
+		Expect(writer.Code).To(Equal(http.StatusCreated))
+		Expect(writer.Body.String()).To(Equal(brokerResponse))
+	})
+
+	Describe("provisioning", func() {
+		It("records the instance", func() {
+			serve("PUT", "/v2/service_instances/i1", provisionBody)
+
+			recorded := instance("i1")
+			Expect(recorded.ServiceID).To(Equal("s1"))
+			Expect(recorded.PlanID).To(Equal("p1"))
+			Expect(recorded.OrganizationGUID).To(Equal("org-1"))
+			Expect(recorded.SpaceGUID).To(Equal("space-1"))
+			Expect(recorded.Context).To(MatchJSON(`{"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1", "instance_name": "db"}`))
+			Expect(recorded.ParametersHash).To(Equal(inventory.HashParameters([]byte(`{"tier": "small"}`))))
+			Expect(recorded.Operation).To(Equal("provision"))
+			Expect(recorded.State).To(Equal(inventory.Succeeded))
+		})
+
+		It("falls back to the legacy organization and space fields", func() {
+			serve("PUT", "/v2/service_instances/i1", `{"service_id": "s1", "plan_id": "p1", "organization_guid": "org-2", "space_guid": "space-2"}`)
+
+			Expect(instance("i1").OrganizationGUID).To(Equal("org-2"))
+			Expect(instance("i1").SpaceGUID).To(Equal("space-2"))
+		})
+
+		It("follows asynchronous provisions through last_operation", func() {
+			brokerStatus = http.StatusAccepted
+			serve("PUT", "/v2/service_instances/i1", provisionBody)
+			Expect(instance("i1").State).To(Equal(inventory.InProgress))
+
+			brokerStatus = http.StatusOK
+			brokerResponse = `{"state": "in progress"}`
+			serve("GET", "/v2/service_instances/i1/last_operation", "")
+			Expect(instance("i1").State).To(Equal(inventory.InProgress))
+
+			brokerResponse = `{"state": "succeeded"}`
+			serve("GET", "/v2/service_instances/i1/last_operation", "")
+			Expect(instance("i1").State).To(Equal(inventory.Succeeded))
+		})
+
+		It("records failed provisions", func() {
+			brokerStatus = http.StatusBadRequest
+			serve("PUT", "/v2/service_instances/i1", provisionBody)
+
+			Expect(instance("i1").State).To(Equal(inventory.Failed))
+		})
+
+		It("does not let conflicting provisions overwrite an instance", func() {
+			serve("PUT", "/v2/service_instances/i1", provisionBody)
+
+			brokerStatus = http.StatusConflict
+			serve("PUT", "/v2/service_instances/i1", `{"service_id": "s2", "plan_id": "p2"}`)
+
+			Expect(instance("i1").ServiceID).To(Equal("s1"))
+			Expect(instance("i1").State).To(Equal(inventory.Succeeded))
+		})
+	})
+
+	Describe("updating", func() {
+		BeforeEach(func() {
+			serve("PUT", "/v2/service_instances/i1", provisionBody)
+		})
+
+		It("records the new plan and parameters", func() {
+			brokerStatus = http.StatusOK
+			serve("PATCH", "/v2/service_instances/i1", `{"service_id": "s1", "plan_id": "p2", "parameters": {"tier": "large"}}`)
+
+			updated := instance("i1")
+			Expect(updated.PlanID).To(Equal("p2"))
+			Expect(updated.ParametersHash).To(Equal(inventory.HashParameters([]byte(`{"tier": "large"}`))))
+			Expect(updated.OrganizationGUID).To(Equal("org-1"))
+			Expect(updated.Operation).To(Equal("update"))
+		})
+
+		It("keeps the instance as it was when the update fails", func() {
+			brokerStatus = http.StatusUnprocessableEntity
+			serve("PATCH", "/v2/service_instances/i1", `{"service_id": "s1", "plan_id": "p2"}`)
+
+			updated := instance("i1")
+			Expect(updated.PlanID).To(Equal("p1"))
+			Expect(updated.Operation).To(Equal("update"))
+			Expect(updated.State).To(Equal(inventory.Failed))
+		})
+	})
+
+	Describe("deprovisioning", func() {
+		BeforeEach(func() {
+			serve("PUT", "/v2/service_instances/i1", provisionBody)
+		})
+
+		It("marks the instance as deleted", func() {
+			brokerStatus = http.StatusOK
+			serve("DELETE", "/v2/service_instances/i1?service_id=s1&plan_id=p1", "")
+
+			deleted := instance("i1")
+			Expect(deleted.Deleted()).To(BeTrue())
+			Expect(deleted.PlanID).To(Equal("p1"))
+		})
+
+		It("treats a gone last_operation as a completed deprovision", func() {
+			brokerStatus = http.StatusAccepted
+			serve("DELETE", "/v2/service_instances/i1?service_id=s1&plan_id=p1", "")
+			Expect(instance("i1").State).To(Equal(inventory.InProgress))
+
+			brokerStatus = http.StatusGone
+			serve("GET", "/v2/service_instances/i1/last_operation", "")
+			Expect(instance("i1").Deleted()).To(BeTrue())
+		})
+	})
+
+	Describe("binding", func() {
+		It("records bindings and unbindings", func() {
+			serve("PUT", "/v2/service_instances/i1/service_bindings/b1", `{"service_id": "s1", "plan_id": "p1", "bind_resource": {"app_guid": "app-1"}, "parameters": {"role": "viewer"}}`)
+
+			recorded := binding("i1", "b1")
+			Expect(recorded.AppGUID).To(Equal("app-1"))
+			Expect(recorded.ServiceID).To(Equal("s1"))
+			Expect(recorded.ParametersHash).NotTo(BeEmpty())
+			Expect(recorded.State).To(Equal(inventory.Succeeded))
+
+			brokerStatus = http.StatusOK
+			serve("DELETE", "/v2/service_instances/i1/service_bindings/b1?service_id=s1&plan_id=p1", "")
+			Expect(binding("i1", "b1").Deleted()).To(BeTrue())
+			Expect(binding("i1", "b1").AppGUID).To(Equal("app-1"))
+		})
+
+		It("follows asynchronous bindings through last_operation", func() {
+			brokerStatus = http.StatusAccepted
+			serve("PUT", "/v2/service_instances/i1/service_bindings/b1", `{"service_id": "s1", "plan_id": "p1"}`)
+			Expect(binding("i1", "b1").State).To(Equal(inventory.InProgress))
+
+			brokerStatus = http.StatusOK
+			brokerResponse = `{"state": "failed"}`
+			serve("GET", "/v2/service_instances/i1/service_bindings/b1/last_operation", "")
+			Expect(binding("i1", "b1").State).To(Equal(inventory.Failed))
+		})
+	})
+
+	It("does not record read-only requests", func() {
+		brokerStatus = http.StatusOK
+		serve("GET", "/v2/service_instances/i1", "")
+		serve("GET", "/v2/catalog", "")
+
+		instances, err := inv.Instances(inventory.Filter{IncludeDeleted: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(instances).To(BeEmpty())
+	})
+})
@@ -0,0 +1,159 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	levelInfo  = "info"
+	levelError = "error"
+	levelFatal = "fatal"
+)
+
+// Data holds the structured fields of a log line.
+type Data map[string]interface{}
+
+type sink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	errOut io.Writer
+	now    func() time.Time
+}
+
+// Logger writes log lines as JSON objects, one per line. Info lines go to the
+// standard output and error lines to the error output. Everything that is
+// logged is redacted first.
+type Logger struct {
+	sink *sink
+	data Data
+}
+
+type entry struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+	Error     string `json:"error,omitempty"`
+	Data      Data   `json:"data,omitempty"`
+}
+
+var (
+	defaultLogger = New(os.Stdout, os.Stderr)
+
+	exit = os.Exit
+)
+
+func New(out, errOut io.Writer) *Logger {
+	return &Logger{sink: &sink{out: out, errOut: errOut, now: time.Now}}
+}
+
+// Default returns the logger of the process.
+func Default() *Logger {
+	return defaultLogger
+}
+
+// SetOutput sends all lines of the default logger to w.
+func SetOutput(w io.Writer) {
+	defaultLogger.sink.mu.Lock()
+	defer defaultLogger.sink.mu.Unlock()
+
+	defaultLogger.sink.out = w
+	defaultLogger.sink.errOut = w
+}
+
+// With returns a logger that adds data to every line.
+func (l *Logger) With(data Data) *Logger {
+	return &Logger{sink: l.sink, data: merge(l.data, data)}
+}
+
+func (l *Logger) Info(message string, data ...Data) {
+	l.log(levelInfo, message, nil, data)
+}
+
+func (l *Logger) Error(message string, err error, data ...Data) {
+	l.log(levelError, message, err, data)
+}
+
+// Fatal logs the error and exits the process.
+func (l *Logger) Fatal(message string, err error, data ...Data) {
+	l.log(levelFatal, message, err, data)
+	exit(1)
+}
+
+func (l *Logger) log(level, message string, err error, data []Data) {
+	e := entry{
+		Level:   level,
+		Message: redactString(message),
+	}
+	if err != nil {
+		e.Error = redactString(err.Error())
+	}
+
+	merged := l.data
+	for _, d := range data {
+		merged = merge(merged, d)
+	}
+	if len(merged) != 0 {
+		e.Data = Redact(merged).(Data)
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	e.Timestamp = l.sink.now().UTC().Format(time.RFC3339Nano)
+
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if encodeErr := encoder.Encode(e); encodeErr != nil {
+		line.Reset()
+		encoder.Encode(entry{Timestamp: e.Timestamp, Level: levelError, Message: "Failed to encode log line", Error: encodeErr.Error()})
+	}
+
+	out := l.sink.out
+	if level != levelInfo {
+		out = l.sink.errOut
+	}
+	out.Write(line.Bytes())
+}
+
+func merge(a, b Data) Data {
+	if len(b) == 0 {
+		return a
+	}
+
+	merged := make(Data, len(a)+len(b))
+	for key, value := range a {
+		merged[key] = value
+	}
+	for key, value := range b {
+		merged[key] = value
+	}
+	return merged
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	annotationsKey
+)
+
+// FromContext returns the logger of the request the context belongs to, or
+// the default logger outside of requests.
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return logger
+	}
+	return defaultLogger
+}
+
+// WithLogger returns a context that carries the logger.
+func WithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
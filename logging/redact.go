@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are redacted wherever they appear, compared case
+// insensitively. Bind responses carry their secrets in credentials.
+var sensitiveKeys = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"credentials":         true,
+	"password":            true,
+	"secret":              true,
+	"client_secret":       true,
+	"private_key":         true,
+	"access_token":        true,
+	"refresh_token":       true,
+	"id_token":            true,
+	"token":               true,
+}
+
+var authorizationPattern = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9\-._~+/]+=*`)
+
+// Redact returns a copy of v in which the values of sensitive keys are
+// replaced. It understands maps, slices, headers and raw JSON.
+func Redact(v interface{}) interface{} {
+	switch value := v.(type) {
+	case Data:
+		return Data(redactMap(value))
+	case map[string]interface{}:
+		return redactMap(value)
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, element := range value {
+			result[i] = Redact(element)
+		}
+		return result
+	case http.Header:
+		result := make(map[string]interface{}, len(value))
+		for key, values := range value {
+			if sensitive(key) {
+				result[key] = redacted
+			} else {
+				result[key] = strings.Join(values, ", ")
+			}
+		}
+		return result
+	case json.RawMessage:
+		return RedactJSON(value)
+	case string:
+		return redactString(value)
+	}
+	return v
+}
+
+// RedactJSON decodes and redacts a JSON document. Documents that cannot be
+// decoded are returned as redacted strings.
+func RedactJSON(body []byte) interface{} {
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return redactString(string(body))
+	}
+	return Redact(decoded)
+}
+
+func redactMap(m map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		if sensitive(key) {
+			result[key] = redacted
+		} else {
+			result[key] = Redact(value)
+		}
+	}
+	return result
+}
+
+func sensitive(key string) bool {
+	return sensitiveKeys[strings.ToLower(key)]
+}
+
+// redactString removes Authorization header values from free text such as
+// error messages.
+func redactString(s string) string {
+	return authorizationPattern.ReplaceAllString(s, "$1 "+redacted)
+}
@@ -0,0 +1,56 @@
+package logging_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redact", func() {
+	It("redacts sensitive keys at any depth", func() {
+		redacted := logging.Redact(map[string]interface{}{
+			"service_id": "s1",
+			"nested": []interface{}{
+				map[string]interface{}{"Password": "hunter2", "name": "db"},
+			},
+			"credentials": map[string]interface{}{"username": "u"},
+		})
+
+		Expect(redacted).To(Equal(map[string]interface{}{
+			"service_id": "s1",
+			"nested": []interface{}{
+				map[string]interface{}{"Password": "[REDACTED]", "name": "db"},
+			},
+			"credentials": "[REDACTED]",
+		}))
+	})
+
+	It("redacts authorization headers", func() {
+		redacted := logging.Redact(http.Header{
+			"Authorization":        {"Bearer 123"},
+			"X-Broker-Api-Version": {"2.14"},
+		})
+
+		Expect(redacted).To(Equal(map[string]interface{}{
+			"Authorization":        "[REDACTED]",
+			"X-Broker-Api-Version": "2.14",
+		}))
+	})
+
+	It("redacts raw JSON", func() {
+		redacted := logging.Redact(json.RawMessage(`{"credentials": {"private_key": "key"}, "syslog_drain_url": "syslog://x"}`))
+
+		Expect(redacted).To(Equal(map[string]interface{}{
+			"credentials":      "[REDACTED]",
+			"syslog_drain_url": "syslog://x",
+		}))
+	})
+
+	It("redacts authorization values in text that is not JSON", func() {
+		Expect(logging.RedactJSON([]byte("header was bearer xyz"))).To(Equal("header was bearer [REDACTED]"))
+	})
+})
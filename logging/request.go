@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// maxLoggedBody caps how much of a request or response body is logged.
+const maxLoggedBody = 64 * 1024
+
+// Option configures the handler returned by RequestLogger.
+type Option func(*options)
+
+type options struct {
+	bodies bool
+}
+
+// WithBodies adds the redacted headers and bodies of requests and responses
+// to the log line of every request.
+func WithBodies() Option {
+	return func(o *options) {
+		o.bodies = true
+	}
+}
+
+type annotations struct {
+	mu   sync.Mutex
+	data Data
+}
+
+// Annotate adds data to the log line of the request the context belongs to.
+// Outside of requests it does nothing.
+func Annotate(ctx context.Context, data Data) {
+	a, ok := ctx.Value(annotationsKey).(*annotations)
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.data = merge(a.data, data)
+}
+
+// RequestLogger logs one line for every request once it has been handled.
+// Handlers further down the chain can log with the request ID through
+// FromContext and add to the line through Annotate.
+func RequestLogger(logger *Logger, opts ...Option) negroni.HandlerFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := logger.sink.now()
+
+		route := osbapi.ParseRoute(r.Method, r.URL.Path)
+		requestLogger := logger.With(Data{"request_id": requestID(r)})
+		a := &annotations{}
+
+		ctx := WithLogger(r.Context(), requestLogger)
+		ctx = context.WithValue(ctx, annotationsKey, a)
+		r = r.WithContext(ctx)
+
+		data := Data{
+			"method": r.Method,
+			"path":   r.URL.Path,
+		}
+		if r.URL.RawQuery != "" {
+			data["query"] = r.URL.RawQuery
+		}
+		if route.Operation != osbapi.Unknown {
+			data["operation"] = route.Operation
+		}
+		if route.InstanceID != "" {
+			data["instance_id"] = route.InstanceID
+		}
+		if route.BindingID != "" {
+			data["binding_id"] = route.BindingID
+		}
+		if header := r.Header.Get("X-Broker-API-Originating-Identity"); header != "" {
+			if identity, err := osbapi.ParseOriginatingIdentity(header); err == nil {
+				data["platform"] = identity.Platform
+				data["user"] = identity.User()
+			}
+		}
+		if o.bodies {
+			data["request_headers"] = r.Header
+			if body, err := ioutil.ReadAll(r.Body); err == nil && len(body) != 0 {
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				data["request_body"] = loggedBody(body)
+			}
+		}
+
+		res := &responseRecorder{ResponseWriter: rw, recordBody: o.bodies}
+		next(res, r)
+
+		data["status"] = res.Status()
+		data["duration_ms"] = Milliseconds(logger.sink.now().Sub(start))
+		if o.bodies && res.body.Len() != 0 {
+			data["response_body"] = loggedBody(res.body.Bytes())
+		}
+
+		a.mu.Lock()
+		data = merge(data, a.data)
+		a.mu.Unlock()
+
+		if res.Status() >= http.StatusInternalServerError {
+			requestLogger.Error("Request failed", nil, data)
+			return
+		}
+		requestLogger.Info("Request handled", data)
+	})
+}
+
+// requestID prefers the ID the platform assigned to the request.
+func requestID(r *http.Request) string {
+	for _, header := range []string{"X-Broker-API-Request-Identity", "X-Vcap-Request-Id", "X-Request-Id"} {
+		if id := r.Header.Get(header); id != "" {
+			return id
+		}
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func loggedBody(body []byte) interface{} {
+	if len(body) > maxLoggedBody {
+		return "[TRUNCATED]"
+	}
+	return RedactJSON(body)
+}
+
+// Milliseconds converts a duration for logging, rounded to microseconds.
+func Milliseconds(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status     int
+	recordBody bool
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.recordBody && r.body.Len() <= maxLoggedBody {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -1,88 +1,571 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/urfave/negroni"
 
+	"code.cloudfoundry.org/gcp-broker-proxy/aggregator"
 	"code.cloudfoundry.org/gcp-broker-proxy/auth"
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/config"
+	"code.cloudfoundry.org/gcp-broker-proxy/inventory"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
 	"code.cloudfoundry.org/gcp-broker-proxy/oauth"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/parameters"
 	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
+	"code.cloudfoundry.org/gcp-broker-proxy/quota"
+	"code.cloudfoundry.org/gcp-broker-proxy/shutdown"
 	"code.cloudfoundry.org/gcp-broker-proxy/startupchecker"
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig"
 	"code.cloudfoundry.org/gcp-broker-proxy/token"
 )
 
+var logger = logging.Default()
+
+const inventoryPruneInterval = time.Hour
+
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate-config":
+			os.Exit(validateConfig(os.Args[2:], os.Stdout, os.Stderr))
+		case "hash-password":
+			os.Exit(hashPassword(os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
+
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"), os.Getenv)
+	if err != nil {
+		logger.Fatal("Invalid configuration", err)
+	}
+
+	syncBindings := proxy.SyncBindingConfig{
+		PollInterval: time.Duration(cfg.Bindings.PollInterval),
+		Timeout:      time.Duration(cfg.Bindings.Timeout),
 	}
 
-	username, password, brokerURLString, serviceAccountJSON := getRequiredEnvs()
+	registry := metrics.NewRegistry()
+
+	// In-flight requests and bindings being polled are drained on SIGTERM
+	// before background work is stopped and the stores are flushed.
+	servers := shutdown.NewGroup(time.Duration(cfg.Shutdown.Timeout))
+
+	var (
+		backends []aggregator.Backend
+		monitors []*startupchecker.Monitor
+		breakers []*breaker.Breaker
+	)
+	for _, broker := range cfg.BrokerList() {
+		backend, monitor, backendBreakers := newBackend(broker, cfg, syncBindings, registry, servers)
+		backends = append(backends, backend)
+		monitors = append(monitors, monitor)
+		breakers = append(breakers, backendBreakers...)
+	}
+	runStartupChecks(monitors, registry, cfg.Health.DegradedStart)
+	for _, monitor := range monitors {
+		servers.OnShutdown(monitor.Stop)
+	}
+
+	authOptions := []auth.Option{auth.WithLockout(newLockout(cfg.LockoutConfig(), registry))}
+	if rules := cfg.CertificateRules(); rules != nil {
+		authOptions = append(authOptions, auth.WithClientCertificates(rules))
+	}
+	if verifier := cfg.TokenVerifier(); verifier != nil {
+		authOptions = append(authOptions, auth.WithBearerTokens(verifier))
+	}
+	basicAuth := auth.Authenticator(cfg.BrokerCredentials(), authOptions...)
 
-	brokerURL, err := url.ParseRequestURI(brokerURLString)
+	inventoryStore, err := store.Open(cfg.InventoryFile)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("BROKER_URL must be a valid URL: %s", brokerURLString))
+		logger.Fatal("Failed to open INVENTORY_FILE", err)
+	}
+	servers.OnShutdown(closeStore(inventoryStore, "INVENTORY_FILE"))
+	inv := inventory.New(inventoryStore)
+	if retention := time.Duration(cfg.InventoryRetention); retention > 0 {
+		servers.OnShutdown(pruneInventory(inv, retention))
+	}
+
+	broker := negroni.New(metrics.Requests(registry), basicAuth, auth.Authorize())
+	if cfg.Validation.Enabled {
+		broker.Use(osbapi.Validator(cfg.ValidatorOptions()...))
+	}
+	catalogCache := catalog.NewCache(
+		catalog.WithTTL(time.Duration(cfg.Catalog.TTL)),
+		catalog.WithRefreshInterval(time.Duration(cfg.Catalog.RefreshInterval)),
+	)
+	registry.Gauge("gcp_broker_proxy_invalid_parameter_schemas",
+		"Parameter schemas of the cached catalog that are invalid, so parameters are not checked against them.").With().SetFunc(func() float64 {
+		return float64(catalogCache.InvalidSchemas())
+	})
+	if policy := cfg.Policy(); policy != nil {
+		broker.Use(catalog.Filter(*policy, catalogCache))
+	}
+	if policy := cfg.ParameterPolicy(); policy != nil {
+		broker.Use(parameters.Enforce(*policy, catalogCache))
+	}
+	if cfg.Validation.Parameters {
+		broker.Use(catalog.ValidateParameters(catalogCache))
+	}
+	// Labels are added after the parameters are validated, so that schemas
+	// that do not allow a labels parameter do not reject provisions.
+	if labels := cfg.ParameterLabels(); labels != nil {
+		broker.Use(parameters.InjectLabels(*labels, catalogCache))
+	}
+	quotas := newQuotas(cfg.QuotaLimits(), inv, catalogCache, registry)
+	if cfg.QuotaLimits() != nil {
+		broker.Use(quotas.Middleware())
+	}
+	broker.Use(inventory.Recorder(inv))
+	if len(backends) == 1 {
+		broker.UseHandler(backends[0].Handler)
+	} else {
+		routes, err := store.Open(cfg.RoutingStateFile)
+		if err != nil {
+			logger.Fatal("Failed to open ROUTING_STATE_FILE", err)
+		}
+		servers.OnShutdown(closeStore(routes, "ROUTING_STATE_FILE"))
+		broker.UseHandler(aggregator.New(backends, aggregator.CollisionStrategy(cfg.Catalog.Collisions), routes,
+			aggregator.WithRefreshInterval(time.Duration(cfg.Catalog.RefreshInterval))))
+	}
+
+	// The admin API is not part of the OSBAPI, so only the full role may use it.
+	adminAuth := []negroni.Handler{auth.Authenticator(cfg.AdminCredentials(), authOptions...), auth.Authorize()}
+	admin := negroni.New(adminAuth...)
+	admin.UseHandler(inventory.Handler(inv, "/admin"))
+	adminBreakers := negroni.New(adminAuth...)
+	adminBreakers.UseHandler(breaker.Handler(breakers...))
+	adminQuotas := negroni.New(adminAuth...)
+	adminQuotas.UseHandler(quota.Handler(quotas))
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", admin)
+	mux.Handle("/admin/breakers", adminBreakers)
+	mux.Handle("/admin/quotas", adminQuotas)
+	mux.Handle("/", broker)
+
+	var metricsAuth negroni.Handler
+	if cfg.MetricsAuthenticated() {
+		metricsAuth = auth.Authenticator(cfg.MetricsCredentials(), authOptions...)
+	}
+	if metricsPort := cfg.Metrics.Port; metricsPort != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metricsHandler(registry, metricsAuth))
+
+		listener := listen(metricsPort, "METRICS_PORT")
+		logger.Info("About to serve metrics on port "+metricsPort, logging.Data{"port": metricsPort})
+		servers.Serve("Metrics", &http.Server{Handler: metricsMux}, listener)
+	} else {
+		mux.Handle("/metrics", metricsHandler(registry, metricsAuth))
+	}
+
+	var loggingOptions []logging.Option
+	if cfg.Logging.Bodies {
+		loggingOptions = append(loggingOptions, logging.WithBodies())
+	}
+
+	n := negroni.New()
+	n.Use(logging.RequestLogger(logger, loggingOptions...))
+	n.UseHandler(mux)
+
+	// Health endpoints are unauthenticated and polled often, so they bypass
+	// the request log.
+	root := http.NewServeMux()
+	root.Handle("/healthz", startupchecker.LivenessHandler())
+	root.Handle("/readyz", startupchecker.ReadinessHandler(monitors...))
+	root.Handle("/", servers.Track(n))
+
+	var reloader *tlsconfig.Reloader
+	if cfg.TLS.Enabled || cfg.TLS.Port != "" {
+		reloader = newReloader(cfg, registry)
+		reloader.Start()
+		servers.OnShutdown(reloader.Stop)
 	}
 
-	tokenFetcher, err := oauth.NewGCPOAuth(serviceAccountJSON)
+	if tlsPort := cfg.TLS.Port; tlsPort != "" {
+		listener := tls.NewListener(listen(tlsPort, "TLS_PORT"), reloader.Config())
+		logger.Info("About to listen for TLS on port "+tlsPort, logging.Data{"port": tlsPort})
+		servers.Serve("TLS", &http.Server{Handler: root}, listener)
+	}
+
+	port := cfg.Port
+	listener := listen(port, "PORT")
+	if cfg.TLS.Enabled {
+		listener = tls.NewListener(listener, reloader.Config())
+	}
+	logger.Info("About to listen on port "+port, logging.Data{"port": port, "tls": cfg.TLS.Enabled})
+	servers.Serve("Broker", &http.Server{Handler: root}, listener)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	err = servers.Wait(signals)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Invalid SERVICE_ACCOUNT_JSON: %s", err))
+		logger.Error("Failed to shut down cleanly", err)
+	} else {
+		logger.Info("Shut down")
 	}
 
-	client := http.Client{}
+	os.Stdout.Sync()
+	os.Stderr.Sync()
+	if err != nil {
+		os.Exit(1)
+	}
+}
 
-	startupChecker := startupchecker.NewChecker(brokerURL, tokenFetcher, &client)
+// closeStore returns a shutdown hook that flushes the store to disk.
+func closeStore(s *store.Store, env string) func() {
+	return func() {
+		if err := s.Close(); err != nil {
+			logger.Error("Failed to flush "+env, err)
+		}
+	}
+}
 
-	err = startupChecker.Perform()
+// listen binds the port before the server is started, so that it accepts
+// connections as soon as it is logged to.
+func listen(port, env string) net.Listener {
+	listener, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		log.Fatal("Failed startup checks: " + err.Error())
+		logger.Fatal("Failed to listen on "+env, err)
 	}
-	fmt.Println("Startup checks passed")
+	return listener
+}
 
-	basicAuth := auth.BasicAuth(username, password)
-	reverseProxy := proxy.ReverseProxy(brokerURL)
-	tokenHandler := token.TokenHandler(tokenFetcher)
+// validateConfig checks the config file given as the only argument, or
+// named by CONFIG_FILE, together with the environment, and returns the exit
+// status.
+func validateConfig(args []string, stdout, stderr io.Writer) int {
+	path := os.Getenv("CONFIG_FILE")
+	switch len(args) {
+	case 0:
+	case 1:
+		path = args[0]
+	default:
+		fmt.Fprintln(stderr, "Usage: gcp-broker-proxy validate-config [path]")
+		return 2
+	}
 
-	n := negroni.New()
+	if _, err := config.Load(path, os.Getenv); err != nil {
+		fmt.Fprintln(stderr, "Invalid configuration:")
+		if configErr, ok := err.(*config.Error); ok {
+			for _, problem := range configErr.Problems {
+				fmt.Fprintln(stderr, "  "+problem)
+			}
+		} else {
+			fmt.Fprintln(stderr, "  "+err.Error())
+		}
+		return 1
+	}
+
+	fmt.Fprintln(stdout, "Configuration is valid")
+	return 0
+}
+
+// hashPassword prints an scrypt hash of the password read from stdin, for
+// use as a password_hash in BROKER_CREDENTIALS.
+func hashPassword(stdin io.Reader, stdout, stderr io.Writer) int {
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(stderr, "Failed to read the password:", err)
+		return 1
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		fmt.Fprintln(stderr, "Usage: echo <password> | gcp-broker-proxy hash-password")
+		return 2
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		fmt.Fprintln(stderr, "Failed to hash the password:", err)
+		return 1
+	}
+
+	fmt.Fprintln(stdout, hash)
+	return 0
+}
+
+func newBackend(broker config.Broker, cfg config.Config, syncBindings proxy.SyncBindingConfig, registry *metrics.Registry, servers *shutdown.Group) (aggregator.Backend, *startupchecker.Monitor, []*breaker.Breaker) {
+	brokerURL, err := url.ParseRequestURI(broker.URL)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("%s must be a valid URL: %s", broker.Setting("BROKER_URL", "url"), broker.URL), nil)
+	}
+
+	var (
+		breakers     []*breaker.Breaker
+		oauthOptions []oauth.Option
+		proxyOptions = []proxy.Option{
+			proxy.WithSyncBindings(syncBindings),
+			proxy.WithMetrics(registry),
+			proxy.WithTransport(cfg.UpstreamTransport()),
+			proxy.WithRetries(cfg.RetryConfig()),
+			proxy.WithShutdown(servers),
+		}
+	)
+	if breakerConfig := cfg.BreakerConfig(); breakerConfig.FailureThreshold > 0 {
+		brokerBreaker := newBreaker(breakerName(broker.Name, "broker"), breakerConfig, registry)
+		tokenBreaker := newBreaker(breakerName(broker.Name, "token"), breakerConfig, registry)
+		breakers = append(breakers, brokerBreaker, tokenBreaker)
+		proxyOptions = append(proxyOptions, proxy.WithBreaker(brokerBreaker))
+		oauthOptions = append(oauthOptions, oauth.WithBreaker(tokenBreaker))
+	}
+
+	tokenFetches := registry.Counter("gcp_broker_proxy_token_fetches_total",
+		"OAuth token requests to Google.", "broker", "result")
+	tokenFetchDurations := registry.Histogram("gcp_broker_proxy_token_fetch_duration_seconds",
+		"Time taken to fetch OAuth tokens.", metrics.DefaultBuckets, "broker")
+	observeTokenFetch := func(duration time.Duration, err error) {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		tokenFetches.With(broker.Name, result).Inc()
+		tokenFetchDurations.With(broker.Name).Observe(duration.Seconds())
+	}
+
+	oauthOptions = append(oauthOptions,
+		oauth.WithRefreshBefore(time.Duration(cfg.Token.RefreshBefore)),
+		oauth.WithFetchTimeout(time.Duration(cfg.Token.FetchTimeout)),
+		oauth.WithHTTPClient(&http.Client{Transport: cfg.UpstreamTransport()}),
+		oauth.WithFetchObserver(observeTokenFetch),
+	)
+	tokenFetcher, err := oauth.NewGCPOAuth(broker.ServiceAccountJSON, oauthOptions...)
+	if err != nil {
+		logger.Fatal("Invalid "+broker.Setting("SERVICE_ACCOUNT_JSON", "service_account_json"), err)
+	}
+	servers.OnShutdown(tokenFetcher.Stop)
+
+	registry.Gauge("gcp_broker_proxy_token_expiry_seconds",
+		"Seconds until the current OAuth token expires.", "broker").With(broker.Name).SetFunc(func() float64 {
+		expiry := tokenFetcher.Expiry()
+		if expiry.IsZero() {
+			return 0
+		}
+		return time.Until(expiry).Seconds()
+	})
+
+	client := &http.Client{Transport: cfg.UpstreamTransport()}
+
+	startupChecker := startupchecker.NewChecker(brokerURL, tokenFetcher, client)
+
+	healthChecks := registry.Gauge("gcp_broker_proxy_health_check_success",
+		"Whether the health check passed when it last ran.", "broker", "check")
+	monitor := startupchecker.NewMonitor(broker.Name, time.Duration(cfg.Health.Interval), startupChecker.Checks(),
+		startupchecker.WithObserver(func(result startupchecker.Result) {
+			success := 0.0
+			if result.Healthy {
+				success = 1
+			}
+			healthChecks.With(broker.Name, result.Name).Set(success)
+		}),
+	)
+
+	handler := negroni.New(
+		token.TokenHandler(tokenFetcher),
+		proxy.ReverseProxy(brokerURL, proxyOptions...),
+	)
+
+	return aggregator.Backend{Name: broker.Name, Handler: handler}, monitor, breakers
+}
+
+// breakerName names the breaker of a broker's upstream, which is "broker"
+// or "token", after the broker when it has a name.
+func breakerName(broker, upstream string) string {
+	if broker == "" {
+		return upstream
+	}
+	return broker + "/" + upstream
+}
+
+// newBreaker returns a circuit breaker whose state is logged and exported.
+func newBreaker(name string, config breaker.Config, registry *metrics.Registry) *breaker.Breaker {
+	states := registry.Gauge("gcp_broker_proxy_circuit_breaker_state",
+		"1 for the current state of the circuit breaker, 0 for the others.", "breaker", "state")
+	transitions := registry.Counter("gcp_broker_proxy_circuit_breaker_transitions_total",
+		"Changes of circuit breaker state by the state changed to.", "breaker", "state")
+
+	b := breaker.New(name, config, breaker.WithObserver(func(from, to breaker.State) {
+		transitions.With(name, string(to)).Inc()
+		data := logging.Data{"breaker": name, "from": string(from), "to": string(to)}
+		if to == breaker.Open {
+			logger.Error("Circuit breaker opened", nil, data)
+			return
+		}
+		logger.Info("Circuit breaker changed state", data)
+	}))
 
-	logger := negroni.NewLogger()
-	logger.SetFormat("{{.Status}} | {{.Method}} {{.Path}} {{.Request.URL.RawQuery}} | \t {{.Duration}} \n")
+	for _, state := range breaker.States {
+		state := state
+		states.With(name, string(state)).SetFunc(func() float64 {
+			if b.State() == state {
+				return 1
+			}
+			return 0
+		})
+	}
+	return b
+}
+
+// runStartupChecks runs the checks of every broker once and then keeps
+// running them in the background. When a check fails the proxy exits,
+// unless it may start in degraded mode, in which case it starts but is not
+// ready until the checks pass.
+func runStartupChecks(monitors []*startupchecker.Monitor, registry *metrics.Registry, degraded bool) {
+	startupChecks := registry.Gauge("gcp_broker_proxy_startup_check_success",
+		"Whether the startup checks of the broker passed.", "broker")
+
+	passed := true
+	for _, monitor := range monitors {
+		message := "Failed startup checks"
+		if monitor.Name() != "" {
+			message += " for broker " + monitor.Name()
+		}
+
+		err := monitor.RunOnce()
+		if err != nil {
+			startupChecks.With(monitor.Name()).Set(0)
+			if !degraded {
+				logger.Fatal(message, err)
+			}
+			logger.Error(message+", starting in degraded mode", err)
+			passed = false
+			continue
+		}
+		startupChecks.With(monitor.Name()).Set(1)
+	}
+
+	if passed {
+		logger.Info("Startup checks passed")
+	}
+
+	for _, monitor := range monitors {
+		monitor.Start()
+	}
+}
+
+// metricsHandler serves the metrics, behind authentication unless it is
+// nil.
+func metricsHandler(registry *metrics.Registry, authentication negroni.Handler) http.Handler {
+	if authentication == nil {
+		return registry.Handler()
+	}
+	return negroni.New(authentication, negroni.Wrap(registry.Handler()))
+}
+
+// newReloader loads the TLS certificates, and counts and logs their
+// reloads.
+func newReloader(cfg config.Config, registry *metrics.Registry) *tlsconfig.Reloader {
+	reloads := registry.Counter("gcp_broker_proxy_tls_reloads_total",
+		"Reloads of changed TLS certificate files by result.", "result")
+	expiry := registry.Gauge("gcp_broker_proxy_tls_certificate_expiry_seconds",
+		"Seconds until the served TLS certificate expires.")
+
+	opts := append([]tlsconfig.Option{}, cfg.TLSOptions()...)
+	opts = append(opts, tlsconfig.WithObserver(func(err error) {
+		if err != nil {
+			reloads.With("failure").Inc()
+			return
+		}
+		reloads.With("success").Inc()
+	}))
 
-	n.Use(logger)
-	n.Use(basicAuth)
-	n.Use(tokenHandler)
-	n.Use(reverseProxy)
+	reloader, err := tlsconfig.NewReloader(cfg.TLSFiles(), time.Duration(cfg.TLS.ReloadInterval), opts...)
+	if err != nil {
+		logger.Fatal("Invalid TLS configuration", err)
+	}
 
-	fmt.Printf("About to listen on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, n))
+	expiry.With().SetFunc(func() float64 {
+		return time.Until(reloader.NotAfter()).Seconds()
+	})
+	return reloader
 }
 
-func getRequiredEnvs() (username, password, brokerURL, serviceAccountJSON string) {
-	var missingEnvs []string
+// pruneInventory removes deleted records older than the retention from the
+// inventory now and then every hour, until the returned function is called.
+func pruneInventory(inv *inventory.Inventory, retention time.Duration) func() {
+	prune := func() {
+		pruned, err := inv.Prune(time.Now().Add(-retention))
+		if err != nil {
+			logger.Error("Failed to prune the inventory", err)
+			return
+		}
+		if pruned > 0 {
+			logger.Info("Pruned deleted records from the inventory", logging.Data{"records": pruned})
+		}
+	}
+	prune()
 
-	getRequiredEnv := func(env string) string {
-		parsedEnv := os.Getenv(env)
-		if parsedEnv == "" {
-			missingEnvs = append(missingEnvs, env)
+	ticker := time.NewTicker(inventoryPruneInterval)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				prune()
+			case <-stop:
+				return
+			}
 		}
-		return parsedEnv
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(stop)
 	}
+}
 
-	username = getRequiredEnv("USERNAME")
-	password = getRequiredEnv("PASSWORD")
-	brokerURL = getRequiredEnv("BROKER_URL")
-	serviceAccountJSON = getRequiredEnv("SERVICE_ACCOUNT_JSON")
+// newQuotas returns the enforcer of the quota limits, which serves their
+// usage even when there are none, and logs and counts rejections.
+func newQuotas(limits *quota.Limits, inv *inventory.Inventory, cache *catalog.Cache, registry *metrics.Registry) *quota.Enforcer {
+	rejections := registry.Counter("gcp_broker_proxy_quota_rejections_total",
+		"Requests rejected for exceeding a quota, by the scope of the quota.", "scope")
 
-	if len(missingEnvs) != 0 {
-		errMsg := fmt.Sprintf("Missing %s environment variable(s)", strings.Join(missingEnvs, ", "))
-		log.Fatal(errMsg)
+	if limits == nil {
+		limits = &quota.Limits{}
 	}
+	enforcer, err := quota.New(*limits, inv, cache, quota.WithObserver(func(rejection quota.Rejection) {
+		rejections.With(rejection.Scope).Inc()
+		logger.Info("Rejected a request over its quota", logging.Data{
+			"scope": rejection.Scope,
+			"key":   rejection.Key,
+			"limit": rejection.Limit,
+		})
+	}))
+	if err != nil {
+		logger.Fatal("Failed to read INVENTORY_FILE", err)
+	}
+	return enforcer
+}
+
+// newLockout tracks failed authentication attempts on every listener, and
+// logs and counts lockouts.
+func newLockout(config auth.LockoutConfig, registry *metrics.Registry) *auth.Lockout {
+	lockouts := registry.Counter("gcp_broker_proxy_auth_lockouts_total",
+		"Client addresses and usernames locked out after failed authentication attempts.", "scope")
 
-	return
+	return auth.NewLockout(config, auth.WithLockoutObserver(func(event auth.LockoutEvent) {
+		lockouts.With(event.Scope).Inc()
+		logger.Info("Locked out after failed authentication attempts", logging.Data{
+			"scope":    event.Scope,
+			"key":      event.Key,
+			"failures": event.Failures,
+			"until":    event.Until.UTC().Format(time.RFC3339),
+		})
+	}))
 }
@@ -1,12 +1,21 @@
 package main_test
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/config"
@@ -14,8 +23,11 @@ import (
 	. "github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"github.com/onsi/gomega/ghttp"
+	yaml "gopkg.in/yaml.v2"
 
 	_ "code.cloudfoundry.org/gcp-broker-proxy"
+	"code.cloudfoundry.org/gcp-broker-proxy/auth/authtest"
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig/tlsconfigtest"
 )
 
 var _ = Describe("GCP Broker Proxy", func() {
@@ -25,6 +37,10 @@ var _ = Describe("GCP Broker Proxy", func() {
 
 		brokerServer   *ghttp.Server
 		gcpOAuthServer *ghttp.Server
+
+		inventoryDir string
+		args         []string
+		stdin        string
 	)
 
 	BeforeEach(func() {
@@ -32,7 +48,7 @@ var _ = Describe("GCP Broker Proxy", func() {
 		brokerServer.AppendHandlers(
 			ghttp.CombineHandlers(
 				ghttp.VerifyRequest("GET", "/v2/catalog"),
-				ghttp.RespondWith(http.StatusOK, "{}"),
+				ghttp.RespondWith(http.StatusOK, `{"services": []}`),
 			),
 		)
 
@@ -58,25 +74,34 @@ var _ = Describe("GCP Broker Proxy", func() {
 			"client_x509_cert_url": "https://www.googleapis.com/robot/v1/metadata/x509/oauth-testing%40oauth-test-172301.iam.gserviceaccount.com"
 		}`
 
+		var err error
+		inventoryDir, err = ioutil.TempDir("", "gcp-broker-proxy-inventory")
+		Expect(err).NotTo(HaveOccurred())
+
 		envs = &envVars{
 			port:               strconv.Itoa(8081 + config.GinkgoConfig.ParallelNode),
 			serviceAccountJSON: testServiceAccountJSON,
 			brokerURL:          brokerServer.URL(),
 			username:           "admin",
 			password:           "password",
+			inventoryFile:      filepath.Join(inventoryDir, "inventory.json"),
 		}
+		args = nil
+		stdin = ""
 	})
 
 	AfterEach(func() {
 		brokerServer.Close()
 		gcpOAuthServer.Close()
+		os.RemoveAll(inventoryDir)
 
 		session.Kill()
 	})
 
 	JustBeforeEach(func() {
-		cmd := exec.Command(gcpBrokerProxyBinary)
+		cmd := exec.Command(gcpBrokerProxyBinary, args...)
 		cmd.Env = envs.toStringArray()
+		cmd.Stdin = strings.NewReader(stdin)
 
 		var err error
 		session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
@@ -167,136 +192,1570 @@ var _ = Describe("GCP Broker Proxy", func() {
 				_, err := client.Do(req)
 				Expect(err).ToNot(HaveOccurred())
 
-				Eventually(session).Should(Say("200"))
-				Eventually(session).Should(Say("PUT /v2/any-endpoint query=param"))
+				Eventually(session).Should(Say(`"message":"Request handled"`))
+				Expect(session).To(Say(`"method":"PUT"`))
+				Expect(session).To(Say(`"path":"/v2/any-endpoint"`))
+				Expect(session).To(Say(`"query":"query=param"`))
+				Expect(session).To(Say(`"request_id":"[0-9a-f]{32}"`))
+				Expect(session).To(Say(`"status":200`))
+				Expect(session).To(Say(`"upstream_status":200`))
 			})
 		})
 
-		Context("when using incorrect credentials", func() {
-			It("responds with 401", func() {
-				Eventually(func() int {
-					res, err := http.Get("http://localhost:" + envs.port)
-					if err != nil {
-						return -1
-					}
-					return res.StatusCode
-				}).Should(Equal(401))
+		Context("when request bodies are logged", func() {
+			BeforeEach(func() {
+				envs.logBodies = "true"
+
+				gcpOAuthServer.RouteToHandler("POST", "/", func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, `{"access_token": "123"}`)
+				})
+			})
+
+			It("logs the originating user and redacts credentials", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+				serveCatalog(brokerServer)
+
+				brokerServer.AppendHandlers(
+					ghttp.RespondWith(http.StatusCreated, `{"credentials": {"private_key": "very-secret"}}`),
+				)
+
+				req, err := http.NewRequest("PUT", "http://localhost:"+envs.port+"/v2/service_instances/instance-1/service_bindings/binding-1?accepts_incomplete=true", strings.NewReader(`{"service_id": "s1", "plan_id": "p1"}`))
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth(envs.username, envs.password)
+				req.Header.Set("X-Broker-API-Originating-Identity", "cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4In0=")
+				req.Header.Set("X-Broker-API-Request-Identity", "request-1")
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusCreated))
+
+				Eventually(session).Should(Say(`"message":"Request handled"`))
+				Expect(session).To(Say(`"binding_id":"binding-1"`))
+				Expect(session).To(Say(`"instance_id":"instance-1"`))
+				Expect(session).To(Say(`"operation":"bind"`))
+				Expect(session).To(Say(`"request_headers":\{[^}]*"Authorization":"\[REDACTED\]"`))
+				Expect(session).To(Say(`"request_id":"request-1"`))
+				Expect(session).To(Say(`"response_body":\{"credentials":"\[REDACTED\]"\}`))
+				Expect(session).To(Say(`"user":"683ea748"`))
+				Expect(session.Out.Contents()).NotTo(ContainSubstring("very-secret"))
 			})
 		})
-	})
 
-	Describe("when the server is not correctly configured", func() {
-		Context("when the server has not been provided service account information", func() {
+		Context("when the broker binds asynchronously", func() {
+			const bindingPath = "/v2/service_instances/instance-1/service_bindings/binding-1"
+
 			BeforeEach(func() {
-				envs.serviceAccountJSON = ""
+				envs.bindingPollInterval = "10ms"
+
+				gcpOAuthServer.AppendHandlers(
+					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						fmt.Fprint(w, `{"access_token": "123"}`)
+					}),
+				)
 			})
 
-			It("it fails to start", func() {
-				Eventually(session).Should(gexec.Exit())
+			It("responds synchronously with the completed binding", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+				serveCatalog(brokerServer)
+
+				brokerServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("PUT", bindingPath, "accepts_incomplete=true"),
+						ghttp.RespondWith(http.StatusAccepted, `{"operation": "op-1"}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath+"/last_operation", "operation=op-1&plan_id=plan-1&service_id=service-1"),
+						ghttp.VerifyHeaderKV("Authorization", "Bearer 123"),
+						ghttp.RespondWith(http.StatusOK, `{"state": "succeeded"}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath),
+						ghttp.RespondWith(http.StatusOK, `{"credentials": {"key": "value"}}`),
+					),
+				)
+
+				body := strings.NewReader(`{"service_id": "service-1", "plan_id": "plan-1"}`)
+				req, err := http.NewRequest("PUT", "http://localhost:"+envs.port+bindingPath, body)
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth(envs.username, envs.password)
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+
+				Expect(res.StatusCode).To(Equal(http.StatusCreated))
+				resBody, err := ioutil.ReadAll(res.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resBody).To(MatchJSON(`{"credentials": {"key": "value"}}`))
 			})
+		})
 
-			It("logs that the server requires the SERVICE_ACCOUNT_JSON param", func() {
-				Eventually(session.Err).Should(Say("Missing SERVICE_ACCOUNT_JSON environment variable"))
+		Context("when a catalog policy is configured", func() {
+			BeforeEach(func() {
+				envs.catalogPolicy = `{"services": {"deny": ["google-pubsub"]}}`
+
+				gcpOAuthServer.AppendHandlers(
+					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						fmt.Fprint(w, `{"access_token": "123"}`)
+					}),
+				)
+			})
+
+			It("filters the catalog", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+				brokerServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/catalog"),
+						ghttp.RespondWith(http.StatusOK, `{"services": [
+							{"id": "s1", "name": "google-storage", "plans": [{"id": "p1", "name": "beta"}]},
+							{"id": "s2", "name": "google-pubsub", "plans": [{"id": "p2", "name": "beta"}]}
+						]}`),
+					),
+				)
+
+				req, err := http.NewRequest("GET", "http://localhost:"+envs.port+"/v2/catalog", nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth(envs.username, envs.password)
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				body, err := ioutil.ReadAll(res.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(body).To(MatchJSON(`{"services": [{"id": "s1", "name": "google-storage", "plans": [{"id": "p1", "name": "beta"}]}]}`))
 			})
 		})
 
-		Context("when the server has not been provided broker url", func() {
+		Context("when several brokers are configured", func() {
+			var (
+				otherBrokerServer *ghttp.Server
+				stateDir          string
+			)
+
 			BeforeEach(func() {
+				otherBrokerServer = ghttp.NewServer()
+				otherBrokerServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, `{"services": []}`))
+
+				gcpOAuthServer.RouteToHandler("POST", "/", func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, `{"access_token": "123"}`)
+				})
+
+				var err error
+				stateDir, err = ioutil.TempDir("", "gcp-broker-proxy")
+				Expect(err).NotTo(HaveOccurred())
+
+				serviceAccountJSON, err := json.Marshal(envs.serviceAccountJSON)
+				Expect(err).NotTo(HaveOccurred())
+				envs.brokers = fmt.Sprintf(`[
+					{"name": "a", "url": %q, "service_account_json": %s},
+					{"name": "b", "url": %q, "service_account_json": %s}
+				]`, brokerServer.URL(), serviceAccountJSON, otherBrokerServer.URL(), serviceAccountJSON)
 				envs.brokerURL = ""
+				envs.serviceAccountJSON = ""
+				envs.routingStateFile = filepath.Join(stateDir, "routes.json")
 			})
 
-			It("it fails to start", func() {
-				Eventually(session).Should(gexec.Exit())
+			AfterEach(func() {
+				otherBrokerServer.Close()
+				os.RemoveAll(stateDir)
 			})
 
-			It("logs that the server requires the BROKER_URL param", func() {
-				Eventually(session.Err).Should(Say("Missing BROKER_URL environment variable"))
+			It("checks every broker at startup", func() {
+				Eventually(session).Should(Say("Startup checks passed"))
+				Expect(brokerServer.ReceivedRequests()).To(HaveLen(1))
+				Expect(otherBrokerServer.ReceivedRequests()).To(HaveLen(1))
+			})
+
+			It("merges the catalogs and routes by service", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+				brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, `{"services": [{"id": "s1", "name": "google-storage", "plans": [{"id": "p1", "name": "beta"}]}]}`))
+				otherBrokerServer.AppendHandlers(
+					ghttp.RespondWith(http.StatusOK, `{"services": [{"id": "s2", "name": "google-pubsub", "plans": [{"id": "p2", "name": "beta"}]}]}`),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("PUT", "/v2/service_instances/instance-1"),
+						ghttp.VerifyHeaderKV("Authorization", "Bearer 123"),
+						ghttp.RespondWith(http.StatusCreated, `{}`),
+					),
+				)
+
+				req, err := http.NewRequest("GET", "http://localhost:"+envs.port+"/v2/catalog", nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth(envs.username, envs.password)
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				body, err := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(body).To(MatchJSON(`{"services": [
+					{"id": "s1", "name": "google-storage", "plans": [{"id": "p1", "name": "beta"}]},
+					{"id": "s2", "name": "google-pubsub", "plans": [{"id": "p2", "name": "beta"}]}
+				]}`))
+
+				req, err = http.NewRequest("PUT", "http://localhost:"+envs.port+"/v2/service_instances/instance-1", strings.NewReader(`{"service_id": "s2", "plan_id": "p2"}`))
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth(envs.username, envs.password)
+
+				res, err = http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusCreated))
+
+				Expect(filepath.Join(stateDir, "routes.json")).To(BeAnExistingFile())
 			})
 		})
 
-		Context("when the broker url is invalid", func() {
+		Context("when instances are provisioned", func() {
 			BeforeEach(func() {
-				envs.brokerURL = "notaurl"
+				gcpOAuthServer.RouteToHandler("POST", "/", func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, `{"access_token": "123"}`)
+				})
+				brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusCreated, `{}`))
 			})
 
-			It("it fails to start", func() {
-				Eventually(session).Should(gexec.Exit())
+			provision := func() {
+				serveCatalog(brokerServer)
+
+				req, err := http.NewRequest("PUT", "http://localhost:"+envs.port+"/v2/service_instances/instance-1", strings.NewReader(`{
+					"service_id": "s1",
+					"plan_id": "p1",
+					"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1"}
+				}`))
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth(envs.username, envs.password)
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusCreated))
+			}
+
+			getInstances := func(username, password string) *http.Response {
+				req, err := http.NewRequest("GET", "http://localhost:"+envs.port+"/admin/instances?organization_guid=org-1", nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth(username, password)
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				return res
+			}
+
+			It("records them in the inventory file", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+				provision()
+
+				Expect(envs.inventoryFile).To(BeAnExistingFile())
 			})
 
-			It("logs that the server requires the BROKER_URL param", func() {
-				Eventually(session.Err).Should(Say("BROKER_URL must be a valid URL: notaurl"))
+			It("lists them through the admin endpoint", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+				provision()
+
+				res := getInstances(envs.username, envs.password)
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				body, err := ioutil.ReadAll(res.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(ContainSubstring(`"instance_id":"instance-1"`))
+				Expect(string(body)).To(ContainSubstring(`"space_guid":"space-1"`))
+			})
+
+			Context("when admin credentials are configured", func() {
+				BeforeEach(func() {
+					envs.adminUsername = "auditor"
+					envs.adminPassword = "secret"
+				})
+
+				It("requires them for the admin endpoint", func() {
+					Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+					res := getInstances(envs.username, envs.password)
+					res.Body.Close()
+					Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+
+					res = getInstances("auditor", "secret")
+					res.Body.Close()
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+				})
 			})
 		})
 
-		Context("when the server has not been provided username", func() {
-			BeforeEach(func() {
-				envs.username = ""
+		Context("when metrics are scraped", func() {
+			getMetrics := func(url, username, password string) (int, string) {
+				req, err := http.NewRequest("GET", url, nil)
+				Expect(err).NotTo(HaveOccurred())
+				if username != "" {
+					req.SetBasicAuth(username, password)
+				}
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+
+				body, err := ioutil.ReadAll(res.Body)
+				Expect(err).ToNot(HaveOccurred())
+				return res.StatusCode, string(body)
+			}
+
+			It("serves them on the broker port behind the admin credentials", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+				status, _ := getMetrics("http://localhost:"+envs.port+"/metrics", "", "")
+				Expect(status).To(Equal(http.StatusUnauthorized))
+
+				status, body := getMetrics("http://localhost:"+envs.port+"/metrics", envs.username, envs.password)
+				Expect(status).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`gcp_broker_proxy_startup_check_success{broker=""} 1`))
+				Expect(body).To(ContainSubstring(`gcp_broker_proxy_token_fetches_total{broker="",result="success"} 1`))
+				Expect(body).To(ContainSubstring(`gcp_broker_proxy_token_expiry_seconds{broker=""}`))
 			})
 
-			It("it fails to start", func() {
-				Eventually(session).Should(gexec.Exit())
+			Context("when they have their own port", func() {
+				BeforeEach(func() {
+					envs.metricsPort = strconv.Itoa(9081 + config.GinkgoConfig.ParallelNode)
+				})
+
+				It("serves them there without credentials", func() {
+					Eventually(session).Should(Say("About to serve metrics on port %s", envs.metricsPort))
+					Eventually(func() error {
+						res, err := http.Get("http://localhost:" + envs.metricsPort + "/metrics")
+						if err == nil {
+							res.Body.Close()
+						}
+						return err
+					}).Should(Succeed())
+
+					status, body := getMetrics("http://localhost:"+envs.metricsPort+"/metrics", "", "")
+					Expect(status).To(Equal(http.StatusOK))
+					Expect(body).To(ContainSubstring("gcp_broker_proxy_startup_check_success"))
+				})
+			})
+		})
+
+		Context("when the health endpoints are requested", func() {
+			It("serves liveness without credentials", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+				res, err := http.Get("http://localhost:" + envs.port + "/healthz")
+				Expect(err).ToNot(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
 			})
 
-			It("logs that the server requires the USERNAME param", func() {
-				Eventually(session.Err).Should(Say("Missing USERNAME environment variable"))
+			It("serves readiness without credentials", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+				res, err := http.Get("http://localhost:" + envs.port + "/readyz")
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				body, err := ioutil.ReadAll(res.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(ContainSubstring(`"status":"ready"`))
+				Expect(string(body)).To(ContainSubstring(`"name":"catalog_schema","healthy":true`))
 			})
 		})
 
-		Context("when the server has not been provided password", func() {
-			BeforeEach(func() {
-				envs.password = ""
+		Context("when using incorrect credentials", func() {
+			It("responds with 401", func() {
+				Eventually(func() int {
+					res, err := http.Get("http://localhost:" + envs.port)
+					if err != nil {
+						return -1
+					}
+					return res.StatusCode
+				}).Should(Equal(401))
 			})
+		})
+	})
 
-			It("it fails to start", func() {
-				Eventually(session).Should(gexec.Exit())
+	Describe("configuration file", func() {
+		var configFile string
+
+		writeConfig := func(settings map[string]interface{}) {
+			raw, err := yaml.Marshal(settings)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(configFile, raw, 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			configFile = filepath.Join(inventoryDir, "config.yml")
+			writeConfig(map[string]interface{}{
+				"port":                 "1",
+				"username":             envs.username,
+				"password":             envs.password,
+				"broker_url":           envs.brokerURL,
+				"service_account_json": envs.serviceAccountJSON,
 			})
 
-			It("logs that the server requires the PASSWORD param", func() {
-				Eventually(session.Err).Should(Say("Missing PASSWORD environment variable"))
+			envs.configFile = configFile
+			envs.username = ""
+			envs.password = ""
+			envs.brokerURL = ""
+			envs.serviceAccountJSON = ""
+		})
+
+		It("reads the settings from the file, overridden by the environment", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			req, err := http.NewRequest("GET", "http://localhost:"+envs.port+"/admin/instances", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth("admin", "password")
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		Context("when the file has unknown keys", func() {
+			BeforeEach(func() {
+				writeConfig(map[string]interface{}{"usernme": "admin"})
+			})
+
+			It("fails to start", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(Say(`"message":"Invalid configuration","error":"Invalid config file .*usernme`))
 			})
 		})
 
-		Context("when there are multiple missing parameters", func() {
+		Context("when running validate-config", func() {
 			BeforeEach(func() {
-				envs = &envVars{}
+				args = []string{"validate-config", configFile}
+				envs.configFile = ""
 			})
 
-			It("it fails to start", func() {
-				Eventually(session).Should(gexec.Exit())
+			It("reports that the file is valid without starting the server", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session).To(Say("Configuration is valid"))
+				Expect(session).NotTo(Say("About to listen"))
+				Expect(brokerServer.ReceivedRequests()).To(BeEmpty())
 			})
 
-			It("logs that it requires all missing params", func() {
-				Eventually(session.Err).Should(Say("Missing USERNAME, PASSWORD, BROKER_URL, SERVICE_ACCOUNT_JSON environment variable\\(s\\)"))
+			Context("when the file is invalid", func() {
+				BeforeEach(func() {
+					writeConfig(map[string]interface{}{
+						"broker_url": "notaurl",
+						"bindings":   map[string]string{"timeout": "0s"},
+					})
+				})
+
+				It("reports every problem", func() {
+					Eventually(session).Should(gexec.Exit(1))
+					Expect(session.Err).To(Say("Invalid configuration:"))
+					Expect(session.Err).To(Say("Missing USERNAME, PASSWORD, SERVICE_ACCOUNT_JSON environment variable\\(s\\)"))
+					Expect(session.Err).To(Say("BROKER_URL must be a valid URL: notaurl"))
+					Expect(session.Err).To(Say("BINDING_TIMEOUT must be a positive duration: 0s"))
+				})
 			})
 		})
 	})
-})
 
-type envVars struct {
-	port               string
-	serviceAccountJSON string
-	brokerURL          string
-	username           string
-	password           string
-}
+	Describe("broker credentials", func() {
+		get := func(username, password string) int {
+			req, err := http.NewRequest("GET", "http://localhost:"+envs.port+"/v2/catalog", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth(username, password)
 
-func (e *envVars) toStringArray() []string {
-	result := []string{}
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res.StatusCode
+		}
 
-	if e.port != "" {
-		result = append(result, "PORT="+e.port)
-	}
-	if e.serviceAccountJSON != "" {
-		result = append(result, "SERVICE_ACCOUNT_JSON="+e.serviceAccountJSON)
-	}
-	if e.brokerURL != "" {
-		result = append(result, "BROKER_URL="+e.brokerURL)
-	}
-	if e.username != "" {
-		result = append(result, "USERNAME="+e.username)
-	}
-	if e.password != "" {
-		result = append(result, "PASSWORD="+e.password)
+		BeforeEach(func() {
+			brokerServer.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, `{"services": []}`))
+
+			envs.brokerCredentials = `
+- label: old
+  username: broker
+  password: old-secret
+  expires: 2000-01-01T00:00:00Z
+- label: new
+  username: broker
+  password_hash: $scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$WKsC9ZI0iGLMMz/KHfEcD2EOm8ToKPyPG/5qc3GwrzY
+`
+		})
+
+		Context("when a credential has a restricted role", func() {
+			BeforeEach(func() {
+				envs.brokerCredentials = `[{"username": "monitoring", "password": "pass", "role": "catalog"}]`
+			})
+
+			It("rejects the operations the role does not allow", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+				Expect(get("monitoring", "pass")).To(Equal(http.StatusOK))
+
+				req, err := http.NewRequest("DELETE", "http://localhost:"+envs.port+"/v2/service_instances/instance-1", nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth("monitoring", "pass")
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).NotTo(HaveOccurred())
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+
+				body, err := ioutil.ReadAll(res.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(body).To(MatchJSON(`{"description": "Credential monitoring has the catalog role, which does not allow the deprovision operation"}`))
+			})
+		})
+
+		Context("when a client fails to authenticate too often", func() {
+			BeforeEach(func() {
+				envs.lockoutThreshold = "2"
+				envs.trustedProxies = "1"
+			})
+
+			It("locks it out and logs and counts the lockout", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+				Expect(get("broker", "wrong")).To(Equal(http.StatusUnauthorized))
+				Expect(get("broker", "wrong")).To(Equal(http.StatusUnauthorized))
+				Expect(get("broker", "new-secret")).To(Equal(http.StatusTooManyRequests))
+				Eventually(session).Should(Say(`"message":"Locked out after failed authentication attempts"`))
+
+				Eventually(func() string {
+					req, err := http.NewRequest("GET", "http://localhost:"+envs.port+"/metrics", nil)
+					Expect(err).NotTo(HaveOccurred())
+					req.SetBasicAuth(envs.username, envs.password)
+					req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+					res, err := http.DefaultClient.Do(req)
+					Expect(err).NotTo(HaveOccurred())
+					defer res.Body.Close()
+
+					body, err := ioutil.ReadAll(res.Body)
+					Expect(err).NotTo(HaveOccurred())
+					return string(body)
+				}).Should(ContainSubstring(`gcp_broker_proxy_auth_lockouts_total{scope="client"} 1`))
+			})
+		})
+
+		It("accepts every valid credential and logs which was used", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			Expect(get("broker", "new-secret")).To(Equal(http.StatusOK))
+			Eventually(session).Should(Say(`"credential":"new"`))
+
+			Expect(get(envs.username, envs.password)).To(Equal(http.StatusOK))
+			Expect(get("broker", "old-secret")).To(Equal(http.StatusUnauthorized))
+		})
+
+		Context("when hashing a password", func() {
+			BeforeEach(func() {
+				args = []string{"hash-password"}
+				stdin = "new-secret\n"
+			})
+
+			It("prints an scrypt hash", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session).To(Say(`^\$scrypt\$ln=15,r=8,p=1\$\S+\$\S+\n$`))
+			})
+		})
+	})
+
+	Describe("HTTPS", func() {
+		var (
+			certDir string
+			ca      *tlsconfigtest.CA
+			client  *http.Client
+		)
+
+		writeCertificate := func(commonName string) {
+			certificate, err := ca.Issue(tlsconfigtest.Options{CommonName: commonName})
+			Expect(err).NotTo(HaveOccurred())
+			certFile, keyFile, err := certificate.WriteFiles(certDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Make sure the modification time changes on coarse file systems.
+			later := time.Now().Add(time.Duration(len(certificate.PEM)) * time.Millisecond)
+			Expect(os.Chtimes(certFile, later, later)).To(Succeed())
+
+			envs.tlsCertFile = certFile
+			envs.tlsKeyFile = keyFile
+		}
+
+		servedCommonName := func() string {
+			res, err := client.Get("https://localhost:" + envs.port + "/healthz")
+			if err != nil {
+				return err.Error()
+			}
+			res.Body.Close()
+			return res.TLS.PeerCertificates[0].Subject.CommonName
+		}
+
+		BeforeEach(func() {
+			var err error
+			certDir, err = ioutil.TempDir("", "gcp-broker-proxy-certs")
+			Expect(err).NotTo(HaveOccurred())
+
+			brokerServer.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, `{"services": []}`))
+
+			ca, err = tlsconfigtest.NewCA("test-ca")
+			Expect(err).NotTo(HaveOccurred())
+			writeCertificate("first")
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Certificate)
+			client = &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: roots},
+				DisableKeepAlives: true,
+			}}
+
+			envs.tlsEnabled = "true"
+			envs.tlsMinVersion = "1.3"
+			envs.tlsReloadInterval = "50ms"
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(certDir)
+		})
+
+		It("serves PORT over HTTPS and reloads changed certificates", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			req, err := http.NewRequest("GET", "https://localhost:"+envs.port+"/v2/catalog", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth(envs.username, envs.password)
+			res, err := client.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.TLS.Version).To(Equal(uint16(tls.VersionTLS13)))
+
+			Expect(servedCommonName()).To(Equal("first"))
+			writeCertificate("second")
+			Eventually(servedCommonName).Should(Equal("second"))
+			Eventually(session).Should(Say(`"message":"Reloaded TLS certificates"`))
+		})
+
+		It("logs and counts failed reloads, and keeps the certificate", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			Expect(ioutil.WriteFile(envs.tlsKeyFile, []byte("not a key"), 0600)).To(Succeed())
+			Eventually(session.Err).Should(Say(`"message":"Failed to reload TLS certificates"`))
+			Expect(servedCommonName()).To(Equal("first"))
+
+			req, err := http.NewRequest("GET", "https://localhost:"+envs.port+"/metrics", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth(envs.username, envs.password)
+			res, err := client.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`gcp_broker_proxy_tls_reloads_total{result="failure"} 1`))
+			Expect(string(body)).To(ContainSubstring("gcp_broker_proxy_tls_certificate_expiry_seconds "))
+		})
+
+		It("does not serve plain HTTP", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			res, err := http.Get("http://localhost:" + envs.port + "/healthz")
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("client certificates", func() {
+		var (
+			certDir string
+			client  *http.Client
+		)
+
+		BeforeEach(func() {
+			brokerServer.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, `{"services": []}`))
+
+			var err error
+			certDir, err = ioutil.TempDir("", "gcp-broker-proxy-certs")
+			Expect(err).NotTo(HaveOccurred())
+
+			ca, err := tlsconfigtest.NewCA("test-ca")
+			Expect(err).NotTo(HaveOccurred())
+			caFile := filepath.Join(certDir, "ca.pem")
+			Expect(ioutil.WriteFile(caFile, ca.PEM, 0600)).To(Succeed())
+
+			server, err := ca.Issue(tlsconfigtest.Options{CommonName: "gcp-broker-proxy"})
+			Expect(err).NotTo(HaveOccurred())
+			certFile, keyFile, err := server.WriteFiles(certDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			clientCertificate, err := ca.Issue(tlsconfigtest.Options{CommonName: "cloud-controller", Organization: "cf"})
+			Expect(err).NotTo(HaveOccurred())
+			keyPair, err := clientCertificate.TLSCertificate()
+			Expect(err).NotTo(HaveOccurred())
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Certificate)
+			client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				Certificates: []tls.Certificate{keyPair},
+			}}}
+
+			envs.tlsPort = strconv.Itoa(8443 + config.GinkgoConfig.ParallelNode)
+			envs.tlsCertFile = certFile
+			envs.tlsKeyFile = keyFile
+			envs.tlsClientCAFile = caFile
+			envs.clientCertificates = `[{"label": "cc", "subject": "CN=cloud-controller,O=cf"}]`
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(certDir)
+		})
+
+		get := func(client *http.Client) int {
+			res, err := client.Get("https://localhost:" + envs.tlsPort + "/v2/catalog")
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		It("accepts a trusted client certificate instead of basic auth", func() {
+			Eventually(session).Should(Say("About to listen for TLS on port %s", envs.tlsPort))
+
+			Eventually(func() error {
+				_, err := client.Get("https://localhost:" + envs.tlsPort + "/v2/catalog")
+				return err
+			}).Should(Succeed())
+			Expect(get(client)).To(Equal(http.StatusOK))
+			Eventually(session).Should(Say(`"credential":"cc"`))
+		})
+
+		It("requires basic auth from clients without a certificate", func() {
+			Eventually(session).Should(Say("About to listen for TLS on port %s", envs.tlsPort))
+
+			withoutCertificate := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs: client.Transport.(*http.Transport).TLSClientConfig.RootCAs,
+			}}}
+			Eventually(func() error {
+				_, err := withoutCertificate.Get("https://localhost:" + envs.tlsPort + "/v2/catalog")
+				return err
+			}).Should(Succeed())
+			Expect(get(withoutCertificate)).To(Equal(http.StatusUnauthorized))
+		})
+
+		Context("when basic auth is turned off", func() {
+			BeforeEach(func() {
+				envs.basicAuth = "false"
+				envs.username = ""
+				envs.password = ""
+			})
+
+			It("still accepts trusted client certificates", func() {
+				Eventually(session).Should(Say("About to listen for TLS on port %s", envs.tlsPort))
+
+				Eventually(func() error {
+					_, err := client.Get("https://localhost:" + envs.tlsPort + "/v2/catalog")
+					return err
+				}).Should(Succeed())
+				Expect(get(client)).To(Equal(http.StatusOK))
+			})
+		})
+	})
+
+	Describe("bearer tokens", func() {
+		var (
+			uaaServer *ghttp.Server
+			signer    *authtest.Signer
+		)
+
+		BeforeEach(func() {
+			brokerServer.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, `{"services": []}`))
+
+			var err error
+			signer, err = authtest.NewSigner("key-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			uaaServer = ghttp.NewServer()
+			uaaServer.RouteToHandler("GET", "/token_keys", ghttp.RespondWith(http.StatusOK, authtest.JWKS(signer)))
+
+			envs.jwtJWKSURL = uaaServer.URL() + "/token_keys"
+			envs.jwtIssuer = uaaServer.URL() + "/oauth/token"
+			envs.jwtAudience = "gcp-broker-proxy"
+			envs.jwtScopes = `{"catalog": "gcp-broker-proxy.read", "default": "gcp-broker-proxy.admin"}`
+		})
+
+		AfterEach(func() {
+			uaaServer.Close()
+		})
+
+		request := func(method, path string, scopes ...string) int {
+			token, err := signer.Sign(map[string]interface{}{
+				"iss":       envs.jwtIssuer,
+				"aud":       []string{"gcp-broker-proxy"},
+				"exp":       time.Now().Add(time.Hour).Unix(),
+				"client_id": "automation",
+				"scope":     scopes,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			req, err := http.NewRequest(method, "http://localhost:"+envs.port+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		It("accepts tokens signed with a key from the JWKS URL that have the operation's scope", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			Expect(request("GET", "/v2/catalog", "gcp-broker-proxy.read")).To(Equal(http.StatusOK))
+			Eventually(session).Should(Say(`"credential":"automation"`))
+
+			Expect(request("DELETE", "/v2/service_instances/instance-1", "gcp-broker-proxy.read")).To(Equal(http.StatusForbidden))
+			Expect(request("GET", "/admin/instances", "gcp-broker-proxy.admin")).To(Equal(http.StatusOK))
+			Expect(uaaServer.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Describe("graceful shutdown", func() {
+		var (
+			release   chan struct{}
+			responses chan int
+		)
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			responses = make(chan int, 1)
+
+			brokerServer.RouteToHandler("PUT", "/v2/service_instances/instance-1", func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{}`))
+			})
+		})
+
+		AfterEach(func() {
+			select {
+			case <-release:
+			default:
+				close(release)
+			}
+		})
+
+		provision := func() {
+			go func() {
+				defer GinkgoRecover()
+
+				req, err := http.NewRequest("PUT", "http://localhost:"+envs.port+"/v2/service_instances/instance-1", strings.NewReader(`{}`))
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth(envs.username, envs.password)
+
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					responses <- 0
+					return
+				}
+				res.Body.Close()
+				responses <- res.StatusCode
+			}()
+
+			Eventually(brokerServer.ReceivedRequests).Should(HaveLen(3))
+		}
+
+		It("finishes in-flight requests on SIGTERM and exits cleanly", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+			serveCatalog(brokerServer)
+			provision()
+
+			session.Signal(syscall.SIGTERM)
+			Eventually(session).Should(Say(`"message":"Shutting down","data":{"background":0,"in_flight":1,"signal":"terminated","timeout":"1m0s"}`))
+			Consistently(session).ShouldNot(gexec.Exit())
+
+			_, err := net.Dial("tcp", "localhost:"+envs.port)
+			Expect(err).To(HaveOccurred())
+
+			close(release)
+			Eventually(responses).Should(Receive(Equal(http.StatusCreated)))
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(Say(`"message":"Shut down"`))
+		})
+
+		Context("when requests outlast the shutdown timeout", func() {
+			BeforeEach(func() {
+				envs.bindingTimeout = "100ms"
+				envs.shutdownTimeout = "100ms"
+			})
+
+			It("cuts them off and exits with an error", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+				serveCatalog(brokerServer)
+				provision()
+
+				session.Signal(syscall.SIGTERM)
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(Say(`"message":"Shutdown deadline exceeded, closed the remaining connections"`))
+				Expect(session.Err).To(Say(`"message":"Failed to shut down cleanly"`))
+				Eventually(responses).Should(Receive(Equal(0)))
+			})
+		})
+	})
+
+	Describe("upstream timeout", func() {
+		var release chan struct{}
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			envs.upstreamTimeout = "200ms"
+
+			brokerServer.RouteToHandler("PUT", "/v2/service_instances/instance-1", func(w http.ResponseWriter, r *http.Request) {
+				<-release
+			})
+		})
+
+		AfterEach(func() {
+			close(release)
+		})
+
+		It("responds with 502 Bad Gateway when the broker is too slow", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+			serveCatalog(brokerServer)
+
+			req, err := http.NewRequest("PUT", "http://localhost:"+envs.port+"/v2/service_instances/instance-1", strings.NewReader(`{}`))
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth(envs.username, envs.password)
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			Eventually(session.Err).Should(Say(`"message":"Failed to reach the broker".*context deadline exceeded`))
+		})
+	})
+
+	Describe("request validation", func() {
+		BeforeEach(func() {
+			envs.validateRequests = "true"
+		})
+
+		It("rejects malformed requests without forwarding them", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			req, err := http.NewRequest("PUT", "http://localhost:"+envs.port+"/v2/service_instances/instance-1", strings.NewReader(`{"plan_id": 1}`))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("X-Broker-API-Version", "2.14")
+			req.SetBasicAuth(envs.username, envs.password)
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(MatchJSON(`{"error": "InvalidRequest", "description": "Invalid provision request: service_id is required; plan_id must be a string"}`))
+			Expect(brokerServer.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("rejects parameters that do not match the plan's schema", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+			brokerServer.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, `{"services": [{"id": "s1", "name": "google-storage", "plans": [{
+				"id": "p1",
+				"name": "standard",
+				"schemas": {"service_instance": {"create": {"parameters": {
+					"type": "object",
+					"properties": {"name": {"type": "string", "pattern": "^[a-z0-9_.-]+$"}},
+					"required": ["name"]
+				}}}}
+			}]}]}`))
+
+			req, err := http.NewRequest("PUT", "http://localhost:"+envs.port+"/v2/service_instances/instance-1", strings.NewReader(`{"service_id": "s1", "plan_id": "p1", "parameters": {"name": "My Bucket"}}`))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("X-Broker-API-Version", "2.14")
+			req.SetBasicAuth(envs.username, envs.password)
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(MatchJSON(`{"error": "InvalidParameters", "description": "Invalid parameters for plan standard of service google-storage: parameters.name must match the pattern ^[a-z0-9_.-]+$"}`))
+		})
+	})
+
+	Describe("parameter policy", func() {
+		BeforeEach(func() {
+			envs.parameterPolicy = `{"rules": [{"services": [service], "defaults": {"labels": {"org": "{{.organization_guid}}"}}, "overrides": {"tier": "small"}, "forbidden": [admin]}]}`
+		})
+
+		provision := func(parameters string) *http.Response {
+			req, err := http.NewRequest("PUT", "http://localhost:"+envs.port+"/v2/service_instances/instance-1", strings.NewReader(`{
+				"service_id": "s1",
+				"plan_id": "p1",
+				"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1"},
+				"parameters": `+parameters+`
+			}`))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("X-Broker-API-Version", "2.14")
+			req.Header.Set("Content-Type", "application/json")
+			req.SetBasicAuth(envs.username, envs.password)
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			return res
+		}
+
+		It("applies the defaults and overrides before forwarding provisions", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+			serveCatalog(brokerServer)
+			brokerServer.RouteToHandler("PUT", "/v2/service_instances/instance-1", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{
+					"service_id": "s1",
+					"plan_id": "p1",
+					"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1"},
+					"parameters": {"tier": "small", "name": "orders", "labels": {"org": "org-1"}}
+				}`),
+				ghttp.RespondWith(http.StatusCreated, `{}`),
+			))
+
+			res := provision(`{"tier": "large", "name": "orders"}`)
+			res.Body.Close()
+
+			Expect(res.StatusCode).To(Equal(http.StatusCreated))
+		})
+
+		It("rejects provisions that set forbidden parameters", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+			serveCatalog(brokerServer)
+
+			res := provision(`{"admin": true}`)
+			defer res.Body.Close()
+
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(MatchJSON(`{"error": "ForbiddenParameters", "description": "Invalid parameters for plan plan of service service: parameters.admin may not be set"}`))
+		})
+
+		Context("when labels are configured", func() {
+			BeforeEach(func() {
+				envs.parameterLabels = `{"services": {"service": "labels"}}`
+			})
+
+			It("adds the Cloud Foundry labels after applying the policy", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+				serveCatalog(brokerServer)
+				brokerServer.RouteToHandler("PUT", "/v2/service_instances/instance-1", ghttp.CombineHandlers(
+					ghttp.VerifyJSON(`{
+						"service_id": "s1",
+						"plan_id": "p1",
+						"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1"},
+						"parameters": {"tier": "small", "labels": {"org": "org-1", "cf-organization-guid": "org-1", "cf-space-guid": "space-1", "cf-instance-id": "instance-1"}}
+					}`),
+					ghttp.RespondWith(http.StatusCreated, `{}`),
+				))
+
+				res := provision(`{}`)
+				res.Body.Close()
+
+				Expect(res.StatusCode).To(Equal(http.StatusCreated))
+			})
+
+			It("does not check the labels against the plan's schema", func() {
+				Eventually(session).Should(Say("About to listen on port " + envs.port))
+				brokerServer.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, `{"services": [{"id": "s1", "name": "service", "plans": [{
+					"id": "p1",
+					"name": "plan",
+					"schemas": {"service_instance": {"create": {"parameters": {
+						"type": "object",
+						"properties": {
+							"tier": {"type": "string"},
+							"labels": {"type": "object", "properties": {"org": {"type": "string"}}, "additionalProperties": false}
+						},
+						"additionalProperties": false
+					}}}}
+				}]}]}`))
+				brokerServer.RouteToHandler("PUT", "/v2/service_instances/instance-1", ghttp.RespondWith(http.StatusCreated, `{}`))
+
+				res := provision(`{}`)
+				res.Body.Close()
+
+				Expect(res.StatusCode).To(Equal(http.StatusCreated))
+			})
+		})
+	})
+
+	Describe("circuit breaker", func() {
+		BeforeEach(func() {
+			envs.breakerThreshold = "2"
+			brokerServer.RouteToHandler("PATCH", "/v2/service_instances/instance-1", ghttp.RespondWith(http.StatusInternalServerError, `{}`))
+		})
+
+		request := func(method, path string) *http.Response {
+			req, err := http.NewRequest(method, "http://localhost:"+envs.port+path, strings.NewReader(`{}`))
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth(envs.username, envs.password)
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			return res
+		}
+
+		It("fails fast once the broker keeps failing and reports the breaker", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			for i := 0; i < 2; i++ {
+				res := request("PATCH", "/v2/service_instances/instance-1")
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
+			}
+			Eventually(session.Err).Should(Say(`"message":"Circuit breaker opened","data":{"breaker":"broker","from":"closed","to":"open"}`))
+
+			res := request("PATCH", "/v2/service_instances/instance-1")
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+			res = request("GET", "/admin/breakers")
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`{"name":"broker","state":"open","consecutive_failures":2`))
+			Expect(string(body)).To(ContainSubstring(`{"name":"token","state":"closed","consecutive_failures":0}`))
+		})
+	})
+
+	Describe("quotas", func() {
+		BeforeEach(func() {
+			envs.quotas = `{"instances_per_space": 1}`
+			brokerServer.RouteToHandler("PUT", "/v2/service_instances/instance-1", ghttp.RespondWith(http.StatusCreated, `{}`))
+		})
+
+		request := func(method, path, body string) *http.Response {
+			req, err := http.NewRequest(method, "http://localhost:"+envs.port+path, strings.NewReader(body))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("X-Broker-API-Version", "2.14")
+			req.SetBasicAuth(envs.username, envs.password)
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			return res
+		}
+
+		It("rejects provisions over the quota and reports the usage", func() {
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+			serveCatalog(brokerServer)
+
+			provision := `{"service_id": "s1", "plan_id": "p1", "organization_guid": "org-1", "space_guid": "space-1"}`
+			res := request("PUT", "/v2/service_instances/instance-1", provision)
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusCreated))
+
+			res = request("PUT", "/v2/service_instances/instance-2", provision)
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(body).To(MatchJSON(`{"error": "QuotaExceeded", "description": "The space space-1 has reached its quota of 1 service instances"}`))
+			Eventually(session).Should(Say(`"message":"Rejected a request over its quota","data":{"key":"space-1","limit":1,"scope":"space"}`))
+
+			res = request("GET", "/admin/quotas", "")
+			defer res.Body.Close()
+			body, err = ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`"spaces":[{"space_guid":"space-1","used":1,"limit":1}]`))
+		})
+	})
+
+	Describe("credentials from VCAP_SERVICES", func() {
+		BeforeEach(func() {
+			vcapServices, err := json.Marshal(map[string]interface{}{
+				"user-provided": []map[string]interface{}{{
+					"name": "gcp-proxy-credentials",
+					"tags": []string{"gcp-broker-proxy"},
+					"credentials": map[string]string{
+						"username":             envs.username,
+						"password":             envs.password,
+						"broker_url":           envs.brokerURL,
+						"service_account_json": envs.serviceAccountJSON,
+					},
+				}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			envs.vcapServices = string(vcapServices)
+			envs.credentialsServiceTag = "gcp-broker-proxy"
+			envs.username = ""
+			envs.password = ""
+			envs.brokerURL = ""
+			envs.serviceAccountJSON = ""
+		})
+
+		It("starts with the credentials of the bound service instance", func() {
+			Eventually(session).Should(Say("Startup checks passed"))
+			Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+			req, err := http.NewRequest("GET", "http://localhost:"+envs.port+"/admin/instances", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth("admin", "password")
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("when the server is not correctly configured", func() {
+		Context("when the server has not been provided service account information", func() {
+			BeforeEach(func() {
+				envs.serviceAccountJSON = ""
+			})
+
+			It("it fails to start", func() {
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			It("logs that the server requires the SERVICE_ACCOUNT_JSON param", func() {
+				Eventually(session.Err).Should(Say("Missing SERVICE_ACCOUNT_JSON environment variable"))
+			})
+		})
+
+		Context("when the server has not been provided broker url", func() {
+			BeforeEach(func() {
+				envs.brokerURL = ""
+			})
+
+			It("it fails to start", func() {
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			It("logs that the server requires the BROKER_URL param", func() {
+				Eventually(session.Err).Should(Say("Missing BROKER_URL environment variable"))
+			})
+		})
+
+		Context("when the brokers are invalid", func() {
+			BeforeEach(func() {
+				envs.brokers = `[{"name": "a"}]`
+			})
+
+			It("logs what is wrong with them", func() {
+				Eventually(session).Should(gexec.Exit())
+				Expect(session.Err).To(Say(`"message":"Invalid configuration","error":"Invalid BROKERS: broker a is missing a url; Invalid BROKERS: broker a is missing a service_account_json"`))
+			})
+		})
+
+		Context("when the catalog policy is invalid", func() {
+			BeforeEach(func() {
+				envs.catalogPolicy = "unknown: key"
+			})
+
+			It("logs that the policy is invalid", func() {
+				Eventually(session).Should(gexec.Exit())
+				Expect(session.Err).To(Say("Invalid CATALOG_POLICY"))
+			})
+		})
+
+		Context("when the broker is unavailable at startup", func() {
+			var catalogStatus int32
+
+			BeforeEach(func() {
+				atomic.StoreInt32(&catalogStatus, http.StatusServiceUnavailable)
+
+				brokerServer.Reset()
+				brokerServer.RouteToHandler("GET", "/v2/catalog", func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(int(atomic.LoadInt32(&catalogStatus)))
+					fmt.Fprint(w, `{"services": []}`)
+				})
+				gcpOAuthServer.RouteToHandler("POST", "/", func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, `{"access_token": "123"}`)
+				})
+			})
+
+			It("it fails to start", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(Say("Failed startup checks"))
+			})
+
+			Context("when degraded start is allowed", func() {
+				BeforeEach(func() {
+					envs.degradedStart = "true"
+					envs.healthCheckInterval = "100ms"
+				})
+
+				It("starts but is not ready until the broker recovers", func() {
+					Eventually(session.Err).Should(Say("Failed startup checks, starting in degraded mode"))
+					Eventually(session).Should(Say("About to listen on port " + envs.port))
+
+					readiness := func() int {
+						res, err := http.Get("http://localhost:" + envs.port + "/readyz")
+						if err != nil {
+							return 0
+						}
+						res.Body.Close()
+						return res.StatusCode
+					}
+					Expect(readiness()).To(Equal(http.StatusServiceUnavailable))
+
+					atomic.StoreInt32(&catalogStatus, http.StatusOK)
+
+					Eventually(readiness).Should(Equal(http.StatusOK))
+					Eventually(session).Should(Say("Health check recovered"))
+				})
+			})
+		})
+
+		Context("when the broker url is invalid", func() {
+			BeforeEach(func() {
+				envs.brokerURL = "notaurl"
+			})
+
+			It("it fails to start", func() {
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			It("logs that the server requires the BROKER_URL param", func() {
+				Eventually(session.Err).Should(Say("BROKER_URL must be a valid URL: notaurl"))
+			})
+		})
+
+		Context("when the server has not been provided username", func() {
+			BeforeEach(func() {
+				envs.username = ""
+			})
+
+			It("it fails to start", func() {
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			It("logs that the server requires the USERNAME param", func() {
+				Eventually(session.Err).Should(Say("Missing USERNAME environment variable"))
+			})
+		})
+
+		Context("when the server has not been provided password", func() {
+			BeforeEach(func() {
+				envs.password = ""
+			})
+
+			It("it fails to start", func() {
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			It("logs that the server requires the PASSWORD param", func() {
+				Eventually(session.Err).Should(Say("Missing PASSWORD environment variable"))
+			})
+		})
+
+		Context("when there are multiple missing parameters", func() {
+			BeforeEach(func() {
+				envs = &envVars{}
+			})
+
+			It("it fails to start", func() {
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			It("logs that it requires all missing params", func() {
+				Eventually(session.Err).Should(Say("Missing USERNAME, PASSWORD, BROKER_URL, SERVICE_ACCOUNT_JSON environment variable\\(s\\)"))
+			})
+		})
+	})
+})
+
+// serveCatalog routes catalog requests to a catalog with the plans the tests
+// provision and bind, once the startup checks have fetched the catalog.
+func serveCatalog(brokerServer *ghttp.Server) {
+	brokerServer.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(http.StatusOK, `{"services": [
+		{"id": "s1", "name": "service", "plans": [{"id": "p1", "name": "plan"}]},
+		{"id": "service-1", "name": "service-1", "plans": [{"id": "plan-1", "name": "plan-1"}]}
+	]}`))
+}
+
+type envVars struct {
+	port                  string
+	serviceAccountJSON    string
+	brokerURL             string
+	username              string
+	password              string
+	bindingPollInterval   string
+	catalogPolicy         string
+	brokers               string
+	routingStateFile      string
+	inventoryFile         string
+	adminUsername         string
+	adminPassword         string
+	logBodies             string
+	metricsPort           string
+	degradedStart         string
+	healthCheckInterval   string
+	configFile            string
+	vcapServices          string
+	credentialsServiceTag string
+	brokerCredentials     string
+	lockoutThreshold      string
+	trustedProxies        string
+	tlsPort               string
+	tlsCertFile           string
+	tlsKeyFile            string
+	tlsClientCAFile       string
+	clientCertificates    string
+	basicAuth             string
+	jwtJWKSURL            string
+	jwtIssuer             string
+	jwtAudience           string
+	jwtScopes             string
+	tlsEnabled            string
+	tlsMinVersion         string
+	tlsReloadInterval     string
+	bindingTimeout        string
+	shutdownTimeout       string
+	upstreamTimeout       string
+	breakerThreshold      string
+	validateRequests      string
+	parameterPolicy       string
+	parameterLabels       string
+	quotas                string
+}
+
+func (e *envVars) toStringArray() []string {
+	result := []string{}
+
+	if e.port != "" {
+		result = append(result, "PORT="+e.port)
+	}
+	if e.serviceAccountJSON != "" {
+		result = append(result, "SERVICE_ACCOUNT_JSON="+e.serviceAccountJSON)
+	}
+	if e.brokerURL != "" {
+		result = append(result, "BROKER_URL="+e.brokerURL)
+	}
+	if e.username != "" {
+		result = append(result, "USERNAME="+e.username)
+	}
+	if e.password != "" {
+		result = append(result, "PASSWORD="+e.password)
+	}
+	if e.bindingPollInterval != "" {
+		result = append(result, "BINDING_POLL_INTERVAL="+e.bindingPollInterval)
+	}
+	if e.catalogPolicy != "" {
+		result = append(result, "CATALOG_POLICY="+e.catalogPolicy)
+	}
+	if e.brokers != "" {
+		result = append(result, "BROKERS="+e.brokers)
+	}
+	if e.routingStateFile != "" {
+		result = append(result, "ROUTING_STATE_FILE="+e.routingStateFile)
+	}
+	if e.inventoryFile != "" {
+		result = append(result, "INVENTORY_FILE="+e.inventoryFile)
+	}
+	if e.adminUsername != "" {
+		result = append(result, "ADMIN_USERNAME="+e.adminUsername)
+	}
+	if e.adminPassword != "" {
+		result = append(result, "ADMIN_PASSWORD="+e.adminPassword)
+	}
+	if e.logBodies != "" {
+		result = append(result, "LOG_BODIES="+e.logBodies)
+	}
+	if e.metricsPort != "" {
+		result = append(result, "METRICS_PORT="+e.metricsPort)
+	}
+	if e.degradedStart != "" {
+		result = append(result, "DEGRADED_START="+e.degradedStart)
+	}
+	if e.healthCheckInterval != "" {
+		result = append(result, "HEALTH_CHECK_INTERVAL="+e.healthCheckInterval)
+	}
+	if e.configFile != "" {
+		result = append(result, "CONFIG_FILE="+e.configFile)
+	}
+	if e.vcapServices != "" {
+		result = append(result, "VCAP_SERVICES="+e.vcapServices)
+	}
+	if e.credentialsServiceTag != "" {
+		result = append(result, "CREDENTIALS_SERVICE_TAG="+e.credentialsServiceTag)
+	}
+	if e.brokerCredentials != "" {
+		result = append(result, "BROKER_CREDENTIALS="+e.brokerCredentials)
+	}
+	if e.lockoutThreshold != "" {
+		result = append(result, "LOCKOUT_THRESHOLD="+e.lockoutThreshold)
+	}
+	if e.trustedProxies != "" {
+		result = append(result, "TRUSTED_PROXIES="+e.trustedProxies)
+	}
+	if e.tlsPort != "" {
+		result = append(result, "TLS_PORT="+e.tlsPort)
+	}
+	if e.tlsCertFile != "" {
+		result = append(result, "TLS_CERT_FILE="+e.tlsCertFile)
+	}
+	if e.tlsKeyFile != "" {
+		result = append(result, "TLS_KEY_FILE="+e.tlsKeyFile)
+	}
+	if e.tlsClientCAFile != "" {
+		result = append(result, "TLS_CLIENT_CA_FILE="+e.tlsClientCAFile)
+	}
+	if e.clientCertificates != "" {
+		result = append(result, "CLIENT_CERTIFICATES="+e.clientCertificates)
+	}
+	if e.basicAuth != "" {
+		result = append(result, "BASIC_AUTH="+e.basicAuth)
+	}
+	if e.jwtJWKSURL != "" {
+		result = append(result, "JWT_JWKS_URL="+e.jwtJWKSURL)
+	}
+	if e.jwtIssuer != "" {
+		result = append(result, "JWT_ISSUER="+e.jwtIssuer)
+	}
+	if e.jwtAudience != "" {
+		result = append(result, "JWT_AUDIENCE="+e.jwtAudience)
+	}
+	if e.jwtScopes != "" {
+		result = append(result, "JWT_SCOPES="+e.jwtScopes)
+	}
+	if e.tlsEnabled != "" {
+		result = append(result, "TLS_ENABLED="+e.tlsEnabled)
+	}
+	if e.tlsMinVersion != "" {
+		result = append(result, "TLS_MIN_VERSION="+e.tlsMinVersion)
+	}
+	if e.tlsReloadInterval != "" {
+		result = append(result, "TLS_RELOAD_INTERVAL="+e.tlsReloadInterval)
+	}
+	if e.bindingTimeout != "" {
+		result = append(result, "BINDING_TIMEOUT="+e.bindingTimeout)
+	}
+	if e.shutdownTimeout != "" {
+		result = append(result, "SHUTDOWN_TIMEOUT="+e.shutdownTimeout)
+	}
+	if e.upstreamTimeout != "" {
+		result = append(result, "UPSTREAM_TIMEOUT="+e.upstreamTimeout)
+	}
+	if e.breakerThreshold != "" {
+		result = append(result, "BREAKER_FAILURE_THRESHOLD="+e.breakerThreshold)
+	}
+	if e.validateRequests != "" {
+		result = append(result, "VALIDATE_REQUESTS="+e.validateRequests)
+	}
+	if e.parameterPolicy != "" {
+		result = append(result, "PARAMETER_POLICY="+e.parameterPolicy)
+	}
+	if e.parameterLabels != "" {
+		result = append(result, "PARAMETER_LABELS="+e.parameterLabels)
+	}
+	if e.quotas != "" {
+		result = append(result, "QUOTAS="+e.quotas)
 	}
 
 	return result
@@ -0,0 +1,360 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of latency histograms.
+// They reach beyond the 60 seconds the platform waits for a broker.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Registry holds metrics and exposes them in the Prometheus text format.
+// Metrics are registered by name on first use and shared afterwards, so
+// every handler can ask for the metrics it records. A nil registry hands out
+// metrics that work but are not exposed.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]metric{}}
+}
+
+// Counter returns the counter with the given name, registering it first if
+// necessary.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return r.register(name, func() metric {
+		return &CounterVec{family: newFamily(name, help, "counter", labels)}
+	}).(*CounterVec)
+}
+
+// Gauge returns the gauge with the given name, registering it first if
+// necessary.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return r.register(name, func() metric {
+		return &GaugeVec{family: newFamily(name, help, "gauge", labels)}
+	}).(*GaugeVec)
+}
+
+// Histogram returns the histogram with the given name, registering it first
+// if necessary.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return r.register(name, func() metric {
+		return &HistogramVec{family: newFamily(name, help, "histogram", labels), buckets: buckets}
+	}).(*HistogramVec)
+}
+
+func (r *Registry) register(name string, create func() metric) metric {
+	if r == nil {
+		return create()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		return m
+	}
+
+	m := create()
+	r.metrics[name] = m
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text exposition format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body bytes.Buffer
+		r.Write(&body)
+
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		rw.Write(body.Bytes())
+	})
+}
+
+// Write writes every metric, sorted by name.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// family is what all metric types share: a name, help text and the series
+// for each combination of label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]interface{}
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{name: name, help: help, kind: kind, labels: labels, series: map[string]interface{}{}}
+}
+
+func (f *family) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = create()
+		f.series[key] = s
+	}
+	return s
+}
+
+// each calls fn for every series, sorted by label values.
+func (f *family) each(fn func(labelValues []string, series interface{})) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := make([]interface{}, len(keys))
+	for i, key := range keys {
+		series[i] = f.series[key]
+	}
+	f.mu.Unlock()
+
+	for i, key := range keys {
+		var labelValues []string
+		if len(f.labels) != 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+		fn(labelValues, series[i])
+	}
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+func (f *family) writeSample(w io.Writer, suffix string, labelValues []string, extraLabel, extraValue string, value float64) {
+	var pairs []string
+	for i, label := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escapeLabelValue(labelValues[i])))
+	}
+	if extraLabel != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraLabel, extraValue))
+	}
+
+	name := f.name + suffix
+	if len(pairs) != 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// CounterVec is a counter with one series per combination of label values.
+type CounterVec struct {
+	*family
+}
+
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.get(labelValues, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value += v
+}
+
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.each(func(labelValues []string, series interface{}) {
+		c.writeSample(w, "", labelValues, "", "", series.(*Counter).Value())
+	})
+}
+
+// GaugeVec is a gauge with one series per combination of label values.
+type GaugeVec struct {
+	*family
+}
+
+type Gauge struct {
+	mu    sync.Mutex
+	value float64
+	fn    func() float64
+}
+
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.get(labelValues, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = v
+	g.fn = nil
+}
+
+// SetFunc makes the gauge report the result of fn whenever it is read.
+func (g *Gauge) SetFunc(fn func() float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.fn = fn
+}
+
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value += v
+}
+
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	fn, value := g.fn, g.value
+	g.mu.Unlock()
+
+	if fn != nil {
+		return fn()
+	}
+	return value
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.writeHeader(w)
+	g.each(func(labelValues []string, series interface{}) {
+		g.writeSample(w, "", labelValues, "", "", series.(*Gauge).Value())
+	})
+}
+
+// HistogramVec is a histogram with one series per combination of label
+// values.
+type HistogramVec struct {
+	*family
+	buckets []float64
+}
+
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.get(labelValues, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns how many values have been observed.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w)
+	h.each(func(labelValues []string, series interface{}) {
+		histogram := series.(*Histogram)
+
+		histogram.mu.Lock()
+		counts := append([]uint64(nil), histogram.counts...)
+		count, sum := histogram.count, histogram.sum
+		histogram.mu.Unlock()
+
+		for i, bound := range h.buckets {
+			h.writeSample(w, "_bucket", labelValues, "le", formatFloat(bound), float64(counts[i]))
+		}
+		h.writeSample(w, "_bucket", labelValues, "le", "+Inf", float64(count))
+		h.writeSample(w, "_sum", labelValues, "", "", sum)
+		h.writeSample(w, "_count", labelValues, "", "", float64(count))
+	})
+}
+
+// StatusClass groups status codes for labels, such as "2xx".
+func StatusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,112 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var registry *metrics.Registry
+
+	exposition := func() string {
+		var buf bytes.Buffer
+		registry.Write(&buf)
+		return buf.String()
+	}
+
+	BeforeEach(func() {
+		registry = metrics.NewRegistry()
+	})
+
+	It("exposes counters", func() {
+		counter := registry.Counter("requests_total", "Requests handled.", "operation", "status_class")
+		counter.With("bind", "2xx").Inc()
+		counter.With("bind", "2xx").Add(2)
+		counter.With("catalog", "5xx").Inc()
+
+		Expect(exposition()).To(Equal(`# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{operation="bind",status_class="2xx"} 3
+requests_total{operation="catalog",status_class="5xx"} 1
+`))
+	})
+
+	It("exposes gauges", func() {
+		gauge := registry.Gauge("token_expiry_seconds", "Seconds until expiry.", "broker")
+		gauge.With("a").Set(42.5)
+		gauge.With("b").SetFunc(func() float64 { return 7 })
+
+		Expect(exposition()).To(Equal(`# HELP token_expiry_seconds Seconds until expiry.
+# TYPE token_expiry_seconds gauge
+token_expiry_seconds{broker="a"} 42.5
+token_expiry_seconds{broker="b"} 7
+`))
+	})
+
+	It("exposes histograms", func() {
+		histogram := registry.Histogram("duration_seconds", "Durations.", []float64{0.1, 1})
+		histogram.With().Observe(0.05)
+		histogram.With().Observe(0.5)
+		histogram.With().Observe(3)
+
+		Expect(exposition()).To(Equal(`# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 3.55
+duration_seconds_count 3
+`))
+	})
+
+	It("sorts metrics by name", func() {
+		registry.Counter("b_total", "B.").With().Inc()
+		registry.Counter("a_total", "A.").With().Inc()
+
+		Expect(exposition()).To(MatchRegexp(`(?s)a_total 1\n.*b_total 1\n`))
+	})
+
+	It("shares metrics registered under the same name", func() {
+		registry.Counter("requests_total", "Requests.", "operation").With("bind").Inc()
+		registry.Counter("requests_total", "Requests.", "operation").With("bind").Inc()
+
+		Expect(exposition()).To(ContainSubstring(`requests_total{operation="bind"} 2`))
+	})
+
+	It("escapes label values", func() {
+		registry.Counter("errors_total", "Errors.", "reason").With("say \"hi\"\n").Inc()
+
+		Expect(exposition()).To(ContainSubstring(`errors_total{reason="say \"hi\"\n"} 1`))
+	})
+
+	It("panics when label values are missing", func() {
+		counter := registry.Counter("requests_total", "Requests.", "operation")
+
+		Expect(func() { counter.With() }).To(Panic())
+	})
+
+	It("hands out working metrics from a nil registry", func() {
+		var nilRegistry *metrics.Registry
+		counter := nilRegistry.Counter("requests_total", "Requests.")
+		counter.With().Inc()
+
+		Expect(counter.With().Value()).To(Equal(1.0))
+	})
+
+	It("serves the text format", func() {
+		registry.Counter("requests_total", "Requests.").With().Inc()
+
+		writer := httptest.NewRecorder()
+		registry.Handler().ServeHTTP(writer, httptest.NewRequest("GET", "/metrics", nil))
+
+		Expect(writer.Code).To(Equal(http.StatusOK))
+		Expect(writer.Header().Get("Content-Type")).To(Equal("text/plain; version=0.0.4; charset=utf-8"))
+		Expect(writer.Body.String()).To(ContainSubstring("requests_total 1\n"))
+	})
+})
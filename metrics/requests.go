@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Requests counts the requests it handles and records their latency, by
+// OSBAPI operation and status class.
+func Requests(registry *Registry) negroni.HandlerFunc {
+	requests := registry.Counter("gcp_broker_proxy_requests_total",
+		"Requests handled by the proxy.", "operation", "status_class")
+	durations := registry.Histogram("gcp_broker_proxy_request_duration_seconds",
+		"Time taken to handle requests.", DefaultBuckets, "operation", "status_class")
+
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+
+		res := negroni.NewResponseWriter(rw)
+		next(res, r)
+
+		operation := string(osbapi.ParseRoute(r.Method, r.URL.Path).Operation)
+		class := StatusClass(res.Status())
+
+		requests.With(operation, class).Inc()
+		durations.With(operation, class).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,38 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Requests", func() {
+	It("counts requests and records their latency by operation and status class", func() {
+		registry := metrics.NewRegistry()
+		middleware := metrics.Requests(registry)
+
+		serve := func(method, path string, status int) {
+			middleware(httptest.NewRecorder(), httptest.NewRequest(method, path, nil), func(rw http.ResponseWriter, r *http.Request) {
+				rw.WriteHeader(status)
+			})
+		}
+
+		serve("GET", "/v2/catalog", http.StatusOK)
+		serve("GET", "/v2/catalog", http.StatusOK)
+		serve("PUT", "/v2/service_instances/i1/service_bindings/b1", http.StatusBadGateway)
+		serve("GET", "/v2/unknown", http.StatusNotFound)
+
+		var buf bytes.Buffer
+		registry.Write(&buf)
+
+		Expect(buf.String()).To(ContainSubstring(`gcp_broker_proxy_requests_total{operation="catalog",status_class="2xx"} 2`))
+		Expect(buf.String()).To(ContainSubstring(`gcp_broker_proxy_requests_total{operation="bind",status_class="5xx"} 1`))
+		Expect(buf.String()).To(ContainSubstring(`gcp_broker_proxy_requests_total{operation="unknown",status_class="4xx"} 1`))
+		Expect(buf.String()).To(ContainSubstring(`gcp_broker_proxy_request_duration_seconds_count{operation="catalog",status_class="2xx"} 2`))
+	})
+})
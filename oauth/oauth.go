@@ -3,22 +3,105 @@ package oauth
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
 )
 
 var (
 	scopes = "https://www.googleapis.com/auth/cloud-platform"
 )
 
+const (
+	defaultRefreshBefore = 5 * time.Minute
+	defaultRetryInterval = 10 * time.Second
+	defaultFetchTimeout  = 10 * time.Second
+)
+
+// GCPOAuth hands out access tokens for a service account. It is safe for
+// concurrent use: the token is cached, refreshed in the background shortly
+// before it expires and only ever fetched by one goroutine at a time.
 type GCPOAuth struct {
-	jwt   *jwt.Config
+	jwt           *jwt.Config
+	refreshBefore time.Duration
+	retryInterval time.Duration
+	fetchTimeout  time.Duration
+	client        *http.Client
+	observe       func(time.Duration, error)
+	breaker       *breaker.Breaker
+
+	mu       sync.Mutex
+	token    *oauth2.Token
+	inflight *fetch
+	timer    *time.Timer
+	stopped  bool
+}
+
+// fetch is a token request shared by every caller waiting for it.
+type fetch struct {
+	done  chan struct{}
 	token *oauth2.Token
+	err   error
+}
+
+type Option func(*GCPOAuth)
+
+// WithRefreshBefore sets how long before expiry the token is refreshed.
+func WithRefreshBefore(d time.Duration) Option {
+	return func(o *GCPOAuth) {
+		o.refreshBefore = d
+	}
+}
+
+// WithRetryInterval sets how long to wait before retrying a failed
+// background refresh while the current token is still valid.
+func WithRetryInterval(d time.Duration) Option {
+	return func(o *GCPOAuth) {
+		o.retryInterval = d
+	}
+}
+
+// WithFetchTimeout limits how long a token request may take, and so how long
+// GetToken waits for one.
+func WithFetchTimeout(d time.Duration) Option {
+	return func(o *GCPOAuth) {
+		o.fetchTimeout = d
+	}
+}
+
+// WithHTTPClient sets the client that requests tokens, for example to send
+// them through the proxy's upstream transport. Its timeout is capped at the
+// fetch timeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *GCPOAuth) {
+		o.client = client
+	}
 }
 
-func NewGCPOAuth(serviceAccountJSON string) (*GCPOAuth, error) {
+// WithFetchObserver calls observe after every token request with its
+// duration and error, for example to record metrics.
+func WithFetchObserver(observe func(duration time.Duration, err error)) Option {
+	return func(o *GCPOAuth) {
+		o.observe = observe
+	}
+}
+
+// WithBreaker stops fetching tokens while b is open. GetToken then returns
+// a *breaker.OpenError unless the cached token is still valid.
+func WithBreaker(b *breaker.Breaker) Option {
+	return func(o *GCPOAuth) {
+		o.breaker = b
+	}
+}
+
+func NewGCPOAuth(serviceAccountJSON string, opts ...Option) (*GCPOAuth, error) {
 	rawJSON := []byte(serviceAccountJSON)
 
 	jwt, err := google.JWTConfigFromJSON(rawJSON, scopes)
@@ -26,24 +109,172 @@ func NewGCPOAuth(serviceAccountJSON string) (*GCPOAuth, error) {
 		return nil, err
 	}
 
-	oauth := GCPOAuth{jwt, nil}
+	oauth := GCPOAuth{
+		jwt:           jwt,
+		refreshBefore: defaultRefreshBefore,
+		retryInterval: defaultRetryInterval,
+		fetchTimeout:  defaultFetchTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(&oauth)
+	}
 
 	return &oauth, nil
 }
 
+// GetToken returns the cached token while it is valid. Only when there is no
+// valid token does the caller wait for one to be fetched, for at most the
+// fetch timeout.
 func (o *GCPOAuth) GetToken() (*oauth2.Token, error) {
-	tokenSource := oauth2.ReuseTokenSource(o.token, o.jwt.TokenSource(context.Background()))
+	o.mu.Lock()
+
+	if o.token.Valid() {
+		token := o.token
+		o.mu.Unlock()
+		return token, nil
+	}
 
-	var err error
-	o.token, err = tokenSource.Token()
+	f := o.startFetch()
+	o.mu.Unlock()
 
+	timer := time.NewTimer(o.fetchTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return f.token, f.err
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out after %s waiting for an access token", o.fetchTimeout)
+	}
+}
+
+// Expiry returns when the cached token expires, or the zero time when there
+// is no token.
+func (o *GCPOAuth) Expiry() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token == nil {
+		return time.Time{}
+	}
+	return o.token.Expiry
+}
+
+// Stop cancels any scheduled background refresh.
+func (o *GCPOAuth) Stop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.stopped = true
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+}
+
+// startFetch must be called with o.mu held.
+func (o *GCPOAuth) startFetch() *fetch {
+	if o.inflight != nil {
+		return o.inflight
+	}
+
+	f := &fetch{done: make(chan struct{})}
+	o.inflight = f
+	go o.runFetch(f)
+
+	return f
+}
+
+func (o *GCPOAuth) runFetch(f *fetch) {
+	start := time.Now()
+	f.token, f.err = o.fetchToken()
+	if o.observe != nil {
+		o.observe(time.Since(start), f.err)
+	}
+
+	o.mu.Lock()
+	o.inflight = nil
+	if f.err == nil {
+		o.token = f.token
+		o.scheduleRefresh(o.refreshDelay(f.token))
+	} else if o.token.Valid() {
+		o.scheduleRefresh(o.retryInterval)
+	}
+	o.mu.Unlock()
+
+	close(f.done)
+}
+
+func (o *GCPOAuth) fetchToken() (token *oauth2.Token, err error) {
+	if o.breaker != nil {
+		done, openErr := o.breaker.Allow()
+		if openErr != nil {
+			return nil, openErr
+		}
+		defer func() {
+			if err != nil {
+				done(breaker.Failure)
+			} else {
+				done(breaker.Success)
+			}
+		}()
+	}
+
+	// The token source does not pass its context on to the request, so the
+	// client's timeout is what bounds the fetch.
+	client := http.Client{}
+	if o.client != nil {
+		client = *o.client
+	}
+	if client.Timeout == 0 || client.Timeout > o.fetchTimeout {
+		client.Timeout = o.fetchTimeout
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &client)
+
+	token, err = o.jwt.TokenSource(ctx).Token()
 	if err != nil {
-		return o.token, err
+		return nil, err
 	}
 
-	if o.token.AccessToken == "" {
+	if token.AccessToken == "" {
 		return nil, errors.New("Missing access_token in oauth response")
 	}
 
-	return o.token, err
+	return token, nil
+}
+
+// scheduleRefresh must be called with o.mu held.
+func (o *GCPOAuth) scheduleRefresh(delay time.Duration) {
+	if o.stopped || delay < 0 {
+		return
+	}
+
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+
+	o.timer = time.AfterFunc(delay, func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		if !o.stopped {
+			o.startFetch()
+		}
+	})
+}
+
+// refreshDelay returns how long until the token should be refreshed, or a
+// negative duration for tokens that never expire. Tokens that are already
+// due are refreshed no sooner than the retry interval, so that a refresh
+// window longer than the token lifetime cannot cause a refresh loop.
+func (o *GCPOAuth) refreshDelay(token *oauth2.Token) time.Duration {
+	if token.Expiry.IsZero() {
+		return -1
+	}
+
+	delay := time.Until(token.Expiry.Add(-o.refreshBefore))
+	if delay < o.retryInterval {
+		return o.retryInterval
+	}
+	return delay
 }
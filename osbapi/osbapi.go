@@ -0,0 +1,187 @@
+package osbapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type Operation string
+
+const (
+	Catalog              Operation = "catalog"
+	Provision            Operation = "provision"
+	Update               Operation = "update"
+	Deprovision          Operation = "deprovision"
+	FetchInstance        Operation = "fetch_instance"
+	LastOperation        Operation = "last_operation"
+	Bind                 Operation = "bind"
+	Unbind               Operation = "unbind"
+	FetchBinding         Operation = "fetch_binding"
+	BindingLastOperation Operation = "binding_last_operation"
+	Unknown              Operation = "unknown"
+)
+
+// Operations lists every operation of the OSBAPI.
+var Operations = []Operation{
+	Catalog, Provision, Update, Deprovision, FetchInstance, LastOperation,
+	Bind, Unbind, FetchBinding, BindingLastOperation,
+}
+
+// Valid reports whether the operation is part of the OSBAPI.
+func (o Operation) Valid() bool {
+	for _, operation := range Operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// Idempotent reports whether sending a request of the operation again has
+// the same effect as sending it once. Provisions and binds are, as long as
+// the body is the same, because brokers answer repeats with 200 OK. Updates
+// are not, and repeated deprovisions and unbinds are answered with 410 Gone.
+func (o Operation) Idempotent() bool {
+	switch o {
+	case Catalog, FetchInstance, LastOperation, FetchBinding, BindingLastOperation, Provision, Bind:
+		return true
+	}
+	return false
+}
+
+const (
+	instancesPathSegment = "service_instances"
+	bindingsPathSegment  = "service_bindings"
+	lastOperationSegment = "last_operation"
+)
+
+// Route describes which OSBAPI endpoint a request targets.
+type Route struct {
+	Operation  Operation
+	InstanceID string
+	BindingID  string
+}
+
+// ParseRoute maps a method and URL path onto the OSBAPI endpoint it
+// addresses. Paths that are not part of the API yield the Unknown operation.
+func ParseRoute(method, path string) Route {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 || segments[0] != "v2" {
+		return Route{Operation: Unknown}
+	}
+
+	if len(segments) == 2 && segments[1] == "catalog" && method == http.MethodGet {
+		return Route{Operation: Catalog}
+	}
+
+	if segments[1] != instancesPathSegment || len(segments) < 3 || segments[2] == "" {
+		return Route{Operation: Unknown}
+	}
+
+	route := Route{InstanceID: segments[2]}
+
+	switch {
+	case len(segments) == 3:
+		route.Operation = instanceOperation(method)
+	case len(segments) == 4 && segments[3] == lastOperationSegment && method == http.MethodGet:
+		route.Operation = LastOperation
+	case len(segments) == 5 && segments[3] == bindingsPathSegment && segments[4] != "":
+		route.BindingID = segments[4]
+		route.Operation = bindingOperation(method)
+	case len(segments) == 6 && segments[3] == bindingsPathSegment && segments[5] == lastOperationSegment && method == http.MethodGet:
+		route.BindingID = segments[4]
+		route.Operation = BindingLastOperation
+	default:
+		route.Operation = Unknown
+	}
+
+	if route.Operation == Unknown {
+		return Route{Operation: Unknown}
+	}
+
+	return route
+}
+
+func instanceOperation(method string) Operation {
+	switch method {
+	case http.MethodPut:
+		return Provision
+	case http.MethodPatch:
+		return Update
+	case http.MethodDelete:
+		return Deprovision
+	case http.MethodGet:
+		return FetchInstance
+	}
+	return Unknown
+}
+
+func bindingOperation(method string) Operation {
+	switch method {
+	case http.MethodPut:
+		return Bind
+	case http.MethodDelete:
+		return Unbind
+	case http.MethodGet:
+		return FetchBinding
+	}
+	return Unknown
+}
+
+// OriginatingIdentity is the decoded X-Broker-API-Originating-Identity
+// header: the platform that sent the request and the user on whose behalf it
+// was sent.
+type OriginatingIdentity struct {
+	Platform string
+	Value    map[string]interface{}
+}
+
+// ParseOriginatingIdentity decodes a header of the form
+// "<platform> <base64 encoded JSON object>".
+func ParseOriginatingIdentity(header string) (OriginatingIdentity, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return OriginatingIdentity{}, errors.New("expected a platform and a value")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return OriginatingIdentity{}, errors.New("the value is not base64 encoded")
+	}
+
+	identity := OriginatingIdentity{Platform: fields[0]}
+	if err := json.Unmarshal(decoded, &identity.Value); err != nil {
+		return OriginatingIdentity{}, errors.New("the value is not a JSON object")
+	}
+
+	return identity, nil
+}
+
+// User returns the ID of the user, which Cloud Foundry sends as user_id and
+// Kubernetes as username.
+func (o OriginatingIdentity) User() string {
+	for _, key := range []string{"user_id", "username"} {
+		if user, ok := o.Value[key].(string); ok {
+			return user
+		}
+	}
+	return ""
+}
+
+// ErrorResponse is the error body defined by the OSBAPI spec.
+type ErrorResponse struct {
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description"`
+}
+
+// WriteError responds with the given status and an OSBAPI error body.
+func WriteError(w http.ResponseWriter, status int, errorCode, description string) {
+	body, _ := json.Marshal(ErrorResponse{Error: errorCode, Description: description})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
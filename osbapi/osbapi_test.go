@@ -0,0 +1,105 @@
+package osbapi_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OSBAPI", func() {
+	DescribeTable("ParseRoute",
+		func(method, path string, expected osbapi.Route) {
+			Expect(osbapi.ParseRoute(method, path)).To(Equal(expected))
+		},
+		Entry("catalog", "GET", "/v2/catalog", osbapi.Route{Operation: osbapi.Catalog}),
+		Entry("provision", "PUT", "/v2/service_instances/i1", osbapi.Route{Operation: osbapi.Provision, InstanceID: "i1"}),
+		Entry("update", "PATCH", "/v2/service_instances/i1", osbapi.Route{Operation: osbapi.Update, InstanceID: "i1"}),
+		Entry("deprovision", "DELETE", "/v2/service_instances/i1", osbapi.Route{Operation: osbapi.Deprovision, InstanceID: "i1"}),
+		Entry("fetch instance", "GET", "/v2/service_instances/i1", osbapi.Route{Operation: osbapi.FetchInstance, InstanceID: "i1"}),
+		Entry("last operation", "GET", "/v2/service_instances/i1/last_operation", osbapi.Route{Operation: osbapi.LastOperation, InstanceID: "i1"}),
+		Entry("bind", "PUT", "/v2/service_instances/i1/service_bindings/b1", osbapi.Route{Operation: osbapi.Bind, InstanceID: "i1", BindingID: "b1"}),
+		Entry("unbind", "DELETE", "/v2/service_instances/i1/service_bindings/b1", osbapi.Route{Operation: osbapi.Unbind, InstanceID: "i1", BindingID: "b1"}),
+		Entry("fetch binding", "GET", "/v2/service_instances/i1/service_bindings/b1", osbapi.Route{Operation: osbapi.FetchBinding, InstanceID: "i1", BindingID: "b1"}),
+		Entry("binding last operation", "GET", "/v2/service_instances/i1/service_bindings/b1/last_operation", osbapi.Route{Operation: osbapi.BindingLastOperation, InstanceID: "i1", BindingID: "b1"}),
+		Entry("trailing slash", "PUT", "/v2/service_instances/i1/", osbapi.Route{Operation: osbapi.Provision, InstanceID: "i1"}),
+		Entry("unsupported method", "POST", "/v2/service_instances/i1", osbapi.Route{Operation: osbapi.Unknown}),
+		Entry("catalog with the wrong method", "PUT", "/v2/catalog", osbapi.Route{Operation: osbapi.Unknown}),
+		Entry("unknown path", "GET", "/v2/any-endpoint", osbapi.Route{Operation: osbapi.Unknown}),
+		Entry("missing instance id", "PUT", "/v2/service_instances/", osbapi.Route{Operation: osbapi.Unknown}),
+		Entry("non v2 path", "GET", "/catalog", osbapi.Route{Operation: osbapi.Unknown}),
+	)
+
+	It("knows which operations are part of the OSBAPI", func() {
+		Expect(osbapi.Provision.Valid()).To(BeTrue())
+		Expect(osbapi.Unknown.Valid()).To(BeFalse())
+		Expect(osbapi.Operation("provisioning").Valid()).To(BeFalse())
+	})
+
+	It("knows which operations are idempotent", func() {
+		Expect(osbapi.Catalog.Idempotent()).To(BeTrue())
+		Expect(osbapi.Provision.Idempotent()).To(BeTrue())
+		Expect(osbapi.BindingLastOperation.Idempotent()).To(BeTrue())
+		Expect(osbapi.Update.Idempotent()).To(BeFalse())
+		Expect(osbapi.Unbind.Idempotent()).To(BeFalse())
+		Expect(osbapi.Unknown.Idempotent()).To(BeFalse())
+	})
+
+	Describe("ParseOriginatingIdentity", func() {
+		It("decodes Cloud Foundry identities", func() {
+			value := base64.StdEncoding.EncodeToString([]byte(`{"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}`))
+
+			identity, err := osbapi.ParseOriginatingIdentity("cloudfoundry " + value)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(identity.Platform).To(Equal("cloudfoundry"))
+			Expect(identity.User()).To(Equal("683ea748-3092-4ff4-b656-39cacc4d5360"))
+		})
+
+		It("decodes Kubernetes identities", func() {
+			value := base64.StdEncoding.EncodeToString([]byte(`{"username": "duke", "uid": "c2dde242-5ce4-11e7-988c-000c2946f14f"}`))
+
+			identity, err := osbapi.ParseOriginatingIdentity("kubernetes " + value)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(identity.User()).To(Equal("duke"))
+		})
+
+		DescribeTable("rejects malformed headers",
+			func(header string) {
+				_, err := osbapi.ParseOriginatingIdentity(header)
+				Expect(err).To(HaveOccurred())
+			},
+			Entry("empty", ""),
+			Entry("missing value", "cloudfoundry"),
+			Entry("not base64", "cloudfoundry !!!"),
+			Entry("not JSON", "cloudfoundry "+base64.StdEncoding.EncodeToString([]byte("user"))),
+		)
+	})
+
+	Describe("WriteError", func() {
+		It("writes an OSBAPI error body with the given status", func() {
+			writer := httptest.NewRecorder()
+
+			osbapi.WriteError(writer, 422, "AsyncRequired", "This request requires async")
+
+			Expect(writer.Code).To(Equal(422))
+			Expect(writer.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			var body osbapi.ErrorResponse
+			Expect(json.Unmarshal(writer.Body.Bytes(), &body)).To(Succeed())
+			Expect(body).To(Equal(osbapi.ErrorResponse{Error: "AsyncRequired", Description: "This request requires async"}))
+		})
+
+		It("omits the error code when none is given", func() {
+			writer := httptest.NewRecorder()
+
+			osbapi.WriteError(writer, 500, "", "oops")
+
+			Expect(writer.Body.String()).To(MatchJSON(`{"description": "oops"}`))
+		})
+	})
+})
@@ -0,0 +1,226 @@
+package osbapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/negroni"
+)
+
+const (
+	// APIVersionHeader is the header in which platforms send the version of
+	// the OSBAPI they speak.
+	APIVersionHeader = "X-Broker-API-Version"
+
+	acceptsIncompleteParameter = "accepts_incomplete"
+)
+
+var apiVersionPattern = regexp.MustCompile(`^2\.[0-9]+$`)
+
+// field describes a field of a request body: a string, or an object with
+// fields of its own. Required strings must not be empty.
+type field struct {
+	name     string
+	object   bool
+	required bool
+	fields   []field
+}
+
+var maintenanceInfo = field{name: "maintenance_info", object: true, fields: []field{
+	{name: "version"},
+}}
+
+// bodySchemas are the request bodies defined by the OSBAPI spec. Fields it
+// does not define are left to the broker.
+var bodySchemas = map[Operation][]field{
+	Provision: {
+		{name: "service_id", required: true},
+		{name: "plan_id", required: true},
+		{name: "organization_guid"},
+		{name: "space_guid"},
+		{name: "context", object: true},
+		{name: "parameters", object: true},
+		maintenanceInfo,
+	},
+	Update: {
+		{name: "service_id", required: true},
+		{name: "plan_id"},
+		{name: "context", object: true},
+		{name: "parameters", object: true},
+		{name: "previous_values", object: true, fields: []field{
+			{name: "service_id"},
+			{name: "plan_id"},
+			{name: "organization_id"},
+			{name: "space_id"},
+			maintenanceInfo,
+		}},
+		maintenanceInfo,
+	},
+	Bind: {
+		{name: "service_id", required: true},
+		{name: "plan_id", required: true},
+		{name: "app_guid"},
+		{name: "bind_resource", object: true, fields: []field{
+			{name: "app_guid"},
+			{name: "route"},
+		}},
+		{name: "context", object: true},
+		{name: "parameters", object: true},
+	},
+}
+
+// asyncOperations are the operations that accept an asynchronous response.
+var asyncOperations = map[Operation]bool{
+	Provision: true, Update: true, Deprovision: true, Bind: true, Unbind: true,
+}
+
+// AcceptsIncomplete reports whether requests of the operation may ask for an
+// asynchronous response with accepts_incomplete.
+func (o Operation) AcceptsIncomplete() bool {
+	return asyncOperations[o]
+}
+
+type validator struct {
+	asyncRequired map[Operation]bool
+}
+
+type ValidatorOption func(*validator)
+
+// WithAsyncRequired rejects requests of the operations that do not set
+// accepts_incomplete=true with 422 AsyncRequired, as brokers that can only
+// perform them asynchronously do.
+func WithAsyncRequired(operations ...Operation) ValidatorOption {
+	return func(v *validator) {
+		for _, operation := range operations {
+			v.asyncRequired[operation] = true
+		}
+	}
+}
+
+// Validator rejects OSBAPI requests that do not follow the spec before they
+// reach the broker: requests without a supported X-Broker-API-Version with
+// 412, and malformed query parameters and bodies with 400. Requests
+// outside the OSBAPI are passed on.
+func Validator(opts ...ValidatorOption) negroni.HandlerFunc {
+	v := &validator{asyncRequired: map[Operation]bool{}}
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		route := ParseRoute(r.Method, r.URL.Path)
+		if route.Operation == Unknown {
+			next(rw, r)
+			return
+		}
+
+		version := r.Header.Get(APIVersionHeader)
+		if version == "" {
+			WriteError(rw, http.StatusPreconditionFailed, "UnsupportedAPIVersion", "The "+APIVersionHeader+" header is required")
+			return
+		}
+		if !apiVersionPattern.MatchString(version) {
+			WriteError(rw, http.StatusPreconditionFailed, "UnsupportedAPIVersion",
+				fmt.Sprintf("%s %q is not supported, the broker supports version 2.x", APIVersionHeader, version))
+			return
+		}
+
+		query := r.URL.Query()
+		problems := checkQuery(route.Operation, query)
+
+		if schema, ok := bodySchemas[route.Operation]; ok {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				WriteError(rw, http.StatusBadRequest, "", "Could not read request body")
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			problems = append(problems, checkBody(schema, body)...)
+		}
+
+		if len(problems) != 0 {
+			WriteError(rw, http.StatusBadRequest, "InvalidRequest",
+				fmt.Sprintf("Invalid %s request: %s", strings.Replace(string(route.Operation), "_", " ", -1), strings.Join(problems, "; ")))
+			return
+		}
+
+		if v.asyncRequired[route.Operation] && query.Get(acceptsIncompleteParameter) != "true" {
+			WriteError(rw, http.StatusUnprocessableEntity, "AsyncRequired",
+				"This service plan requires client support for asynchronous service operations.")
+			return
+		}
+
+		next(rw, r)
+	})
+}
+
+func checkQuery(operation Operation, query url.Values) []string {
+	var problems []string
+
+	if operation.AcceptsIncomplete() {
+		if values, ok := query[acceptsIncompleteParameter]; ok {
+			if len(values) != 1 || (values[0] != "true" && values[0] != "false") {
+				problems = append(problems, "accepts_incomplete must be true or false")
+			}
+		}
+	}
+
+	// Deprovisions and unbinds have no body, so the IDs come as parameters.
+	if operation == Deprovision || operation == Unbind {
+		for _, name := range []string{"service_id", "plan_id"} {
+			if query.Get(name) == "" {
+				problems = append(problems, fmt.Sprintf("the %s query parameter is required", name))
+			}
+		}
+	}
+
+	return problems
+}
+
+func checkBody(schema []field, body []byte) []string {
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil || object == nil {
+		return []string{"the body must be a JSON object"}
+	}
+	return checkFields("", schema, object)
+}
+
+func checkFields(prefix string, schema []field, object map[string]interface{}) []string {
+	var problems []string
+	for _, f := range schema {
+		name := prefix + f.name
+		value, present := object[f.name]
+		if !present || value == nil {
+			if f.required {
+				problems = append(problems, name+" is required")
+			}
+			continue
+		}
+
+		if f.object {
+			nested, ok := value.(map[string]interface{})
+			if !ok {
+				problems = append(problems, name+" must be an object")
+				continue
+			}
+			problems = append(problems, checkFields(name+".", f.fields, nested)...)
+			continue
+		}
+
+		s, ok := value.(string)
+		switch {
+		case !ok:
+			problems = append(problems, name+" must be a string")
+		case f.required && s == "":
+			problems = append(problems, name+" must not be empty")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,149 @@
+package osbapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validator", func() {
+	var (
+		opts      []osbapi.ValidatorOption
+		forwarded *http.Request
+		body      string
+	)
+
+	BeforeEach(func() {
+		opts = nil
+		forwarded = nil
+		body = ""
+	})
+
+	serve := func(method, path, requestBody string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(requestBody))
+		req.Header.Set("X-Broker-API-Version", "2.14")
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		w := httptest.NewRecorder()
+		n := negroni.New(osbapi.Validator(opts...))
+		n.UseHandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			forwarded = r
+			read, _ := ioutil.ReadAll(r.Body)
+			body = string(read)
+		})
+		n.ServeHTTP(w, req)
+		return w
+	}
+
+	It("forwards valid requests with their body", func() {
+		w := serve("PUT", "/v2/service_instances/6a5f0a4e-5d0b-4c5e-9d39-8a3c1e2f7b10?accepts_incomplete=true", `{
+			"service_id": "s1",
+			"plan_id": "p1",
+			"context": {"platform": "cloudfoundry"},
+			"parameters": {"name": "db"},
+			"maintenance_info": {"version": "1.0.0"},
+			"extension": 1
+		}`, nil)
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(forwarded).NotTo(BeNil())
+		Expect(body).To(ContainSubstring(`"service_id": "s1"`))
+	})
+
+	It("passes requests outside the OSBAPI on", func() {
+		req := httptest.NewRequest("GET", "/v2/any-endpoint", nil)
+		w := httptest.NewRecorder()
+		n := negroni.New(osbapi.Validator())
+		n.UseHandlerFunc(func(rw http.ResponseWriter, r *http.Request) { forwarded = r })
+		n.ServeHTTP(w, req)
+
+		Expect(forwarded).NotTo(BeNil())
+	})
+
+	DescribeTable("rejects unsupported API versions with 412",
+		func(version, description string) {
+			w := serve("GET", "/v2/catalog", "", http.Header{"X-Broker-Api-Version": {version}})
+
+			Expect(w.Code).To(Equal(http.StatusPreconditionFailed))
+			Expect(w.Body.String()).To(MatchJSON(`{"error": "UnsupportedAPIVersion", "description": "` + description + `"}`))
+			Expect(forwarded).To(BeNil())
+		},
+		Entry("missing", "", "The X-Broker-API-Version header is required"),
+		Entry("another major version", "3.0", `X-Broker-API-Version \"3.0\" is not supported, the broker supports version 2.x`),
+		Entry("malformed", "latest", `X-Broker-API-Version \"latest\" is not supported, the broker supports version 2.x`),
+	)
+
+	DescribeTable("rejects malformed requests with 400",
+		func(method, path, requestBody, description string) {
+			w := serve(method, path, requestBody, nil)
+
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(w.Body.String()).To(MatchJSON(`{"error": "InvalidRequest", "description": "` + description + `"}`))
+			Expect(forwarded).To(BeNil())
+		},
+		Entry("provision without a body", "PUT", "/v2/service_instances/i1", "",
+			"Invalid provision request: the body must be a JSON object"),
+		Entry("provision with a JSON array", "PUT", "/v2/service_instances/i1", `[]`,
+			"Invalid provision request: the body must be a JSON object"),
+		Entry("provision without IDs", "PUT", "/v2/service_instances/i1", `{"parameters": "x"}`,
+			"Invalid provision request: service_id is required; plan_id is required; parameters must be an object"),
+		Entry("provision with an empty plan", "PUT", "/v2/service_instances/i1", `{"service_id": "s1", "plan_id": ""}`,
+			"Invalid provision request: plan_id must not be empty"),
+		Entry("update with previous values of the wrong type", "PATCH", "/v2/service_instances/i1",
+			`{"service_id": "s1", "plan_id": 2, "previous_values": {"plan_id": true}, "maintenance_info": {"version": 1}}`,
+			"Invalid update request: plan_id must be a string; previous_values.plan_id must be a string; maintenance_info.version must be a string"),
+		Entry("bind with a malformed bind resource", "PUT", "/v2/service_instances/i1/service_bindings/b1",
+			`{"service_id": "s1", "plan_id": "p1", "bind_resource": "app", "context": []}`,
+			"Invalid bind request: bind_resource must be an object; context must be an object"),
+		Entry("deprovision without IDs", "DELETE", "/v2/service_instances/i1?service_id=s1", "",
+			"Invalid deprovision request: the plan_id query parameter is required"),
+		Entry("unbind without IDs", "DELETE", "/v2/service_instances/i1/service_bindings/b1", "",
+			"Invalid unbind request: the service_id query parameter is required; the plan_id query parameter is required"),
+		Entry("accepts_incomplete that is not a boolean", "DELETE", "/v2/service_instances/i1?service_id=s1&plan_id=p1&accepts_incomplete=yes", "",
+			"Invalid deprovision request: accepts_incomplete must be true or false"),
+	)
+
+	It("ignores accepts_incomplete on operations that are always synchronous", func() {
+		w := serve("GET", "/v2/service_instances/i1?accepts_incomplete=yes", "", nil)
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+	})
+
+	Describe("WithAsyncRequired", func() {
+		BeforeEach(func() {
+			opts = []osbapi.ValidatorOption{osbapi.WithAsyncRequired(osbapi.Provision, osbapi.Deprovision)}
+		})
+
+		It("rejects requests that do not accept an asynchronous response with 422", func() {
+			w := serve("DELETE", "/v2/service_instances/i1?service_id=s1&plan_id=p1&accepts_incomplete=false", "", nil)
+
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(w.Body.String()).To(MatchJSON(`{"error": "AsyncRequired", "description": "This service plan requires client support for asynchronous service operations."}`))
+			Expect(forwarded).To(BeNil())
+		})
+
+		It("forwards requests that do", func() {
+			w := serve("PUT", "/v2/service_instances/i1?accepts_incomplete=true", `{"service_id": "s1", "plan_id": "p1"}`, nil)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(forwarded).NotTo(BeNil())
+		})
+
+		It("leaves the other operations alone", func() {
+			w := serve("PATCH", "/v2/service_instances/i1", `{"service_id": "s1"}`, nil)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+		})
+	})
+})
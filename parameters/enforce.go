@@ -0,0 +1,42 @@
+package parameters
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Enforce applies the policy to the parameters of provisions, updates and
+// binds. The names of services and plans are looked up in the cached
+// catalog. Requests that set forbidden parameters are rejected with 400.
+func Enforce(policy Policy, cache *catalog.Cache) negroni.HandlerFunc {
+	operations := []osbapi.Operation{osbapi.Provision, osbapi.Update, osbapi.Bind}
+	return rewriter(operations, cache, func(rw http.ResponseWriter, r *http.Request, target Target, parameters map[string]interface{}, data map[string]string) (map[string]interface{}, bool) {
+		parameters, matched, err := policy.Apply(target, parameters, data)
+		if forbidden, ok := err.(*ForbiddenError); ok {
+			problems := make([]string, len(forbidden.Paths))
+			for i, path := range forbidden.Paths {
+				problems[i] = "parameters." + path + " may not be set"
+			}
+			osbapi.WriteError(rw, http.StatusBadRequest, "ForbiddenParameters",
+				fmt.Sprintf("Invalid parameters for plan %s of service %s: %s", catalog.Describe(target.PlanName, target.PlanID), catalog.Describe(target.ServiceName, target.ServiceID), strings.Join(problems, "; ")))
+			return nil, false
+		}
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to apply the parameter policy: "+err.Error())
+			return nil, false
+		}
+		if !matched {
+			return nil, true
+		}
+
+		logging.Annotate(r.Context(), logging.Data{"parameter_policy": "applied"})
+		return parameters, true
+	})
+}
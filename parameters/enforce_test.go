@@ -0,0 +1,146 @@
+package parameters_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/parameters"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/urfave/negroni"
+)
+
+const testCatalog = `{
+	"services": [
+		{
+			"id": "mysql-id",
+			"name": "google-cloudsql-mysql",
+			"bindable": true,
+			"plans": [{"id": "beta-id", "name": "beta"}]
+		},
+		{
+			"id": "storage-id",
+			"name": "google-storage",
+			"bindable": true,
+			"plans": [{"id": "standard-id", "name": "standard"}]
+		}
+	]
+}`
+
+var _ = Describe("Enforce", func() {
+	var (
+		requests  []string
+		forwarded string
+		handler   http.Handler
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		forwarded = ""
+
+		policy, err := parameters.ParsePolicy(securityPolicy)
+		Expect(err).NotTo(HaveOccurred())
+
+		n := negroni.New(parameters.Enforce(policy, catalog.NewCache()))
+		n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if r.URL.Path == "/v2/catalog" {
+				w.Write([]byte(testCatalog))
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			Expect(r.ContentLength).To(BeEquivalentTo(len(body)))
+			forwarded = string(body)
+			w.WriteHeader(http.StatusCreated)
+		})
+		handler = n
+	})
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	It("rewrites the parameters of provisions", func() {
+		w := serve("PUT", "/v2/service_instances/i1", `{
+			"service_id": "mysql-id",
+			"plan_id": "beta-id",
+			"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1", "instance_name": "orders"},
+			"parameters": {"tier": "db-f1-micro", "labels": {"compliance": "none"}}
+		}`)
+
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		Expect(forwarded).To(MatchJSON(`{
+			"service_id": "mysql-id",
+			"plan_id": "beta-id",
+			"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1", "instance_name": "orders"},
+			"parameters": {
+				"tier": "db-f1-micro",
+				"backups_enabled": "true",
+				"instance_name": "orders-db",
+				"authorized_networks": [],
+				"labels": {"compliance": "pci", "cost-center": "org-1", "space": "space-1"}
+			}
+		}`))
+		Expect(requests).To(Equal([]string{"GET /v2/catalog", "PUT /v2/service_instances/i1"}))
+	})
+
+	It("adds parameters to requests without any", func() {
+		serve("PUT", "/v2/service_instances/i1", `{"service_id": "storage-id", "plan_id": "standard-id", "organization_guid": "org-1", "space_guid": "space-1"}`)
+
+		Expect(forwarded).To(MatchJSON(`{
+			"service_id": "storage-id",
+			"plan_id": "standard-id",
+			"organization_guid": "org-1",
+			"space_guid": "space-1",
+			"parameters": {"labels": {"cost-center": "org-1", "space": "space-1"}}
+		}`))
+	})
+
+	It("applies rules for binds", func() {
+		serve("PUT", "/v2/service_instances/i1/service_bindings/b1", `{"service_id": "mysql-id", "plan_id": "beta-id", "parameters": {"role": "cloudsql.admin"}}`)
+
+		Expect(forwarded).To(MatchJSON(`{"service_id": "mysql-id", "plan_id": "beta-id", "parameters": {"role": "cloudsql.client"}}`))
+	})
+
+	It("looks up the plan of updates that keep it", func() {
+		serve("PATCH", "/v2/service_instances/i1", `{"service_id": "mysql-id", "previous_values": {"plan_id": "beta-id"}}`)
+
+		Expect(forwarded).To(ContainSubstring(`"authorized_networks":[]`))
+	})
+
+	It("rejects requests that set forbidden parameters", func() {
+		w := serve("PUT", "/v2/service_instances/i1", `{"service_id": "mysql-id", "plan_id": "beta-id", "parameters": {"binlog": true}}`)
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(w.Body.String()).To(MatchJSON(`{
+			"error": "ForbiddenParameters",
+			"description": "Invalid parameters for plan beta of service google-cloudsql-mysql: parameters.binlog may not be set"
+		}`))
+		Expect(requests).To(Equal([]string{"GET /v2/catalog"}))
+	})
+
+	It("keeps large integers exact", func() {
+		serve("PUT", "/v2/service_instances/i1", `{"service_id": "mysql-id", "plan_id": "beta-id", "parameters": {"max_bytes": 9007199254740993, "ratio": 0.1}}`)
+
+		Expect(forwarded).To(ContainSubstring(`"max_bytes":9007199254740993`))
+		Expect(forwarded).To(ContainSubstring(`"ratio":0.1`))
+	})
+
+	It("forwards other requests unchanged", func() {
+		Expect(serve("DELETE", "/v2/service_instances/i1?service_id=mysql-id&plan_id=beta-id", "").Code).To(Equal(http.StatusCreated))
+		Expect(requests).To(Equal([]string{"DELETE /v2/service_instances/i1"}))
+	})
+
+	It("forwards malformed bodies unchanged", func() {
+		serve("PUT", "/v2/service_instances/i1", `{"service_id": `)
+
+		Expect(forwarded).To(Equal(`{"service_id": `))
+		Expect(requests).To(Equal([]string{"PUT /v2/service_instances/i1"}))
+	})
+})
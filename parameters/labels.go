@@ -0,0 +1,171 @@
+package parameters
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/urfave/negroni"
+	yaml "gopkg.in/yaml.v2"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// maxLabelLength is the length, in characters, GCP allows label keys and
+// values to have.
+const maxLabelLength = 63
+
+var labelKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+// defaultLabelKeys are the labels added when a configuration sets no keys,
+// and the fields of the request they are taken from.
+var defaultLabelKeys = map[string]string{
+	"cf-organization-guid": "organization_guid",
+	"cf-organization-name": "organization_name",
+	"cf-space-guid":        "space_guid",
+	"cf-space-name":        "space_name",
+	"cf-instance-id":       "instance_id",
+	"cf-instance-name":     "instance_name",
+	"cf-user-id":           "user",
+}
+
+// Labels configures the GCP labels added to the parameters of provisions.
+// Services maps the services that support labels, by name or ID, to the
+// dotted path of the parameter that holds them. Keys maps label keys to the
+// fields of the request they are taken from, which are those templates of a
+// policy can refer to.
+type Labels struct {
+	Services map[string]string `yaml:"services"`
+	Keys     map[string]string `yaml:"keys"`
+}
+
+// ParseLabels reads a label configuration from YAML, or JSON as a subset of
+// it.
+func ParseLabels(raw string) (Labels, error) {
+	var labels Labels
+	if err := yaml.UnmarshalStrict([]byte(raw), &labels); err != nil {
+		return Labels{}, err
+	}
+
+	for _, service := range sortedKeys(labels.Services) {
+		if path := labels.Services[service]; !validPath(path) {
+			return Labels{}, fmt.Errorf("services.%s: invalid path %q", service, path)
+		}
+	}
+
+	if len(labels.Keys) == 0 {
+		labels.Keys = defaultLabelKeys
+	}
+	for _, key := range sortedKeys(labels.Keys) {
+		if !labelKeyPattern.MatchString(key) {
+			return Labels{}, fmt.Errorf("keys: %q is not a valid label key, which must start with a lowercase letter and have at most 63 lowercase letters, digits, '_' or '-'", key)
+		}
+		if labels.Keys[key] == "" {
+			return Labels{}, fmt.Errorf("keys.%s: no field given", key)
+		}
+	}
+
+	return labels, nil
+}
+
+// Path returns the path of the parameter that holds the labels of the
+// target's service, and whether the service supports labels.
+func (l Labels) Path(target Target) ([]string, bool) {
+	for _, key := range []string{target.ServiceID, target.ServiceName} {
+		if path, ok := l.Services[key]; ok && key != "" {
+			return strings.Split(path, "."), true
+		}
+	}
+	return nil, false
+}
+
+// Values returns the labels for a request, sanitized to follow GCP's rules.
+// Labels whose field is empty are left out.
+func (l Labels) Values(data map[string]string) map[string]interface{} {
+	values := map[string]interface{}{}
+	for key, field := range l.Keys {
+		if value := SanitizeLabelValue(data[field]); value != "" {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// SanitizeLabelValue turns a string into a GCP label value: lowercase
+// letters, digits, '_' and '-', with other characters replaced by '-', and
+// at most 63 characters.
+func SanitizeLabelValue(value string) string {
+	var b strings.Builder
+	length := 0
+	for _, r := range strings.ToLower(value) {
+		if length == maxLabelLength {
+			break
+		}
+		if !unicode.IsLower(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			r = '-'
+		}
+		b.WriteRune(r)
+		length++
+	}
+	return b.String()
+}
+
+// InjectLabels adds labels identifying the Cloud Foundry org, space,
+// instance and user to the parameters of provisions of the services that
+// support them. The labels replace those of the same keys the request sets.
+// Requests whose labels parameter is not an object are rejected with 400.
+func InjectLabels(labels Labels, cache *catalog.Cache) negroni.HandlerFunc {
+	operations := []osbapi.Operation{osbapi.Provision}
+	return rewriter(operations, cache, func(rw http.ResponseWriter, r *http.Request, target Target, parameters map[string]interface{}, data map[string]string) (map[string]interface{}, bool) {
+		path, ok := labels.Path(target)
+		if !ok {
+			return nil, true
+		}
+
+		values := labels.Values(data)
+		if len(values) == 0 {
+			return nil, true
+		}
+
+		if existing, ok := lookup(parameters, path); ok {
+			if _, isObject := existing.(map[string]interface{}); !isObject {
+				osbapi.WriteError(rw, http.StatusBadRequest, "InvalidParameters",
+					fmt.Sprintf("Invalid parameters for plan %s of service %s: parameters.%s must be an object", catalog.Describe(target.PlanName, target.PlanID), catalog.Describe(target.ServiceName, target.ServiceID), strings.Join(path, ".")))
+				return nil, false
+			}
+		}
+
+		var overlay map[string]interface{} = values
+		for i := len(path) - 1; i >= 0; i-- {
+			overlay = map[string]interface{}{path[i]: overlay}
+		}
+		return merge(parameters, overlay), true
+	})
+}
+
+// lookup returns the value at the path of the parameters, or the first value
+// on the way that is not an object.
+func lookup(parameters map[string]interface{}, path []string) (interface{}, bool) {
+	value, ok := parameters[path[0]]
+	if !ok || len(path) == 1 {
+		return value, ok
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value, true
+	}
+	return lookup(object, path[1:])
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,167 @@
+package parameters_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/parameters"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/urfave/negroni"
+)
+
+var _ = Describe("Labels", func() {
+	DescribeTable("SanitizeLabelValue",
+		func(value, sanitized string) {
+			Expect(parameters.SanitizeLabelValue(value)).To(Equal(sanitized))
+		},
+		Entry("GUIDs", "683ea748-3092-4ff4-b656-39cacc4d5360", "683ea748-3092-4ff4-b656-39cacc4d5360"),
+		Entry("uppercase letters", "Orders", "orders"),
+		Entry("spaces and punctuation", "My Space (prod)", "my-space--prod-"),
+		Entry("email addresses", "jane.doe@example.com", "jane-doe-example-com"),
+		Entry("international characters", "Zürich_ÉQUIPE", "zürich_équipe"),
+		Entry("long values", strings.Repeat("a", 70), strings.Repeat("a", 63)),
+		Entry("long international values", strings.Repeat("é", 70), strings.Repeat("é", 63)),
+	)
+
+	DescribeTable("rejects invalid configurations",
+		func(raw, message string) {
+			_, err := parameters.ParseLabels(raw)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("unknown fields", `{"service": {}}`, "field service not found"),
+		Entry("invalid paths", `{"services": {"google-storage": "labels."}}`, `services.google-storage: invalid path "labels."`),
+		Entry("invalid keys", `{"services": {"google-storage": "labels"}, "keys": {"CF-Org": "organization_guid"}}`, `keys: "CF-Org" is not a valid label key`),
+		Entry("keys starting with digits", `{"keys": {"1org": "organization_guid"}}`, `keys: "1org" is not a valid label key`),
+		Entry("keys without fields", `{"keys": {"org": ""}}`, "keys.org: no field given"),
+	)
+
+	It("adds the default labels when no keys are configured", func() {
+		labels, err := parameters.ParseLabels(`{"services": {"google-storage": "labels"}}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(labels.Values(map[string]string{
+			"organization_guid": "org-1",
+			"organization_name": "Platform",
+			"space_guid":        "space-1",
+			"space_name":        "dev",
+			"instance_id":       "instance-1",
+			"instance_name":     "orders-bucket",
+			"user":              "683ea748",
+		})).To(Equal(map[string]interface{}{
+			"cf-organization-guid": "org-1",
+			"cf-organization-name": "platform",
+			"cf-space-guid":        "space-1",
+			"cf-space-name":        "dev",
+			"cf-instance-id":       "instance-1",
+			"cf-instance-name":     "orders-bucket",
+			"cf-user-id":           "683ea748",
+		}))
+	})
+
+	Describe("InjectLabels", func() {
+		var (
+			requests  []string
+			forwarded string
+			handler   http.Handler
+		)
+
+		BeforeEach(func() {
+			requests = nil
+			forwarded = ""
+
+			labels, err := parameters.ParseLabels(`{
+				"services": {"google-cloudsql-mysql": "labels", "storage-id": "bucket.labels"},
+				"keys": {"org": "organization_guid", "space": "space_name", "user": "user"}
+			}`)
+			Expect(err).NotTo(HaveOccurred())
+
+			n := negroni.New(parameters.InjectLabels(labels, catalog.NewCache()))
+			n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				if r.URL.Path == "/v2/catalog" {
+					w.Write([]byte(testCatalog))
+					return
+				}
+				body, _ := ioutil.ReadAll(r.Body)
+				forwarded = string(body)
+				w.WriteHeader(http.StatusCreated)
+			})
+			handler = n
+		})
+
+		serve := func(method, path, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("X-Broker-API-Originating-Identity", "cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4In0=")
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		It("adds the labels to the parameters of provisions", func() {
+			w := serve("PUT", "/v2/service_instances/i1", `{
+				"service_id": "mysql-id",
+				"plan_id": "beta-id",
+				"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1", "space_name": "Team Orders"},
+				"parameters": {"tier": "db-f1-micro", "labels": {"team": "orders", "org": "spoofed"}}
+			}`)
+
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(forwarded).To(MatchJSON(`{
+				"service_id": "mysql-id",
+				"plan_id": "beta-id",
+				"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1", "space_name": "Team Orders"},
+				"parameters": {
+					"tier": "db-f1-micro",
+					"labels": {"team": "orders", "org": "org-1", "space": "team-orders", "user": "683ea748"}
+				}
+			}`))
+		})
+
+		It("creates the labels parameter where the service expects it", func() {
+			serve("PUT", "/v2/service_instances/i1", `{"service_id": "storage-id", "plan_id": "standard-id", "organization_guid": "org-1", "space_guid": "space-1"}`)
+
+			Expect(forwarded).To(MatchJSON(`{
+				"service_id": "storage-id",
+				"plan_id": "standard-id",
+				"organization_guid": "org-1",
+				"space_guid": "space-1",
+				"parameters": {"bucket": {"labels": {"org": "org-1", "user": "683ea748"}}}
+			}`))
+		})
+
+		It("rejects provisions whose labels are not an object", func() {
+			w := serve("PUT", "/v2/service_instances/i1", `{"service_id": "mysql-id", "plan_id": "beta-id", "organization_guid": "org-1", "parameters": {"labels": "team=orders"}}`)
+
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(w.Body.String()).To(MatchJSON(`{
+				"error": "InvalidParameters",
+				"description": "Invalid parameters for plan beta of service google-cloudsql-mysql: parameters.labels must be an object"
+			}`))
+		})
+
+		It("leaves the parameters of services without labels unchanged", func() {
+			body := `{"service_id": "pubsub-id", "plan_id": "default-id", "organization_guid": "org-1", "parameters": {"topic_name": "orders"}}`
+			serve("PUT", "/v2/service_instances/i1", body)
+
+			Expect(forwarded).To(Equal(body))
+		})
+
+		It("leaves updates and binds unchanged", func() {
+			update := `{"service_id": "mysql-id", "plan_id": "beta-id", "context": {"organization_guid": "org-1"}}`
+			serve("PATCH", "/v2/service_instances/i1", update)
+			Expect(forwarded).To(Equal(update))
+
+			bind := `{"service_id": "mysql-id", "plan_id": "beta-id", "context": {"organization_guid": "org-1"}}`
+			serve("PUT", "/v2/service_instances/i1/service_bindings/b1", bind)
+			Expect(forwarded).To(Equal(bind))
+
+			Expect(requests).To(Equal([]string{"PATCH /v2/service_instances/i1", "PUT /v2/service_instances/i1/service_bindings/b1"}))
+		})
+	})
+})
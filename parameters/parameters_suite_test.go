@@ -0,0 +1,13 @@
+package parameters_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestParameters(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Parameters Suite")
+}
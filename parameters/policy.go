@@ -0,0 +1,328 @@
+// Package parameters rewrites the parameters of provisions, updates and
+// binds according to an operator's policy before they reach the broker.
+package parameters
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Policy is a list of rules applied in order to the parameters of every
+// request they match.
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule applies to requests for the listed services, matched by name or ID,
+// and plans, matched by name, ID or "service-name/plan-name". Empty lists
+// match everything, and rules without operations apply to provisions and
+// updates.
+//
+// Defaults are merged into the parameters wherever the request sets none,
+// overrides are merged in whatever the request sets, and requests that set
+// one of the forbidden keys, written as dotted paths, are rejected. String
+// values are templates that can refer to the request's context, such as
+// {{.organization_guid}}, {{.space_guid}} and {{.instance_name}}.
+type Rule struct {
+	Services   []string               `yaml:"services"`
+	Plans      []string               `yaml:"plans"`
+	Operations []osbapi.Operation     `yaml:"operations"`
+	Defaults   map[string]interface{} `yaml:"defaults"`
+	Overrides  map[string]interface{} `yaml:"overrides"`
+	Forbidden  []string               `yaml:"forbidden"`
+
+	defaults  map[string]interface{}
+	overrides map[string]interface{}
+}
+
+var defaultOperations = []osbapi.Operation{osbapi.Provision, osbapi.Update}
+
+// ParsePolicy reads a policy from YAML, or JSON as a subset of it.
+func ParsePolicy(raw string) (Policy, error) {
+	var policy Policy
+	if err := yaml.UnmarshalStrict([]byte(raw), &policy); err != nil {
+		return Policy{}, err
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+
+		if len(rule.Operations) == 0 {
+			rule.Operations = defaultOperations
+		}
+		for _, operation := range rule.Operations {
+			if operation != osbapi.Provision && operation != osbapi.Update && operation != osbapi.Bind {
+				return Policy{}, fmt.Errorf("rules[%d].operations: %s has no parameters", i, operation)
+			}
+		}
+
+		for _, path := range rule.Forbidden {
+			if !validPath(path) {
+				return Policy{}, fmt.Errorf("rules[%d].forbidden: invalid path %q", i, path)
+			}
+		}
+
+		var err error
+		if rule.defaults, err = compileObject(rule.Defaults); err != nil {
+			return Policy{}, fmt.Errorf("rules[%d].defaults%s", i, err)
+		}
+		if rule.overrides, err = compileObject(rule.Overrides); err != nil {
+			return Policy{}, fmt.Errorf("rules[%d].overrides%s", i, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// Target is what a request's parameters are for. The names of the service
+// and plan are empty when they are not in the catalog.
+type Target struct {
+	Operation   osbapi.Operation
+	ServiceID   string
+	ServiceName string
+	PlanID      string
+	PlanName    string
+}
+
+// ForbiddenError lists the forbidden parameters a request sets.
+type ForbiddenError struct {
+	Paths []string
+}
+
+func (e *ForbiddenError) Error() string {
+	return "forbidden parameters: " + strings.Join(e.Paths, ", ")
+}
+
+// Apply returns the parameters with the matching rules applied, and whether
+// any rule matched. The parameters passed in are not modified. It returns a
+// *ForbiddenError if they set forbidden keys.
+func (p Policy) Apply(target Target, parameters map[string]interface{}, data map[string]string) (map[string]interface{}, bool, error) {
+	result := parameters
+	matched := false
+	var forbidden []string
+
+	for _, rule := range p.Rules {
+		if !rule.matches(target) {
+			continue
+		}
+		matched = true
+
+		for _, path := range rule.Forbidden {
+			if has(parameters, strings.Split(path, ".")) {
+				forbidden = append(forbidden, path)
+			}
+		}
+
+		defaults, err := render(rule.defaults, data)
+		if err != nil {
+			return nil, false, err
+		}
+		overrides, err := render(rule.overrides, data)
+		if err != nil {
+			return nil, false, err
+		}
+
+		result = merge(defaults, result)
+		result = merge(result, overrides)
+	}
+
+	if len(forbidden) != 0 {
+		sort.Strings(forbidden)
+		return nil, true, &ForbiddenError{Paths: forbidden}
+	}
+	return result, matched, nil
+}
+
+func (r Rule) matches(target Target) bool {
+	if !containsOperation(r.Operations, target.Operation) {
+		return false
+	}
+	if len(r.Services) != 0 && !containsAny(r.Services, target.ServiceID, target.ServiceName) {
+		return false
+	}
+	if len(r.Plans) != 0 {
+		keys := []string{target.PlanID, target.PlanName}
+		if target.ServiceName != "" && target.PlanName != "" {
+			keys = append(keys, target.ServiceName+"/"+target.PlanName)
+		}
+		if !containsAny(r.Plans, keys...) {
+			return false
+		}
+	}
+	return true
+}
+
+// merge returns the values of base with those of overlay merged in, deeply
+// for objects. Neither is modified.
+func merge(base, overlay map[string]interface{}) map[string]interface{} {
+	if len(overlay) == 0 {
+		return base
+	}
+
+	result := make(map[string]interface{}, len(base)+len(overlay))
+	for key, value := range base {
+		result[key] = value
+	}
+	for key, value := range overlay {
+		baseObject, baseIsObject := result[key].(map[string]interface{})
+		overlayObject, overlayIsObject := value.(map[string]interface{})
+		if baseIsObject && overlayIsObject {
+			result[key] = merge(baseObject, overlayObject)
+		} else {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// validPath reports whether the path is a dotted list of keys.
+func validPath(path string) bool {
+	return path != "" && !strings.HasPrefix(path, ".") && !strings.HasSuffix(path, ".") && !strings.Contains(path, "..")
+}
+
+func has(parameters map[string]interface{}, path []string) bool {
+	value, ok := parameters[path[0]]
+	if !ok {
+		return false
+	}
+	if len(path) == 1 {
+		return true
+	}
+	object, ok := value.(map[string]interface{})
+	return ok && has(object, path[1:])
+}
+
+// compileObject converts the values the YAML decoder produces into JSON
+// values, with templates in place of strings.
+func compileObject(object map[string]interface{}) (map[string]interface{}, error) {
+	compiled, err := compile(object)
+	if err != nil {
+		return nil, err
+	}
+	result, _ := compiled.(map[string]interface{})
+	return result, nil
+}
+
+func compile(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf(": key %v is not a string", key)
+			}
+			compiled, err := compile(item)
+			if err != nil {
+				return nil, prefix(name, err)
+			}
+			converted[name] = compiled
+		}
+		return converted, nil
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			compiled, err := compile(item)
+			if err != nil {
+				return nil, prefix(name, err)
+			}
+			converted[name] = compiled
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			compiled, err := compile(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]%s", i, err)
+			}
+			converted[i] = compiled
+		}
+		return converted, nil
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, nil
+		}
+		tmpl, err := template.New("").Option("missingkey=zero").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf(": %s", err)
+		}
+		return tmpl, nil
+	default:
+		return v, nil
+	}
+}
+
+func prefix(name string, err error) error {
+	return fmt.Errorf(".%s%s", name, err)
+}
+
+// render returns the value with its templates executed.
+func render(object map[string]interface{}, data map[string]string) (map[string]interface{}, error) {
+	rendered, err := renderValue(object, data)
+	if err != nil {
+		return nil, err
+	}
+	result, _ := rendered.(map[string]interface{})
+	return result, nil
+}
+
+func renderValue(value interface{}, data map[string]string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			rendered, err := renderValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = rendered
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			rendered, err := renderValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = rendered
+		}
+		return result, nil
+	case *template.Template:
+		var buf bytes.Buffer
+		if err := v.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	default:
+		return v, nil
+	}
+}
+
+func containsOperation(operations []osbapi.Operation, operation osbapi.Operation) bool {
+	for _, candidate := range operations {
+		if candidate == operation {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list []string, keys ...string) bool {
+	for _, entry := range list {
+		for _, key := range keys {
+			if key != "" && entry == key {
+				return true
+			}
+		}
+	}
+	return false
+}
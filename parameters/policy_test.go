@@ -0,0 +1,149 @@
+package parameters_test
+
+import (
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/parameters"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+const securityPolicy = `
+rules:
+- defaults:
+    labels:
+      cost-center: "{{.organization_guid}}"
+      space: "{{.space_guid}}"
+- services: [google-cloudsql-mysql, google-cloudsql-postgres]
+  defaults:
+    backups_enabled: "true"
+    instance_name: "{{.instance_name}}-db"
+  overrides:
+    authorized_networks: []
+    labels:
+      compliance: pci
+  forbidden: [binlog, settings.ip_configuration]
+- plans: [google-cloudsql-mysql/beta]
+  operations: [bind]
+  overrides:
+    role: cloudsql.client
+`
+
+var _ = Describe("Policy", func() {
+	var (
+		policy parameters.Policy
+		data   map[string]string
+		mysql  parameters.Target
+	)
+
+	BeforeEach(func() {
+		var err error
+		policy, err = parameters.ParsePolicy(securityPolicy)
+		Expect(err).NotTo(HaveOccurred())
+
+		data = map[string]string{"organization_guid": "org-1", "space_guid": "space-1", "instance_name": "orders"}
+		mysql = parameters.Target{
+			Operation:   osbapi.Provision,
+			ServiceID:   "mysql-id",
+			ServiceName: "google-cloudsql-mysql",
+			PlanID:      "beta-id",
+			PlanName:    "beta",
+		}
+	})
+
+	It("merges defaults and overrides into the parameters", func() {
+		result, matched, err := policy.Apply(mysql, map[string]interface{}{
+			"backups_enabled":     "false",
+			"authorized_networks": []interface{}{map[string]interface{}{"value": "0.0.0.0/0"}},
+			"labels":              map[string]interface{}{"team": "orders", "compliance": "none"},
+		}, data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(matched).To(BeTrue())
+
+		Expect(result).To(Equal(map[string]interface{}{
+			"backups_enabled":     "false",
+			"instance_name":       "orders-db",
+			"authorized_networks": []interface{}{},
+			"labels": map[string]interface{}{
+				"team":        "orders",
+				"cost-center": "org-1",
+				"space":       "space-1",
+				"compliance":  "pci",
+			},
+		}))
+	})
+
+	It("does not modify the parameters passed in", func() {
+		labels := map[string]interface{}{"team": "orders"}
+		_, _, err := policy.Apply(mysql, map[string]interface{}{"labels": labels}, data)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(labels).To(Equal(map[string]interface{}{"team": "orders"}))
+	})
+
+	It("renders missing context fields as empty strings", func() {
+		result, _, err := policy.Apply(mysql, nil, map[string]string{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(result["instance_name"]).To(Equal("-db"))
+	})
+
+	It("only applies the rules that match the service, plan and operation", func() {
+		storage := parameters.Target{Operation: osbapi.Provision, ServiceID: "storage-id", ServiceName: "google-storage", PlanID: "standard-id", PlanName: "standard"}
+		result, _, err := policy.Apply(storage, nil, data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(map[string]interface{}{
+			"labels": map[string]interface{}{"cost-center": "org-1", "space": "space-1"},
+		}))
+
+		mysql.Operation = osbapi.Bind
+		result, _, err = policy.Apply(mysql, map[string]interface{}{"role": "cloudsql.admin"}, data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(map[string]interface{}{"role": "cloudsql.client"}))
+	})
+
+	It("matches services and plans by ID when they are not in the catalog", func() {
+		policy, err := parameters.ParsePolicy(`{"rules": [{"services": ["mysql-id"], "plans": ["beta-id"], "overrides": {"tier": "db-f1-micro"}}]}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, _, err := policy.Apply(parameters.Target{Operation: osbapi.Update, ServiceID: "mysql-id", PlanID: "beta-id"}, nil, data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(map[string]interface{}{"tier": "db-f1-micro"}))
+	})
+
+	It("reports that no rule matched", func() {
+		policy, err := parameters.ParsePolicy(`{"rules": [{"services": ["google-pubsub"], "defaults": {"a": "b"}}]}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, matched, err := policy.Apply(mysql, map[string]interface{}{"x": "y"}, data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(matched).To(BeFalse())
+		Expect(result).To(Equal(map[string]interface{}{"x": "y"}))
+	})
+
+	It("rejects forbidden parameters", func() {
+		_, _, err := policy.Apply(mysql, map[string]interface{}{
+			"binlog":   "true",
+			"settings": map[string]interface{}{"ip_configuration": map[string]interface{}{}, "tier": "db-n1-standard-1"},
+		}, data)
+
+		Expect(err).To(Equal(&parameters.ForbiddenError{Paths: []string{"binlog", "settings.ip_configuration"}}))
+	})
+
+	It("allows forbidden parameters when a parent is not an object", func() {
+		_, _, err := policy.Apply(mysql, map[string]interface{}{"settings": "none"}, data)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("rejects invalid policies",
+		func(raw, message string) {
+			_, err := parameters.ParsePolicy(raw)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("unknown fields", `{"rules": [{"default": {}}]}`, "field default not found"),
+		Entry("operations without parameters", `{"rules": [{"operations": ["deprovision"]}]}`, "rules[0].operations: deprovision has no parameters"),
+		Entry("invalid forbidden paths", `{"rules": [{"forbidden": ["labels."]}]}`, `rules[0].forbidden: invalid path "labels."`),
+		Entry("invalid templates", `{"rules": [{}, {"overrides": {"labels": {"org": "{{.organization_guid"}}}]}`, "rules[1].overrides.labels.org: template"),
+	)
+})
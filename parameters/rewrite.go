@@ -0,0 +1,136 @@
+package parameters
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+type requestDetails struct {
+	ServiceID        string                 `json:"service_id"`
+	PlanID           string                 `json:"plan_id"`
+	OrganizationGUID string                 `json:"organization_guid"`
+	SpaceGUID        string                 `json:"space_guid"`
+	Context          map[string]interface{} `json:"context"`
+	Parameters       map[string]interface{} `json:"parameters"`
+	PreviousValues   struct {
+		PlanID string `json:"plan_id"`
+	} `json:"previous_values"`
+}
+
+// rewriteFunc returns the parameters to forward the request with, or nil to
+// forward it unchanged. It returns false if it responded to the request.
+type rewriteFunc func(rw http.ResponseWriter, r *http.Request, target Target, parameters map[string]interface{}, data map[string]string) (map[string]interface{}, bool)
+
+// rewriter returns a middleware that passes the parameters of requests for
+// the operations to rewrite, and forwards the requests with the parameters
+// it returns. The names of services and plans are looked up in the cached
+// catalog.
+func rewriter(operations []osbapi.Operation, cache *catalog.Cache, rewrite rewriteFunc) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		route := osbapi.ParseRoute(r.Method, r.URL.Path)
+		if !containsOperation(operations, route.Operation) {
+			next(rw, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusBadRequest, "", "Could not read request body")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var fields map[string]json.RawMessage
+		var details requestDetails
+		// Malformed bodies are left to the broker.
+		if json.Unmarshal(body, &fields) != nil || decode(body, &details) != nil {
+			next(rw, r)
+			return
+		}
+
+		target := Target{Operation: route.Operation, ServiceID: details.ServiceID, PlanID: details.PlanID}
+		if target.PlanID == "" {
+			target.PlanID = details.PreviousValues.PlanID
+		}
+
+		service, plan, found, err := catalog.Lookup(cache, r, next, target.ServiceID, target.PlanID)
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusBadGateway, "", "Could not retrieve the catalog: "+err.Error())
+			return
+		}
+		if found {
+			target.ServiceName, target.PlanName = service.Name, plan.Name
+		}
+
+		parameters, ok := rewrite(rw, r, target, details.Parameters, templateData(r, route, details))
+		if !ok {
+			return
+		}
+		if parameters == nil {
+			next(rw, r)
+			return
+		}
+
+		if fields["parameters"], err = json.Marshal(parameters); err == nil {
+			body, err = json.Marshal(fields)
+		}
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to encode the parameters: "+err.Error())
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+		next(rw, r)
+	})
+}
+
+// decode decodes a JSON body like json.Unmarshal, but keeps numbers as
+// json.Number so that integers beyond 2^53 are forwarded unchanged.
+func decode(body []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid data after the JSON value")
+	}
+	return nil
+}
+
+// templateData is what policies and labels can refer to: the string fields
+// of the request's context, the IDs of the request, and the user it was sent
+// on behalf of. Platforms before OSBAPI 2.12 send the org and space outside
+// of the context.
+func templateData(r *http.Request, route osbapi.Route, details requestDetails) map[string]string {
+	data := map[string]string{
+		"organization_guid": details.OrganizationGUID,
+		"space_guid":        details.SpaceGUID,
+	}
+	for key, value := range details.Context {
+		if s, ok := value.(string); ok {
+			data[key] = s
+		}
+	}
+	data["instance_id"] = route.InstanceID
+	data["binding_id"] = route.BindingID
+	data["service_id"] = details.ServiceID
+	data["plan_id"] = details.PlanID
+	data["user"] = ""
+	if identity, err := osbapi.ParseOriginatingIdentity(r.Header.Get("X-Broker-API-Originating-Identity")); err == nil {
+		data["user"] = identity.User()
+	}
+	return data
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/buffer"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+const orphanMitigationTimeout = 30 * time.Second
+
+var forwardedHeaders = []string{
+	"Authorization",
+	"X-Broker-API-Version",
+	"X-Broker-API-Originating-Identity",
+	"X-Broker-API-Request-Identity",
+}
+
+type SyncBindingConfig struct {
+	// PollInterval is the time between last_operation requests when the
+	// broker does not ask for a different one with a Retry-After header.
+	PollInterval time.Duration
+	// Timeout is how long a binding may stay in progress before it is
+	// abandoned and unbound again.
+	Timeout time.Duration
+}
+
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// bindingEmulator turns "202 Accepted" bind responses into synchronous ones
+// by polling the binding's last_operation and then fetching the binding.
+type bindingEmulator struct {
+	brokerURL *url.URL
+	proxy     http.Handler
+	client    httpDoer
+	config    SyncBindingConfig
+	// begin counts the polling and orphan mitigation as background work,
+	// which shutdown waits for.
+	begin func() (done func())
+}
+
+type pendingBinding struct {
+	route     osbapi.Route
+	serviceID string
+	planID    string
+	operation string
+	header    http.Header
+	logger    *logging.Logger
+}
+
+type lastOperationResponse struct {
+	State       string `json:"state"`
+	Description string `json:"description"`
+}
+
+func newBindingEmulator(brokerURL *url.URL, proxy http.Handler, client httpDoer, config SyncBindingConfig) *bindingEmulator {
+	return &bindingEmulator{
+		brokerURL: brokerURL,
+		proxy:     proxy,
+		client:    client,
+		config:    config,
+		begin:     func() func() { return func() {} },
+	}
+}
+
+func (b *bindingEmulator) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	route := osbapi.ParseRoute(r.Method, r.URL.Path)
+	if route.Operation != osbapi.Bind || r.URL.Query().Get("accepts_incomplete") == "true" {
+		b.proxy.ServeHTTP(rw, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		osbapi.WriteError(rw, http.StatusBadRequest, "", "Could not read request body")
+		return
+	}
+
+	var details struct {
+		ServiceID string `json:"service_id"`
+		PlanID    string `json:"plan_id"`
+	}
+	// Malformed bodies are forwarded as they are so that the broker can reject them.
+	json.Unmarshal(body, &details)
+
+	upstreamReq := r.WithContext(r.Context())
+	upstreamURL := *r.URL
+	query := upstreamURL.Query()
+	query.Set("accepts_incomplete", "true")
+	upstreamURL.RawQuery = query.Encode()
+	upstreamReq.URL = &upstreamURL
+	upstreamReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	upstreamReq.ContentLength = int64(len(body))
+
+	res := buffer.NewResponse()
+	b.proxy.ServeHTTP(res, upstreamReq)
+
+	if res.Status() != http.StatusAccepted {
+		res.WriteTo(rw)
+		return
+	}
+
+	var accepted struct {
+		Operation string `json:"operation"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &accepted)
+
+	b.awaitBinding(rw, r.Context(), pendingBinding{
+		route:     route,
+		serviceID: details.ServiceID,
+		planID:    details.PlanID,
+		operation: accepted.Operation,
+		header:    r.Header,
+		logger:    logging.FromContext(r.Context()),
+	})
+}
+
+func (b *bindingEmulator) awaitBinding(rw http.ResponseWriter, ctx context.Context, binding pendingBinding) {
+	defer b.begin()()
+
+	ctx, cancel := context.WithTimeout(ctx, b.config.Timeout)
+	defer cancel()
+
+	lastOperation, err := b.pollLastOperation(ctx, binding)
+	if err != nil {
+		b.mitigateOrphan(binding)
+		osbapi.WriteError(rw, http.StatusGatewayTimeout, "", fmt.Sprintf("Binding did not complete within %s and has been unbound", b.config.Timeout))
+		return
+	}
+
+	if lastOperation.State == "failed" {
+		osbapi.WriteError(rw, http.StatusBadGateway, "", "Binding failed: "+lastOperation.Description)
+		return
+	}
+
+	res, err := b.brokerRequest(ctx, http.MethodGet, bindingPath(binding.route), b.identifyingQuery(binding), binding)
+	if err != nil {
+		b.mitigateOrphan(binding)
+		osbapi.WriteError(rw, http.StatusBadGateway, "", "Binding succeeded but could not be fetched: "+err.Error())
+		return
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil || res.StatusCode != http.StatusOK {
+		b.mitigateOrphan(binding)
+		osbapi.WriteError(rw, http.StatusBadGateway, "", fmt.Sprintf("Binding succeeded but could not be fetched. status: %d", res.StatusCode))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write(body)
+}
+
+func (b *bindingEmulator) pollLastOperation(ctx context.Context, binding pendingBinding) (lastOperationResponse, error) {
+	query := b.identifyingQuery(binding)
+	if binding.operation != "" {
+		query.Set("operation", binding.operation)
+	}
+
+	wait := b.config.PollInterval
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return lastOperationResponse{}, ctx.Err()
+		case <-timer.C:
+		}
+
+		res, err := b.brokerRequest(ctx, http.MethodGet, bindingPath(binding.route)+"/last_operation", query, binding)
+		if err != nil {
+			if ctx.Err() != nil {
+				return lastOperationResponse{}, ctx.Err()
+			}
+			binding.logger.Error("Error polling binding", err, logging.Data{"binding_id": binding.route.BindingID})
+			wait = b.config.PollInterval
+			continue
+		}
+
+		wait = retryAfter(res, b.config.PollInterval)
+		lastOperation, err := decodeLastOperation(res)
+		if err != nil {
+			binding.logger.Error("Error polling binding", err, logging.Data{"binding_id": binding.route.BindingID})
+			continue
+		}
+
+		if lastOperation.State == "succeeded" || lastOperation.State == "failed" {
+			return lastOperation, nil
+		}
+	}
+}
+
+// mitigateOrphan unbinds a binding that may have been created by the broker
+// but will never be reported to the platform.
+func (b *bindingEmulator) mitigateOrphan(binding pendingBinding) {
+	defer b.begin()()
+
+	ctx, cancel := context.WithTimeout(context.Background(), orphanMitigationTimeout)
+	defer cancel()
+
+	query := b.identifyingQuery(binding)
+	query.Set("accepts_incomplete", "true")
+
+	res, err := b.brokerRequest(ctx, http.MethodDelete, bindingPath(binding.route), query, binding)
+	if err != nil {
+		binding.logger.Error("Orphan mitigation failed", err, logging.Data{"binding_id": binding.route.BindingID})
+		return
+	}
+	defer res.Body.Close()
+
+	binding.logger.Info("Orphan mitigation completed", logging.Data{"binding_id": binding.route.BindingID, "status": res.StatusCode})
+}
+
+func (b *bindingEmulator) identifyingQuery(binding pendingBinding) url.Values {
+	query := url.Values{}
+	if binding.serviceID != "" {
+		query.Set("service_id", binding.serviceID)
+	}
+	if binding.planID != "" {
+		query.Set("plan_id", binding.planID)
+	}
+	return query
+}
+
+func (b *bindingEmulator) brokerRequest(ctx context.Context, method, path string, query url.Values, binding pendingBinding) (*http.Response, error) {
+	brokerURL := *b.brokerURL
+	brokerURL.Path = strings.TrimSuffix(b.brokerURL.Path, "/") + path
+	brokerURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, brokerURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, header := range forwardedHeaders {
+		if value := binding.header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	return b.client.Do(req.WithContext(ctx))
+}
+
+func decodeLastOperation(res *http.Response) (lastOperationResponse, error) {
+	defer res.Body.Close()
+
+	var lastOperation lastOperationResponse
+
+	if res.StatusCode == http.StatusGone {
+		lastOperation.State = "failed"
+		lastOperation.Description = "the binding no longer exists"
+		return lastOperation, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return lastOperation, fmt.Errorf("last_operation responded with status %d", res.StatusCode)
+	}
+
+	err := json.NewDecoder(res.Body).Decode(&lastOperation)
+	return lastOperation, err
+}
+
+// retryAfter returns the wait a response asks for in its Retry-After
+// header, which is either a number of seconds or an HTTP date, or fallback
+// if it asks for none.
+func retryAfter(res *http.Response, fallback time.Duration) time.Duration {
+	header := res.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds <= 0 {
+			return fallback
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return fallback
+}
+
+func bindingPath(route osbapi.Route) string {
+	return fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s", route.InstanceID, route.BindingID)
+}
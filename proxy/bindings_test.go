@@ -0,0 +1,283 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
+	"code.cloudfoundry.org/gcp-broker-proxy/shutdown"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Synchronous binding emulation", func() {
+	const (
+		bindingPath = "/v2/service_instances/instance-1/service_bindings/binding-1"
+		bindBody    = `{"service_id": "service-1", "plan_id": "plan-1"}`
+	)
+
+	var (
+		brokerURL    *url.URL
+		brokerServer *ghttp.Server
+		noOpHandler  = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+		writer       *httptest.ResponseRecorder
+		req          *http.Request
+		config       proxy.SyncBindingConfig
+		servers      *shutdown.Group
+	)
+
+	BeforeEach(func() {
+		var err error
+		brokerServer = ghttp.NewServer()
+		brokerURL, err = url.ParseRequestURI(brokerServer.URL())
+		Expect(err).ToNot(HaveOccurred())
+
+		req, err = http.NewRequest("PUT", bindingPath, strings.NewReader(bindBody))
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer 123")
+		req.Header.Set("X-Broker-API-Version", "2.14")
+
+		writer = httptest.NewRecorder()
+		config = proxy.SyncBindingConfig{PollInterval: time.Millisecond, Timeout: time.Second}
+		servers = shutdown.NewGroup(time.Second)
+	})
+
+	AfterEach(func() {
+		brokerServer.Close()
+	})
+
+	JustBeforeEach(func() {
+		proxyHandler := proxy.ReverseProxy(brokerURL, proxy.WithSyncBindings(config), proxy.WithShutdown(servers))
+		proxyHandler(writer, req, noOpHandler)
+	})
+
+	Context("when the broker binds synchronously", func() {
+		BeforeEach(func() {
+			brokerServer.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", bindingPath, "accepts_incomplete=true"),
+					ghttp.VerifyBody([]byte(bindBody)),
+					ghttp.RespondWith(http.StatusCreated, `{"credentials": {"key": "value"}}`),
+				),
+			)
+		})
+
+		It("passes the response through", func() {
+			Expect(brokerServer.ReceivedRequests()).To(HaveLen(1))
+			Expect(writer.Code).To(Equal(http.StatusCreated))
+			Expect(writer.Body.String()).To(MatchJSON(`{"credentials": {"key": "value"}}`))
+		})
+	})
+
+	Context("when the broker binds asynchronously", func() {
+		BeforeEach(func() {
+			brokerServer.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", bindingPath, "accepts_incomplete=true"),
+					ghttp.VerifyBody([]byte(bindBody)),
+					ghttp.RespondWith(http.StatusAccepted, `{"operation": "op-1"}`),
+				),
+			)
+		})
+
+		Context("and the binding succeeds", func() {
+			BeforeEach(func() {
+				brokerServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath+"/last_operation", "operation=op-1&plan_id=plan-1&service_id=service-1"),
+						ghttp.VerifyHeaderKV("Authorization", "Bearer 123"),
+						ghttp.VerifyHeaderKV("X-Broker-API-Version", "2.14"),
+						ghttp.RespondWith(http.StatusOK, `{"state": "in progress"}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath+"/last_operation"),
+						ghttp.RespondWith(http.StatusOK, `{"state": "succeeded"}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath, "plan_id=plan-1&service_id=service-1"),
+						ghttp.VerifyHeaderKV("Authorization", "Bearer 123"),
+						ghttp.RespondWith(http.StatusOK, `{"credentials": {"key": "value"}}`),
+					),
+				)
+			})
+
+			It("polls until the binding has completed and responds with the fetched binding", func() {
+				Expect(brokerServer.ReceivedRequests()).To(HaveLen(4))
+				Expect(writer.Code).To(Equal(http.StatusCreated))
+				Expect(writer.Header().Get("Content-Type")).To(Equal("application/json"))
+				Expect(writer.Body.String()).To(MatchJSON(`{"credentials": {"key": "value"}}`))
+			})
+		})
+
+		Context("and the binding fails", func() {
+			BeforeEach(func() {
+				brokerServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath+"/last_operation"),
+						ghttp.RespondWith(http.StatusOK, `{"state": "failed", "description": "quota exceeded"}`),
+					),
+				)
+			})
+
+			It("responds with the failure description", func() {
+				Expect(brokerServer.ReceivedRequests()).To(HaveLen(2))
+				Expect(writer.Code).To(Equal(http.StatusBadGateway))
+				Expect(writer.Body.String()).To(MatchJSON(`{"description": "Binding failed: quota exceeded"}`))
+			})
+		})
+
+		Context("and the binding disappears", func() {
+			BeforeEach(func() {
+				brokerServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath+"/last_operation"),
+						ghttp.RespondWith(http.StatusGone, `{}`),
+					),
+				)
+			})
+
+			It("responds with a failure", func() {
+				Expect(writer.Code).To(Equal(http.StatusBadGateway))
+				Expect(writer.Body.String()).To(ContainSubstring("no longer exists"))
+			})
+		})
+
+		Context("and polling fails transiently", func() {
+			BeforeEach(func() {
+				brokerServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath+"/last_operation"),
+						ghttp.RespondWith(http.StatusInternalServerError, `{}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath+"/last_operation"),
+						ghttp.RespondWith(http.StatusOK, `{"state": "succeeded"}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath),
+						ghttp.RespondWith(http.StatusOK, `{"credentials": {}}`),
+					),
+				)
+			})
+
+			It("keeps polling", func() {
+				Expect(brokerServer.ReceivedRequests()).To(HaveLen(4))
+				Expect(writer.Code).To(Equal(http.StatusCreated))
+			})
+		})
+
+		Context("and the binding does not complete before the timeout", func() {
+			BeforeEach(func() {
+				config.Timeout = 50 * time.Millisecond
+				config.PollInterval = 10 * time.Millisecond
+
+				brokerServer.RouteToHandler("GET", bindingPath+"/last_operation",
+					ghttp.RespondWith(http.StatusOK, `{"state": "in progress"}`),
+				)
+				brokerServer.RouteToHandler("DELETE", bindingPath,
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("DELETE", bindingPath, "accepts_incomplete=true&plan_id=plan-1&service_id=service-1"),
+						ghttp.VerifyHeaderKV("Authorization", "Bearer 123"),
+						ghttp.RespondWith(http.StatusOK, `{}`),
+					),
+				)
+			})
+
+			It("unbinds to avoid orphaning the binding", func() {
+				lastRequest := brokerServer.ReceivedRequests()[len(brokerServer.ReceivedRequests())-1]
+				Expect(lastRequest.Method).To(Equal("DELETE"))
+				Expect(lastRequest.URL.Path).To(Equal(bindingPath))
+			})
+
+			It("responds with a gateway timeout", func() {
+				Expect(writer.Code).To(Equal(http.StatusGatewayTimeout))
+				Expect(writer.Body.String()).To(ContainSubstring("did not complete within 50ms"))
+			})
+
+			Context("with a shutdown group", func() {
+				var background int64
+
+				BeforeEach(func() {
+					brokerServer.RouteToHandler("DELETE", bindingPath, func(rw http.ResponseWriter, r *http.Request) {
+						background = servers.Background()
+						rw.Write([]byte(`{}`))
+					})
+				})
+
+				It("counts the polling and unbinding as background work", func() {
+					Expect(background).To(Equal(int64(2)))
+					Expect(servers.Background()).To(BeZero())
+				})
+			})
+		})
+
+		Context("and the completed binding cannot be fetched", func() {
+			BeforeEach(func() {
+				brokerServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath+"/last_operation"),
+						ghttp.RespondWith(http.StatusOK, `{"state": "succeeded"}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", bindingPath),
+						ghttp.RespondWith(http.StatusNotFound, `{}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("DELETE", bindingPath, "accepts_incomplete=true&plan_id=plan-1&service_id=service-1"),
+						ghttp.RespondWith(http.StatusOK, `{}`),
+					),
+				)
+			})
+
+			It("unbinds and responds with a failure", func() {
+				Expect(brokerServer.ReceivedRequests()).To(HaveLen(4))
+				Expect(writer.Code).To(Equal(http.StatusBadGateway))
+				Expect(writer.Body.String()).To(ContainSubstring("could not be fetched"))
+			})
+		})
+	})
+
+	Context("when the platform accepts asynchronous bindings itself", func() {
+		BeforeEach(func() {
+			req.URL.RawQuery = "accepts_incomplete=true"
+
+			brokerServer.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", bindingPath, "accepts_incomplete=true"),
+					ghttp.RespondWith(http.StatusAccepted, `{"operation": "op-1"}`),
+				),
+			)
+		})
+
+		It("does not poll on its behalf", func() {
+			Expect(brokerServer.ReceivedRequests()).To(HaveLen(1))
+			Expect(writer.Code).To(Equal(http.StatusAccepted))
+			Expect(writer.Body.String()).To(MatchJSON(`{"operation": "op-1"}`))
+		})
+	})
+
+	Context("for requests other than binds", func() {
+		BeforeEach(func() {
+			var err error
+			req, err = http.NewRequest("PUT", "/v2/service_instances/instance-1", strings.NewReader(`{}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			brokerServer.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v2/service_instances/instance-1", ""),
+					ghttp.RespondWith(http.StatusAccepted, `{}`),
+				),
+			)
+		})
+
+		It("proxies them unchanged", func() {
+			Expect(brokerServer.ReceivedRequests()).To(HaveLen(1))
+			Expect(writer.Code).To(Equal(http.StatusAccepted))
+		})
+	})
+})
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+)
+
+// breakerTransport fails broker requests fast while the breaker is open.
+// Requests that fail to get a response or get a server error count as
+// failures. Requests the caller gave up on count neither way.
+type breakerTransport struct {
+	transport http.RoundTripper
+	breaker   *breaker.Breaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done, err := t.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.transport.RoundTrip(req)
+	switch {
+	case req.Context().Err() == context.Canceled:
+		done(breaker.Canceled)
+	case err != nil, res.StatusCode >= http.StatusInternalServerError:
+		done(breaker.Failure)
+	default:
+		done(breaker.Success)
+	}
+	return res, err
+}
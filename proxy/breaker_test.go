@@ -0,0 +1,109 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/onsi/gomega/ghttp"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
+	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Breaker", func() {
+	var (
+		brokerServer *ghttp.Server
+		brokerURL    *url.URL
+		b            *breaker.Breaker
+		registry     *metrics.Registry
+	)
+
+	BeforeEach(func() {
+		brokerServer = ghttp.NewServer()
+
+		var err error
+		brokerURL, err = url.ParseRequestURI(brokerServer.URL())
+		Expect(err).NotTo(HaveOccurred())
+
+		b = breaker.New("broker", breaker.Config{FailureThreshold: 2, OpenTimeout: time.Minute, HalfOpenRequests: 1})
+		registry = metrics.NewRegistry()
+	})
+
+	AfterEach(func() {
+		brokerServer.Close()
+	})
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		proxy.ReverseProxy(brokerURL, proxy.WithBreaker(b), proxy.WithMetrics(registry))(w, req, func(http.ResponseWriter, *http.Request) {})
+		return w
+	}
+
+	It("fails fast once the broker keeps failing", func() {
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusInternalServerError, `{}`),
+			ghttp.RespondWith(http.StatusBadGateway, `{}`),
+		)
+
+		Expect(serve("GET", "/v2/catalog").Code).To(Equal(http.StatusInternalServerError))
+		Expect(serve("PATCH", "/v2/service_instances/i1").Code).To(Equal(http.StatusBadGateway))
+
+		w := serve("GET", "/v2/catalog")
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(w.Header().Get("Retry-After")).To(Equal("60"))
+		Expect(w.Body.String()).To(MatchJSON(`{"description": "The broker is unavailable after repeated failures, try again later"}`))
+		Expect(brokerServer.ReceivedRequests()).To(HaveLen(2))
+
+		var buf bytes.Buffer
+		registry.Write(&buf)
+		Expect(buf.String()).To(ContainSubstring(`gcp_broker_proxy_upstream_errors_total{operation="catalog",reason="circuit_open"} 1`))
+	})
+
+	It("does not count requests the caller gave up on", func() {
+		received := make(chan struct{})
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusInternalServerError, `{}`),
+			func(w http.ResponseWriter, r *http.Request) {
+				close(received)
+				<-r.Context().Done()
+			},
+			ghttp.RespondWith(http.StatusInternalServerError, `{}`),
+		)
+
+		serve("GET", "/v2/catalog")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-received
+			cancel()
+		}()
+		req, _ := http.NewRequest("GET", "/v2/catalog", nil)
+		proxy.ReverseProxy(brokerURL, proxy.WithBreaker(b), proxy.WithMetrics(registry))(httptest.NewRecorder(), req.WithContext(ctx), func(http.ResponseWriter, *http.Request) {})
+		Expect(b.Status().ConsecutiveFailures).To(Equal(1))
+
+		serve("GET", "/v2/catalog")
+		Expect(b.State()).To(Equal(breaker.Open))
+	})
+
+	It("does not count client errors as failures", func() {
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusNotFound, `{}`),
+			ghttp.RespondWith(http.StatusConflict, `{}`),
+			ghttp.RespondWith(http.StatusOK, `{}`),
+		)
+
+		serve("GET", "/v2/service_instances/i1")
+		serve("PUT", "/v2/service_instances/i1")
+		Expect(serve("GET", "/v2/catalog").Code).To(Equal(http.StatusOK))
+		Expect(b.State()).To(Equal(breaker.Closed))
+	})
+})
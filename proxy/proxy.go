@@ -6,9 +6,86 @@ import (
 	"net/url"
 
 	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
+	"code.cloudfoundry.org/gcp-broker-proxy/shutdown"
 )
 
-func ReverseProxy(brokerURL *url.URL) negroni.HandlerFunc {
+// Option configures the handler returned by ReverseProxy.
+type Option func(*options)
+
+type options struct {
+	syncBindings *SyncBindingConfig
+	metrics      *metrics.Registry
+	transport    http.RoundTripper
+	retries      *RetryConfig
+	breaker      *breaker.Breaker
+	shutdown     *shutdown.Group
+}
+
+// WithSyncBindings makes the proxy present asynchronous bindings from the
+// broker to the platform as synchronous ones.
+func WithSyncBindings(config SyncBindingConfig) Option {
+	return func(o *options) {
+		o.syncBindings = &config
+	}
+}
+
+// WithMetrics counts failed broker requests in the registry.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(o *options) {
+		o.metrics = registry
+	}
+}
+
+// WithTransport sends broker requests with transport instead of
+// http.DefaultTransport.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithRetries retries idempotent broker requests that fail with a
+// connection error or a transient error status.
+func WithRetries(config RetryConfig) Option {
+	return func(o *options) {
+		o.retries = &config
+	}
+}
+
+// WithBreaker stops sending requests to the broker while b is open, and
+// responds with 503 Service Unavailable instead.
+func WithBreaker(b *breaker.Breaker) Option {
+	return func(o *options) {
+		o.breaker = b
+	}
+}
+
+// WithShutdown makes the shutdown of servers wait for bindings that are
+// being polled and orphaned bindings that are being removed.
+func WithShutdown(servers *shutdown.Group) Option {
+	return func(o *options) {
+		o.shutdown = servers
+	}
+}
+
+func ReverseProxy(brokerURL *url.URL, opts ...Option) negroni.HandlerFunc {
+	o := options{transport: http.DefaultTransport}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	transport := o.transport
+	if o.retries != nil {
+		transport = newRetryTransport(brokerURL, transport, *o.retries, o.metrics)
+	}
+	if o.breaker != nil {
+		transport = &breakerTransport{transport: transport, breaker: o.breaker}
+	}
+
 	reverseProxy := httputil.NewSingleHostReverseProxy(brokerURL)
 	dirFunc := reverseProxy.Director
 
@@ -18,9 +95,31 @@ func ReverseProxy(brokerURL *url.URL) negroni.HandlerFunc {
 	}
 
 	reverseProxy.Director = newDirFunc
+	reverseProxy.Transport = &loggingTransport{
+		transport: transport,
+		errors: o.metrics.Counter("gcp_broker_proxy_upstream_errors_total",
+			"Broker requests that failed to get a response or got a server error.", "operation", "reason"),
+	}
+	reverseProxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		if openErr, ok := err.(*breaker.OpenError); ok {
+			breaker.WriteOpen(rw, openErr, "The broker is unavailable after repeated failures, try again later")
+			return
+		}
+		logging.FromContext(r.Context()).Error("Failed to reach the broker", err)
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+
+	var handler http.Handler = reverseProxy
+	if o.syncBindings != nil {
+		emulator := newBindingEmulator(brokerURL, reverseProxy, &http.Client{Transport: transport}, *o.syncBindings)
+		if o.shutdown != nil {
+			emulator.begin = o.shutdown.Begin
+		}
+		handler = emulator
+	}
 
 	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		reverseProxy.ServeHTTP(rw, r)
+		handler.ServeHTTP(rw, r)
 		next(rw, r)
 	})
 }
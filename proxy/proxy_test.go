@@ -1,15 +1,19 @@
 package proxy_test
 
 import (
+	"bytes"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
 	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"github.com/urfave/negroni"
 )
 
 var _ = Describe("ReverseProxy", func() {
@@ -68,4 +72,77 @@ var _ = Describe("ReverseProxy", func() {
 
 		Expect(brokerServer.ReceivedRequests()[0].Host).Should(Equal(brokerURL.Host))
 	})
+
+	It("sends requests with the given transport", func() {
+		brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, "{}"))
+
+		var sent []string
+		transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = append(sent, req.URL.Path)
+			return http.DefaultTransport.RoundTrip(req)
+		})
+
+		req, _ := http.NewRequest("GET", "/v2/catalog", nil)
+		w := httptest.NewRecorder()
+		proxy.ReverseProxy(brokerURL, proxy.WithTransport(transport))(w, req, noOpHandler)
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(sent).To(Equal([]string{"/v2/catalog"}))
+	})
+
+	Describe("logging", func() {
+		var out bytes.Buffer
+
+		serve := func() {
+			req, _ := http.NewRequest("PUT", "/v2/service_instances/i1", nil)
+			n := negroni.New(logging.RequestLogger(logging.New(&out, &out)), proxy.ReverseProxy(brokerURL))
+			n.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		BeforeEach(func() {
+			out.Reset()
+		})
+
+		It("adds the broker status and latency to the request log line", func() {
+			brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusCreated, "{}"))
+			serve()
+
+			Expect(out.String()).To(ContainSubstring(`"upstream_status":201`))
+			Expect(out.String()).To(ContainSubstring(`"upstream_duration_ms":`))
+		})
+
+		It("adds the broker's error description", func() {
+			brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusUnprocessableEntity, `{"error": "AsyncRequired", "description": "This service plan requires client support for asynchronous service operations."}`))
+			serve()
+
+			Expect(out.String()).To(ContainSubstring(`"upstream_error":"AsyncRequired: This service plan requires client support for asynchronous service operations."`))
+		})
+
+		It("counts broker errors", func() {
+			registry := metrics.NewRegistry()
+			brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, "{}"))
+
+			req, _ := http.NewRequest("GET", "/v2/catalog", nil)
+			proxy.ReverseProxy(brokerURL, proxy.WithMetrics(registry))(httptest.NewRecorder(), req, noOpHandler)
+
+			var buf bytes.Buffer
+			registry.Write(&buf)
+			Expect(buf.String()).To(ContainSubstring(`gcp_broker_proxy_upstream_errors_total{operation="catalog",reason="5xx"} 1`))
+		})
+
+		It("logs when the broker cannot be reached", func() {
+			brokerServer.Close()
+			serve()
+
+			Expect(out.String()).To(ContainSubstring(`"message":"Failed to reach the broker"`))
+			Expect(out.String()).To(ContainSubstring(`"status":502`))
+			Expect(out.String()).To(ContainSubstring(`"upstream_error":`))
+		})
+	})
 })
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
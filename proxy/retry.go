@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/upstream"
+)
+
+// RetryConfig configures the retries of broker requests that failed to get
+// a response or got a transient error. Only idempotent operations are
+// retried.
+type RetryConfig struct {
+	// BaseDelay is the wait before the first retry. It doubles with every
+	// retry up to MaxDelay, and a random part of it is waited, so that
+	// retries of concurrent requests spread out. A longer Retry-After
+	// header is honoured.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Budgets limits the retries of an operation. Operations without a
+	// budget get DefaultBudget.
+	Budgets       map[osbapi.Operation]RetryBudget
+	DefaultBudget RetryBudget
+}
+
+// RetryBudget limits the retries of a request: there are at most
+// MaxRetries, and the request, with all of its attempts, is given up once
+// MaxElapsed has passed since it was first sent. MaxElapsed must be shorter
+// than PlatformTimeout, so that the platform gets the last response instead
+// of timing out.
+type RetryBudget struct {
+	MaxRetries int
+	MaxElapsed time.Duration
+}
+
+// PlatformTimeout is how long Cloud Foundry waits for a broker response by
+// default.
+const PlatformTimeout = 60 * time.Second
+
+func (c RetryConfig) budget(operation osbapi.Operation) RetryBudget {
+	if budget, ok := c.Budgets[operation]; ok {
+		return budget
+	}
+	return c.DefaultBudget
+}
+
+// retryableStatuses are the broker responses worth another attempt.
+var retryableStatuses = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// retryTransport retries idempotent broker requests within their budget.
+type retryTransport struct {
+	brokerPath string
+	transport  http.RoundTripper
+	config     RetryConfig
+	retries    *metrics.CounterVec
+}
+
+func newRetryTransport(brokerURL *url.URL, transport http.RoundTripper, config RetryConfig, registry *metrics.Registry) *retryTransport {
+	return &retryTransport{
+		brokerPath: strings.TrimSuffix(brokerURL.Path, "/"),
+		transport:  transport,
+		config:     config,
+		retries: registry.Counter("gcp_broker_proxy_upstream_retries_total",
+			"Broker requests retried after a failure.", "operation", "reason"),
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation := osbapi.ParseRoute(req.Method, strings.TrimPrefix(req.URL.Path, t.brokerPath)).Operation
+	budget := t.config.budget(operation)
+	if !operation.Idempotent() || budget.MaxRetries <= 0 {
+		return t.transport.RoundTrip(req)
+	}
+
+	// The body is sent again with every retry, so it has to be kept.
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Every attempt shares one deadline, so a broker that hangs cannot make
+	// the request outlast its budget.
+	ctx, cancel := context.WithTimeout(req.Context(), budget.MaxElapsed)
+	start := time.Now()
+	for retries := 0; ; retries++ {
+		attempt := req.Clone(ctx)
+		if body != nil {
+			attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		res, err := t.transport.RoundTrip(attempt)
+		reason := retryReason(ctx, res, err)
+		if retries == budget.MaxRetries {
+			reason = ""
+		}
+
+		var wait time.Duration
+		if reason != "" {
+			wait = t.backoff(retries)
+			if res != nil {
+				if requested := retryAfter(res, 0); requested > wait {
+					wait = requested
+				}
+			}
+			if time.Since(start)+wait > budget.MaxElapsed {
+				reason = ""
+			}
+		}
+
+		if reason == "" {
+			if retries > 0 {
+				logging.Annotate(ctx, logging.Data{"upstream_retries": retries})
+			}
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			// The deadline applies until the body has been read.
+			res.Body = upstream.CancelOnClose(res.Body, cancel)
+			return res, nil
+		}
+
+		if res != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxErrorBody))
+			res.Body.Close()
+		}
+		t.retries.With(string(operation), reason).Inc()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			cancel()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the wait before the retry after the given number of
+// retries: a random duration between half and all of the exponentially
+// growing delay.
+func (t *retryTransport) backoff(retries int) time.Duration {
+	delay := t.config.BaseDelay
+	for i := 0; i < retries && delay < t.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.config.MaxDelay {
+		delay = t.config.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// retryReason returns why a request should be retried, or "" if it should
+// not be. Requests whose caller has given up are not retried.
+func retryReason(ctx context.Context, res *http.Response, err error) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	if err != nil {
+		return "unreachable"
+	}
+	if retryableStatuses[res.StatusCode] {
+		return metrics.StatusClass(res.StatusCode)
+	}
+	return ""
+}
@@ -0,0 +1,206 @@
+package proxy_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/onsi/gomega/ghttp"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+	"code.cloudfoundry.org/gcp-broker-proxy/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/urfave/negroni"
+)
+
+var _ = Describe("Retries", func() {
+	var (
+		brokerServer *ghttp.Server
+		brokerURL    *url.URL
+		config       proxy.RetryConfig
+		registry     *metrics.Registry
+		transport    http.RoundTripper
+		out          bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		brokerServer = ghttp.NewServer()
+
+		var err error
+		brokerURL, err = url.ParseRequestURI(brokerServer.URL() + "/v1beta1/projects/p/brokers/default")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = proxy.RetryConfig{
+			BaseDelay:     time.Millisecond,
+			MaxDelay:      10 * time.Millisecond,
+			DefaultBudget: proxy.RetryBudget{MaxRetries: 2, MaxElapsed: 5 * time.Second},
+		}
+		registry = metrics.NewRegistry()
+		transport = http.DefaultTransport
+		out.Reset()
+	})
+
+	AfterEach(func() {
+		brokerServer.Close()
+	})
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		n := negroni.New(
+			logging.RequestLogger(logging.New(&out, &out)),
+			proxy.ReverseProxy(brokerURL, proxy.WithRetries(config), proxy.WithMetrics(registry), proxy.WithTransport(transport)),
+		)
+		n.ServeHTTP(w, req)
+		return w
+	}
+
+	written := func() string {
+		var buf bytes.Buffer
+		registry.Write(&buf)
+		return buf.String()
+	}
+
+	It("retries the catalog after transient errors", func() {
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`),
+			ghttp.RespondWith(http.StatusBadGateway, `{}`),
+			ghttp.RespondWith(http.StatusOK, `{"services": []}`),
+		)
+
+		w := serve("GET", "/v2/catalog", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(brokerServer.ReceivedRequests()).To(HaveLen(3))
+
+		Expect(written()).To(ContainSubstring(`gcp_broker_proxy_upstream_retries_total{operation="catalog",reason="5xx"} 2`))
+		Expect(out.String()).To(ContainSubstring(`"upstream_retries":2`))
+	})
+
+	It("sends the same body when retrying a provision", func() {
+		var bodies []string
+		record := func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+		}
+		brokerServer.AppendHandlers(
+			ghttp.CombineHandlers(record, ghttp.RespondWith(http.StatusInternalServerError, `{}`)),
+			ghttp.CombineHandlers(record, ghttp.RespondWith(http.StatusCreated, `{}`)),
+		)
+
+		w := serve("PUT", "/v2/service_instances/i1", `{"service_id": "s1", "plan_id": "p1"}`)
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		Expect(bodies).To(Equal([]string{
+			`{"service_id": "s1", "plan_id": "p1"}`,
+			`{"service_id": "s1", "plan_id": "p1"}`,
+		}))
+	})
+
+	It("never retries operations that are not idempotent", func() {
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`),
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`),
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`),
+		)
+
+		Expect(serve("PATCH", "/v2/service_instances/i1", `{}`).Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(serve("DELETE", "/v2/service_instances/i1?service_id=s1&plan_id=p1", "").Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(serve("DELETE", "/v2/service_instances/i1/service_bindings/b1", "").Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(brokerServer.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("does not retry other errors", func() {
+		brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusNotImplemented, `{}`))
+
+		Expect(serve("GET", "/v2/service_instances/i1", "").Code).To(Equal(http.StatusNotImplemented))
+		Expect(brokerServer.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("returns the last response once the retries are used up", func() {
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`),
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`),
+			ghttp.RespondWith(http.StatusGatewayTimeout, `{"description": "last"}`),
+		)
+
+		w := serve("GET", "/v2/service_instances/i1/last_operation", "")
+		Expect(w.Code).To(Equal(http.StatusGatewayTimeout))
+		Expect(w.Body.String()).To(Equal(`{"description": "last"}`))
+		Expect(brokerServer.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("uses the budget of the operation", func() {
+		config.Budgets = map[osbapi.Operation]proxy.RetryBudget{osbapi.FetchBinding: {MaxRetries: 0}}
+		brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, `{}`))
+
+		Expect(serve("GET", "/v2/service_instances/i1/service_bindings/b1", "").Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(brokerServer.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("waits as long as Retry-After asks", func() {
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusTooManyRequests, `{}`, http.Header{"Retry-After": {"1"}}),
+			ghttp.RespondWith(http.StatusOK, `{}`),
+		)
+
+		start := time.Now()
+		Expect(serve("GET", "/v2/catalog", "").Code).To(Equal(http.StatusOK))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+	})
+
+	It("waits until the date Retry-After asks for", func() {
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`, http.Header{"Retry-After": {time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)}}),
+			ghttp.RespondWith(http.StatusOK, `{}`),
+		)
+
+		start := time.Now()
+		Expect(serve("GET", "/v2/catalog", "").Code).To(Equal(http.StatusOK))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+	})
+
+	It("gives up when Retry-After asks for longer than the budget allows", func() {
+		brokerServer.AppendHandlers(
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`, http.Header{"Retry-After": {"30"}}),
+		)
+
+		Expect(serve("GET", "/v2/catalog", "").Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(brokerServer.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("gives up on a broker that hangs once the budget has elapsed", func() {
+		config.DefaultBudget.MaxElapsed = 200 * time.Millisecond
+		hang := func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}
+		brokerServer.AppendHandlers(hang, hang, hang)
+
+		start := time.Now()
+		Expect(serve("GET", "/v2/catalog", "").Code).To(Equal(http.StatusBadGateway))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(out.String()).To(ContainSubstring("context deadline exceeded"))
+	})
+
+	It("retries requests that could not reach the broker", func() {
+		failures := 1
+		transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if failures > 0 {
+				failures--
+				return nil, errors.New("connection reset by peer")
+			}
+			return http.DefaultTransport.RoundTrip(req)
+		})
+		brokerServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, `{}`))
+
+		Expect(serve("GET", "/v2/service_instances/i1/service_bindings/b1/last_operation", "").Code).To(Equal(http.StatusOK))
+		Expect(written()).To(ContainSubstring(`gcp_broker_proxy_upstream_retries_total{operation="binding_last_operation",reason="unreachable"} 1`))
+	})
+})
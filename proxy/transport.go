@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/metrics"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// maxErrorBody caps how much of an error response is read to find its
+// description.
+const maxErrorBody = 16 * 1024
+
+// loggingTransport adds the status and latency of broker responses, and the
+// cause of failed ones, to the log line of the request. Failures are also
+// counted.
+type loggingTransport struct {
+	transport http.RoundTripper
+	errors    *metrics.CounterVec
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.transport.RoundTrip(req)
+
+	data := logging.Data{"upstream_duration_ms": logging.Milliseconds(time.Since(start))}
+	operation := string(osbapi.ParseRoute(req.Method, req.URL.Path).Operation)
+	if err != nil {
+		reason := "unreachable"
+		if _, ok := err.(*breaker.OpenError); ok {
+			reason = "circuit_open"
+		}
+		t.errors.With(operation, reason).Inc()
+		data["upstream_error"] = err.Error()
+		logging.Annotate(req.Context(), data)
+		return nil, err
+	}
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		t.errors.With(operation, metrics.StatusClass(res.StatusCode)).Inc()
+	}
+	data["upstream_status"] = res.StatusCode
+	if res.StatusCode >= http.StatusBadRequest {
+		if description := errorDescription(res); description != "" {
+			data["upstream_error"] = description
+		}
+	}
+	logging.Annotate(req.Context(), data)
+
+	return res, nil
+}
+
+// errorDescription peeks at an OSBAPI error body without consuming it.
+func errorDescription(res *http.Response) string {
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+	if err != nil {
+		return ""
+	}
+
+	var errorResponse osbapi.ErrorResponse
+	if json.Unmarshal(body, &errorResponse) != nil {
+		return ""
+	}
+
+	if errorResponse.Error != "" && errorResponse.Description != "" {
+		return errorResponse.Error + ": " + errorResponse.Description
+	}
+	return errorResponse.Error + errorResponse.Description
+}
@@ -0,0 +1,149 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Usage is how many instances an organization, space, service or plan has,
+// or how many bindings an instance has, and its limit. Limits of zero mean
+// no limit.
+type Usage struct {
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+	ServiceID        string `json:"service_id,omitempty"`
+	ServiceName      string `json:"service_name,omitempty"`
+	PlanID           string `json:"plan_id,omitempty"`
+	PlanName         string `json:"plan_name,omitempty"`
+	InstanceID       string `json:"instance_id,omitempty"`
+	Used             int    `json:"used"`
+	Limit            int    `json:"limit"`
+}
+
+// Report is the usage of everything that has instances or bindings, as
+// served by Handler.
+type Report struct {
+	Organizations []Usage `json:"organizations"`
+	Spaces        []Usage `json:"spaces"`
+	Services      []Usage `json:"services"`
+	Plans         []Usage `json:"plans"`
+	Instances     []Usage `json:"instances"`
+}
+
+var errNotCached = errors.New("the catalog is not cached")
+
+// Usage counts the instances and bindings in the inventory and those being
+// created. The names of services and plans are taken from the cached
+// catalog, if there is one, and their limits are only matched by ID without
+// it.
+func (e *Enforcer) Usage() (Report, error) {
+	cached, _ := e.cache.Get(func() (catalog.Catalog, error) {
+		return catalog.Catalog{}, errNotCached
+	})
+
+	e.mu.Lock()
+	instances := e.allInstances()
+	bindings := e.allBindings()
+	e.mu.Unlock()
+
+	organizations := map[string]*Usage{}
+	spaces := map[string]*Usage{}
+	services := map[string]*Usage{}
+	plans := map[string]*Usage{}
+	for _, instance := range instances {
+		service, plan, _ := cached.FindPlan(instance.ServiceID, instance.PlanID)
+
+		if instance.OrganizationGUID != "" {
+			count(organizations, instance.OrganizationGUID, Usage{
+				OrganizationGUID: instance.OrganizationGUID,
+				Limit:            e.limits.InstancesPerOrganization.For(instance.OrganizationGUID),
+			})
+		}
+		if instance.SpaceGUID != "" {
+			count(spaces, instance.SpaceGUID, Usage{
+				SpaceGUID: instance.SpaceGUID,
+				Limit:     e.limits.InstancesPerSpace.For(instance.SpaceGUID),
+			})
+		}
+		count(services, instance.ServiceID, Usage{
+			ServiceID:   instance.ServiceID,
+			ServiceName: service.Name,
+			Limit:       e.limits.service(instance.ServiceID, service.Name),
+		})
+		count(plans, instance.ServiceID+"/"+instance.PlanID, Usage{
+			ServiceID:   instance.ServiceID,
+			ServiceName: service.Name,
+			PlanID:      instance.PlanID,
+			PlanName:    plan.Name,
+			Limit:       e.limits.plan(service.Name, instance.PlanID, plan.Name),
+		})
+	}
+
+	perInstance := map[string]*Usage{}
+	for _, binding := range bindings {
+		count(perInstance, binding.InstanceID, Usage{
+			InstanceID: binding.InstanceID,
+			Limit:      e.limits.BindingsPerInstance,
+		})
+	}
+
+	return Report{
+		Organizations: sorted(organizations),
+		Spaces:        sorted(spaces),
+		Services:      sorted(services),
+		Plans:         sorted(plans),
+		Instances:     sorted(perInstance),
+	}, nil
+}
+
+// count adds one to the usage of the key, starting from usage.
+func count(usages map[string]*Usage, key string, usage Usage) {
+	if _, ok := usages[key]; !ok {
+		usages[key] = &usage
+	}
+	usages[key].Used++
+}
+
+func sorted(usages map[string]*Usage) []Usage {
+	keys := make([]string, 0, len(usages))
+	for key := range usages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]Usage, len(keys))
+	for i, key := range keys {
+		result[i] = *usages[key]
+	}
+	return result
+}
+
+// Handler serves the usage of the enforcer's limits as JSON.
+func Handler(e *Enforcer) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			osbapi.WriteError(rw, http.StatusMethodNotAllowed, "", "Only GET is supported")
+			return
+		}
+
+		report, err := e.Usage()
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to read the inventory: "+err.Error())
+			return
+		}
+
+		encoded, err := json.Marshal(report)
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to encode the usage: "+err.Error())
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(encoded)
+	})
+}
@@ -0,0 +1,121 @@
+// Package quota limits the service instances and bindings created through
+// the proxy, counting them in the inventory.
+package quota
+
+import (
+	"fmt"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Limits are the most service instances there may be per organization,
+// space, service and plan, and the most bindings per instance. Limits of
+// zero, or that are not set, mean no limit.
+//
+// Services are matched by name or ID, and plans by name, ID or
+// "service-name/plan-name". The limit of a plan applies to each plan it
+// matches.
+type Limits struct {
+	InstancesPerOrganization Limit          `yaml:"instances_per_organization"`
+	InstancesPerSpace        Limit          `yaml:"instances_per_space"`
+	InstancesPerService      map[string]int `yaml:"instances_per_service"`
+	InstancesPerPlan         map[string]int `yaml:"instances_per_plan"`
+	BindingsPerInstance      int            `yaml:"bindings_per_instance"`
+}
+
+// Limit applies to every organization or space, except those given their
+// own limit by GUID. It can be written as a number, for a limit without
+// overrides.
+type Limit struct {
+	Default   int            `yaml:"default"`
+	Overrides map[string]int `yaml:"overrides"`
+}
+
+func (l *Limit) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&l.Default); err == nil {
+		return nil
+	}
+
+	type plain Limit
+	return unmarshal((*plain)(l))
+}
+
+// For returns the limit of the organization or space.
+func (l Limit) For(guid string) int {
+	if limit, ok := l.Overrides[guid]; ok {
+		return limit
+	}
+	return l.Default
+}
+
+// ParseLimits reads limits from YAML, or JSON as a subset of it.
+func ParseLimits(raw string) (Limits, error) {
+	var limits Limits
+	if err := yaml.UnmarshalStrict([]byte(raw), &limits); err != nil {
+		return Limits{}, err
+	}
+
+	for _, err := range []error{
+		checkLimit("instances_per_organization", limits.InstancesPerOrganization.Default),
+		checkLimits("instances_per_organization.overrides", limits.InstancesPerOrganization.Overrides),
+		checkLimit("instances_per_space", limits.InstancesPerSpace.Default),
+		checkLimits("instances_per_space.overrides", limits.InstancesPerSpace.Overrides),
+		checkLimits("instances_per_service", limits.InstancesPerService),
+		checkLimits("instances_per_plan", limits.InstancesPerPlan),
+		checkLimit("bindings_per_instance", limits.BindingsPerInstance),
+	} {
+		if err != nil {
+			return Limits{}, err
+		}
+	}
+
+	return limits, nil
+}
+
+func checkLimit(name string, limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("%s must not be negative: %d", name, limit)
+	}
+	return nil
+}
+
+func checkLimits(name string, limits map[string]int) error {
+	keys := make([]string, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := checkLimit(name+"."+key, limits[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// service returns the limit of the service.
+func (l Limits) service(serviceID, serviceName string) int {
+	return lookup(l.InstancesPerService, serviceID, serviceName)
+}
+
+// plan returns the limit of the plan.
+func (l Limits) plan(serviceName, planID, planName string) int {
+	keys := []string{planID, planName}
+	if serviceName != "" && planName != "" {
+		keys = append(keys, serviceName+"/"+planName)
+	}
+	return lookup(l.InstancesPerPlan, keys...)
+}
+
+// lookup returns the smallest limit of the keys, if any are limited.
+func lookup(limits map[string]int, keys ...string) int {
+	result := 0
+	for _, key := range keys {
+		if limit := limits[key]; key != "" && limit > 0 && (result == 0 || limit < result) {
+			result = limit
+		}
+	}
+	return result
+}
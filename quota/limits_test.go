@@ -0,0 +1,43 @@
+package quota_test
+
+import (
+	"code.cloudfoundry.org/gcp-broker-proxy/quota"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limits", func() {
+	It("reads limits written as numbers or with overrides", func() {
+		limits, err := quota.ParseLimits(`
+instances_per_organization: 20
+instances_per_space:
+  default: 5
+  overrides:
+    space-1: 10
+instances_per_plan:
+  google-cloudsql-mysql/beta: 2
+bindings_per_instance: 3
+`)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(limits.InstancesPerOrganization.For("org-1")).To(Equal(20))
+		Expect(limits.InstancesPerSpace.For("space-1")).To(Equal(10))
+		Expect(limits.InstancesPerSpace.For("space-2")).To(Equal(5))
+		Expect(limits.InstancesPerPlan).To(Equal(map[string]int{"google-cloudsql-mysql/beta": 2}))
+		Expect(limits.BindingsPerInstance).To(Equal(3))
+	})
+
+	DescribeTable("rejects invalid limits",
+		func(raw, message string) {
+			_, err := quota.ParseLimits(raw)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("unknown fields", `{"instances_per_org": 1}`, "field instances_per_org not found"),
+		Entry("unknown fields of limits", `{"instances_per_space": {"max": 1}}`, "field max not found"),
+		Entry("negative limits", `{"instances_per_organization": -1}`, "instances_per_organization must not be negative: -1"),
+		Entry("negative overrides", `{"instances_per_space": {"overrides": {"space-1": -2}}}`, "instances_per_space.overrides.space-1 must not be negative: -2"),
+		Entry("negative plan limits", `{"instances_per_plan": {"beta": -1}}`, "instances_per_plan.beta must not be negative: -1"),
+	)
+})
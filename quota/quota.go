@@ -0,0 +1,460 @@
+package quota
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/urfave/negroni"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/inventory"
+	"code.cloudfoundry.org/gcp-broker-proxy/osbapi"
+)
+
+// Scopes of limits, as reported in rejections.
+const (
+	Organization = "organization"
+	Space        = "space"
+	Service      = "service"
+	Plan         = "plan"
+	Instance     = "instance"
+)
+
+// Rejection describes a request rejected for exceeding a limit. Key is the
+// organization, space, service, plan or instance whose limit it is.
+type Rejection struct {
+	Scope       string
+	Key         string
+	Limit       int
+	Description string
+}
+
+// requestDetails are the fields of a request that the limits depend on.
+type requestDetails struct {
+	ServiceID        string
+	PlanID           string
+	OrganizationGUID string
+	SpaceGUID        string
+}
+
+// Enforcer rejects provisions, plan changes and binds that would exceed the
+// limits, counting the instances and bindings in the inventory and those
+// being created. It watches the inventory to keep its counts up to date, so
+// checking a request does not read every record. It is safe for concurrent
+// use.
+type Enforcer struct {
+	limits   Limits
+	inv      *inventory.Inventory
+	cache    *catalog.Cache
+	observer func(Rejection)
+
+	mu                  sync.Mutex
+	instances           map[string]inventory.Instance
+	instanceCounts      tally
+	bindings            map[string]inventory.Binding
+	bindingsPerInstance map[string]int
+	nextReservation     int
+	pendingInstances    map[int]inventory.Instance
+	pendingBindings     map[int]inventory.Binding
+}
+
+// tally counts the instances of each organization, space, service and plan.
+type tally map[tallyKey]int
+
+type tallyKey struct {
+	scope, key string
+}
+
+type Option func(*Enforcer)
+
+// WithObserver calls observe whenever a request is rejected, for example to
+// log it or record metrics.
+func WithObserver(observe func(Rejection)) Option {
+	return func(e *Enforcer) {
+		e.observer = observe
+	}
+}
+
+// New returns an enforcer of the limits, which counts the instances and
+// bindings in the inventory. The names of services and plans are looked up
+// in the cached catalog.
+func New(limits Limits, inv *inventory.Inventory, cache *catalog.Cache, opts ...Option) (*Enforcer, error) {
+	e := &Enforcer{
+		limits:              limits,
+		inv:                 inv,
+		cache:               cache,
+		observer:            func(Rejection) {},
+		instances:           map[string]inventory.Instance{},
+		instanceCounts:      tally{},
+		bindings:            map[string]inventory.Binding{},
+		bindingsPerInstance: map[string]int{},
+		pendingInstances:    map[int]inventory.Instance{},
+		pendingBindings:     map[int]inventory.Binding{},
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	err := inv.Watch(inventory.Watcher{
+		Instance: e.instanceChanged,
+		Binding:  e.bindingChanged,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Middleware rejects requests over a limit with 403 and a QuotaExceeded
+// error before they reach the broker. It must come before the inventory's
+// recorder, so that the requests it lets through are recorded by the time
+// it stops counting them as pending.
+func (e *Enforcer) Middleware() negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		route := osbapi.ParseRoute(r.Method, r.URL.Path)
+		if route.Operation != osbapi.Provision && route.Operation != osbapi.Update && route.Operation != osbapi.Bind {
+			next(rw, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusBadRequest, "", "Could not read request body")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		details, err := parseDetails(body)
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusBadRequest, "InvalidRequest", "The request body must be a JSON object")
+			return
+		}
+
+		var release func()
+		var rejection *Rejection
+		if route.Operation == osbapi.Bind {
+			release, rejection, err = e.reserveBinding(route, details)
+		} else {
+			release, rejection, err = e.reserveInstance(route, details, r, next)
+		}
+		if err != nil {
+			osbapi.WriteError(rw, http.StatusInternalServerError, "", "Failed to check the quotas: "+err.Error())
+			return
+		}
+		if rejection != nil {
+			e.observer(*rejection)
+			osbapi.WriteError(rw, http.StatusForbidden, "QuotaExceeded", rejection.Description)
+			return
+		}
+
+		defer release()
+		next(rw, r)
+	})
+}
+
+func (e *Enforcer) reserveInstance(route osbapi.Route, details requestDetails, r *http.Request, next http.HandlerFunc) (func(), *Rejection, error) {
+	existing, found, err := e.inv.Instance(route.InstanceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	exists := found && counts(existing)
+
+	instance := inventory.Instance{
+		InstanceID:       route.InstanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+	}
+
+	// Provisions of instances that exist are repeated requests, which the
+	// broker answers, and updates only count when they change the plan.
+	if route.Operation == osbapi.Provision && exists {
+		return func() {}, nil, nil
+	}
+	if route.Operation == osbapi.Update {
+		if !exists || instance.PlanID == "" || instance.PlanID == existing.PlanID {
+			return func() {}, nil, nil
+		}
+		existing.PlanID = instance.PlanID
+		instance = existing
+	}
+
+	var serviceName, planName string
+	if len(e.limits.InstancesPerService) != 0 || len(e.limits.InstancesPerPlan) != 0 {
+		service, plan, found, err := catalog.Lookup(e.cache, r, next, instance.ServiceID, instance.PlanID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not retrieve the catalog: %s", err)
+		}
+		if found {
+			serviceName, planName = service.Name, plan.Name
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	used := e.usedBy(instance)
+	keys := tallyKeys(instance)
+	org, space, sameService, samePlan := used[keys[0]], used[keys[1]], used[keys[2]], used[keys[3]]
+
+	type check struct {
+		scope, key, name string
+		limit, used      int
+	}
+	serviceDescription := catalog.Describe(serviceName, instance.ServiceID)
+	checks := []check{
+		{Plan, instance.PlanID, fmt.Sprintf("plan %s of service %s", catalog.Describe(planName, instance.PlanID), serviceDescription),
+			e.limits.plan(serviceName, instance.PlanID, planName), samePlan},
+	}
+	if route.Operation == osbapi.Provision {
+		checks = append([]check{
+			{Organization, instance.OrganizationGUID, "organization " + instance.OrganizationGUID,
+				e.limits.InstancesPerOrganization.For(instance.OrganizationGUID), org},
+			{Space, instance.SpaceGUID, "space " + instance.SpaceGUID,
+				e.limits.InstancesPerSpace.For(instance.SpaceGUID), space},
+			{Service, instance.ServiceID, "service " + serviceDescription,
+				e.limits.service(instance.ServiceID, serviceName), sameService},
+		}, checks...)
+	}
+	for _, c := range checks {
+		if c.key != "" && c.limit > 0 && c.used >= c.limit {
+			return nil, &Rejection{
+				Scope:       c.scope,
+				Key:         c.key,
+				Limit:       c.limit,
+				Description: fmt.Sprintf("The %s has reached its quota of %d service instances", c.name, c.limit),
+			}, nil
+		}
+	}
+
+	reservation := e.nextReservation
+	e.nextReservation++
+	e.pendingInstances[reservation] = instance
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.pendingInstances, reservation)
+	}, nil, nil
+}
+
+func (e *Enforcer) reserveBinding(route osbapi.Route, details requestDetails) (func(), *Rejection, error) {
+	if e.limits.BindingsPerInstance == 0 {
+		return func() {}, nil, nil
+	}
+
+	existing, found, err := e.inv.Binding(route.InstanceID, route.BindingID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if found && countsBinding(existing) {
+		return func() {}, nil, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if used := e.bindingsOf(route.InstanceID, route.BindingID); used >= e.limits.BindingsPerInstance {
+		return nil, &Rejection{
+			Scope:       Instance,
+			Key:         route.InstanceID,
+			Limit:       e.limits.BindingsPerInstance,
+			Description: fmt.Sprintf("The service instance %s has reached its quota of %d service bindings", route.InstanceID, e.limits.BindingsPerInstance),
+		}, nil
+	}
+
+	reservation := e.nextReservation
+	e.nextReservation++
+	e.pendingBindings[reservation] = inventory.Binding{
+		InstanceID: route.InstanceID,
+		BindingID:  route.BindingID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+	}
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.pendingBindings, reservation)
+	}, nil, nil
+}
+
+// usedBy counts the other instances that share the organization, space,
+// service and plan of the instance, by its tally keys. Instances being
+// created or moved to another plan replace those of the same ID in the
+// inventory. It must be called with the enforcer locked.
+func (e *Enforcer) usedBy(instance inventory.Instance) tally {
+	changes := tally{}
+	if recorded, ok := e.instances[instance.InstanceID]; ok {
+		changes.add(recorded, -1)
+	}
+	for id, pending := range e.pendingByID() {
+		if id == instance.InstanceID {
+			continue
+		}
+		if recorded, ok := e.instances[id]; ok {
+			changes.add(recorded, -1)
+		}
+		changes.add(pending, 1)
+	}
+
+	used := tally{}
+	for _, key := range tallyKeys(instance) {
+		used[key] = e.instanceCounts[key] + changes[key]
+	}
+	return used
+}
+
+// bindingsOf counts the bindings of the instance other than bindingID that
+// exist or are being created. It must be called with the enforcer locked.
+func (e *Enforcer) bindingsOf(instanceID, bindingID string) int {
+	used := e.bindingsPerInstance[instanceID]
+	if _, ok := e.bindings[instanceID+"/"+bindingID]; ok {
+		used--
+	}
+
+	pending := map[string]bool{}
+	for _, binding := range e.pendingBindings {
+		key := binding.InstanceID + "/" + binding.BindingID
+		if _, recorded := e.bindings[key]; binding.InstanceID == instanceID && binding.BindingID != bindingID && !recorded {
+			pending[key] = true
+		}
+	}
+	return used + len(pending)
+}
+
+// pendingByID returns the instances being created or moved to another plan.
+// It must be called with the enforcer locked.
+func (e *Enforcer) pendingByID() map[string]inventory.Instance {
+	instances := map[string]inventory.Instance{}
+	for _, instance := range e.pendingInstances {
+		instances[instance.InstanceID] = instance
+	}
+	return instances
+}
+
+// allInstances returns the instances that exist or are being created or
+// moved to another plan. It must be called with the enforcer locked.
+func (e *Enforcer) allInstances() map[string]inventory.Instance {
+	instances := e.pendingByID()
+	for id, instance := range e.instances {
+		if _, ok := instances[id]; !ok {
+			instances[id] = instance
+		}
+	}
+	return instances
+}
+
+// allBindings returns the bindings that exist or are being created. It must
+// be called with the enforcer locked.
+func (e *Enforcer) allBindings() map[string]inventory.Binding {
+	bindings := map[string]inventory.Binding{}
+	for key, binding := range e.bindings {
+		bindings[key] = binding
+	}
+	for _, binding := range e.pendingBindings {
+		bindings[binding.InstanceID+"/"+binding.BindingID] = binding
+	}
+	return bindings
+}
+
+// instanceChanged updates the counts when a record in the inventory changes.
+func (e *Enforcer) instanceChanged(before, after *inventory.Instance) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if before != nil && counts(*before) {
+		delete(e.instances, before.InstanceID)
+		e.instanceCounts.add(*before, -1)
+	}
+	if after != nil && counts(*after) {
+		e.instances[after.InstanceID] = *after
+		e.instanceCounts.add(*after, 1)
+	}
+}
+
+func (e *Enforcer) bindingChanged(before, after *inventory.Binding) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if before != nil && countsBinding(*before) {
+		delete(e.bindings, before.InstanceID+"/"+before.BindingID)
+		e.bindingsPerInstance[before.InstanceID]--
+		if e.bindingsPerInstance[before.InstanceID] == 0 {
+			delete(e.bindingsPerInstance, before.InstanceID)
+		}
+	}
+	if after != nil && countsBinding(*after) {
+		e.bindings[after.InstanceID+"/"+after.BindingID] = *after
+		e.bindingsPerInstance[after.InstanceID]++
+	}
+}
+
+// add adds n to the counts of the organization, space, service and plan of
+// the instance.
+func (t tally) add(instance inventory.Instance, n int) {
+	for _, key := range tallyKeys(instance) {
+		t[key] += n
+		if t[key] == 0 {
+			delete(t, key)
+		}
+	}
+}
+
+// tallyKeys returns the keys of the organization, space, service and plan
+// of the instance, in that order.
+func tallyKeys(instance inventory.Instance) [4]tallyKey {
+	return [4]tallyKey{
+		{Organization, instance.OrganizationGUID},
+		{Space, instance.SpaceGUID},
+		{Service, instance.ServiceID},
+		{Plan, instance.ServiceID + "/" + instance.PlanID},
+	}
+}
+
+// counts reports whether the instance exists, or is being created. Failed
+// provisions created nothing.
+func counts(instance inventory.Instance) bool {
+	return !instance.Deleted() && !(instance.Operation == string(osbapi.Provision) && instance.State == inventory.Failed)
+}
+
+func countsBinding(binding inventory.Binding) bool {
+	return !binding.Deleted() && !(binding.Operation == string(osbapi.Bind) && binding.State == inventory.Failed)
+}
+
+// parseDetails decodes the fields the limits depend on. Fields of another
+// type than expected are ignored rather than failing the whole body, so that
+// a malformed field cannot get a request past the limits.
+func parseDetails(body []byte) (requestDetails, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return requestDetails{}, err
+	}
+	var context map[string]json.RawMessage
+	json.Unmarshal(fields["context"], &context)
+
+	return requestDetails{
+		ServiceID:        stringField(fields, "service_id"),
+		PlanID:           stringField(fields, "plan_id"),
+		OrganizationGUID: first(stringField(context, "organization_guid"), stringField(fields, "organization_guid")),
+		SpaceGUID:        first(stringField(context, "space_guid"), stringField(fields, "space_guid")),
+	}, nil
+}
+
+func stringField(fields map[string]json.RawMessage, name string) string {
+	var value string
+	json.Unmarshal(fields[name], &value)
+	return value
+}
+
+func first(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
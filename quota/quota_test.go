@@ -0,0 +1,347 @@
+package quota_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/catalog"
+	"code.cloudfoundry.org/gcp-broker-proxy/inventory"
+	"code.cloudfoundry.org/gcp-broker-proxy/quota"
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/urfave/negroni"
+)
+
+const testCatalog = `{
+	"services": [
+		{
+			"id": "mysql-id",
+			"name": "google-cloudsql-mysql",
+			"bindable": true,
+			"plans": [{"id": "beta-id", "name": "beta"}, {"id": "dev-id", "name": "dev"}]
+		},
+		{
+			"id": "storage-id",
+			"name": "google-storage",
+			"bindable": true,
+			"plans": [{"id": "standard-id", "name": "standard"}]
+		}
+	]
+}`
+
+var _ = Describe("Enforcer", func() {
+	var (
+		inv        *inventory.Inventory
+		cache      *catalog.Cache
+		limits     quota.Limits
+		enforcer   *quota.Enforcer
+		handler    http.Handler
+		requests   []string
+		status     int
+		block      chan struct{}
+		rejections []quota.Rejection
+	)
+
+	BeforeEach(func() {
+		s, err := store.Open("")
+		Expect(err).NotTo(HaveOccurred())
+		inv = inventory.New(s)
+		cache = catalog.NewCache()
+		limits = quota.Limits{}
+		requests = nil
+		status = http.StatusCreated
+		block = nil
+		rejections = nil
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		enforcer, err = quota.New(limits, inv, cache, quota.WithObserver(func(rejection quota.Rejection) {
+			rejections = append(rejections, rejection)
+		}))
+		Expect(err).NotTo(HaveOccurred())
+
+		n := negroni.New(enforcer.Middleware(), inventory.Recorder(inv))
+		n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if r.URL.Path == "/v2/catalog" {
+				w.Write([]byte(testCatalog))
+				return
+			}
+			if block != nil {
+				<-block
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(`{}`))
+		})
+		handler = n
+	})
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	provision := func(instanceID, org, space, serviceID, planID string) *httptest.ResponseRecorder {
+		return serve("PUT", "/v2/service_instances/"+instanceID, `{
+			"service_id": "`+serviceID+`",
+			"plan_id": "`+planID+`",
+			"context": {"platform": "cloudfoundry", "organization_guid": "`+org+`", "space_guid": "`+space+`"}
+		}`)
+	}
+
+	Context("with organization and space limits", func() {
+		BeforeEach(func() {
+			limits.InstancesPerOrganization = quota.Limit{Default: 2}
+			limits.InstancesPerSpace = quota.Limit{Default: 1, Overrides: map[string]int{"space-2": 2}}
+		})
+
+		It("rejects provisions over the limit of the space", func() {
+			Expect(provision("i1", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+
+			w := provision("i2", "org-1", "space-1", "mysql-id", "beta-id")
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			Expect(w.Body.String()).To(MatchJSON(`{
+				"error": "QuotaExceeded",
+				"description": "The space space-1 has reached its quota of 1 service instances"
+			}`))
+			Expect(requests).To(Equal([]string{"PUT /v2/service_instances/i1"}))
+			Expect(rejections).To(Equal([]quota.Rejection{{
+				Scope:       quota.Space,
+				Key:         "space-1",
+				Limit:       1,
+				Description: "The space space-1 has reached its quota of 1 service instances",
+			}}))
+		})
+
+		It("rejects provisions over the limit of the organization", func() {
+			Expect(provision("i1", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+			Expect(provision("i2", "org-1", "space-2", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+
+			w := provision("i3", "org-1", "space-2", "mysql-id", "beta-id")
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			Expect(w.Body.String()).To(ContainSubstring("The organization org-1 has reached its quota of 2 service instances"))
+
+			Expect(provision("i3", "org-2", "space-3", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+		})
+
+		It("reads the organization and space of platforms before OSBAPI 2.12", func() {
+			serve("PUT", "/v2/service_instances/i1", `{"service_id": "mysql-id", "plan_id": "beta-id", "organization_guid": "org-1", "space_guid": "space-1"}`)
+
+			w := serve("PUT", "/v2/service_instances/i2", `{"service_id": "mysql-id", "plan_id": "beta-id", "organization_guid": "org-1", "space_guid": "space-1"}`)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("checks provisions with malformed fields", func() {
+			Expect(provision("i1", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+
+			w := serve("PUT", "/v2/service_instances/i2", `{
+				"service_id": "mysql-id",
+				"plan_id": "beta-id",
+				"organization_guid": 1,
+				"context": {"platform": "cloudfoundry", "organization_guid": "org-1", "space_guid": "space-1"}
+			}`)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			Expect(requests).To(Equal([]string{"PUT /v2/service_instances/i1"}))
+		})
+
+		It("rejects provisions whose body is not a JSON object", func() {
+			w := serve("PUT", "/v2/service_instances/i1", `[]`)
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(w.Body.String()).To(MatchJSON(`{
+				"error": "InvalidRequest",
+				"description": "The request body must be a JSON object"
+			}`))
+			Expect(requests).To(BeEmpty())
+		})
+
+		It("does not count deprovisioned instances or failed provisions", func() {
+			provision("i1", "org-1", "space-1", "mysql-id", "beta-id")
+			Expect(serve("DELETE", "/v2/service_instances/i1?service_id=mysql-id&plan_id=beta-id", "").Code).To(Equal(http.StatusCreated))
+
+			status = http.StatusBadRequest
+			provision("i2", "org-1", "space-1", "mysql-id", "beta-id")
+
+			status = http.StatusCreated
+			Expect(provision("i3", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+		})
+
+		Context("when the inventory has instances before the enforcer is created", func() {
+			BeforeEach(func() {
+				Expect(inv.PutInstance(inventory.Instance{InstanceID: "i1", ServiceID: "mysql-id", PlanID: "beta-id", OrganizationGUID: "org-1", SpaceGUID: "space-1", Operation: "provision", State: inventory.Succeeded})).To(Succeed())
+				Expect(inv.PutInstance(inventory.Instance{InstanceID: "i2", ServiceID: "mysql-id", PlanID: "beta-id", OrganizationGUID: "org-1", SpaceGUID: "space-2", Operation: "deprovision", State: inventory.Succeeded})).To(Succeed())
+			})
+
+			It("counts them", func() {
+				Expect(provision("i3", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusForbidden))
+				Expect(provision("i3", "org-1", "space-2", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+			})
+		})
+
+		It("keeps counting as the inventory changes", func() {
+			status = http.StatusAccepted
+			provision("i1", "org-1", "space-1", "mysql-id", "beta-id")
+			Expect(provision("i2", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusForbidden))
+
+			instance, _, err := inv.Instance("i1")
+			Expect(err).NotTo(HaveOccurred())
+			instance.State = inventory.Failed
+			Expect(inv.PutInstance(instance)).To(Succeed())
+			Expect(provision("i2", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusAccepted))
+
+			instance, _, err = inv.Instance("i2")
+			Expect(err).NotTo(HaveOccurred())
+			instance.Operation, instance.State = "deprovision", inventory.Succeeded
+			Expect(inv.PutInstance(instance)).To(Succeed())
+			Expect(inv.Prune(time.Now().Add(time.Hour))).To(Equal(1))
+			Expect(provision("i3", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusAccepted))
+		})
+
+		It("counts instances whose provision is in progress", func() {
+			status = http.StatusAccepted
+			provision("i1", "org-1", "space-1", "mysql-id", "beta-id")
+
+			Expect(provision("i2", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("forwards repeated provisions of an instance", func() {
+			provision("i1", "org-1", "space-1", "mysql-id", "beta-id")
+
+			Expect(provision("i1", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+		})
+
+		It("counts provisions that are being forwarded", func() {
+			block = make(chan struct{})
+			done := make(chan int)
+			go func() {
+				defer GinkgoRecover()
+				done <- provision("i1", "org-1", "space-1", "mysql-id", "beta-id").Code
+			}()
+			Eventually(func() []quota.Usage {
+				report, err := enforcer.Usage()
+				Expect(err).NotTo(HaveOccurred())
+				return report.Spaces
+			}).Should(HaveLen(1))
+
+			Expect(provision("i2", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusForbidden))
+
+			close(block)
+			Eventually(done).Should(Receive(Equal(http.StatusCreated)))
+		})
+	})
+
+	Context("with service and plan limits", func() {
+		BeforeEach(func() {
+			limits.InstancesPerService = map[string]int{"google-storage": 1}
+			limits.InstancesPerPlan = map[string]int{"google-cloudsql-mysql/beta": 1}
+		})
+
+		It("matches services and plans by name", func() {
+			Expect(provision("i1", "org-1", "space-1", "storage-id", "standard-id").Code).To(Equal(http.StatusCreated))
+			w := provision("i2", "org-2", "space-2", "storage-id", "standard-id")
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			Expect(w.Body.String()).To(ContainSubstring("The service google-storage has reached its quota of 1 service instances"))
+
+			Expect(provision("i3", "org-1", "space-1", "mysql-id", "beta-id").Code).To(Equal(http.StatusCreated))
+			w = provision("i4", "org-1", "space-1", "mysql-id", "beta-id")
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			Expect(w.Body.String()).To(ContainSubstring("The plan beta of service google-cloudsql-mysql has reached its quota of 1 service instances"))
+
+			Expect(provision("i4", "org-1", "space-1", "mysql-id", "dev-id").Code).To(Equal(http.StatusCreated))
+		})
+
+		It("rejects updates to a plan over its limit", func() {
+			provision("i1", "org-1", "space-1", "mysql-id", "beta-id")
+			provision("i2", "org-1", "space-1", "mysql-id", "dev-id")
+
+			w := serve("PATCH", "/v2/service_instances/i2", `{"service_id": "mysql-id", "plan_id": "beta-id"}`)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+
+			Expect(serve("PATCH", "/v2/service_instances/i1", `{"service_id": "mysql-id", "plan_id": "beta-id", "parameters": {"tier": "db-f1-micro"}}`).Code).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Context("with a limit of bindings per instance", func() {
+		BeforeEach(func() {
+			limits.BindingsPerInstance = 1
+		})
+
+		It("rejects binds over the limit", func() {
+			bind := func(bindingID string) *httptest.ResponseRecorder {
+				return serve("PUT", "/v2/service_instances/i1/service_bindings/"+bindingID, `{"service_id": "mysql-id", "plan_id": "beta-id"}`)
+			}
+
+			Expect(bind("b1").Code).To(Equal(http.StatusCreated))
+			Expect(bind("b1").Code).To(Equal(http.StatusCreated))
+
+			w := bind("b2")
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			Expect(w.Body.String()).To(MatchJSON(`{
+				"error": "QuotaExceeded",
+				"description": "The service instance i1 has reached its quota of 1 service bindings"
+			}`))
+
+			serve("DELETE", "/v2/service_instances/i1/service_bindings/b1?service_id=mysql-id&plan_id=beta-id", "")
+			Expect(bind("b2").Code).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Describe("Handler", func() {
+		BeforeEach(func() {
+			limits.InstancesPerSpace = quota.Limit{Default: 5}
+			limits.InstancesPerPlan = map[string]int{"beta": 3}
+			limits.BindingsPerInstance = 2
+		})
+
+		It("serves the usage of the limits", func() {
+			provision("i1", "org-1", "space-1", "mysql-id", "beta-id")
+			provision("i2", "org-1", "space-2", "mysql-id", "beta-id")
+			provision("i3", "org-1", "space-2", "storage-id", "standard-id")
+			serve("PUT", "/v2/service_instances/i1/service_bindings/b1", `{"service_id": "mysql-id", "plan_id": "beta-id"}`)
+
+			w := httptest.NewRecorder()
+			quota.Handler(enforcer).ServeHTTP(w, httptest.NewRequest("GET", "/admin/quotas", nil))
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(w.Body.String()).To(MatchJSON(`{
+				"organizations": [{"organization_guid": "org-1", "used": 3, "limit": 0}],
+				"spaces": [
+					{"space_guid": "space-1", "used": 1, "limit": 5},
+					{"space_guid": "space-2", "used": 2, "limit": 5}
+				],
+				"services": [
+					{"service_id": "mysql-id", "service_name": "google-cloudsql-mysql", "used": 2, "limit": 0},
+					{"service_id": "storage-id", "service_name": "google-storage", "used": 1, "limit": 0}
+				],
+				"plans": [
+					{"service_id": "mysql-id", "service_name": "google-cloudsql-mysql", "plan_id": "beta-id", "plan_name": "beta", "used": 2, "limit": 3},
+					{"service_id": "storage-id", "service_name": "google-storage", "plan_id": "standard-id", "plan_name": "standard", "used": 1, "limit": 0}
+				],
+				"instances": [{"instance_id": "i1", "used": 1, "limit": 2}]
+			}`))
+		})
+
+		It("matches limits by ID when the catalog is not cached", func() {
+			provision("i1", "org-1", "space-1", "mysql-id", "beta-id")
+
+			uncached, err := quota.New(quota.Limits{InstancesPerPlan: map[string]int{"beta": 3, "beta-id": 4}}, inv, catalog.NewCache())
+			Expect(err).NotTo(HaveOccurred())
+			report, err := uncached.Usage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Plans).To(Equal([]quota.Usage{{ServiceID: "mysql-id", PlanID: "beta-id", Used: 1, Limit: 4}}))
+		})
+
+		It("only supports GET", func() {
+			w := httptest.NewRecorder()
+			quota.Handler(enforcer).ServeHTTP(w, httptest.NewRequest("POST", "/admin/quotas", nil))
+
+			Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
@@ -0,0 +1,516 @@
+// Package schema validates JSON documents against JSON Schemas, as brokers
+// publish them for service parameters in their catalogs.
+//
+// It supports the validation keywords of drafts 4 to 7 that catalogs use.
+// References must point into the schema itself, and formats are not
+// checked.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Problem is a part of a document that does not match its schema.
+type Problem struct {
+	// Path locates the value, such as parameters.labels.env or
+	// parameters.networks[0].
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	return p.Path + " " + p.Message
+}
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// Parse parses a JSON Schema, checking that its patterns compile and its
+// references resolve.
+func Parse(raw []byte) (*Schema, error) {
+	var root interface{}
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, err
+	}
+	return New(root)
+}
+
+// New returns the schema of an already decoded JSON document.
+func New(root interface{}) (*Schema, error) {
+	switch root.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, fmt.Errorf("a schema must be an object or a boolean")
+	}
+
+	s := &Schema{root: root, patterns: map[string]*regexp.Regexp{}}
+	if err := s.prepare(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// prepare compiles the patterns and resolves the references of a schema and
+// every schema nested in it.
+func (s *Schema) prepare(node interface{}) error {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		if ref, ok := node["$ref"].(string); ok {
+			if _, err := s.resolve(ref); err != nil {
+				return err
+			}
+		}
+		if pattern, ok := node["pattern"].(string); ok {
+			if err := s.compile(pattern); err != nil {
+				return err
+			}
+		}
+		if properties, ok := node["patternProperties"].(map[string]interface{}); ok {
+			for pattern := range properties {
+				if err := s.compile(pattern); err != nil {
+					return err
+				}
+			}
+		}
+		for _, child := range node {
+			if err := s.prepare(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range node {
+			if err := s.prepare(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) compile(pattern string) error {
+	if _, ok := s.patterns[pattern]; ok {
+		return nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+	}
+	s.patterns[pattern] = compiled
+	return nil
+}
+
+// resolve returns the schema a reference such as #/definitions/network
+// points to.
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported reference %q, only references within the schema are supported", ref)
+	}
+
+	node := s.root
+	pointer := strings.TrimPrefix(ref, "#")
+	if pointer == "" {
+		return node, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("unsupported reference %q", ref)
+	}
+
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch current := node.(type) {
+		case map[string]interface{}:
+			next, ok := current[token]
+			if !ok {
+				return nil, fmt.Errorf("reference %q cannot be resolved", ref)
+			}
+			node = next
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(current) {
+				return nil, fmt.Errorf("reference %q cannot be resolved", ref)
+			}
+			node = current[index]
+		default:
+			return nil, fmt.Errorf("reference %q cannot be resolved", ref)
+		}
+	}
+	return node, nil
+}
+
+// maxDepth stops references that refer to themselves without consuming any
+// of the document.
+const maxDepth = 100
+
+// Validate returns every problem of the decoded JSON value, with paths
+// starting at root.
+func (s *Schema) Validate(root string, value interface{}) []Problem {
+	v := &validation{schema: s}
+	v.validate(s.root, value, root, 0)
+	return v.problems
+}
+
+type validation struct {
+	schema   *Schema
+	problems []Problem
+}
+
+func (v *validation) report(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// matches reports whether the value matches the schema without recording
+// any problem, as anyOf, oneOf and not need.
+func (v *validation) matches(node, value interface{}, path string, depth int) bool {
+	nested := &validation{schema: v.schema}
+	nested.validate(node, value, path, depth)
+	return len(nested.problems) == 0
+}
+
+func (v *validation) validate(node, value interface{}, path string, depth int) {
+	if depth > maxDepth {
+		v.report(path, "cannot be validated, the schema is nested too deeply")
+		return
+	}
+
+	switch node := node.(type) {
+	case bool:
+		if !node {
+			v.report(path, "is not allowed")
+		}
+		return
+	case map[string]interface{}:
+		v.validateObjectSchema(node, value, path, depth)
+	}
+}
+
+func (v *validation) validateObjectSchema(node map[string]interface{}, value interface{}, path string, depth int) {
+	// Keywords next to a reference are ignored, as drafts before 2019-09
+	// specify.
+	if ref, ok := node["$ref"].(string); ok {
+		target, _ := v.schema.resolve(ref)
+		v.validate(target, value, path, depth+1)
+		return
+	}
+
+	if !v.validateType(node, value, path) {
+		return
+	}
+
+	if enum, ok := node["enum"].([]interface{}); ok && !contains(enum, value) {
+		v.report(path, "must be one of %s", list(enum))
+	}
+	if constant, ok := node["const"]; ok && !reflect.DeepEqual(constant, value) {
+		v.report(path, "must be %s", encode(constant))
+	}
+
+	switch value := value.(type) {
+	case string:
+		v.validateString(node, value, path)
+	case float64:
+		v.validateNumber(node, value, path)
+	case map[string]interface{}:
+		v.validateObject(node, value, path, depth)
+	case []interface{}:
+		v.validateArray(node, value, path, depth)
+	}
+
+	if allOf, ok := node["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			v.validate(sub, value, path, depth+1)
+		}
+	}
+	if anyOf, ok := node["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if v.matches(sub, value, path, depth+1) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.report(path, "must match at least one of the allowed schemas")
+		}
+	}
+	if oneOf, ok := node["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if v.matches(sub, value, path, depth+1) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.report(path, "must match exactly one of the allowed schemas")
+		}
+	}
+	if not, ok := node["not"]; ok && v.matches(not, value, path, depth+1) {
+		v.report(path, "must not match the disallowed schema")
+	}
+}
+
+// validateType reports whether the value has one of the types the schema
+// allows. Other keywords are not checked if it does not.
+func (v *validation) validateType(node map[string]interface{}, value interface{}, path string) bool {
+	var types []string
+	switch t := node["type"].(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, element := range t {
+			if name, ok := element.(string); ok {
+				types = append(types, name)
+			}
+		}
+	default:
+		return true
+	}
+
+	actual := typeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+
+	v.report(path, "must be %s", strings.Join(articles(types), " or "))
+	return false
+}
+
+func (v *validation) validateString(node map[string]interface{}, value, path string) {
+	length := utf8.RuneCountInString(value)
+	if min, ok := number(node, "minLength"); ok && float64(length) < min {
+		v.report(path, "must be at least %s characters long", format(min))
+	}
+	if max, ok := number(node, "maxLength"); ok && float64(length) > max {
+		v.report(path, "must be at most %s characters long", format(max))
+	}
+	if pattern, ok := node["pattern"].(string); ok && !v.schema.patterns[pattern].MatchString(value) {
+		v.report(path, "must match the pattern %s", pattern)
+	}
+}
+
+func (v *validation) validateNumber(node map[string]interface{}, value float64, path string) {
+	if min, ok := number(node, "minimum"); ok {
+		if exclusive, _ := node["exclusiveMinimum"].(bool); exclusive && value <= min {
+			v.report(path, "must be greater than %s", format(min))
+		} else if value < min {
+			v.report(path, "must be at least %s", format(min))
+		}
+	}
+	if min, ok := number(node, "exclusiveMinimum"); ok && value <= min {
+		v.report(path, "must be greater than %s", format(min))
+	}
+	if max, ok := number(node, "maximum"); ok {
+		if exclusive, _ := node["exclusiveMaximum"].(bool); exclusive && value >= max {
+			v.report(path, "must be less than %s", format(max))
+		} else if value > max {
+			v.report(path, "must be at most %s", format(max))
+		}
+	}
+	if max, ok := number(node, "exclusiveMaximum"); ok && value >= max {
+		v.report(path, "must be less than %s", format(max))
+	}
+	if divisor, ok := number(node, "multipleOf"); ok && divisor > 0 {
+		if quotient := value / divisor; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			v.report(path, "must be a multiple of %s", format(divisor))
+		}
+	}
+}
+
+func (v *validation) validateObject(node map[string]interface{}, value map[string]interface{}, path string, depth int) {
+	if required, ok := node["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := value[name]; !present {
+					v.report(child(path, name), "is required")
+				}
+			}
+		}
+	}
+	if min, ok := number(node, "minProperties"); ok && float64(len(value)) < min {
+		v.report(path, "must have at least %s properties", format(min))
+	}
+	if max, ok := number(node, "maxProperties"); ok && float64(len(value)) > max {
+		v.report(path, "must have at most %s properties", format(max))
+	}
+
+	properties, _ := node["properties"].(map[string]interface{})
+	patternProperties, _ := node["patternProperties"].(map[string]interface{})
+	dependencies, _ := node["dependencies"].(map[string]interface{})
+	additional, hasAdditional := node["additionalProperties"]
+
+	for _, name := range sortedKeys(value) {
+		property := value[name]
+		propertyPath := child(path, name)
+
+		matched := false
+		if sub, ok := properties[name]; ok {
+			matched = true
+			v.validate(sub, property, propertyPath, depth+1)
+		}
+		for _, pattern := range sortedKeys(patternProperties) {
+			if v.schema.patterns[pattern].MatchString(name) {
+				matched = true
+				v.validate(patternProperties[pattern], property, propertyPath, depth+1)
+			}
+		}
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				v.report(propertyPath, "is not allowed")
+			} else {
+				v.validate(additional, property, propertyPath, depth+1)
+			}
+		}
+
+		switch dependency := dependencies[name].(type) {
+		case []interface{}:
+			for _, required := range dependency {
+				if required, ok := required.(string); ok {
+					if _, present := value[required]; !present {
+						v.report(child(path, required), "is required when %s is set", name)
+					}
+				}
+			}
+		case map[string]interface{}, bool:
+			v.validate(dependency, value, path, depth+1)
+		}
+	}
+}
+
+func (v *validation) validateArray(node map[string]interface{}, value []interface{}, path string, depth int) {
+	if min, ok := number(node, "minItems"); ok && float64(len(value)) < min {
+		v.report(path, "must have at least %s items", format(min))
+	}
+	if max, ok := number(node, "maxItems"); ok && float64(len(value)) > max {
+		v.report(path, "must have at most %s items", format(max))
+	}
+	if unique, _ := node["uniqueItems"].(bool); unique {
+	duplicates:
+		for i := range value {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					v.report(path, "must not contain duplicate items")
+					break duplicates
+				}
+			}
+		}
+	}
+
+	switch items := node["items"].(type) {
+	case []interface{}:
+		// Each item has its own schema, and additionalItems applies to the
+		// rest.
+		for i, item := range value {
+			if i < len(items) {
+				v.validate(items[i], item, index(path, i), depth+1)
+			} else if additional, ok := node["additionalItems"]; ok {
+				v.validate(additional, item, index(path, i), depth+1)
+			}
+		}
+	case map[string]interface{}, bool:
+		for i, item := range value {
+			v.validate(items, item, index(path, i), depth+1)
+		}
+	}
+}
+
+func typeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func articles(types []string) []string {
+	result := make([]string, len(types))
+	for i, t := range types {
+		switch t {
+		case "null":
+			result[i] = "null"
+		case "array", "integer", "object":
+			result[i] = "an " + t
+		default:
+			result[i] = "a " + t
+		}
+	}
+	return result
+}
+
+func number(node map[string]interface{}, keyword string) (float64, bool) {
+	value, ok := node[keyword].(float64)
+	return value, ok
+}
+
+func format(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func contains(values []interface{}, value interface{}) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(value interface{}) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+func list(values []interface{}) string {
+	encoded := make([]string, len(values))
+	for i, value := range values {
+		encoded[i] = encode(value)
+	}
+	return strings.Join(encoded, ", ")
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// child returns the path of a property, quoting names that are not plain
+// identifiers.
+func child(path, name string) string {
+	if identifier.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+func index(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
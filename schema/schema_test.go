@@ -0,0 +1,179 @@
+package schema_test
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/schema"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// cloudSQLSchema is modelled on the create parameters of Google's Cloud SQL
+// for MySQL plans.
+const cloudSQLSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"type": "object",
+	"properties": {
+		"instance_name": {
+			"type": "string",
+			"title": "Instance name",
+			"description": "Name of the Cloud SQL instance.",
+			"pattern": "^[a-z][a-z0-9-]+$",
+			"maxLength": 84
+		},
+		"database_name": {"type": "string", "pattern": "^[a-zA-Z0-9_-]+$", "maxLength": 64},
+		"version": {"type": "string", "enum": ["MYSQL_5_6", "MYSQL_5_7"], "default": "MYSQL_5_7"},
+		"disk_size": {"type": "integer", "minimum": 10, "maximum": 30720},
+		"backups_enabled": {"type": "boolean"},
+		"binlog": {"type": "string", "enum": ["true", "false"]},
+		"authorized_networks": {
+			"type": "array",
+			"items": {"$ref": "#/definitions/network"},
+			"uniqueItems": true
+		},
+		"labels": {
+			"type": "object",
+			"maxProperties": 64,
+			"additionalProperties": {"type": "string", "maxLength": 63, "pattern": "^[a-z0-9_-]*$"}
+		}
+	},
+	"required": ["instance_name"],
+	"definitions": {
+		"network": {
+			"type": "object",
+			"properties": {
+				"name": {"type": "string"},
+				"value": {"type": "string", "pattern": "^[0-9./]+$"}
+			},
+			"required": ["value"],
+			"additionalProperties": false
+		}
+	}
+}`
+
+// storageBindingSchema is modelled on the bind parameters of Google's Cloud
+// Storage plans.
+const storageBindingSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"type": "object",
+	"properties": {
+		"role": {"type": "string", "enum": ["storage.objectAdmin", "storage.objectViewer", "storage.admin"]}
+	},
+	"required": ["role"]
+}`
+
+var _ = Describe("Schema", func() {
+	validate := func(rawSchema, document string) []string {
+		s, err := schema.Parse([]byte(rawSchema))
+		Expect(err).NotTo(HaveOccurred())
+
+		var value interface{}
+		Expect(json.Unmarshal([]byte(document), &value)).To(Succeed())
+
+		var problems []string
+		for _, problem := range s.Validate("parameters", value) {
+			problems = append(problems, problem.String())
+		}
+		return problems
+	}
+
+	It("accepts valid Cloud SQL parameters", func() {
+		Expect(validate(cloudSQLSchema, `{
+			"instance_name": "orders-db",
+			"version": "MYSQL_5_6",
+			"disk_size": 50,
+			"backups_enabled": true,
+			"authorized_networks": [{"name": "office", "value": "203.0.113.0/24"}],
+			"labels": {"team": "orders"},
+			"unknown": "left to the broker"
+		}`)).To(BeEmpty())
+	})
+
+	It("lists every problem with its path", func() {
+		Expect(validate(cloudSQLSchema, `{
+			"version": "MYSQL_8_0",
+			"disk_size": 5.5,
+			"backups_enabled": "yes",
+			"authorized_networks": [{"value": "203.0.113.0/24", "mask": 24}, {"name": "home"}],
+			"labels": {"Team": "Orders", "cost center": 12}
+		}`)).To(Equal([]string{
+			"parameters.instance_name is required",
+			"parameters.authorized_networks[0].mask is not allowed",
+			"parameters.authorized_networks[1].value is required",
+			"parameters.backups_enabled must be a boolean",
+			"parameters.disk_size must be an integer",
+			"parameters.labels.Team must match the pattern ^[a-z0-9_-]*$",
+			`parameters.labels["cost center"] must be a string`,
+			`parameters.version must be one of "MYSQL_5_6", "MYSQL_5_7"`,
+		}))
+	})
+
+	It("checks the bounds of strings and numbers", func() {
+		Expect(validate(cloudSQLSchema, `{"instance_name": "9-lives", "disk_size": 40000, "database_name": "`+
+			"abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyz"+`"}`)).To(Equal([]string{
+			"parameters.database_name must be at most 64 characters long",
+			"parameters.disk_size must be at most 30720",
+			"parameters.instance_name must match the pattern ^[a-z][a-z0-9-]+$",
+		}))
+	})
+
+	It("requires the role of a Cloud Storage binding", func() {
+		Expect(validate(storageBindingSchema, `{}`)).To(Equal([]string{"parameters.role is required"}))
+		Expect(validate(storageBindingSchema, `{"role": "owner"}`)).To(Equal([]string{
+			`parameters.role must be one of "storage.objectAdmin", "storage.objectViewer", "storage.admin"`,
+		}))
+		Expect(validate(storageBindingSchema, `[]`)).To(Equal([]string{"parameters must be an object"}))
+	})
+
+	DescribeTable("applies the other keywords",
+		func(rawSchema, document string, expected []string) {
+			Expect(validate(rawSchema, document)).To(Equal(expected))
+		},
+		Entry("exclusive minimum of draft 4", `{"minimum": 0, "exclusiveMinimum": true}`, `0`,
+			[]string{"parameters must be greater than 0"}),
+		Entry("exclusive maximum of draft 6", `{"exclusiveMaximum": 1}`, `1`,
+			[]string{"parameters must be less than 1"}),
+		Entry("multipleOf", `{"multipleOf": 0.5}`, `1.25`,
+			[]string{"parameters must be a multiple of 0.5"}),
+		Entry("several types", `{"type": ["string", "null"]}`, `1`,
+			[]string{"parameters must be a string or null"}),
+		Entry("const", `{"const": "fixed"}`, `"other"`,
+			[]string{`parameters must be "fixed"`}),
+		Entry("array bounds", `{"minItems": 2, "maxItems": 3}`, `[1]`,
+			[]string{"parameters must have at least 2 items"}),
+		Entry("duplicate items", `{"uniqueItems": true}`, `["a", "b", "a"]`,
+			[]string{"parameters must not contain duplicate items"}),
+		Entry("tuples", `{"items": [{"type": "string"}], "additionalItems": false}`, `["a", "b"]`,
+			[]string{"parameters[1] is not allowed"}),
+		Entry("pattern properties", `{"patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": false}`, `{"x-a": 1, "b": "c"}`,
+			[]string{"parameters.b is not allowed", "parameters.x-a must be a string"}),
+		Entry("dependencies", `{"dependencies": {"user": ["password"]}}`, `{"user": "admin"}`,
+			[]string{"parameters.password is required when user is set"}),
+		Entry("allOf", `{"allOf": [{"minLength": 2}, {"pattern": "^a"}]}`, `"b"`,
+			[]string{"parameters must be at least 2 characters long", "parameters must match the pattern ^a"}),
+		Entry("anyOf", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `true`,
+			[]string{"parameters must match at least one of the allowed schemas"}),
+		Entry("oneOf", `{"oneOf": [{"type": "integer"}, {"minimum": 0}]}`, `1`,
+			[]string{"parameters must match exactly one of the allowed schemas"}),
+		Entry("not", `{"not": {"type": "null"}}`, `null`,
+			[]string{"parameters must not match the disallowed schema"}),
+		Entry("false schema", `{"properties": {"legacy": false}}`, `{"legacy": 1}`,
+			[]string{"parameters.legacy is not allowed"}),
+		Entry("recursive references", `{"properties": {"child": {"$ref": "#"}}, "required": ["name"]}`, `{"name": "a", "child": {}}`,
+			[]string{"parameters.child.name is required"}),
+	)
+
+	DescribeTable("rejects schemas it cannot use",
+		func(rawSchema, message string) {
+			_, err := schema.Parse([]byte(rawSchema))
+			Expect(err).To(MatchError(message))
+		},
+		Entry("not a schema", `[]`, "a schema must be an object or a boolean"),
+		Entry("invalid pattern", `{"pattern": "("}`, "invalid pattern \"(\": error parsing regexp: missing closing ): `(`"),
+		Entry("remote reference", `{"$ref": "https://example.com/schema.json"}`,
+			`unsupported reference "https://example.com/schema.json", only references within the schema are supported`),
+		Entry("missing definition", `{"$ref": "#/definitions/missing"}`, `reference "#/definitions/missing" cannot be resolved`),
+	)
+})
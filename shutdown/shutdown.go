@@ -0,0 +1,189 @@
+// Package shutdown drains the servers of the proxy when it is asked to stop,
+// so that in-flight broker operations are not cut off.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+)
+
+// ErrDeadlineExceeded is returned by Wait when requests or background work
+// were still in flight at the deadline.
+var ErrDeadlineExceeded = errors.New("requests were still in flight at the shutdown deadline")
+
+// Group is a set of servers that are shut down together. Background work
+// started with Begin is drained within the same deadline as the requests.
+// Hooks registered with OnShutdown run once both have drained, in reverse
+// order, to stop the rest.
+type Group struct {
+	timeout time.Duration
+	logger  *logging.Logger
+
+	inFlight   int64
+	background int64
+	work       sync.WaitGroup
+	failures   chan error
+
+	mu      sync.Mutex
+	servers []*http.Server
+	hooks   []func()
+}
+
+func NewGroup(timeout time.Duration) *Group {
+	return &Group{
+		timeout:  timeout,
+		logger:   logging.Default(),
+		failures: make(chan error, 1),
+	}
+}
+
+// Track counts the requests handled by h, so that Wait can report how many
+// were cut off.
+func (g *Group) Track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&g.inFlight, 1)
+		defer atomic.AddInt64(&g.inFlight, -1)
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// InFlight returns the number of tracked requests being handled.
+func (g *Group) InFlight() int64 {
+	return atomic.LoadInt64(&g.inFlight)
+}
+
+// Begin counts background work, such as a binding being polled or an
+// orphaned binding being removed, that must finish before the proxy exits.
+// Call the returned function when it is done. Work may only begin while
+// requests are being served or other work is in flight.
+func (g *Group) Begin() (done func()) {
+	g.work.Add(1)
+	atomic.AddInt64(&g.background, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&g.background, -1)
+			g.work.Done()
+		})
+	}
+}
+
+// Background returns the amount of background work in flight.
+func (g *Group) Background() int64 {
+	return atomic.LoadInt64(&g.background)
+}
+
+// OnShutdown registers fn to run after the servers have drained.
+func (g *Group) OnShutdown(fn func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.hooks = append(g.hooks, fn)
+}
+
+// Serve serves server on listener in the background. If it stops other than
+// by being shut down, Wait returns its error.
+func (g *Group) Serve(name string, server *http.Server, listener net.Listener) {
+	g.mu.Lock()
+	g.servers = append(g.servers, server)
+	g.mu.Unlock()
+
+	go func() {
+		err := server.Serve(listener)
+		if err == http.ErrServerClosed {
+			return
+		}
+
+		select {
+		case g.failures <- fmt.Errorf("%s server stopped: %s", name, err):
+		default:
+		}
+	}()
+}
+
+// Wait blocks until a signal is received, then stops accepting
+// connections and waits until the in-flight requests and background work
+// are done or the timeout has passed. It returns an error if a server failed or the
+// deadline was exceeded.
+func (g *Group) Wait(signals <-chan os.Signal) error {
+	var failure error
+	select {
+	case sig := <-signals:
+		g.logger.Info("Shutting down", logging.Data{
+			"signal":     sig.String(),
+			"in_flight":  g.InFlight(),
+			"background": g.Background(),
+			"timeout":    g.timeout.String(),
+		})
+	case failure = <-g.failures:
+	}
+
+	err := g.shutdown()
+	if failure != nil {
+		return failure
+	}
+	return err
+}
+
+func (g *Group) shutdown() error {
+	g.mu.Lock()
+	servers := g.servers
+	hooks := g.hooks
+	g.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		timedOut int32
+	)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				atomic.StoreInt32(&timedOut, 1)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	var err error
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = ErrDeadlineExceeded
+		g.logger.Error("Shutdown deadline exceeded, closed the remaining connections", err,
+			logging.Data{"in_flight": g.InFlight()})
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		g.work.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ErrDeadlineExceeded
+		g.logger.Error("Shutdown deadline exceeded, abandoned the remaining background work", err,
+			logging.Data{"background": g.Background()})
+	}
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+
+	return err
+}
@@ -0,0 +1,192 @@
+package shutdown_test
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/shutdown"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Group", func() {
+	var (
+		group    *shutdown.Group
+		listener net.Listener
+		signals  chan os.Signal
+		released chan struct{}
+		release  func()
+		handlers *sync.WaitGroup
+		started  chan struct{}
+		logs     *gbytes.Buffer
+		timeout  time.Duration
+
+		mu      sync.Mutex
+		stopped []string
+	)
+
+	stop := func(name string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			stopped = append(stopped, name)
+		}
+	}
+
+	stoppedHooks := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, stopped...)
+	}
+
+	BeforeEach(func() {
+		logs = gbytes.NewBuffer()
+		logging.SetOutput(logs)
+
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		signals = make(chan os.Signal, 1)
+		started = make(chan struct{}, 10)
+		timeout = time.Second
+
+		released = make(chan struct{})
+		var once sync.Once
+		ch := released
+		release = func() { once.Do(func() { close(ch) }) }
+		handlers = &sync.WaitGroup{}
+
+		mu.Lock()
+		stopped = nil
+		mu.Unlock()
+	})
+
+	AfterEach(func() {
+		release()
+		handlers.Wait()
+		logging.SetOutput(os.Stdout)
+	})
+
+	JustBeforeEach(func() {
+		group = shutdown.NewGroup(timeout)
+		group.OnShutdown(stop("first"))
+		group.OnShutdown(stop("second"))
+
+		// The handler may outlive the spec, so it only uses the channels of
+		// its own spec.
+		released, started, handlers := released, started, handlers
+		handler := group.Track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+
+			started <- struct{}{}
+			<-released
+			w.Write([]byte("done"))
+		}))
+		group.Serve("test", &http.Server{Handler: handler}, listener)
+	})
+
+	get := func() <-chan *http.Response {
+		url := "http://" + listener.Addr().String()
+		responses := make(chan *http.Response, 1)
+		go func() {
+			res, err := http.Get(url)
+			if err != nil {
+				responses <- nil
+				return
+			}
+			res.Body.Close()
+			responses <- res
+		}()
+		return responses
+	}
+
+	It("waits for in-flight requests before running the hooks", func() {
+		responses := get()
+		Eventually(started).Should(Receive())
+		Expect(group.InFlight()).To(Equal(int64(1)))
+
+		done := make(chan error, 1)
+		signals <- syscall.SIGTERM
+		go func() { done <- group.Wait(signals) }()
+
+		Eventually(logs).Should(gbytes.Say(`"message":"Shutting down","data":{"background":0,"in_flight":1,"signal":"terminated","timeout":"1s"}`))
+		Consistently(done).ShouldNot(Receive())
+
+		release()
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(stoppedHooks()).To(Equal([]string{"second", "first"}))
+
+		var res *http.Response
+		Eventually(responses).Should(Receive(&res))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("waits for background work before running the hooks", func() {
+		done := group.Begin()
+		Expect(group.Background()).To(Equal(int64(1)))
+
+		waited := make(chan error, 1)
+		signals <- syscall.SIGTERM
+		go func() { waited <- group.Wait(signals) }()
+
+		Consistently(waited).ShouldNot(Receive())
+		Expect(stoppedHooks()).To(BeEmpty())
+
+		done()
+		done()
+		Eventually(waited).Should(Receive(BeNil()))
+		Expect(group.Background()).To(BeZero())
+		Expect(stoppedHooks()).To(Equal([]string{"second", "first"}))
+	})
+
+	It("stops accepting connections", func() {
+		signals <- syscall.SIGTERM
+		Expect(group.Wait(signals)).To(Succeed())
+
+		_, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("when requests outlast the timeout", func() {
+		BeforeEach(func() {
+			timeout = 50 * time.Millisecond
+		})
+
+		It("gives up on them and still runs the hooks", func() {
+			get()
+			Eventually(started).Should(Receive())
+
+			signals <- syscall.SIGTERM
+			Expect(group.Wait(signals)).To(MatchError(shutdown.ErrDeadlineExceeded))
+			Expect(logs).To(gbytes.Say(`"message":"Shutdown deadline exceeded, closed the remaining connections"`))
+			Expect(stoppedHooks()).To(Equal([]string{"second", "first"}))
+		})
+
+		It("gives up on background work and still runs the hooks", func() {
+			done := group.Begin()
+			defer done()
+
+			signals <- syscall.SIGTERM
+			Expect(group.Wait(signals)).To(MatchError(shutdown.ErrDeadlineExceeded))
+			Expect(logs).To(gbytes.Say(`"message":"Shutdown deadline exceeded, abandoned the remaining background work",.*"data":{"background":1}`))
+			Expect(stoppedHooks()).To(Equal([]string{"second", "first"}))
+		})
+	})
+
+	It("returns the error of a server that stops by itself", func() {
+		listener.Close()
+
+		err := group.Wait(signals)
+		Expect(err).To(MatchError(ContainSubstring("test server stopped: ")))
+		Expect(stoppedHooks()).To(Equal([]string{"second", "first"}))
+	})
+})
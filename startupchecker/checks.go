@@ -1,10 +1,13 @@
 package startupchecker
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
@@ -20,6 +23,12 @@ type HTTPDoer interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// Check is a named health check. Run returns nil when the check passes.
+type Check struct {
+	Name string
+	Run  func() error
+}
+
 type Checker struct {
 	brokerURL      *url.URL
 	tokenRetriever TokenRetriever
@@ -34,16 +43,75 @@ func NewChecker(brokerURL *url.URL, tr TokenRetriever, httpDoer HTTPDoer) Checke
 	}
 }
 
-// 1. Once the proxy is setup can we just call ourselves?
+// Perform checks once that a token can be obtained and that the broker
+// serves its catalog with it.
 func (s *Checker) Perform() error {
+	_, err := s.fetchCatalog()
+	return err
+}
+
+// Checks returns the token, catalog and catalog schema checks of the broker.
+// The schema check validates the catalog fetched by the catalog check, so
+// the checks must run in the order they are returned.
+func (s *Checker) Checks() []Check {
+	var (
+		mu      sync.Mutex
+		catalog []byte
+	)
+
+	return []Check{
+		{
+			Name: "token",
+			Run: func() error {
+				_, err := s.token()
+				return err
+			},
+		},
+		{
+			Name: "catalog",
+			Run: func() error {
+				body, err := s.fetchCatalog()
+
+				mu.Lock()
+				catalog = body
+				mu.Unlock()
+
+				return err
+			},
+		},
+		{
+			Name: "catalog_schema",
+			Run: func() error {
+				mu.Lock()
+				body := catalog
+				mu.Unlock()
+
+				if body == nil {
+					return errors.New("The catalog could not be fetched")
+				}
+				return ValidateCatalog(body)
+			},
+		},
+	}
+}
+
+func (s *Checker) token() (*oauth2.Token, error) {
 	token, err := s.tokenRetriever.GetToken()
 	if err != nil {
-		return errors.Wrap(err, "Failed obtaining oauth token")
+		return nil, errors.Wrap(err, "Failed obtaining oauth token")
+	}
+	return token, nil
+}
+
+func (s *Checker) fetchCatalog() ([]byte, error) {
+	token, err := s.token()
+	if err != nil {
+		return nil, err
 	}
 
 	req, err := http.NewRequest("GET", s.brokerURL.String()+"/v2/catalog", nil)
 	if err != nil {
-		return errors.Wrap(err, "Failed to create request")
+		return nil, errors.Wrap(err, "Failed to create request")
 	}
 
 	req.Header.Add("Authorization", "Bearer "+token.AccessToken)
@@ -52,20 +120,92 @@ func (s *Checker) Perform() error {
 	res, err := s.httpDoer.Do(req)
 
 	if err != nil {
-		return errors.Wrap(err, "Failed to make request to the broker")
+		return nil, errors.Wrap(err, "Failed to make request to the broker")
 	}
+	defer res.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(res.Body)
 
 	if res.StatusCode != http.StatusOK {
-		defer res.Body.Close()
-		bodyBytes, err := ioutil.ReadAll(res.Body)
 		var bodyString string
 		if err != nil {
 			bodyString = "Could not read body"
 		} else {
 			bodyString = string(bodyBytes)
 		}
-		return fmt.Errorf("Broker did not respond successfully. status: %d body: %s", res.StatusCode, bodyString)
+		return nil, fmt.Errorf("Broker did not respond successfully. status: %d body: %s", res.StatusCode, bodyString)
 	}
 
-	return err
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the catalog")
+	}
+
+	return bodyBytes, nil
+}
+
+type catalogSchema struct {
+	Services *[]struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Bindable    *bool  `json:"bindable"`
+		Plans       []struct {
+			ID          string `json:"id"`
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		} `json:"plans"`
+	} `json:"services"`
+}
+
+// ValidateCatalog checks that a catalog has the fields the OSBAPI spec
+// requires. All problems are reported at once.
+func ValidateCatalog(body []byte) error {
+	var catalog catalogSchema
+	if err := json.Unmarshal(body, &catalog); err != nil {
+		return errors.Wrap(err, "The catalog is not valid JSON")
+	}
+
+	if catalog.Services == nil {
+		return errors.New("The catalog has no services field")
+	}
+
+	var problems []string
+	for i, service := range *catalog.Services {
+		missing := missingFields(map[string]bool{
+			"id":          service.ID == "",
+			"name":        service.Name == "",
+			"description": service.Description == "",
+			"bindable":    service.Bindable == nil,
+			"plans":       len(service.Plans) == 0,
+		})
+		if len(missing) != 0 {
+			problems = append(problems, fmt.Sprintf("service %d (%s) is missing %s", i, service.ID, strings.Join(missing, ", ")))
+		}
+
+		for j, plan := range service.Plans {
+			missing := missingFields(map[string]bool{
+				"id":          plan.ID == "",
+				"name":        plan.Name == "",
+				"description": plan.Description == "",
+			})
+			if len(missing) != 0 {
+				problems = append(problems, fmt.Sprintf("plan %d (%s) of service %s is missing %s", j, plan.ID, service.ID, strings.Join(missing, ", ")))
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("The catalog is invalid: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func missingFields(fields map[string]bool) []string {
+	var missing []string
+	for _, field := range []string{"id", "name", "description", "bindable", "plans"} {
+		if fields[field] {
+			missing = append(missing, field)
+		}
+	}
+	return missing
 }
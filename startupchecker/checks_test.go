@@ -109,4 +109,100 @@ var _ = Describe("StartupChecks", func() {
 			})
 		})
 	})
+
+	Describe("Checks", func() {
+		var (
+			tokenRetrieverFake *startupcheckerfakes.FakeTokenRetriever
+			httpClientFake     *startupcheckerfakes.FakeHTTPDoer
+			checks             []startupchecker.Check
+		)
+
+		respondWith := func(status int, body string) {
+			httpClientFake.DoReturns(&http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(body))}, nil)
+		}
+
+		BeforeEach(func() {
+			brokerURL, err := url.ParseRequestURI("http://example-broker.com")
+			Expect(err).ToNot(HaveOccurred())
+
+			tokenRetrieverFake = new(startupcheckerfakes.FakeTokenRetriever)
+			tokenRetrieverFake.GetTokenReturns(&oauth2.Token{AccessToken: "my-gcp-token"}, nil)
+			httpClientFake = new(startupcheckerfakes.FakeHTTPDoer)
+
+			checker := startupchecker.NewChecker(brokerURL, tokenRetrieverFake, httpClientFake)
+			checks = checker.Checks()
+		})
+
+		run := func() []error {
+			var errs []error
+			for _, check := range checks {
+				errs = append(errs, check.Run())
+			}
+			return errs
+		}
+
+		It("checks the token, the catalog and its schema", func() {
+			Expect(checks).To(HaveLen(3))
+			Expect(checks[0].Name).To(Equal("token"))
+			Expect(checks[1].Name).To(Equal("catalog"))
+			Expect(checks[2].Name).To(Equal("catalog_schema"))
+		})
+
+		It("passes for a reachable, valid catalog", func() {
+			respondWith(http.StatusOK, `{"services": []}`)
+
+			Expect(run()).To(Equal([]error{nil, nil, nil}))
+			Expect(httpClientFake.DoCallCount()).To(Equal(1))
+		})
+
+		It("fails the schema check for an invalid catalog", func() {
+			respondWith(http.StatusOK, `{}`)
+
+			errs := run()
+			Expect(errs[1]).NotTo(HaveOccurred())
+			Expect(errs[2]).To(MatchError("The catalog has no services field"))
+		})
+
+		It("fails the catalog checks when the broker fails", func() {
+			respondWith(http.StatusBadGateway, "unavailable")
+
+			errs := run()
+			Expect(errs[0]).NotTo(HaveOccurred())
+			Expect(errs[1]).To(MatchError(ContainSubstring("502")))
+			Expect(errs[2]).To(MatchError("The catalog could not be fetched"))
+		})
+
+		It("fails every check when there is no token", func() {
+			tokenRetrieverFake.GetTokenReturns(nil, errors.New("oops"))
+
+			for _, err := range run()[:2] {
+				Expect(err).To(MatchError(ContainSubstring("oops")))
+			}
+		})
+	})
+
+	Describe("ValidateCatalog", func() {
+		It("accepts valid catalogs", func() {
+			Expect(startupchecker.ValidateCatalog([]byte(`{"services": [{
+				"id": "s1", "name": "storage", "description": "Storage", "bindable": false,
+				"plans": [{"id": "p1", "name": "standard", "description": "Standard"}]
+			}]}`))).To(Succeed())
+		})
+
+		It("rejects catalogs that are not JSON", func() {
+			Expect(startupchecker.ValidateCatalog([]byte(`<html>`))).To(MatchError(ContainSubstring("The catalog is not valid JSON")))
+		})
+
+		It("reports every missing field", func() {
+			err := startupchecker.ValidateCatalog([]byte(`{"services": [
+				{"id": "s1", "name": "storage", "plans": [{"id": "p1"}]},
+				{"id": "s2", "name": "pubsub", "description": "Pub/Sub", "bindable": true}
+			]}`))
+
+			Expect(err).To(MatchError("The catalog is invalid: " +
+				"service 0 (s1) is missing description, bindable; " +
+				"plan 0 (p1) of service s1 is missing name, description; " +
+				"service 1 (s2) is missing plans"))
+		})
+	})
 })
@@ -0,0 +1,54 @@
+package startupchecker
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type brokerHealth struct {
+	Broker string   `json:"broker,omitempty"`
+	Ready  bool     `json:"ready"`
+	Checks []Result `json:"checks"`
+}
+
+// LivenessHandler responds as long as the process can serve requests.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, map[string]string{"status": "alive"})
+	})
+}
+
+// ReadinessHandler responds with 200 when every monitor is ready and with
+// 503 otherwise. The body lists the checks, but not their errors, which are
+// logged instead because the endpoint is unauthenticated.
+func ReadinessHandler(monitors ...*Monitor) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		status, ready := "ready", true
+		brokers := make([]brokerHealth, len(monitors))
+
+		for i, monitor := range monitors {
+			brokers[i] = brokerHealth{Broker: monitor.Name(), Ready: monitor.Ready(), Checks: monitor.Results()}
+			if brokers[i].Checks == nil {
+				brokers[i].Checks = []Result{}
+			}
+			if !brokers[i].Ready {
+				status, ready = "not ready", false
+			}
+		}
+
+		code := http.StatusOK
+		if !ready {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(rw, code, map[string]interface{}{"status": status, "brokers": brokers})
+	})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, body interface{}) {
+	encoded, _ := json.Marshal(body)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(encoded)
+}
@@ -0,0 +1,68 @@
+package startupchecker_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/startupchecker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handlers", func() {
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, httptest.NewRequest("GET", "/", nil))
+		return writer
+	}
+
+	Describe("LivenessHandler", func() {
+		It("responds with 200", func() {
+			writer := serve(startupchecker.LivenessHandler())
+
+			Expect(writer.Code).To(Equal(http.StatusOK))
+			Expect(writer.Body.String()).To(MatchJSON(`{"status": "alive"}`))
+		})
+	})
+
+	Describe("ReadinessHandler", func() {
+		var healthy, failing *startupchecker.Monitor
+
+		BeforeEach(func() {
+			healthy = startupchecker.NewMonitor("a", time.Minute, []startupchecker.Check{
+				{Name: "token", Run: func() error { return nil }},
+			})
+			failing = startupchecker.NewMonitor("b", time.Minute, []startupchecker.Check{
+				{Name: "catalog", Run: func() error { return errors.New("secret broker details") }},
+			})
+			healthy.RunOnce()
+			failing.RunOnce()
+		})
+
+		It("responds with 200 when every monitor is ready", func() {
+			writer := serve(startupchecker.ReadinessHandler(healthy))
+
+			Expect(writer.Code).To(Equal(http.StatusOK))
+			Expect(writer.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(writer.Body.String()).To(ContainSubstring(`"status":"ready"`))
+			Expect(writer.Body.String()).To(ContainSubstring(`{"broker":"a","ready":true,"checks":[{"name":"token","healthy":true,`))
+		})
+
+		It("responds with 503 when a monitor is not ready", func() {
+			writer := serve(startupchecker.ReadinessHandler(healthy, failing))
+
+			Expect(writer.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(writer.Body.String()).To(ContainSubstring(`"status":"not ready"`))
+			Expect(writer.Body.String()).To(ContainSubstring(`"name":"catalog","healthy":false`))
+		})
+
+		It("does not expose check errors", func() {
+			writer := serve(startupchecker.ReadinessHandler(failing))
+
+			Expect(writer.Body.String()).NotTo(ContainSubstring("secret broker details"))
+		})
+	})
+})
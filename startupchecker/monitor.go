@@ -0,0 +1,181 @@
+package startupchecker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+)
+
+// Result is the outcome of the last run of a check.
+type Result struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"-"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Monitor runs checks periodically and remembers their results. The checks
+// of a monitor run one after the other, in order.
+type Monitor struct {
+	name     string
+	interval time.Duration
+	checks   []Check
+	observe  func(Result)
+	logger   *logging.Logger
+
+	mu      sync.Mutex
+	results []Result
+	stop    chan struct{}
+}
+
+type MonitorOption func(*Monitor)
+
+// WithObserver calls observe with the result of every check, for example
+// to record metrics.
+func WithObserver(observe func(Result)) MonitorOption {
+	return func(m *Monitor) {
+		m.observe = observe
+	}
+}
+
+// NewMonitor creates a monitor for the named broker. Its checks are not run
+// until RunOnce or Start is called.
+func NewMonitor(name string, interval time.Duration, checks []Check, opts ...MonitorOption) *Monitor {
+	m := &Monitor{
+		name:     name,
+		interval: interval,
+		checks:   checks,
+		logger:   logging.Default(),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if name != "" {
+		m.logger = m.logger.With(logging.Data{"broker": name})
+	}
+
+	return m
+}
+
+func (m *Monitor) Name() string {
+	return m.name
+}
+
+// RunOnce runs every check and returns an error describing the checks that
+// failed.
+func (m *Monitor) RunOnce() error {
+	results := make([]Result, len(m.checks))
+	var failures []string
+
+	for i, check := range m.checks {
+		err := check.Run()
+
+		results[i] = Result{Name: check.Name, Healthy: err == nil, CheckedAt: time.Now().UTC()}
+		if err != nil {
+			results[i].Error = err.Error()
+			failures = append(failures, fmt.Sprintf("%s: %s", check.Name, err))
+		}
+
+		if m.observe != nil {
+			m.observe(results[i])
+		}
+	}
+
+	m.mu.Lock()
+	previous := m.results
+	m.results = results
+	m.mu.Unlock()
+
+	m.logTransitions(previous, results)
+
+	if len(failures) != 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Start runs the checks every interval in the background until Stop is
+// called.
+func (m *Monitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				m.RunOnce()
+			}
+		}
+	}(m.stop)
+}
+
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+// Ready reports whether every check passed when it last ran. A monitor whose
+// checks have not run yet is not ready.
+func (m *Monitor) Ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.results == nil {
+		return false
+	}
+	for _, result := range m.results {
+		if !result.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Monitor) Results() []Result {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Result(nil), m.results...)
+}
+
+// logTransitions logs checks that start failing or recover, rather than
+// every run.
+func (m *Monitor) logTransitions(previous, current []Result) {
+	healthy := map[string]bool{}
+	for _, result := range previous {
+		healthy[result.Name] = result.Healthy
+	}
+
+	for _, result := range current {
+		wasHealthy, ran := healthy[result.Name]
+		switch {
+		case !result.Healthy && (!ran || wasHealthy):
+			m.logger.Error("Health check failed", errors.New(result.Error), logging.Data{"check": result.Name})
+		case result.Healthy && ran && !wasHealthy:
+			m.logger.Info("Health check recovered", logging.Data{"check": result.Name})
+		}
+	}
+}
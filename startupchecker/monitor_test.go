@@ -0,0 +1,121 @@
+package startupchecker_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/startupchecker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Monitor", func() {
+	var (
+		tokenErr   atomic.Value
+		catalogRun int32
+		checks     []startupchecker.Check
+		monitor    *startupchecker.Monitor
+		options    []startupchecker.MonitorOption
+	)
+
+	BeforeEach(func() {
+		tokenErr.Store(errors.New(""))
+		atomic.StoreInt32(&catalogRun, 0)
+		options = nil
+
+		checks = []startupchecker.Check{
+			{Name: "token", Run: func() error {
+				if err := tokenErr.Load().(error); err.Error() != "" {
+					return err
+				}
+				return nil
+			}},
+			{Name: "catalog", Run: func() error {
+				atomic.AddInt32(&catalogRun, 1)
+				return nil
+			}},
+		}
+	})
+
+	JustBeforeEach(func() {
+		monitor = startupchecker.NewMonitor("broker-a", 10*time.Millisecond, checks, options...)
+	})
+
+	AfterEach(func() {
+		monitor.Stop()
+	})
+
+	It("is not ready before the checks have run", func() {
+		Expect(monitor.Ready()).To(BeFalse())
+		Expect(monitor.Results()).To(BeEmpty())
+	})
+
+	It("is ready when every check passes", func() {
+		Expect(monitor.RunOnce()).To(Succeed())
+
+		Expect(monitor.Ready()).To(BeTrue())
+		results := monitor.Results()
+		Expect(results).To(HaveLen(2))
+		Expect(results[0].Name).To(Equal("token"))
+		Expect(results[0].Healthy).To(BeTrue())
+		Expect(results[0].CheckedAt).NotTo(BeZero())
+	})
+
+	It("is not ready when a check fails", func() {
+		tokenErr.Store(errors.New("token endpoint unavailable"))
+
+		err := monitor.RunOnce()
+		Expect(err).To(MatchError("token: token endpoint unavailable"))
+		Expect(monitor.Ready()).To(BeFalse())
+		Expect(monitor.Results()[0].Error).To(Equal("token endpoint unavailable"))
+	})
+
+	It("runs every check even when one fails", func() {
+		tokenErr.Store(errors.New("oops"))
+		monitor.RunOnce()
+
+		Expect(atomic.LoadInt32(&catalogRun)).To(Equal(int32(1)))
+	})
+
+	It("runs the checks periodically once started", func() {
+		tokenErr.Store(errors.New("oops"))
+		monitor.RunOnce()
+		monitor.Start()
+
+		tokenErr.Store(errors.New(""))
+		Eventually(monitor.Ready).Should(BeTrue())
+		Expect(atomic.LoadInt32(&catalogRun)).To(BeNumerically(">", 1))
+
+		monitor.Stop()
+		runs := atomic.LoadInt32(&catalogRun)
+		Consistently(func() int32 { return atomic.LoadInt32(&catalogRun) }, 50*time.Millisecond).Should(BeNumerically("<=", runs+1))
+	})
+
+	Context("with an observer", func() {
+		var (
+			mu       sync.Mutex
+			observed []startupchecker.Result
+		)
+
+		BeforeEach(func() {
+			observed = nil
+			options = []startupchecker.MonitorOption{startupchecker.WithObserver(func(result startupchecker.Result) {
+				mu.Lock()
+				defer mu.Unlock()
+				observed = append(observed, result)
+			})}
+		})
+
+		It("reports every result", func() {
+			monitor.RunOnce()
+
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(observed).To(HaveLen(2))
+			Expect(observed[1].Name).To(Equal("catalog"))
+		})
+	})
+})
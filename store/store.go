@@ -0,0 +1,262 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minCompaction is how many superseded records the log may hold before it
+// is compacted, however few entries there are.
+const minCompaction = 100
+
+// Store is a small key/value store persisted as a log of JSON records, one
+// per line. Every change appends a record, and the log is compacted by
+// writing the current entries to a temporary file that then replaces it, so
+// a crash never leaves a partially compacted store behind. A record cut off
+// by a crash is ignored when the store is opened. Appends are not synced
+// individually; call Sync or Close to flush them to disk. A store without a
+// path only lives in memory.
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]json.RawMessage
+	records int
+}
+
+type record struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// Open loads the store at path, creating it on the first write if it does
+// not exist yet.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, entries: map[string]json.RawMessage{}}
+	if path == "" {
+		return s, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(contents) == 0 {
+		return s, nil
+	}
+
+	if err := s.load(contents); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load(contents []byte) error {
+	reader := bufio.NewReader(bytes.NewReader(contents))
+	for line := 1; ; line++ {
+		raw, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A last record without a newline was cut off while it was
+			// being appended.
+			return nil
+		}
+
+		var r record
+		if err := json.Unmarshal(raw, &r); err != nil || r.Key == "" {
+			return fmt.Errorf("invalid record on line %d of %s", line, s.path)
+		}
+		s.apply(r)
+	}
+}
+
+// apply must be called with s.mu held for writing, or before the store is
+// shared.
+func (s *Store) apply(r record) {
+	if r.Deleted {
+		delete(s.entries, r.Key)
+	} else {
+		s.entries[r.Key] = r.Value
+	}
+	s.records++
+}
+
+// Get decodes the value stored under key into v and reports whether there
+// was one.
+func (s *Store) Get(key string, v interface{}) (bool, error) {
+	s.mu.RLock()
+	raw, ok := s.entries[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+func (s *Store) Put(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.append(record{Key: key, Value: raw})
+}
+
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, existed := s.entries[key]; !existed {
+		return nil
+	}
+	return s.append(record{Key: key, Deleted: true})
+}
+
+// Keys returns the sorted keys that start with prefix.
+func (s *Store) Keys(prefix string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []string{}
+	for key := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Sync flushes the appended records to disk.
+func (s *Store) Sync() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Close flushes the store to disk. The store must not be written to after
+// it is closed.
+func (s *Store) Close() error {
+	return s.Sync()
+}
+
+// append writes r to the log and applies it, compacting the log when most
+// of it is superseded. It must be called with s.mu held for writing.
+func (s *Store) append(r record) error {
+	if s.path != "" {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(append(line, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.apply(r)
+
+	if s.records-len(s.entries) > minCompaction && s.records > 2*len(s.entries) {
+		// The record is already in the log, so a failed compaction only
+		// leaves the log longer than it needs to be.
+		s.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log with one record per entry. It must be called
+// with s.mu held for writing.
+func (s *Store) compact() error {
+	if s.path == "" {
+		return nil
+	}
+
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var contents bytes.Buffer
+	for _, key := range keys {
+		line, err := json.Marshal(record{Key: key, Value: s.entries[key]})
+		if err != nil {
+			return err
+		}
+		contents.Write(line)
+		contents.WriteByte('\n')
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.records = len(s.entries)
+	return nil
+}
@@ -0,0 +1,176 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+	type record struct {
+		Name string `json:"name"`
+	}
+
+	var (
+		dir  string
+		path string
+		s    *store.Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "store")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "store.json")
+
+		s, err = store.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("stores and retrieves values", func() {
+		Expect(s.Put("a", record{Name: "first"})).To(Succeed())
+
+		var r record
+		found, err := s.Get("a", &r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(r.Name).To(Equal("first"))
+	})
+
+	It("reports missing keys", func() {
+		var r record
+		found, err := s.Get("missing", &r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+	})
+
+	It("deletes values", func() {
+		Expect(s.Put("a", record{Name: "first"})).To(Succeed())
+		Expect(s.Delete("a")).To(Succeed())
+		Expect(s.Delete("never-stored")).To(Succeed())
+
+		var r record
+		found, _ := s.Get("a", &r)
+		Expect(found).To(BeFalse())
+	})
+
+	It("lists keys by prefix", func() {
+		Expect(s.Put("instance/b", record{})).To(Succeed())
+		Expect(s.Put("instance/a", record{})).To(Succeed())
+		Expect(s.Put("binding/a", record{})).To(Succeed())
+
+		Expect(s.Keys("instance/")).To(Equal([]string{"instance/a", "instance/b"}))
+		Expect(s.Keys("")).To(HaveLen(3))
+	})
+
+	It("persists values across reopening", func() {
+		Expect(s.Put("a", record{Name: "first"})).To(Succeed())
+		Expect(s.Put("b", record{Name: "second"})).To(Succeed())
+		Expect(s.Delete("b")).To(Succeed())
+
+		reopened, err := store.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		var r record
+		found, err := reopened.Get("a", &r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(r.Name).To(Equal("first"))
+		Expect(reopened.Keys("")).To(Equal([]string{"a"}))
+	})
+
+	It("does not leave temporary files behind", func() {
+		Expect(s.Put("a", record{})).To(Succeed())
+
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+
+	It("keeps the previous value when persisting fails", func() {
+		Expect(s.Put("a", record{Name: "first"})).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+
+		Expect(s.Put("a", record{Name: "second"})).NotTo(Succeed())
+
+		var r record
+		s.Get("a", &r)
+		Expect(r.Name).To(Equal("first"))
+	})
+
+	It("appends changes instead of rewriting the file", func() {
+		Expect(s.Put("a", record{Name: "first"})).To(Succeed())
+		Expect(s.Put("a", record{Name: "second"})).To(Succeed())
+		Expect(s.Delete("a")).To(Succeed())
+		Expect(s.Sync()).To(Succeed())
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal(`{"key":"a","value":{"name":"first"}}
+{"key":"a","value":{"name":"second"}}
+{"key":"a","deleted":true}
+`))
+	})
+
+	It("compacts the log once most of it is superseded", func() {
+		for i := 0; i < 500; i++ {
+			Expect(s.Put("a", record{Name: "first"})).To(Succeed())
+		}
+		Expect(s.Put("b", record{Name: "second"})).To(Succeed())
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.Count(string(contents), "\n")).To(BeNumerically("<=", 102))
+
+		reopened, err := store.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reopened.Keys("")).To(Equal([]string{"a", "b"}))
+	})
+
+	It("ignores a record cut off while it was appended", func() {
+		Expect(s.Put("a", record{Name: "first"})).To(Succeed())
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = file.WriteString(`{"key":"b","val`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
+
+		reopened, err := store.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reopened.Keys("")).To(Equal([]string{"a"}))
+		Expect(reopened.Put("c", record{})).To(Succeed())
+
+		reopened, err = store.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reopened.Keys("")).To(Equal([]string{"a", "c"}))
+	})
+
+	It("fails to open corrupted stores", func() {
+		Expect(ioutil.WriteFile(path, []byte("not json\n"), 0600)).To(Succeed())
+
+		_, err := store.Open(path)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("without a path", func() {
+		It("keeps values in memory", func() {
+			memory, err := store.Open("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(memory.Put("a", record{Name: "first"})).To(Succeed())
+
+			var r record
+			found, _ := memory.Get("a", &r)
+			Expect(found).To(BeTrue())
+		})
+	})
+})
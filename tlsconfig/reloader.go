@@ -0,0 +1,264 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+)
+
+// Files names the PEM files of a TLS listener. ClientCAFile is optional;
+// when it is set, client certificates signed by its CAs are verified.
+type Files struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// Reloader serves the certificate and client CAs from Files, and reloads
+// them when the files change so that they can be rotated without a
+// restart. A failed reload keeps the previous certificates.
+type Reloader struct {
+	files        Files
+	interval     time.Duration
+	minVersion   uint16
+	cipherSuites []uint16
+	observe      func(error)
+	logger       *logging.Logger
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	versions    []fileVersion
+	stop        chan struct{}
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+type Option func(*Reloader)
+
+// WithMinVersion sets the minimum TLS version, TLS 1.2 by default.
+func WithMinVersion(version uint16) Option {
+	return func(r *Reloader) {
+		r.minVersion = version
+	}
+}
+
+// WithCipherSuites restricts the cipher suites of TLS 1.2 connections. The
+// cipher suites of TLS 1.3 cannot be configured.
+func WithCipherSuites(suites []uint16) Option {
+	return func(r *Reloader) {
+		r.cipherSuites = suites
+	}
+}
+
+// WithObserver is called after every reload of changed files, with the
+// error if the reload failed.
+func WithObserver(observe func(error)) Option {
+	return func(r *Reloader) {
+		r.observe = observe
+	}
+}
+
+// NewReloader loads the files and checks them for changes every interval
+// once Start is called.
+func NewReloader(files Files, interval time.Duration, opts ...Option) (*Reloader, error) {
+	r := &Reloader{
+		files:      files,
+		interval:   interval,
+		minVersion: tls.VersionTLS12,
+		observe:    func(error) {},
+		logger:     logging.Default().With(logging.Data{"cert_file": files.CertFile}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load checks that the files hold a certificate, its key and, if given, CA
+// certificates.
+func Load(files Files) error {
+	_, _, err := load(files)
+	return err
+}
+
+func load(files Files) (*tls.Certificate, *x509.CertPool, error) {
+	certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the certificate: %s", err)
+	}
+
+	if files.ClientCAFile == "" {
+		return &certificate, nil, nil
+	}
+
+	bundle, err := ioutil.ReadFile(files.ClientCAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the client CAs: %s", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(bundle) {
+		return nil, nil, fmt.Errorf("failed to load the client CAs: %s has no PEM certificates", files.ClientCAFile)
+	}
+
+	return &certificate, clientCAs, nil
+}
+
+// Reload loads the files now.
+func (r *Reloader) Reload() error {
+	versions := r.fileVersions()
+
+	certificate, clientCAs, err := load(r.files)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.certificate = certificate
+	r.clientCAs = clientCAs
+	r.versions = versions
+	return nil
+}
+
+// Config returns a TLS config that always uses the latest certificates.
+// Client certificates are verified when sent, but not required, so that
+// other authentication methods can be used alongside them.
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:   r.minVersion,
+		CipherSuites: r.cipherSuites,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+func (r *Reloader) current() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	config := &tls.Config{
+		MinVersion:   r.minVersion,
+		CipherSuites: r.cipherSuites,
+		Certificates: []tls.Certificate{*r.certificate},
+	}
+	if r.clientCAs != nil {
+		config.ClientCAs = r.clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// NotAfter returns when the current certificate expires.
+func (r *Reloader) NotAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.certificate.Leaf == nil {
+		return time.Time{}
+	}
+	return r.certificate.Leaf.NotAfter
+}
+
+// Start checks the files for changes every interval in the background
+// until Stop is called.
+func (r *Reloader) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				r.reloadIfChanged()
+			}
+		}
+	}(r.stop)
+}
+
+func (r *Reloader) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+func (r *Reloader) reloadIfChanged() {
+	versions := r.fileVersions()
+
+	r.mu.RLock()
+	changed := !equalVersions(versions, r.versions)
+	r.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	err := r.Reload()
+	r.observe(err)
+	if err != nil {
+		r.logger.Error("Failed to reload TLS certificates", err)
+
+		// Remember the broken files so that the error is logged once
+		// rather than on every check.
+		r.mu.Lock()
+		r.versions = versions
+		r.mu.Unlock()
+		return
+	}
+
+	r.logger.Info("Reloaded TLS certificates")
+}
+
+func (r *Reloader) fileVersions() []fileVersion {
+	var versions []fileVersion
+	for _, path := range []string{r.files.CertFile, r.files.KeyFile, r.files.ClientCAFile} {
+		var version fileVersion
+		if info, err := os.Stat(path); err == nil {
+			version = fileVersion{modTime: info.ModTime(), size: info.Size()}
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+func equalVersions(a, b []fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
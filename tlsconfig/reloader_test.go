@@ -0,0 +1,219 @@
+package tlsconfig_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig"
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig/tlsconfigtest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Reloader", func() {
+	var (
+		dir      string
+		ca       *tlsconfigtest.CA
+		files    tlsconfig.Files
+		reloader *tlsconfig.Reloader
+		server   *httptest.Server
+		logs     *gbytes.Buffer
+		opts     []tlsconfig.Option
+	)
+
+	issue := func(commonName string) *tlsconfigtest.Certificate {
+		certificate, err := ca.Issue(tlsconfigtest.Options{CommonName: commonName})
+		Expect(err).NotTo(HaveOccurred())
+		return certificate
+	}
+
+	writeServerCertificate := func(certificate *tlsconfigtest.Certificate) {
+		_, _, err := certificate.WriteFiles(dir)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure the modification time changes on coarse file systems.
+		later := time.Now().Add(time.Duration(len(certificate.PEM)) * time.Millisecond)
+		Expect(os.Chtimes(files.CertFile, later, later)).To(Succeed())
+	}
+
+	servedCommonName := func() string {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tlsconfig")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca, err = tlsconfigtest.NewCA("test-ca")
+		Expect(err).NotTo(HaveOccurred())
+
+		files = tlsconfig.Files{
+			CertFile:     filepath.Join(dir, "cert.pem"),
+			KeyFile:      filepath.Join(dir, "key.pem"),
+			ClientCAFile: filepath.Join(dir, "ca.pem"),
+		}
+		Expect(ioutil.WriteFile(files.ClientCAFile, ca.PEM, 0600)).To(Succeed())
+		writeServerCertificate(issue("first"))
+
+		logs = gbytes.NewBuffer()
+		logging.SetOutput(logs)
+
+		opts = nil
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		reloader, err = tlsconfig.NewReloader(files, 10*time.Millisecond, opts...)
+		Expect(err).NotTo(HaveOccurred())
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.VerifiedChains) > 0 {
+				w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+			}
+		}))
+		server.TLS = reloader.Config()
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		reloader.Stop()
+		server.Close()
+		logging.SetOutput(os.Stdout)
+		os.RemoveAll(dir)
+	})
+
+	It("serves the certificate", func() {
+		Expect(servedCommonName()).To(Equal("first"))
+	})
+
+	It("verifies client certificates signed by the client CAs", func() {
+		client := issue("cloud_controller")
+		clientCertificate, err := client.TLSCertificate()
+		Expect(err).NotTo(HaveOccurred())
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Certificate)
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{clientCertificate},
+		}}}
+
+		res, err := httpClient.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("cloud_controller"))
+	})
+
+	It("does not accept client certificates from other CAs", func() {
+		otherCA, err := tlsconfigtest.NewCA("other-ca")
+		Expect(err).NotTo(HaveOccurred())
+		client, err := otherCA.Issue(tlsconfigtest.Options{CommonName: "intruder"})
+		Expect(err).NotTo(HaveOccurred())
+		clientCertificate, err := client.TLSCertificate()
+		Expect(err).NotTo(HaveOccurred())
+
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &clientCertificate, nil
+			},
+		}}}
+
+		res, err := httpClient.Get(server.URL)
+		if err == nil {
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).To(HaveOccurred(), "the handshake should fail, got "+string(body))
+		}
+	})
+
+	It("reloads the certificate when the files change", func() {
+		reloader.Start()
+
+		writeServerCertificate(issue("second"))
+
+		Eventually(servedCommonName).Should(Equal("second"))
+		Eventually(logs).Should(gbytes.Say(`"message":"Reloaded TLS certificates"`))
+	})
+
+	It("keeps the certificate when the new files are invalid", func() {
+		reloader.Start()
+
+		Expect(ioutil.WriteFile(files.KeyFile, []byte("not a key"), 0600)).To(Succeed())
+
+		Eventually(logs).Should(gbytes.Say(`"message":"Failed to reload TLS certificates"`))
+		Expect(servedCommonName()).To(Equal("first"))
+	})
+
+	It("reports when the certificate expires", func() {
+		certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloader.NotAfter()).To(Equal(certificate.Leaf.NotAfter))
+	})
+
+	Context("with an observer", func() {
+		var reloads chan error
+
+		BeforeEach(func() {
+			reloads = make(chan error, 10)
+			opts = append(opts, tlsconfig.WithObserver(func(err error) { reloads <- err }))
+		})
+
+		It("tells it about every reload", func() {
+			reloader.Start()
+
+			writeServerCertificate(issue("second"))
+			Eventually(reloads).Should(Receive(BeNil()))
+
+			Expect(ioutil.WriteFile(files.KeyFile, []byte("not a key"), 0600)).To(Succeed())
+			Eventually(reloads).Should(Receive(MatchError(ContainSubstring("failed to load the certificate"))))
+		})
+	})
+
+	Context("with a minimum version and cipher suites", func() {
+		BeforeEach(func() {
+			opts = append(opts,
+				tlsconfig.WithMinVersion(tls.VersionTLS13),
+				tlsconfig.WithCipherSuites([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}))
+		})
+
+		It("rejects older clients", func() {
+			_, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS12,
+			})
+			Expect(err).To(HaveOccurred())
+
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			Expect(conn.ConnectionState().Version).To(Equal(uint16(tls.VersionTLS13)))
+		})
+	})
+
+	It("fails to start with invalid files", func() {
+		Expect(ioutil.WriteFile(files.ClientCAFile, []byte("no certificates"), 0600)).To(Succeed())
+
+		_, err := tlsconfig.NewReloader(files, time.Second)
+		Expect(err).To(MatchError("failed to load the client CAs: " + files.ClientCAFile + " has no PEM certificates"))
+		Expect(tlsconfig.Load(files)).To(MatchError(ContainSubstring("has no PEM certificates")))
+	})
+})
@@ -0,0 +1,149 @@
+// Package tlsconfigtest issues certificates for tests.
+package tlsconfigtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// CA is a certificate authority that issues certificates valid for a day.
+type CA struct {
+	Certificate *x509.Certificate
+	PEM         []byte
+	key         *ecdsa.PrivateKey
+}
+
+// Certificate is an issued certificate and its key, PEM encoded.
+type Certificate struct {
+	Certificate *x509.Certificate
+	PEM         []byte
+	KeyPEM      []byte
+}
+
+// Options describes the subject and SANs of an issued certificate.
+type Options struct {
+	CommonName   string
+	Organization string
+	DNSNames     []string
+	URIs         []string
+}
+
+func NewCA(name string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{
+		Certificate: certificate,
+		PEM:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:         key,
+	}, nil
+}
+
+// Issue issues a certificate for servers and clients. Servers are valid for
+// localhost and 127.0.0.1 in addition to the given DNS names.
+func (ca *CA) Issue(opts Options) (*Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: opts.CommonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     append([]string{"localhost"}, opts.DNSNames...),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if opts.Organization != "" {
+		template.Subject.Organization = []string{opts.Organization}
+	}
+	for _, raw := range opts.URIs {
+		uri, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		template.URIs = append(template.URIs, uri)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Certificate{
+		Certificate: certificate,
+		PEM:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// TLSCertificate returns the certificate for use in a tls.Config.
+func (c *Certificate) TLSCertificate() (tls.Certificate, error) {
+	return tls.X509KeyPair(c.PEM, c.KeyPEM)
+}
+
+// WriteFiles writes the certificate and key to cert.pem and key.pem in dir
+// and returns their paths.
+func (c *Certificate) WriteFiles(dir string) (certFile, keyFile string, err error) {
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	if err := ioutil.WriteFile(certFile, c.PEM, 0600); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(keyFile, c.KeyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
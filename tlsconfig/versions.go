@@ -0,0 +1,41 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion parses a TLS version given as "1.2" or "1.3". Older versions
+// are not supported.
+func ParseVersion(version string) (uint16, error) {
+	parsed, ok := versions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, use 1.2 or 1.3", version)
+	}
+	return parsed, nil
+}
+
+// ParseCipherSuites parses cipher suites given by their IANA names, such
+// as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only the suites Go considers
+// secure are accepted.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	secure := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range names {
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
@@ -0,0 +1,32 @@
+package tlsconfig_test
+
+import (
+	"crypto/tls"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/tlsconfig"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Versions", func() {
+	It("parses TLS versions", func() {
+		Expect(tlsconfig.ParseVersion("1.3")).To(Equal(uint16(tls.VersionTLS13)))
+
+		_, err := tlsconfig.ParseVersion("1.0")
+		Expect(err).To(MatchError(`unsupported TLS version "1.0", use 1.2 or 1.3`))
+	})
+
+	It("parses secure cipher suites", func() {
+		Expect(tlsconfig.ParseCipherSuites([]string{
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+		})).To(Equal([]uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		}))
+
+		_, err := tlsconfig.ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+		Expect(err).To(MatchError(`unsupported or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`))
+	})
+})
@@ -2,12 +2,14 @@ package token
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/urfave/negroni"
 
 	"golang.org/x/oauth2"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
 )
 
 //go:generate counterfeiter . TokenRetriever
@@ -18,12 +20,16 @@ type TokenRetriever interface {
 func TokenHandler(tr TokenRetriever) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		token, err := tr.GetToken()
+		if openErr, ok := err.(*breaker.OpenError); ok {
+			logging.Annotate(r.Context(), logging.Data{"upstream_error": err.Error()})
+			breaker.WriteOpen(w, openErr, "Google's OAuth token endpoint is unavailable after repeated failures, try again later")
+			return
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusBadGateway)
 
-			msg := fmt.Sprintf("Error retrieving OAuth token: %s", err.Error())
-			log.Println(msg)
-			w.Write([]byte(msg))
+			logging.FromContext(r.Context()).Error("Error retrieving OAuth token", err)
+			w.Write([]byte(fmt.Sprintf("Error retrieving OAuth token: %s", err.Error())))
 			return
 		}
 
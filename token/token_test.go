@@ -2,14 +2,17 @@ package token_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"time"
 
 	"golang.org/x/oauth2"
 
+	"code.cloudfoundry.org/gcp-broker-proxy/breaker"
+	"code.cloudfoundry.org/gcp-broker-proxy/logging"
 	"code.cloudfoundry.org/gcp-broker-proxy/token"
 	"code.cloudfoundry.org/gcp-broker-proxy/token/tokenfakes"
 
@@ -63,11 +66,12 @@ var _ = Describe("TokenHandler", func() {
 			tokenRetrieverFake.GetTokenReturns(nil, errors.New("oops"))
 			tokenHandler = token.TokenHandler(tokenRetrieverFake)
 
-			log.SetOutput(&buf)
+			buf.Reset()
+			logging.SetOutput(&buf)
 		})
 
 		AfterEach(func() {
-			log.SetOutput(os.Stderr)
+			logging.SetOutput(os.Stderr)
 		})
 
 		It("should not call the given handler", func() {
@@ -89,7 +93,30 @@ var _ = Describe("TokenHandler", func() {
 
 		It("logs the error", func() {
 			tokenHandler(writer, req, noOpHandler)
-			Expect(buf.String()).To(ContainSubstring("Error retrieving OAuth token: oops"))
+
+			var line struct {
+				Level   string `json:"level"`
+				Message string `json:"message"`
+				Error   string `json:"error"`
+			}
+			Expect(json.Unmarshal(buf.Bytes(), &line)).To(Succeed())
+			Expect(line.Level).To(Equal("error"))
+			Expect(line.Message).To(Equal("Error retrieving OAuth token"))
+			Expect(line.Error).To(Equal("oops"))
+		})
+	})
+
+	Context("when the token endpoint's breaker is open", func() {
+		It("responds with a 503 and an OSBAPI error", func() {
+			tokenRetrieverFake = new(tokenfakes.FakeTokenRetriever)
+			tokenRetrieverFake.GetTokenReturns(nil, &breaker.OpenError{Name: "token", RetryAt: time.Now().Add(20 * time.Second)})
+
+			writer := httptest.NewRecorder()
+			token.TokenHandler(tokenRetrieverFake)(writer, req, noOpHandler)
+
+			Expect(writer.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(writer.Header().Get("Retry-After")).To(Equal("20"))
+			Expect(writer.Body.String()).To(MatchJSON(`{"description": "Google's OAuth token endpoint is unavailable after repeated failures, try again later"}`))
 		})
 	})
 })
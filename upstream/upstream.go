@@ -0,0 +1,166 @@
+// Package upstream builds the HTTP transport the proxy uses to reach the
+// brokers.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Config configures the connections to the brokers. Zero values mean what
+// they do for http.Transport.
+type Config struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// Timeout limits a whole request, including reading the response body.
+	Timeout time.Duration
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	HTTP2 bool
+
+	// ProxyURL is an HTTP or HTTPS proxy that requests are sent through.
+	// Without it the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+	// variables are used.
+	ProxyURL      string
+	ProxyUsername string
+	ProxyPassword string
+
+	// CAFile is a PEM bundle of certificate authorities that are trusted in
+	// addition to the system ones.
+	CAFile string
+}
+
+// NewTransport returns a transport configured by config. It is safe for
+// concurrent use and should be shared, so that connections are reused.
+func NewTransport(config Config) (http.RoundTripper, error) {
+	proxy, err := proxyFunc(config)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := rootCAs(config.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       &tls.Config{RootCAs: roots},
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     config.HTTP2,
+	}
+	if !config.HTTP2 {
+		// A non-nil empty map turns HTTP/2 off.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if config.Timeout == 0 {
+		return transport, nil
+	}
+	return &timeoutTransport{transport: transport, timeout: config.Timeout}, nil
+}
+
+func proxyFunc(config Config) (func(*http.Request) (*url.URL, error), error) {
+	if config.ProxyURL == "" {
+		if config.ProxyUsername != "" || config.ProxyPassword != "" {
+			return nil, errors.New("proxy credentials require a proxy URL")
+		}
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(config.ProxyURL)
+	if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q, it must be an http or https URL", config.ProxyURL)
+	}
+
+	switch {
+	case config.ProxyUsername != "":
+		proxyURL.User = url.UserPassword(config.ProxyUsername, config.ProxyPassword)
+	case config.ProxyPassword != "":
+		return nil, errors.New("a proxy password requires a proxy username")
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// rootCAs returns the system certificate pool with the certificates in
+// caFile added, or nil to use the system pool as it is.
+func rootCAs(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA file: %s", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("the CA file %s has no PEM certificates", caFile)
+	}
+	return pool, nil
+}
+
+// timeoutTransport limits the time from sending a request until its response
+// body is closed.
+type timeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	res, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res.Body = CancelOnClose(res.Body, cancel)
+	return res, nil
+}
+
+// CancelOnClose returns body, which cancels the context of its request once
+// it is closed, so that a deadline applies until the body has been read.
+func CancelOnClose(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	return &cancelingBody{ReadCloser: body, cancel: cancel}
+}
+
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
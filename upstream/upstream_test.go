@@ -0,0 +1,253 @@
+package upstream_test
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onsi/gomega/ghttp"
+
+	"code.cloudfoundry.org/gcp-broker-proxy/upstream"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewTransport", func() {
+	var (
+		config upstream.Config
+		client *http.Client
+	)
+
+	BeforeEach(func() {
+		config = upstream.Config{}
+	})
+
+	JustBeforeEach(func() {
+		transport, err := upstream.NewTransport(config)
+		Expect(err).NotTo(HaveOccurred())
+		client = &http.Client{Transport: transport}
+	})
+
+	Describe("timeouts", func() {
+		var (
+			server  *httptest.Server
+			release chan struct{}
+		)
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+		})
+
+		AfterEach(func() {
+			close(release)
+			server.Close()
+		})
+
+		Context("when the response headers are slow", func() {
+			BeforeEach(func() {
+				config.ResponseHeaderTimeout = 50 * time.Millisecond
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					<-release
+				}))
+			})
+
+			It("fails the request", func() {
+				_, err := client.Get(server.URL)
+				Expect(err).To(MatchError(ContainSubstring("timeout awaiting response headers")))
+			})
+		})
+
+		Context("when the response body is slow", func() {
+			BeforeEach(func() {
+				config.Timeout = 100 * time.Millisecond
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+					w.(http.Flusher).Flush()
+					<-release
+				}))
+			})
+
+			It("fails reading the body", func() {
+				res, err := client.Get(server.URL)
+				Expect(err).NotTo(HaveOccurred())
+				defer res.Body.Close()
+
+				_, err = ioutil.ReadAll(res.Body)
+				Expect(err).To(MatchError(ContainSubstring("context deadline exceeded")))
+			})
+		})
+
+		Context("when the response is fast", func() {
+			BeforeEach(func() {
+				config.Timeout = time.Second
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte("ok"))
+				}))
+			})
+
+			It("returns the whole body", func() {
+				res, err := client.Get(server.URL)
+				Expect(err).NotTo(HaveOccurred())
+				defer res.Body.Close()
+
+				Expect(ioutil.ReadAll(res.Body)).To(Equal([]byte("ok")))
+			})
+		})
+	})
+
+	Describe("certificate authorities", func() {
+		var (
+			server *httptest.Server
+			dir    string
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			var err error
+			dir, err = ioutil.TempDir("", "upstream")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("does not trust unknown authorities", func() {
+			_, err := client.Get(server.URL)
+			Expect(err).To(MatchError(ContainSubstring("certificate")))
+		})
+
+		Context("with a CA file", func() {
+			BeforeEach(func() {
+				config.CAFile = filepath.Join(dir, "ca.pem")
+				block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+				Expect(ioutil.WriteFile(config.CAFile, pem.EncodeToMemory(block), 0600)).To(Succeed())
+			})
+
+			It("trusts its authorities", func() {
+				res, err := client.Get(server.URL)
+				Expect(err).NotTo(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		It("rejects CA files without certificates", func() {
+			caFile := filepath.Join(dir, "ca.pem")
+			Expect(ioutil.WriteFile(caFile, []byte("not a certificate"), 0600)).To(Succeed())
+
+			_, err := upstream.NewTransport(upstream.Config{CAFile: caFile})
+			Expect(err).To(MatchError("the CA file " + caFile + " has no PEM certificates"))
+		})
+
+		It("rejects missing CA files", func() {
+			_, err := upstream.NewTransport(upstream.Config{CAFile: filepath.Join(dir, "missing.pem")})
+			Expect(err).To(MatchError(ContainSubstring("failed to read the CA file")))
+		})
+	})
+
+	Describe("HTTP/2", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.EnableHTTP2 = true
+			server.StartTLS()
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		protocol := func() int {
+			dir, err := ioutil.TempDir("", "upstream")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			config.CAFile = filepath.Join(dir, "ca.pem")
+			block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+			Expect(ioutil.WriteFile(config.CAFile, pem.EncodeToMemory(block), 0600)).To(Succeed())
+
+			transport, err := upstream.NewTransport(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			res, err := (&http.Client{Transport: transport}).Get(server.URL)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res.ProtoMajor
+		}
+
+		It("is used when enabled", func() {
+			config.HTTP2 = true
+			Expect(protocol()).To(Equal(2))
+		})
+
+		It("is not used when disabled", func() {
+			Expect(protocol()).To(Equal(1))
+		})
+	})
+
+	Describe("proxies", func() {
+		var proxyServer *ghttp.Server
+
+		BeforeEach(func() {
+			proxyServer = ghttp.NewServer()
+			config.ProxyURL = proxyServer.URL()
+		})
+
+		AfterEach(func() {
+			proxyServer.Close()
+		})
+
+		It("sends requests through the proxy", func() {
+			proxyServer.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/v2/catalog"),
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.Host).To(Equal("broker.example.com"))
+					Expect(r.Header).NotTo(HaveKey("Proxy-Authorization"))
+				},
+			))
+
+			res, err := client.Get("http://broker.example.com/v2/catalog")
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			Expect(proxyServer.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		Context("with credentials", func() {
+			BeforeEach(func() {
+				config.ProxyUsername = "egress"
+				config.ProxyPassword = "secret"
+			})
+
+			It("authenticates with the proxy", func() {
+				proxyServer.AppendHandlers(ghttp.VerifyHeaderKV("Proxy-Authorization",
+					"Basic "+base64.StdEncoding.EncodeToString([]byte("egress:secret"))))
+
+				res, err := client.Get("http://broker.example.com/v2/catalog")
+				Expect(err).NotTo(HaveOccurred())
+				res.Body.Close()
+				Expect(proxyServer.ReceivedRequests()).To(HaveLen(1))
+			})
+		})
+
+		It("rejects invalid proxy settings", func() {
+			_, err := upstream.NewTransport(upstream.Config{ProxyURL: "socks5://proxy:1080"})
+			Expect(err).To(MatchError(`invalid proxy URL "socks5://proxy:1080", it must be an http or https URL`))
+
+			_, err = upstream.NewTransport(upstream.Config{ProxyURL: "http://proxy:3128", ProxyPassword: "secret"})
+			Expect(err).To(MatchError("a proxy password requires a proxy username"))
+
+			_, err = upstream.NewTransport(upstream.Config{ProxyUsername: "egress"})
+			Expect(err).To(MatchError("proxy credentials require a proxy URL"))
+		})
+	})
+})